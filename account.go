@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+/*
+accountDeletionGrace is how long an account is kept after its user asked for
+it to be deleted. Logging in and cancelling within it keeps the account.
+*/
+const accountDeletionGrace = 14 * 24 * time.Hour
+
+/*
+AccountExport is everything kept about a user, for them to download: their
+profile, their sites, the sessions they're logged in with, and their audit
+log. Password and session hashes aren't part of it.
+*/
+type AccountExport struct {
+	Profile  AccountProfile   `json:"profile"`
+	Sites    []ExportSite     `json:"sites"`
+	Sessions []AccountSession `json:"sessions"`
+	Audit    []AccountEvent   `json:"audit"`
+}
+
+// AccountProfile is the user themselves in an AccountExport.
+type AccountProfile struct {
+	ID                  uint       `json:"id"`
+	Email               string     `json:"email"`
+	CreatedAt           time.Time  `json:"createdAt"`
+	UpdatedAt           time.Time  `json:"updatedAt"`
+	DeletionRequestedAt *time.Time `json:"deletionRequestedAt"`
+}
+
+// AccountSession is a session in an AccountExport.
+type AccountSession struct {
+	ID        string    `json:"id"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// AccountEvent is an audit event in an AccountExport.
+type AccountEvent struct {
+	Action    string    `json:"action"`
+	Detail    string    `json:"detail"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// DeletionDue returns when the account is deleted, or nil if no one asked for it to be.
+func (u User) DeletionDue() *time.Time {
+	if u.DeletionRequestedAt == nil {
+		return nil
+	}
+	due := u.DeletionRequestedAt.Add(accountDeletionGrace)
+	return &due
+}
+
+// accountExport collects everything kept about the user.
+func (h *Handlers) accountExport(user User) AccountExport {
+	export := AccountExport{
+		Profile: AccountProfile{
+			ID:                  user.ID,
+			Email:               user.Email,
+			CreatedAt:           user.CreatedAt,
+			UpdatedAt:           user.UpdatedAt,
+			DeletionRequestedAt: user.DeletionRequestedAt,
+		},
+		Sites:    []ExportSite{},
+		Sessions: []AccountSession{},
+		Audit:    []AccountEvent{},
+	}
+
+	var sites []Site
+	h.db.Where("user_id = ?", user.ID).Order("id").Find(&sites)
+	for _, site := range sites {
+		export.Sites = append(export.Sites, exportSite(site))
+	}
+
+	var sessions []Session
+	h.db.Where("user_id = ?", user.ID).Order("created_at").Find(&sessions)
+	for _, session := range sessions {
+		export.Sessions = append(export.Sessions, AccountSession{
+			ID:        session.ID,
+			IP:        session.IP,
+			UserAgent: session.UserAgent,
+			CreatedAt: session.CreatedAt,
+		})
+	}
+
+	var events []AuditEvent
+	h.db.Where("user_id = ?", user.ID).Order("created_at").Find(&events)
+	for _, event := range events {
+		export.Audit = append(export.Audit, AccountEvent{
+			Action:    event.Action,
+			Detail:    event.Detail,
+			IP:        event.IP,
+			UserAgent: event.UserAgent,
+			CreatedAt: event.CreatedAt,
+		})
+	}
+
+	return export
+}
+
+// AdminAccount handles GET /admin/account to show the data export and account deletion.
+func (h *Handlers) AdminAccount(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	return c.Render(http.StatusOK, "adminaccount", struct {
+		Csrf  interface{}
+		User  User
+		Due   *time.Time
+		Grace int
+	}{
+		Csrf:  c.Get("csrf"),
+		User:  user,
+		Due:   user.DeletionDue(),
+		Grace: int(accountDeletionGrace / (24 * time.Hour)),
+	})
+}
+
+// AdminAccountExport handles GET /admin/account/export to download everything kept about the user as JSON.
+func (h *Handlers) AdminAccountExport(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	export := h.accountExport(user)
+	h.audit(c, user.ID, auditAccountExport, "")
+
+	name := fmt.Sprintf("account-%d-%s.json", user.ID, time.Now().Format("2006-01-02"))
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", name))
+
+	return c.JSONPretty(http.StatusOK, export, "  ")
+}
+
+/*
+AdminAccountDeletePost handles POST /admin/account/delete. It needs the
+user's password. The account is deleted accountDeletionGrace later; until
+then every session is logged out, its API tokens don't work, and logging in
+again can cancel it.
+*/
+func (h *Handlers) AdminAccountDeletePost(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	match, err := h.pwh.ComparePasswordAndHash(c.FormValue("password"), user.HashedPassword)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ResponseError{"Checking passwords failed."})
+	}
+
+	if !match {
+		return c.JSON(http.StatusUnauthorized, ResponseError{"Password is wrong."})
+	}
+
+	now := time.Now()
+	if result := h.db.Model(&user).UpdateColumn("deletion_requested_at", now); result.Error != nil {
+		return c.JSON(http.StatusBadRequest, ResponseError{"Something failed while saving."})
+	}
+	user.DeletionRequestedAt = &now
+
+	h.db.Delete(Session{}, "user_id = ?", user.ID)
+	h.audit(c, user.ID, auditAccountDeleteRequest, "")
+
+	h.send(user.Email, "Your account will be deleted", fmt.Sprintf(
+		"You asked for your account to be deleted, along with your sites and their comments. "+
+			"This happens on %s. Log in and cancel it at %s/admin/account before then to keep your account.\n",
+		user.DeletionDue().Format("2 Jan 2006 15:04 MST"), h.cfg.PublicURL,
+	), nil)
+
+	return h.destroySessionCookie(c)
+}
+
+// AdminAccountRestorePost handles POST /admin/account/restore to cancel deleting the account.
+func (h *Handlers) AdminAccountRestorePost(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	if user.DeletionRequestedAt != nil {
+		if result := h.db.Model(&user).UpdateColumn("deletion_requested_at", nil); result.Error != nil {
+			return c.String(http.StatusBadRequest, "Something failed while saving")
+		}
+		h.audit(c, user.ID, auditAccountDeleteCancel, "")
+	}
+
+	return c.Redirect(http.StatusFound, "/admin/account")
+}
+
+// AccountDeletions deletes the accounts whose grace period is over, until ctx is done.
+func (h *Handlers) AccountDeletions(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			h.deleteAccounts(now)
+		}
+	}
+}
+
+// deleteAccounts deletes every account that asked to be deleted more than accountDeletionGrace before now.
+func (h *Handlers) deleteAccounts(now time.Time) {
+	var due []User
+
+	h.db.Where("deletion_requested_at < ?", now.Add(-accountDeletionGrace)).Find(&due)
+
+	for _, user := range due {
+		if err := h.deleteAccount(user); err != nil {
+			h.log.Error("Deleting an account failed", "user_id", user.ID, "error", err)
+		}
+	}
+}
+
+/*
+deleteAccount deletes the user for good. The database's foreign keys take
+their sessions, memberships and sites with them, and with the sites their
+threads, comments, members, webhooks and exports. The files of those
+exports, and of the ones the user made on sites they were only a member of,
+are removed here. Commenters aren't the user's, so they stay, as do the
+comments they left on other people's sites.
+
+Their audit events stay without a user, and one more is left behind, so it
+can be told that the account was there and when it went.
+*/
+func (h *Handlers) deleteAccount(user User) error {
+	var exports []Export
+	h.db.Where("user_id = ? OR site_id IN (?)", user.ID, h.db.Table("sites").Select("id").Where("user_id = ?", user.ID).QueryExpr()).Find(&exports)
+
+	if err := h.db.Unscoped().Delete(&user).Error; err != nil {
+		return err
+	}
+
+	for _, x := range exports {
+		if err := os.Remove(h.exportPath(x)); err != nil && !os.IsNotExist(err) {
+			h.log.Error("Removing the export of a deleted account failed", "export", x.ID, "error", err)
+		}
+	}
+
+	h.log.Info("audit", "action", auditAccountDelete, "user_id", user.ID)
+	return h.db.Create(&AuditEvent{Action: auditAccountDelete, Detail: fmt.Sprintf("user %d", user.ID)}).Error
+}
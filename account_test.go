@@ -0,0 +1,185 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	mocket "github.com/selvatico/go-mocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminAccountExport(t *testing.T) {
+	mocket.Catcher.Reset()
+	defer mocket.Catcher.Reset()
+	mocket.Catcher.NewMock().WithQuery(`FROM "sites"`).WithReply([]map[string]interface{}{{"id": 3, "user_id": 7, "designation": "blog", "domains": `["example.com"]`}})
+	mocket.Catcher.NewMock().WithQuery(`FROM "sessions"`).WithReply([]map[string]interface{}{{"id": "current-session", "user_id": 7, "ip": "192.0.2.1", "hash": "secret"}})
+	mocket.Catcher.NewMock().WithQuery(`FROM "audit_events"`).WithReply([]map[string]interface{}{{"id": 1, "user_id": 7, "action": auditLoginSuccess}})
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/account/export", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.Set("model.user", User{Model: gorm.Model{ID: 7}, Email: "owner@example.com", HashedPassword: "hashedpassword"})
+
+	if !assert.NoError(t, h.AdminAccountExport(c)) {
+		return
+	}
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get(echo.HeaderContentDisposition), "account-7-")
+	assert.NotContains(t, rec.Body.String(), "hashedpassword")
+	assert.NotContains(t, rec.Body.String(), "secret")
+
+	export := AccountExport{}
+	if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &export)) {
+		assert.Equal(t, "owner@example.com", export.Profile.Email)
+		if assert.Len(t, export.Sites, 1) {
+			assert.Equal(t, []string{"example.com"}, export.Sites[0].Domains)
+		}
+		if assert.Len(t, export.Sessions, 1) {
+			assert.Equal(t, "192.0.2.1", export.Sessions[0].IP)
+		}
+		if assert.Len(t, export.Audit, 1) {
+			assert.Equal(t, auditLoginSuccess, export.Audit[0].Action)
+		}
+	}
+}
+
+func TestAdminAccountDeletePost(t *testing.T) {
+	pairs := []struct {
+		Form         string
+		ExpectedCode int
+	}{
+		{"password=wrongpassword", http.StatusUnauthorized},
+		{"password=cantcomparethis", http.StatusBadRequest},
+		{"password=goodpassword", http.StatusFound},
+	}
+
+	for _, p := range pairs {
+		mocket.Catcher.Reset()
+		outbox.messages = nil
+
+		var requested, loggedOut bool
+		mocket.Catcher.NewMock().WithQuery(`UPDATE "users" SET "deletion_requested_at"`).WithCallback(func(_ string, _ []driver.NamedValue) {
+			requested = true
+		})
+		mocket.Catcher.NewMock().WithQuery(`DELETE FROM "sessions"`).WithCallback(func(_ string, _ []driver.NamedValue) {
+			loggedOut = true
+		})
+
+		req := httptest.NewRequest(http.MethodPost, "/admin/account/delete", strings.NewReader(p.Form))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("model.user", User{Model: gorm.Model{ID: 7}, Email: "owner@example.com", HashedPassword: "hashedpassword"})
+
+		if !assert.NoError(t, h.AdminAccountDeletePost(c)) {
+			continue
+		}
+
+		deleting := p.ExpectedCode == http.StatusFound
+		assert.Equal(t, p.ExpectedCode, rec.Code, p.Form)
+		assert.Equal(t, deleting, requested, p.Form)
+		assert.Equal(t, deleting, loggedOut, p.Form)
+
+		if deleting {
+			assert.Equal(t, "/login", rec.Header().Get(echo.HeaderLocation))
+			if assert.Len(t, outbox.messages, 1) {
+				assert.Equal(t, "owner@example.com", outbox.messages[0].To)
+				assert.Contains(t, outbox.messages[0].Text, "/admin/account")
+			}
+		}
+	}
+
+	mocket.Catcher.Reset()
+}
+
+func TestAdminAccountRestorePost(t *testing.T) {
+	mocket.Catcher.Reset()
+	defer mocket.Catcher.Reset()
+
+	var restored []driver.NamedValue
+	mocket.Catcher.NewMock().WithQuery(`UPDATE "users" SET "deletion_requested_at"`).WithCallback(func(_ string, args []driver.NamedValue) {
+		restored = args
+	})
+
+	requested := time.Now().Add(-time.Hour)
+	req := httptest.NewRequest(http.MethodPost, "/admin/account/restore", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.Set("model.user", User{Model: gorm.Model{ID: 7}, DeletionRequestedAt: &requested})
+
+	if assert.NoError(t, h.AdminAccountRestorePost(c)) {
+		assert.Equal(t, http.StatusFound, rec.Code)
+		if assert.Len(t, restored, 2) {
+			assert.Nil(t, restored[0].Value)
+		}
+	}
+}
+
+func TestDeleteAccounts(t *testing.T) {
+	dir, err := os.MkdirTemp("", "exports")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	h.cfg.ExportDir = dir
+	defer func() { h.cfg.ExportDir = "" }()
+
+	// One export of their own site, and one they made on a site they're a member of.
+	files := []string{filepath.Join(dir, "export-9.jsonl"), filepath.Join(dir, "export-10.jsonl")}
+	for _, file := range files {
+		if !assert.NoError(t, os.WriteFile(file, []byte("{}\n"), 0600)) {
+			return
+		}
+	}
+
+	mocket.Catcher.Reset()
+	defer mocket.Catcher.Reset()
+
+	now := time.Now()
+	var due []driver.NamedValue
+	mocket.Catcher.NewMock().WithQuery(`(deletion_requested_at <`).WithCallback(func(_ string, args []driver.NamedValue) {
+		due = args
+	}).WithReply([]map[string]interface{}{{"id": 7, "email": "owner@example.com"}})
+	mocket.Catcher.NewMock().WithQuery(`FROM "exports"  WHERE (user_id = 7 OR site_id IN`).WithReply([]map[string]interface{}{
+		{"id": 9, "site_id": 3, "user_id": 7, "format": ExportJSONL},
+		{"id": 10, "site_id": 5, "user_id": 7, "format": ExportJSONL},
+	})
+
+	var deleted []driver.NamedValue
+	mocket.Catcher.NewMock().WithQuery(`DELETE FROM "users"`).WithCallback(func(_ string, args []driver.NamedValue) {
+		deleted = args
+	})
+
+	var audited map[string]driver.Value
+	mocket.Catcher.NewMock().WithQuery(`INSERT INTO "audit_events"`).WithCallback(func(query string, args []driver.NamedValue) {
+		audited = insertedValues(query, args)
+	})
+
+	h.deleteAccounts(now)
+
+	if assert.Len(t, due, 1) {
+		assert.Equal(t, now.Add(-accountDeletionGrace), due[0].Value)
+	}
+	if assert.Len(t, deleted, 1) {
+		assert.EqualValues(t, 7, deleted[0].Value)
+	}
+
+	for _, file := range files {
+		_, err = os.Stat(file)
+		assert.True(t, os.IsNotExist(err), file)
+	}
+
+	assert.Equal(t, auditAccountDelete, audited["action"])
+	assert.Nil(t, audited["user_id"])
+}
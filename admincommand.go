@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// adminUsage lists what the admin command can do.
+const adminUsage = `Usage: admin <command>
+
+  users list
+  users create <email>               the password is read from standard input
+  users password <email>             sets a new password, read from standard input, and logs the user out everywhere
+  users promote <email>              makes the user an instance superadmin
+  users demote <email>
+  sites list [-user <email>]
+  sites create <owner email> <designation> [domain...]
+  sites delete <site id> <designation>
+  sessions list [<email>]
+  sessions revoke <session id>
+  sessions revoke -user <email>      logs the user out everywhere
+  stats
+`
+
+// adminCommandAgent is the user agent of the audit events the admin command records.
+const adminCommandAgent = "admin command"
+
+/*
+AdminCommand runs "admin <command>", which manages users, sites and sessions
+from the command line, with the same configuration and database as the
+server. It's for whoever runs the instance, so it can do things no one can
+from the admin area, like making someone a superadmin. It returns the exit
+code for the process.
+*/
+func (h *Handlers) AdminCommand(args []string) int {
+	return h.adminCommand(os.Stdout, os.Stdin, args)
+}
+
+// adminCommand runs the admin command with its output going to w, and passwords read from in.
+func (h *Handlers) adminCommand(w io.Writer, in io.Reader, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(w, adminUsage)
+		return 2
+	}
+
+	command := args[0]
+	if len(args) > 1 {
+		command += " " + args[1]
+	}
+
+	switch {
+	case command == "users list":
+		return h.adminUsersList(w)
+	case command == "users create" && len(args) == 3:
+		return h.adminUsersCreate(w, in, args[2])
+	case command == "users password" && len(args) == 3:
+		return h.adminUsersPassword(w, in, args[2])
+	case command == "users promote" && len(args) == 3:
+		return h.adminUsersSuperadmin(w, args[2], true)
+	case command == "users demote" && len(args) == 3:
+		return h.adminUsersSuperadmin(w, args[2], false)
+	case command == "sites list":
+		return h.adminSitesList(w, args[2:])
+	case command == "sites create" && len(args) >= 4:
+		return h.adminSitesCreate(w, args[2], args[3], args[4:])
+	case command == "sites delete" && len(args) == 4:
+		return h.adminSitesDelete(w, args[2], args[3])
+	case command == "sessions list" && len(args) <= 3:
+		return h.adminSessionsList(w, args[2:])
+	case command == "sessions revoke" && len(args) >= 3:
+		return h.adminSessionsRevoke(w, args[2:])
+	case args[0] == "stats" && len(args) == 1:
+		return h.adminStats(w)
+	}
+
+	fmt.Fprint(w, adminUsage)
+	return 2
+}
+
+// auditCommand records an event of the admin command for the user with the given ID, or for no one if the ID is 0.
+func (h *Handlers) auditCommand(userID uint, action, detail string) {
+	event := AuditEvent{Action: action, Detail: detail, UserAgent: adminCommandAgent}
+	if userID != 0 {
+		event.UserID = &userID
+	}
+
+	h.log.Info("audit", "action", action, "user_id", userID, "detail", detail)
+
+	if err := h.db.Create(&event).Error; err != nil {
+		h.log.Error("saving audit event failed", "action", action, "error", err)
+	}
+}
+
+// userByEmail looks up the user with the email address for the admin command, and says so if there's none.
+func (h *Handlers) userByEmail(w io.Writer, email string) (User, bool) {
+	user := User{}
+	if h.db.Where("email = ?", email).First(&user).RecordNotFound() {
+		fmt.Fprintf(w, "There is no user with the email address %s\n", email)
+		return user, false
+	}
+	return user, true
+}
+
+/*
+readPassword reads a new password from in. From a terminal it's asked for
+twice without being shown; otherwise it's the first line, so scripts can
+pipe it in without it ending up in the process list.
+*/
+func readPassword(w io.Writer, in io.Reader) (string, error) {
+	if f, ok := in.(*os.File); ok && terminal.IsTerminal(int(f.Fd())) {
+		fmt.Fprint(w, "Password: ")
+		one, err := terminal.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(w)
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Fprint(w, "Password again: ")
+		two, err := terminal.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(w)
+		if err != nil {
+			return "", err
+		}
+
+		if string(one) != string(two) {
+			return "", fmt.Errorf("passwords do not match")
+		}
+		return string(one), nil
+	}
+
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", fmt.Errorf("no password was passed")
+	}
+	return password, nil
+}
+
+// adminUsersList runs "admin users list".
+func (h *Handlers) adminUsersList(w io.Writer) int {
+	var users []User
+	h.db.Order("id").Find(&users)
+
+	t := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(t, "ID\tEMAIL\tCREATED\tSUPERADMIN\tDELETION DUE")
+	for _, u := range users {
+		due := ""
+		if d := u.DeletionDue(); d != nil {
+			due = d.Format(time.RFC3339)
+		}
+		fmt.Fprintf(t, "%d\t%s\t%s\t%t\t%s\n", u.ID, u.Email, u.CreatedAt.Format(time.RFC3339), u.Superadmin, due)
+	}
+	t.Flush()
+
+	return 0
+}
+
+// adminUsersCreate runs "admin users create <email>".
+func (h *Handlers) adminUsersCreate(w io.Writer, in io.Reader, email string) int {
+	if !rxEmail.MatchString(email) {
+		fmt.Fprintf(w, "%s is not an email address\n", email)
+		return 2
+	}
+
+	password, err := readPassword(w, in)
+	if err != nil {
+		fmt.Fprintf(w, "Reading the password failed: %v\n", err)
+		return 1
+	}
+
+	hashedPassword, err := h.pwh.GenerateFromPassword(password)
+	if err != nil {
+		fmt.Fprintf(w, "Hashing the password failed: %v\n", err)
+		return 1
+	}
+
+	user := User{Email: email, HashedPassword: hashedPassword}
+	if result := h.db.Create(&user); result.Error != nil {
+		fmt.Fprintf(w, "Creating the user failed, the email address may be taken: %v\n", result.Error)
+		return 1
+	}
+
+	h.auditCommand(user.ID, auditUserCreate, "")
+	fmt.Fprintf(w, "Created user %d, %s\n", user.ID, user.Email)
+
+	return 0
+}
+
+// adminUsersPassword runs "admin users password <email>".
+func (h *Handlers) adminUsersPassword(w io.Writer, in io.Reader, email string) int {
+	user, ok := h.userByEmail(w, email)
+	if !ok {
+		return 1
+	}
+
+	password, err := readPassword(w, in)
+	if err != nil {
+		fmt.Fprintf(w, "Reading the password failed: %v\n", err)
+		return 1
+	}
+
+	hashedPassword, err := h.pwh.GenerateFromPassword(password)
+	if err != nil {
+		fmt.Fprintf(w, "Hashing the password failed: %v\n", err)
+		return 1
+	}
+
+	if result := h.db.Model(&user).Update("hashed_password", hashedPassword); result.Error != nil {
+		fmt.Fprintf(w, "Saving the password failed: %v\n", result.Error)
+		return 1
+	}
+
+	h.db.Delete(Session{}, "user_id = ?", user.ID)
+	h.auditCommand(user.ID, auditPasswordReset, "")
+	fmt.Fprintf(w, "Set a new password for %s and logged them out everywhere\n", user.Email)
+
+	return 0
+}
+
+// adminUsersSuperadmin runs "admin users promote <email>" and "admin users demote <email>".
+func (h *Handlers) adminUsersSuperadmin(w io.Writer, email string, superadmin bool) int {
+	user, ok := h.userByEmail(w, email)
+	if !ok {
+		return 1
+	}
+
+	if result := h.db.Model(&user).UpdateColumn("superadmin", superadmin); result.Error != nil {
+		fmt.Fprintf(w, "Saving the user failed: %v\n", result.Error)
+		return 1
+	}
+
+	if superadmin {
+		h.auditCommand(user.ID, auditUserPromote, "")
+		fmt.Fprintf(w, "%s is a superadmin now\n", user.Email)
+	} else {
+		h.auditCommand(user.ID, auditUserDemote, "")
+		fmt.Fprintf(w, "%s is not a superadmin anymore\n", user.Email)
+	}
+
+	return 0
+}
+
+// adminSitesList runs "admin sites list [-user <email>]".
+func (h *Handlers) adminSitesList(w io.Writer, args []string) int {
+	flags := flag.NewFlagSet("sites list", flag.ContinueOnError)
+	flags.SetOutput(w)
+	email := flags.String("user", "", "only list the sites of the user with this email address")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		return 2
+	}
+
+	query := h.db.Order("id")
+	if *email != "" {
+		user, ok := h.userByEmail(w, *email)
+		if !ok {
+			return 1
+		}
+		query = query.Where("user_id = ?", user.ID)
+	}
+
+	var sites []Site
+	query.Find(&sites)
+
+	t := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(t, "ID\tDESIGNATION\tOWNER\tDOMAINS\tCREATED")
+	for _, s := range sites {
+		fmt.Fprintf(t, "%d\t%s\t%d\t%s\t%s\n", s.ID, s.Designation, s.UserID, strings.Join(s.DomainList(), " "), s.CreatedAt.Format(time.RFC3339))
+	}
+	t.Flush()
+
+	return 0
+}
+
+// adminSitesCreate runs "admin sites create <owner email> <designation> [domain...]".
+func (h *Handlers) adminSitesCreate(w io.Writer, email, designation string, domains []string) int {
+	user, ok := h.userByEmail(w, email)
+	if !ok {
+		return 1
+	}
+
+	site := newSite(user.ID, strings.TrimSpace(designation), encodeDomains(strings.Join(domains, "\r\n")))
+	if site.Designation == "" {
+		fmt.Fprintln(w, "The designation can't be empty")
+		return 2
+	}
+
+	if result := h.db.Create(&site); result.Error != nil {
+		fmt.Fprintf(w, "Creating the site failed, the designation may be taken: %v\n", result.Error)
+		return 1
+	}
+
+	h.auditCommand(user.ID, auditSiteCreate, fmt.Sprintf("site %d: %s", site.ID, site.Designation))
+	fmt.Fprintf(w, "Created site %d, %s, for %s\n", site.ID, site.Designation, user.Email)
+
+	return 0
+}
+
+/*
+adminSitesDelete runs "admin sites delete <site id> <designation>". The
+designation has to be given too, so a mistyped ID doesn't delete the wrong
+site. The site goes for good, with everything that hangs off it.
+*/
+func (h *Handlers) adminSitesDelete(w io.Writer, id, designation string) int {
+	site := Site{}
+	if h.db.Where("id = ?", id).First(&site).RecordNotFound() {
+		fmt.Fprintf(w, "There is no site with the ID %s\n", id)
+		return 1
+	}
+
+	if site.Designation != designation {
+		fmt.Fprintf(w, "Site %d is %s, not %s\n", site.ID, site.Designation, designation)
+		return 1
+	}
+
+	if err := h.deleteSite(site); err != nil {
+		fmt.Fprintf(w, "Deleting the site failed: %v\n", err)
+		return 1
+	}
+
+	h.auditCommand(site.UserID, auditSiteDelete, fmt.Sprintf("site %d: %s", site.ID, site.Designation))
+	fmt.Fprintf(w, "Deleted site %d, %s\n", site.ID, site.Designation)
+
+	return 0
+}
+
+/*
+deleteSite deletes the site for good. The database's foreign keys take its
+threads, comments, members, webhooks and exports with it; the files of those
+exports are removed here.
+*/
+func (h *Handlers) deleteSite(site Site) error {
+	var exports []Export
+	h.db.Where("site_id = ?", site.ID).Find(&exports)
+
+	if err := h.db.Unscoped().Delete(&site).Error; err != nil {
+		return err
+	}
+
+	for _, x := range exports {
+		if err := os.Remove(h.exportPath(x)); err != nil && !os.IsNotExist(err) {
+			h.log.Error("Removing the export of a deleted site failed", "export", x.ID, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// adminSessionsList runs "admin sessions list [<email>]".
+func (h *Handlers) adminSessionsList(w io.Writer, args []string) int {
+	query := h.db.Order("created_at desc")
+	if len(args) == 1 {
+		user, ok := h.userByEmail(w, args[0])
+		if !ok {
+			return 1
+		}
+		query = query.Where("user_id = ?", user.ID)
+	}
+
+	var sessions []Session
+	query.Find(&sessions)
+
+	t := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(t, "ID\tUSER\tCREATED\tIP\tUSER AGENT")
+	for _, s := range sessions {
+		fmt.Fprintf(t, "%s\t%d\t%s\t%s\t%s\n", s.ID, s.UserID, s.CreatedAt.Format(time.RFC3339), s.IP, s.UserAgent)
+	}
+	t.Flush()
+
+	return 0
+}
+
+// adminSessionsRevoke runs "admin sessions revoke <session id>" and "admin sessions revoke -user <email>".
+func (h *Handlers) adminSessionsRevoke(w io.Writer, args []string) int {
+	flags := flag.NewFlagSet("sessions revoke", flag.ContinueOnError)
+	flags.SetOutput(w)
+	email := flags.String("user", "", "log out every session of the user with this email address")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *email != "" {
+		if flags.NArg() > 0 {
+			fmt.Fprint(w, adminUsage)
+			return 2
+		}
+
+		user, ok := h.userByEmail(w, *email)
+		if !ok {
+			return 1
+		}
+
+		result := h.db.Delete(Session{}, "user_id = ?", user.ID)
+		h.auditCommand(user.ID, auditSessionDelete, "all sessions")
+		fmt.Fprintf(w, "Logged out %d sessions of %s\n", result.RowsAffected, user.Email)
+		return 0
+	}
+
+	if flags.NArg() != 1 {
+		fmt.Fprint(w, adminUsage)
+		return 2
+	}
+
+	session := Session{}
+	if h.db.Where("id = ?", flags.Arg(0)).First(&session).RecordNotFound() {
+		fmt.Fprintf(w, "There is no session with the ID %s\n", flags.Arg(0))
+		return 1
+	}
+
+	h.db.Delete(Session{}, "id = ?", session.ID)
+	h.auditCommand(session.UserID, auditSessionDelete, session.ID)
+	fmt.Fprintf(w, "Logged out session %s of user %d\n", session.ID, session.UserID)
+
+	return 0
+}
+
+// statusCount is a row of the comments, counted by status.
+type statusCount struct {
+	Status string
+	Count  int
+}
+
+// adminStats runs "admin stats".
+func (h *Handlers) adminStats(w io.Writer) int {
+	count := func(model interface{}, where ...interface{}) int {
+		n := 0
+		query := h.db.Model(model)
+		if len(where) > 0 {
+			query = query.Where(where[0], where[1:]...)
+		}
+		query.Count(&n)
+		return n
+	}
+
+	var statuses []statusCount
+	h.db.Model(&Comment{}).Select("status, count(*) as count").Group("status").Order("status").Scan(&statuses)
+
+	t := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(t, "Users\t%d\n", count(&User{}))
+	fmt.Fprintf(t, "Superadmins\t%d\n", count(&User{}, "superadmin = ?", true))
+	fmt.Fprintf(t, "Accounts to be deleted\t%d\n", count(&User{}, "deletion_requested_at IS NOT NULL"))
+	fmt.Fprintf(t, "Sites\t%d\n", count(&Site{}))
+	fmt.Fprintf(t, "Threads\t%d\n", count(&Thread{}))
+	for _, s := range statuses {
+		fmt.Fprintf(t, "Comments %s\t%d\n", s.Status, s.Count)
+	}
+	fmt.Fprintf(t, "Commenters\t%d\n", count(&Commenter{}))
+	fmt.Fprintf(t, "Sessions\t%d\n", count(&Session{}))
+	fmt.Fprintf(t, "API tokens\t%d\n", count(&APIToken{}, "expires_at > ?", time.Now()))
+	t.Flush()
+
+	return 0
+}
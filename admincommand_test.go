@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"strings"
+	"testing"
+
+	mocket "github.com/selvatico/go-mocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminCommandUsage(t *testing.T) {
+	pairs := [][]string{
+		{},
+		{"users"},
+		{"users", "create"},
+		{"sites", "delete", "3"},
+		{"nonsense"},
+	}
+
+	for _, args := range pairs {
+		var out bytes.Buffer
+		assert.Equal(t, 2, h.adminCommand(&out, strings.NewReader(""), args), strings.Join(args, " "))
+		assert.Contains(t, out.String(), "Usage: admin", strings.Join(args, " "))
+	}
+}
+
+func TestAdminCommandUsersCreate(t *testing.T) {
+	pairs := []struct {
+		Email        string
+		Password     string
+		ExpectedCode int
+	}{
+		{"nobody", "goodpassword\n", 2},
+		{"new@example.com", "", 1},
+		{"new@example.com", "canthashthis\n", 1},
+		{"new@example.com", "goodpassword\n", 0},
+	}
+
+	for _, p := range pairs {
+		mocket.Catcher.Reset()
+
+		var created map[string]driver.Value
+		mocket.Catcher.NewMock().WithQuery(`INSERT INTO "users"`).WithCallback(func(query string, args []driver.NamedValue) {
+			created = insertedValues(query, args)
+		})
+
+		var audited map[string]driver.Value
+		mocket.Catcher.NewMock().WithQuery(`INSERT INTO "audit_events"`).WithCallback(func(query string, args []driver.NamedValue) {
+			audited = insertedValues(query, args)
+		})
+
+		var out bytes.Buffer
+		code := h.adminCommand(&out, strings.NewReader(p.Password), []string{"users", "create", p.Email})
+
+		assert.Equal(t, p.ExpectedCode, code, p.Email+" "+p.Password)
+		if p.ExpectedCode != 0 {
+			assert.Nil(t, created, p.Email+" "+p.Password)
+			continue
+		}
+
+		assert.Equal(t, "new@example.com", created["email"])
+		assert.Equal(t, "hashedpassword", created["hashed_password"])
+		assert.Equal(t, auditUserCreate, audited["action"])
+		assert.Equal(t, adminCommandAgent, audited["user_agent"])
+	}
+
+	mocket.Catcher.Reset()
+}
+
+func TestAdminCommandUsersPassword(t *testing.T) {
+	mocket.Catcher.Reset()
+	mocket.Catcher.NewMock().WithQuery(`SELECT * FROM "users"`).WithReply([]map[string]interface{}{{"id": 7, "email": "owner@example.com"}})
+
+	var hashed []driver.NamedValue
+	mocket.Catcher.NewMock().WithQuery(`UPDATE "users" SET "hashed_password"`).WithCallback(func(_ string, args []driver.NamedValue) {
+		hashed = args
+	})
+
+	var loggedOut []driver.NamedValue
+	mocket.Catcher.NewMock().WithQuery(`DELETE FROM "sessions"`).WithCallback(func(_ string, args []driver.NamedValue) {
+		loggedOut = args
+	})
+
+	var out bytes.Buffer
+	code := h.adminCommand(&out, strings.NewReader("goodpassword\n"), []string{"users", "password", "owner@example.com"})
+
+	assert.Equal(t, 0, code, out.String())
+	if assert.NotEmpty(t, hashed) {
+		assert.Equal(t, "hashedpassword", hashed[0].Value)
+	}
+	if assert.NotEmpty(t, loggedOut) {
+		assert.EqualValues(t, 7, loggedOut[0].Value)
+	}
+
+	mocket.Catcher.Reset()
+}
+
+func TestAdminCommandUsersPromote(t *testing.T) {
+	mocket.Catcher.Reset()
+	mocket.Catcher.NewMock().WithQuery(`SELECT * FROM "users"`).WithReply([]map[string]interface{}{{"id": 7, "email": "owner@example.com"}})
+
+	var promoted []driver.NamedValue
+	mocket.Catcher.NewMock().WithQuery(`UPDATE "users" SET "superadmin"`).WithCallback(func(_ string, args []driver.NamedValue) {
+		promoted = args
+	})
+
+	var out bytes.Buffer
+	code := h.adminCommand(&out, strings.NewReader(""), []string{"users", "promote", "owner@example.com"})
+
+	assert.Equal(t, 0, code, out.String())
+	if assert.NotEmpty(t, promoted) {
+		assert.Equal(t, true, promoted[0].Value)
+	}
+
+	mocket.Catcher.Reset()
+
+	out.Reset()
+	assert.Equal(t, 1, h.adminCommand(&out, strings.NewReader(""), []string{"users", "promote", "nobody@example.com"}))
+	assert.Contains(t, out.String(), "There is no user")
+}
+
+func TestAdminCommandSitesDelete(t *testing.T) {
+	pairs := []struct {
+		Designation  string
+		ExpectedCode int
+	}{
+		{"other", 1},
+		{"blog", 0},
+	}
+
+	for _, p := range pairs {
+		mocket.Catcher.Reset()
+		mocket.Catcher.NewMock().WithQuery(`SELECT * FROM "sites"`).WithReply([]map[string]interface{}{{"id": 3, "user_id": 7, "designation": "blog"}})
+
+		var deleted bool
+		mocket.Catcher.NewMock().WithQuery(`DELETE FROM "sites"`).WithCallback(func(_ string, _ []driver.NamedValue) {
+			deleted = true
+		})
+
+		var out bytes.Buffer
+		code := h.adminCommand(&out, strings.NewReader(""), []string{"sites", "delete", "3", p.Designation})
+
+		assert.Equal(t, p.ExpectedCode, code, p.Designation)
+		assert.Equal(t, p.ExpectedCode == 0, deleted, p.Designation)
+	}
+
+	mocket.Catcher.Reset()
+}
+
+func TestAdminCommandStats(t *testing.T) {
+	mocket.Catcher.Reset()
+	mocket.Catcher.NewMock().WithQuery(`SELECT status, count(*) as count FROM "comments"`).WithReply([]map[string]interface{}{
+		{"status": StatusApproved, "count": 12},
+		{"status": StatusPending, "count": 3},
+	})
+	mocket.Catcher.NewMock().WithQuery(`SELECT count(*) FROM "sites"`).WithReply([]map[string]interface{}{{"count(*)": 4}})
+
+	var out bytes.Buffer
+	assert.Equal(t, 0, h.adminCommand(&out, strings.NewReader(""), []string{"stats"}))
+
+	assert.Regexp(t, `Sites\s+4\n`, out.String())
+	assert.Regexp(t, `Comments approved\s+12\n`, out.String())
+	assert.Regexp(t, `Comments pending\s+3\n`, out.String())
+
+	mocket.Catcher.Reset()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/javorszky/go-comments/openapi"
+	"github.com/labstack/echo"
+)
+
+/*
+registerAPI adds the routes under /api: the public API the embed uses, the
+admin API for scripts with an API token, and the OpenAPI document of both.
+Every route but the preflight ones has to be in the document; the tests
+check.
+*/
+func (h *Handlers) registerAPI(e *echo.Echo) {
+	// Public API routes
+	api := e.Group("/api")
+	api.GET("/openapi.json", h.OpenAPI)
+	sites := api.Group("/sites/:site", h.SiteCheck)
+	sites.GET("/comments", h.Comments)
+	sites.POST("/comments", h.CommentsPost)
+	sites.OPTIONS("/comments", h.Preflight)
+	sites.PUT("/comments/:comment", h.CommentsPut)
+	sites.DELETE("/comments/:comment", h.CommentsDelete)
+	sites.OPTIONS("/comments/:comment", h.Preflight)
+	sites.GET("/comments/:comment/revisions", h.CommentsRevisions)
+	sites.POST("/comments/:comment/vote", h.CommentsVote)
+	sites.OPTIONS("/comments/:comment/vote", h.Preflight)
+	sites.POST("/comments/:comment/reactions", h.CommentsReact)
+	sites.OPTIONS("/comments/:comment/reactions", h.Preflight)
+	sites.GET("/providers", h.Providers)
+	sites.POST("/sso", h.SSOLogin)
+	sites.OPTIONS("/sso", h.Preflight)
+
+	// Admin API routes, for scripts with an API token
+	v1 := api.Group("/v1", h.TokenCheck)
+	v1.GET("/sites", h.APISites, h.Scope(ScopeSitesRead))
+	v1.POST("/sites", h.APISitesPost, h.Scope(ScopeSitesWrite))
+	v1.GET("/sites/:id", h.APISite, h.Scope(ScopeSitesRead))
+	v1.PATCH("/sites/:id", h.APISitePatch, h.Scope(ScopeSitesWrite))
+	v1.GET("/sites/:id/threads", h.APIThreads, h.Scope(ScopeCommentsRead))
+	v1.GET("/sites/:id/comments", h.APIComments, h.Scope(ScopeCommentsRead))
+	v1.GET("/sites/:id/comments/:comment", h.APIComment, h.Scope(ScopeCommentsRead))
+	v1.POST("/sites/:id/comments/:comment/approve", h.APICommentApprove, h.Scope(ScopeCommentsModerate))
+	v1.POST("/sites/:id/comments/:comment/reject", h.APICommentReject, h.Scope(ScopeCommentsModerate))
+	v1.POST("/sites/:id/comments/:comment/spam", h.APICommentSpam, h.Scope(ScopeCommentsModerate))
+	v1.GET("/sessions", h.APISessions, h.Scope(ScopeSessionsRead))
+	v1.DELETE("/sessions/:session", h.APISessionDelete, h.Scope(ScopeSessionsWrite))
+}
+
+// OpenAPI handles GET /api/openapi.json with the OpenAPI document of the API.
+func (h *Handlers) OpenAPI(c echo.Context) error {
+	return c.Blob(http.StatusOK, echo.MIMEApplicationJSONCharsetUTF8, openapi.Spec)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/javorszky/go-comments/diff"
+	"github.com/javorszky/go-comments/openapi"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenAPIRoutes(t *testing.T) {
+	doc, err := openapi.Load()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	api := echo.New()
+	h.registerAPI(api)
+
+	var routes []string
+	for _, r := range api.Routes() {
+		// Groups with middleware add catch-all routes of their own, and
+		// preflight requests are answered for the browser, not documented.
+		if strings.HasPrefix(r.Name, "github.com/labstack/echo") || r.Method == http.MethodOptions {
+			continue
+		}
+		routes = append(routes, r.Method+" "+r.Path)
+	}
+	sort.Strings(routes)
+
+	assert.Equal(t, doc.Routes(), routes)
+}
+
+func TestOpenAPISchemas(t *testing.T) {
+	doc, err := openapi.Load()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	types := map[string]interface{}{
+		"Error":           ResponseError{},
+		"PublicComment":   PublicComment{},
+		"CommentRequest":  CommentRequest{},
+		"PublicRevision":  PublicRevision{},
+		"Change":          diff.Change{},
+		"VoteRequest":     VoteRequest{},
+		"ReactionRequest": ReactionRequest{},
+		"PublicProvider":  PublicProvider{},
+		"SSORequest":      SSORequest{},
+		"PublicCommenter": PublicCommenter{},
+		"APISite":         APISite{},
+		"APISiteRequest":  APISiteRequest{},
+		"APIThread":       APIThread{},
+		"APIComment":      APIComment{},
+		"APISession":      APISession{},
+	}
+
+	for name, schema := range doc.Components.Schemas {
+		v, ok := types[name]
+		if !assert.True(t, ok, name) {
+			continue
+		}
+
+		var fields []string
+		typ := reflect.TypeOf(v)
+		for i := 0; i < typ.NumField(); i++ {
+			fields = append(fields, strings.Split(typ.Field(i).Tag.Get("json"), ",")[0])
+		}
+		sort.Strings(fields)
+
+		var properties []string
+		for p := range schema.Properties {
+			properties = append(properties, p)
+		}
+		sort.Strings(properties)
+
+		assert.Equal(t, fields, properties, name)
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	rec := httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodGet, "/api/openapi.json", nil), rec)
+
+	if assert.NoError(t, h.OpenAPI(c)) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.True(t, json.Valid(rec.Body.Bytes()))
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Scopes of API tokens: what a token lets a script do on the user's behalf.
+const (
+	ScopeSitesRead        = "sites:read"
+	ScopeSitesWrite       = "sites:write"
+	ScopeCommentsRead     = "comments:read"
+	ScopeCommentsModerate = "comments:moderate"
+	ScopeSessionsRead     = "sessions:read"
+	ScopeSessionsWrite    = "sessions:write"
+)
+
+// scopes are all the scopes, in the order the token form lists them.
+var scopes = []string{ScopeSitesRead, ScopeSitesWrite, ScopeCommentsRead, ScopeCommentsModerate, ScopeSessionsRead, ScopeSessionsWrite}
+
+// tokenLifetimes are the number of days a token can be valid for.
+var tokenLifetimes = []int{7, 30, 90, 365}
+
+// tokenPrefix starts every API token, so they're easy to spot in code and logs.
+const tokenPrefix = "gct_"
+
+/*
+APIToken is a personal access token a user made to use the API at /api/v1
+with. Like session secrets, only the hash of the token is kept, and it's
+shown to the user once, when it's made. A token can only do what its scopes
+allow, on the sites its user can, until it expires.
+*/
+type APIToken struct {
+	ID         uint `gorm:"primary_key"`
+	CreatedAt  time.Time
+	UserID     uint   `gorm:"index:api_token_user"`
+	Name       string `gorm:"type:varchar(100)"`
+	Hash       string `gorm:"type:varchar(64);unique_index:api_token_hash"`
+	Scopes     string `gorm:"type:varchar(191)"`
+	ExpiresAt  time.Time
+	LastUsedAt *time.Time
+	LastUsedIP string
+}
+
+// ScopeList returns the scopes of the token.
+func (t APIToken) ScopeList() []string {
+	if t.Scopes == "" {
+		return []string{}
+	}
+	return strings.Split(t.Scopes, ",")
+}
+
+// Allows tells whether the token has the scope.
+func (t APIToken) Allows(scope string) bool {
+	for _, s := range t.ScopeList() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// parseScopes keeps the known scopes, in their usual order.
+func parseScopes(list []string) string {
+	wanted := map[string]bool{}
+	for _, s := range list {
+		wanted[s] = true
+	}
+
+	var kept []string
+	for _, s := range scopes {
+		if wanted[s] {
+			kept = append(kept, s)
+		}
+	}
+	return strings.Join(kept, ",")
+}
+
+// validTokenLifetime tells whether tokens can be valid for the number of days.
+func validTokenLifetime(days int) bool {
+	for _, d := range tokenLifetimes {
+		if d == days {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+TokenCheck is a middleware for the API. It looks up the bearer token in the
+Authorization header, and if it's valid and its user isn't disabled or
+waiting to be deleted, sets its user like SessionCheck does, and the token
+itself as "model.token". Otherwise it answers 401. Users who cancel the
+deletion of their account get their tokens back.
+*/
+func (h *Handlers) TokenCheck(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		header := c.Request().Header.Get(echo.HeaderAuthorization)
+		if !strings.HasPrefix(header, "Bearer ") {
+			return unauthorized(c, "An API token is needed.")
+		}
+
+		token := APIToken{}
+		if h.db.Where("hash = ? AND expires_at > ?", h.hashString(strings.TrimPrefix(header, "Bearer ")), time.Now()).First(&token).RecordNotFound() {
+			return unauthorized(c, "The API token is wrong or expired.")
+		}
+
+		user := User{}
+		if h.db.Where("id = ?", token.UserID).First(&user).RecordNotFound() || user.DisabledAt != nil || user.DeletionRequestedAt != nil {
+			return unauthorized(c, "The API token is wrong or expired.")
+		}
+
+		h.db.Model(&token).UpdateColumns(map[string]interface{}{"last_used_at": time.Now(), "last_used_ip": clientIP(c, h.cfg.TrustedProxies)})
+
+		c.Set("model.user", user)
+		c.Set("model.token", token)
+
+		return next(c)
+	}
+}
+
+// unauthorized answers that the request needs a valid token.
+func unauthorized(c echo.Context, message string) error {
+	c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer realm="api"`)
+	return c.JSON(http.StatusUnauthorized, ResponseError{message})
+}
+
+// Scope returns a middleware that only lets requests through if their token has the scope.
+func (h *Handlers) Scope(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			token, ok := c.Get("model.token").(APIToken)
+			if !ok {
+				panic("not okay")
+			}
+
+			if !token.Allows(scope) {
+				return c.JSON(http.StatusForbidden, ResponseError{fmt.Sprintf("The API token needs the %s scope.", scope)})
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// AdminTokens handles GET /admin/tokens to list the user's API tokens and make new ones.
+func (h *Handlers) AdminTokens(c echo.Context) error {
+	return h.renderTokens(c, "")
+}
+
+// renderTokens shows the user's API tokens, and the one they just made, if any.
+func (h *Handlers) renderTokens(c echo.Context, created string) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	var tokens []APIToken
+
+	h.db.Where("user_id = ?", user.ID).Order("created_at desc").Find(&tokens)
+
+	return c.Render(http.StatusOK, "admintokens", struct {
+		Csrf      interface{}
+		Tokens    []APIToken
+		Created   string
+		Scopes    []string
+		Lifetimes []int
+		Now       time.Time
+	}{
+		Csrf:      c.Get("csrf"),
+		Tokens:    tokens,
+		Created:   created,
+		Scopes:    scopes,
+		Lifetimes: tokenLifetimes,
+		Now:       time.Now(),
+	})
+}
+
+// AdminTokensPost handles POST /admin/tokens to make a new API token. The token is shown this once.
+func (h *Handlers) AdminTokensPost(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	form, err := c.FormParams()
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Could not read the form")
+	}
+
+	name := strings.TrimSpace(c.FormValue("name"))
+	if name == "" {
+		return c.String(http.StatusBadRequest, "Give the token a name")
+	}
+
+	scopeList := parseScopes(form["scopes"])
+	if scopeList == "" {
+		return c.String(http.StatusBadRequest, "Pick at least one scope")
+	}
+
+	days, err := strconv.Atoi(c.FormValue("expires"))
+	if err != nil || !validTokenLifetime(days) {
+		return c.String(http.StatusBadRequest, "Unknown expiry")
+	}
+
+	secret := tokenPrefix + randomToken(32)
+	token := APIToken{
+		UserID:    user.ID,
+		Name:      truncate(name, 100),
+		Hash:      h.hashString(secret),
+		Scopes:    scopeList,
+		ExpiresAt: time.Now().AddDate(0, 0, days),
+	}
+
+	if result := h.db.Create(&token); result.Error != nil {
+		return c.String(http.StatusBadRequest, "Something failed while saving")
+	}
+
+	h.audit(c, user.ID, auditTokenCreate, fmt.Sprintf("token %d: %s (%s)", token.ID, token.Name, token.Scopes))
+
+	return h.renderTokens(c, secret)
+}
+
+// AdminTokenDelete handles POST /admin/tokens/:token/delete to revoke one of the user's API tokens.
+func (h *Handlers) AdminTokenDelete(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	if result := h.db.Delete(APIToken{}, "id = ? AND user_id = ?", c.Param("token"), user.ID); result.RowsAffected > 0 {
+		h.audit(c, user.ID, auditTokenRevoke, "token "+c.Param("token"))
+	}
+
+	return c.Redirect(http.StatusFound, "/admin/tokens")
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	mocket "github.com/selvatico/go-mocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenCheck(t *testing.T) {
+	pairs := []struct {
+		Header       string
+		Found        bool
+		ExpectedCode int
+	}{
+		{"", true, http.StatusUnauthorized},
+		{"Basic dXNlcjpwYXNz", true, http.StatusUnauthorized},
+		{"Bearer gct_wrong", false, http.StatusUnauthorized},
+		{"Bearer gct_right", true, http.StatusOK},
+	}
+
+	for _, p := range pairs {
+		mocket.Catcher.Reset()
+		var args []driver.NamedValue
+		if p.Found {
+			mocket.Catcher.NewMock().WithQuery(`SELECT * FROM "api_tokens"`).WithCallback(func(_ string, a []driver.NamedValue) {
+				args = a
+			}).WithReply([]map[string]interface{}{{"id": 2, "user_id": 7, "scopes": ScopeSitesRead}})
+		}
+		mocket.Catcher.NewMock().WithQuery(`FROM "users"`).WithReply([]map[string]interface{}{{"id": 7, "email": "owner@example.com"}})
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/sites", nil)
+		if p.Header != "" {
+			req.Header.Set(echo.HeaderAuthorization, p.Header)
+		}
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+
+		err := h.TokenCheck(func(c echo.Context) error {
+			assert.EqualValues(t, 7, c.Get("model.user").(User).ID)
+			assert.EqualValues(t, 2, c.Get("model.token").(APIToken).ID)
+			return c.NoContent(http.StatusOK)
+		})(c)
+
+		if !assert.NoError(t, err) {
+			continue
+		}
+
+		assert.Equal(t, p.ExpectedCode, rec.Code, p.Header)
+		if p.ExpectedCode == http.StatusUnauthorized {
+			assert.NotEmpty(t, rec.Header().Get(echo.HeaderWWWAuthenticate), p.Header)
+			continue
+		}
+
+		if assert.NotEmpty(t, args) {
+			assert.Equal(t, h.hashString("gct_right"), args[0].Value)
+		}
+	}
+
+	mocket.Catcher.Reset()
+}
+
+func TestTokenCheckInactiveUser(t *testing.T) {
+	pairs := []map[string]interface{}{
+		{"id": 7, "email": "owner@example.com", "disabled_at": time.Now()},
+		{"id": 7, "email": "owner@example.com", "deletion_requested_at": time.Now()},
+	}
+
+	for _, p := range pairs {
+		mocket.Catcher.Reset()
+		mocket.Catcher.NewMock().WithQuery(`SELECT * FROM "api_tokens"`).WithReply([]map[string]interface{}{{"id": 2, "user_id": 7, "scopes": ScopeSitesRead}})
+		mocket.Catcher.NewMock().WithQuery(`FROM "users"`).WithReply([]map[string]interface{}{p})
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/sites", nil)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer gct_right")
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+
+		err := h.TokenCheck(func(c echo.Context) error {
+			return c.NoContent(http.StatusOK)
+		})(c)
+
+		if assert.NoError(t, err) {
+			assert.Equal(t, http.StatusUnauthorized, rec.Code, p)
+		}
+	}
+
+	mocket.Catcher.Reset()
+}
+
+func TestScope(t *testing.T) {
+	pairs := []struct {
+		Scopes       string
+		ExpectedCode int
+	}{
+		{ScopeCommentsRead, http.StatusForbidden},
+		{ScopeCommentsRead + "," + ScopeCommentsModerate, http.StatusOK},
+	}
+
+	for _, p := range pairs {
+		rec := httptest.NewRecorder()
+		c := e.NewContext(httptest.NewRequest(http.MethodPost, "/api/v1/sites/3/comments/5/approve", nil), rec)
+		c.Set("model.token", APIToken{Scopes: p.Scopes})
+
+		err := h.Scope(ScopeCommentsModerate)(func(c echo.Context) error {
+			return c.NoContent(http.StatusOK)
+		})(c)
+
+		if assert.NoError(t, err) {
+			assert.Equal(t, p.ExpectedCode, rec.Code, p.Scopes)
+		}
+	}
+}
+
+func TestParseScopes(t *testing.T) {
+	assert.Equal(t, "sites:read,comments:moderate", parseScopes([]string{ScopeCommentsModerate, "everything", ScopeSitesRead}))
+	assert.Equal(t, "", parseScopes(nil))
+}
+
+func TestAdminTokensPost(t *testing.T) {
+	pairs := []struct {
+		Form         string
+		ExpectedCode int
+	}{
+		{"name=&scopes=sites%3Aread&expires=30", http.StatusBadRequest},
+		{"name=deploy&scopes=everything&expires=30", http.StatusBadRequest},
+		{"name=deploy&scopes=sites%3Aread&expires=1000", http.StatusBadRequest},
+		{"name=deploy&scopes=sites%3Aread&scopes=comments%3Amoderate&expires=30", http.StatusOK},
+	}
+
+	for _, p := range pairs {
+		mocket.Catcher.Reset()
+
+		var created map[string]driver.Value
+		mocket.Catcher.NewMock().WithQuery(`INSERT INTO "api_tokens"`).WithCallback(func(query string, args []driver.NamedValue) {
+			created = insertedValues(query, args)
+		})
+
+		req := httptest.NewRequest(http.MethodPost, "/admin/tokens", strings.NewReader(p.Form))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("model.user", User{Model: gorm.Model{ID: 7}})
+
+		if !assert.NoError(t, h.AdminTokensPost(c)) {
+			continue
+		}
+
+		assert.Equal(t, p.ExpectedCode, rec.Code, p.Form)
+		if p.ExpectedCode != http.StatusOK {
+			assert.Nil(t, created, p.Form)
+			continue
+		}
+
+		assert.EqualValues(t, 7, created["user_id"])
+		assert.Equal(t, "sites:read,comments:moderate", created["scopes"])
+
+		body := rec.Body.String()
+		start := strings.Index(body, tokenPrefix)
+		if assert.True(t, start >= 0) {
+			secret := body[start : start+len(tokenPrefix)+64]
+			assert.Equal(t, h.hashString(secret), created["hash"])
+		}
+	}
+
+	mocket.Catcher.Reset()
+}
+
+func TestAPICommentReject(t *testing.T) {
+	mocket.Catcher.Reset()
+	mocket.Catcher.NewMock().WithQuery(`FROM "sites"`).WithReply([]map[string]interface{}{{"id": 3, "user_id": 7}})
+	mocket.Catcher.NewMock().WithQuery(`SELECT * FROM "comments"`).WithReply([]map[string]interface{}{{"id": 5, "site_id": 3, "thread_id": 1, "status": StatusPending, "body": "Hi"}})
+
+	var rejected bool
+	mocket.Catcher.NewMock().WithQuery(`UPDATE "comments" SET "status"`).WithCallback(func(_ string, _ []driver.NamedValue) {
+		rejected = true
+	})
+
+	rec := httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodPost, "/api/v1/sites/3/comments/5/reject", nil), rec)
+	c.Set("model.user", User{Model: gorm.Model{ID: 7}})
+	c.Set("model.token", APIToken{ID: 2, Scopes: ScopeCommentsModerate})
+	c.SetParamNames("id", "comment")
+	c.SetParamValues("3", "5")
+
+	if assert.NoError(t, h.APICommentReject(c)) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.True(t, rejected)
+		assert.Contains(t, rec.Body.String(), `"status":"rejected"`)
+	}
+
+	mocket.Catcher.Reset()
+}
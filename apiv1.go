@@ -0,0 +1,415 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// apiPageSize is how many items a page of a list in the API has, unless the request asks for fewer.
+const apiPageSize = 100
+
+/*
+The JSON the admin API at /api/v1 answers with. Comments have everything a
+moderator sees, unlike PublicComment.
+*/
+type (
+	APISite struct {
+		ID                uint      `json:"id"`
+		Designation       string    `json:"designation"`
+		Domains           []string  `json:"domains"`
+		Role              string    `json:"role"`
+		CommenterPolicy   string    `json:"commenterPolicy"`
+		EditWindowMinutes int       `json:"editWindowMinutes"`
+		MarkdownFeatures  string    `json:"markdownFeatures"`
+		Reactions         []string  `json:"reactions"`
+		CreatedAt         time.Time `json:"createdAt"`
+	}
+
+	APIThread struct {
+		ID        uint      `json:"id"`
+		URL       string    `json:"url"`
+		CreatedAt time.Time `json:"createdAt"`
+	}
+
+	APIComment struct {
+		ID            uint       `json:"id"`
+		ThreadID      uint       `json:"threadId"`
+		ParentID      *uint      `json:"parentId"`
+		CommenterID   *uint      `json:"commenterId"`
+		AuthorName    string     `json:"authorName"`
+		AuthorWebsite string     `json:"authorWebsite"`
+		Body          string     `json:"body"`
+		HTML          string     `json:"html"`
+		Status        string     `json:"status"`
+		SpamReasons   string     `json:"spamReasons"`
+		Upvotes       int        `json:"upvotes"`
+		Downvotes     int        `json:"downvotes"`
+		Score         int        `json:"score"`
+		CreatedAt     time.Time  `json:"createdAt"`
+		EditedAt      *time.Time `json:"editedAt"`
+	}
+
+	APISession struct {
+		ID        string    `json:"id"`
+		IP        string    `json:"ip"`
+		UserAgent string    `json:"userAgent"`
+		CreatedAt time.Time `json:"createdAt"`
+	}
+)
+
+/*
+APISiteRequest is what the API takes to add or change a site. Fields left
+out of a change stay as they are.
+*/
+type APISiteRequest struct {
+	Designation       *string   `json:"designation"`
+	Domains           *[]string `json:"domains"`
+	CommenterPolicy   *string   `json:"commenterPolicy"`
+	EditWindowMinutes *int      `json:"editWindowMinutes"`
+}
+
+// apiSite returns the site as the API shows it.
+func apiSite(site Site, role string) APISite {
+	return APISite{
+		ID:                site.ID,
+		Designation:       site.Designation,
+		Domains:           site.DomainList(),
+		Role:              role,
+		CommenterPolicy:   site.CommenterPolicy,
+		EditWindowMinutes: site.EditWindowMinutes,
+		MarkdownFeatures:  site.MarkdownFeatures,
+		Reactions:         site.ReactionList(),
+		CreatedAt:         site.CreatedAt,
+	}
+}
+
+// apiComment returns the comment as the API shows it.
+func apiComment(comment Comment) APIComment {
+	return APIComment{
+		ID:            comment.ID,
+		ThreadID:      comment.ThreadID,
+		ParentID:      comment.ParentID,
+		CommenterID:   comment.CommenterID,
+		AuthorName:    comment.AuthorName,
+		AuthorWebsite: comment.AuthorWebsite,
+		Body:          comment.Body,
+		HTML:          comment.BodyHTML,
+		Status:        comment.Status,
+		SpamReasons:   comment.SpamReasons,
+		Upvotes:       comment.Upvotes,
+		Downvotes:     comment.Downvotes,
+		Score:         comment.Score,
+		CreatedAt:     comment.CreatedAt,
+		EditedAt:      comment.EditedAt,
+	}
+}
+
+/*
+apiPage reads the paging of a list from the query: limit, how many items to
+return, and before, the ID the items have to be older than. Lists are newest
+first, so the ID of the last item is the before of the next page.
+*/
+func apiPage(c echo.Context) (before uint64, limit int, err error) {
+	limit = apiPageSize
+
+	if v := c.QueryParam("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > apiPageSize {
+			return 0, 0, fmt.Errorf("limit has to be between 1 and %d", apiPageSize)
+		}
+	}
+
+	if v := c.QueryParam("before"); v != "" {
+		if before, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("before has to be an ID")
+		}
+	}
+
+	return before, limit, nil
+}
+
+// apiToken returns the token of an API request.
+func apiToken(c echo.Context) APIToken {
+	token, ok := c.Get("model.token").(APIToken)
+	if !ok {
+		panic("not okay")
+	}
+	return token
+}
+
+// validateSiteRequest checks the fields of a site the request has.
+func validateSiteRequest(r APISiteRequest) error {
+	if r.Designation != nil && strings.TrimSpace(*r.Designation) == "" {
+		return fmt.Errorf("designation can't be empty")
+	}
+
+	if r.CommenterPolicy != nil && !validPolicy(*r.CommenterPolicy) {
+		return fmt.Errorf("unknown commenter policy")
+	}
+
+	if r.EditWindowMinutes != nil && *r.EditWindowMinutes < 0 {
+		return fmt.Errorf("editWindowMinutes can't be negative")
+	}
+
+	return nil
+}
+
+// applySiteRequest changes the site to what the request has.
+func applySiteRequest(site *Site, r APISiteRequest) {
+	if r.Designation != nil {
+		site.Designation = strings.TrimSpace(*r.Designation)
+	}
+	if r.Domains != nil {
+		site.Domains = encodeDomains(strings.Join(*r.Domains, "\r\n"))
+	}
+	if r.CommenterPolicy != nil {
+		site.CommenterPolicy = *r.CommenterPolicy
+	}
+	if r.EditWindowMinutes != nil {
+		site.EditWindowMinutes = *r.EditWindowMinutes
+	}
+}
+
+// APISites handles GET /api/v1/sites to list the sites the user owns or is a member of.
+func (h *Handlers) APISites(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	sites := []APISite{}
+	for _, s := range h.memberSites(user) {
+		sites = append(sites, apiSite(s.Site, s.Role))
+	}
+
+	return c.JSON(http.StatusOK, sites)
+}
+
+// APISitesPost handles POST /api/v1/sites to add a site the user owns.
+func (h *Handlers) APISitesPost(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	r := APISiteRequest{}
+	if err := c.Bind(&r); err != nil {
+		return c.JSON(http.StatusBadRequest, ResponseError{"Could not read the site."})
+	}
+
+	if r.Designation == nil {
+		return c.JSON(http.StatusUnprocessableEntity, ResponseError{"designation is needed"})
+	}
+
+	if err := validateSiteRequest(r); err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, ResponseError{err.Error()})
+	}
+
+	site := newSite(user.ID, "", encodeDomains(""))
+	applySiteRequest(&site, r)
+
+	if result := h.db.Create(&site); result.Error != nil {
+		return c.JSON(http.StatusConflict, ResponseError{"Something failed while saving. The designation may be taken."})
+	}
+
+	h.audit(c, user.ID, auditSiteCreate, fmt.Sprintf("site %d: %s (token %d)", site.ID, site.Designation, apiToken(c).ID))
+
+	return c.JSON(http.StatusCreated, apiSite(site, RoleOwner))
+}
+
+// APISite handles GET /api/v1/sites/:id.
+func (h *Handlers) APISite(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	site, ok := h.siteFor(c, RoleModerator)
+	if !ok {
+		return c.JSON(http.StatusNotFound, ResponseError{"No such site."})
+	}
+
+	return c.JSON(http.StatusOK, apiSite(site, h.siteRole(site, user.ID)))
+}
+
+// APISitePatch handles PATCH /api/v1/sites/:id to change a site's settings.
+func (h *Handlers) APISitePatch(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	site, ok := h.siteFor(c, RoleAdmin)
+	if !ok {
+		return c.JSON(http.StatusNotFound, ResponseError{"No such site."})
+	}
+
+	r := APISiteRequest{}
+	if err := c.Bind(&r); err != nil {
+		return c.JSON(http.StatusBadRequest, ResponseError{"Could not read the site."})
+	}
+
+	if err := validateSiteRequest(r); err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, ResponseError{err.Error()})
+	}
+
+	applySiteRequest(&site, r)
+
+	if result := h.db.Save(&site); result.Error != nil {
+		return c.JSON(http.StatusConflict, ResponseError{"Something failed while saving. The designation may be taken."})
+	}
+
+	h.audit(c, user.ID, auditSiteUpdate, fmt.Sprintf("site %d: %s (token %d)", site.ID, site.Designation, apiToken(c).ID))
+
+	return c.JSON(http.StatusOK, apiSite(site, h.siteRole(site, user.ID)))
+}
+
+// APIThreads handles GET /api/v1/sites/:id/threads to list a site's threads, newest first.
+func (h *Handlers) APIThreads(c echo.Context) error {
+	site, ok := h.siteFor(c, RoleModerator)
+	if !ok {
+		return c.JSON(http.StatusNotFound, ResponseError{"No such site."})
+	}
+
+	before, limit, err := apiPage(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ResponseError{err.Error()})
+	}
+
+	query := h.db.Where("site_id = ?", site.ID)
+	if before > 0 {
+		query = query.Where("id < ?", before)
+	}
+
+	var threads []Thread
+	query.Order("id desc").Limit(limit).Find(&threads)
+
+	list := []APIThread{}
+	for _, t := range threads {
+		list = append(list, APIThread{ID: t.ID, URL: t.URL, CreatedAt: t.CreatedAt})
+	}
+
+	return c.JSON(http.StatusOK, list)
+}
+
+/*
+APIComments handles GET /api/v1/sites/:id/comments to list a site's
+comments, newest first. They can be narrowed down to a status and a thread.
+*/
+func (h *Handlers) APIComments(c echo.Context) error {
+	site, ok := h.siteFor(c, RoleModerator)
+	if !ok {
+		return c.JSON(http.StatusNotFound, ResponseError{"No such site."})
+	}
+
+	before, limit, err := apiPage(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ResponseError{err.Error()})
+	}
+
+	query := h.db.Where("site_id = ?", site.ID)
+	if before > 0 {
+		query = query.Where("id < ?", before)
+	}
+	if status := c.QueryParam("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if thread := c.QueryParam("thread"); thread != "" {
+		query = query.Where("thread_id = ?", thread)
+	}
+
+	var comments []Comment
+	query.Order("id desc").Limit(limit).Find(&comments)
+
+	list := []APIComment{}
+	for _, comment := range comments {
+		list = append(list, apiComment(comment))
+	}
+
+	return c.JSON(http.StatusOK, list)
+}
+
+// APIComment handles GET /api/v1/sites/:id/comments/:comment.
+func (h *Handlers) APIComment(c echo.Context) error {
+	_, comment, err := h.adminComment(c)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, ResponseError{err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, apiComment(comment))
+}
+
+// APICommentApprove handles POST /api/v1/sites/:id/comments/:comment/approve.
+func (h *Handlers) APICommentApprove(c echo.Context) error {
+	return h.apiModerate(c, StatusApproved)
+}
+
+// APICommentReject handles POST /api/v1/sites/:id/comments/:comment/reject.
+func (h *Handlers) APICommentReject(c echo.Context) error {
+	return h.apiModerate(c, StatusRejected)
+}
+
+// APICommentSpam handles POST /api/v1/sites/:id/comments/:comment/spam.
+func (h *Handlers) APICommentSpam(c echo.Context) error {
+	return h.apiModerate(c, StatusSpam)
+}
+
+// apiModerate sets the status of a comment like moderate does, and answers with the comment.
+func (h *Handlers) apiModerate(c echo.Context, status string) error {
+	site, comment, err := h.adminComment(c)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, ResponseError{err.Error()})
+	}
+
+	if err := h.setStatus(c, site, &comment, status); err != nil {
+		return c.JSON(http.StatusInternalServerError, ResponseError{"Something failed while saving."})
+	}
+
+	return c.JSON(http.StatusOK, apiComment(comment))
+}
+
+// APISessions handles GET /api/v1/sessions to list the user's sessions.
+func (h *Handlers) APISessions(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	var sessions []Session
+
+	h.db.Where("user_id = ?", user.ID).Order("created_at desc").Find(&sessions)
+
+	list := []APISession{}
+	for _, s := range sessions {
+		list = append(list, APISession{ID: s.ID, IP: s.IP, UserAgent: s.UserAgent, CreatedAt: s.CreatedAt})
+	}
+
+	return c.JSON(http.StatusOK, list)
+}
+
+// APISessionDelete handles DELETE /api/v1/sessions/:session to log one of the user's sessions out.
+func (h *Handlers) APISessionDelete(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	result := h.db.Delete(Session{}, "id = ? AND user_id = ?", c.Param("session"), user.ID)
+	if result.RowsAffected == 0 {
+		return c.JSON(http.StatusNotFound, ResponseError{"No such session."})
+	}
+
+	h.audit(c, user.ID, auditSessionDelete, fmt.Sprintf("%s (token %d)", c.Param("session"), apiToken(c).ID))
+
+	return c.NoContent(http.StatusNoContent)
+}
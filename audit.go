@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Actions recorded in the audit log.
+const (
+	auditLoginSuccess   = "login.success"
+	auditLoginFailure   = "login.failure"
+	auditSessionDelete  = "session.delete"
+	auditSiteCreate     = "site.create"
+	auditSiteUpdate     = "site.update"
+	auditPasswordChange = "password.change"
+	auditCommentEdit    = "comment.edit"
+	auditWebhookCreate  = "webhook.create"
+	auditWebhookDelete  = "webhook.delete"
+	auditSiteImport     = "site.import"
+	auditSiteExport     = "site.export"
+
+	auditAccountExport        = "account.export"
+	auditAccountDeleteRequest = "account.delete_request"
+	auditAccountDeleteCancel  = "account.delete_cancel"
+	auditAccountDelete        = "account.delete"
+
+	auditSiteInvite       = "site.invite"
+	auditSiteInviteRevoke = "site.invite_revoke"
+	auditSiteJoin         = "site.join"
+	auditSiteMemberRole   = "site.member_role"
+	auditSiteMemberRemove = "site.member_remove"
+	auditSiteTransfer     = "site.transfer"
+
+	auditUserCreate    = "user.create"
+	auditPasswordReset = "password.reset"
+	auditUserPromote   = "user.promote"
+	auditUserDemote    = "user.demote"
+	auditSiteDelete    = "site.delete"
+
+	auditUserDisable       = "user.disable"
+	auditUserEnable        = "user.enable"
+	auditImpersonateStart  = "impersonation.start"
+	auditImpersonateStop   = "impersonation.stop"
+	auditRegistrationOpen  = "registration.open"
+	auditRegistrationClose = "registration.close"
+
+	auditTokenCreate = "token.create"
+	auditTokenRevoke = "token.revoke"
+
+	auditCommenterExport    = "commenter.export"
+	auditCommenterErase     = "commenter.erase"
+	auditCommenterAnonymize = "commenter.anonymize"
+)
+
+/*
+AuditEvent is a security relevant thing that happened to a user's account.
+
+UserID is nil for failed logins with an email address that doesn't belong
+to anyone; the address is kept in Detail instead. It becomes nil too when
+the account is deleted, so the events outlive it.
+*/
+type AuditEvent struct {
+	ID        uint      `gorm:"primary_key"`
+	CreatedAt time.Time `gorm:"index:audit_created_at"`
+	UserID    *uint
+	Action    string `gorm:"type:varchar(64);index:audit_action"`
+	Detail    string `gorm:"type:text"`
+	IP        string
+	UserAgent string
+	RequestID string `gorm:"type:varchar(64)"`
+}
+
+/*
+audit records an event for the user with the given ID, or for no one if the
+ID is 0. The event is also logged, so it shows up next to the request even
+if saving it failed. What a superadmin does while impersonating the user
+says so in the detail.
+*/
+func (h *Handlers) audit(c echo.Context, userID uint, action, detail string) {
+	if impersonator, ok := c.Get("model.impersonator").(User); ok {
+		detail = strings.TrimSpace(fmt.Sprintf("%s (by superadmin %d, %s)", detail, impersonator.ID, impersonator.Email))
+	}
+
+	event := AuditEvent{
+		Action:    action,
+		Detail:    detail,
+		IP:        clientIP(c, h.cfg.TrustedProxies),
+		UserAgent: c.Request().UserAgent(),
+		RequestID: c.Response().Header().Get(echo.HeaderXRequestID),
+	}
+	if userID != 0 {
+		event.UserID = &userID
+	}
+
+	logger := h.logger(c)
+	logger.Info("audit", "action", action, "user_id", userID, "detail", detail)
+
+	if err := h.db.Create(&event).Error; err != nil {
+		logger.Error("Saving audit event failed", "action", action, "error", err)
+	}
+}
+
+// AdminAudit handles GET /admin/audit to show the user's own audit trail.
+func (h *Handlers) AdminAudit(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	var events []AuditEvent
+
+	h.db.Where("user_id = ?", user.ID).Order("created_at desc").Limit(200).Find(&events)
+
+	return c.Render(http.StatusOK, "adminaudit", events)
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/javorszky/go-comments/client/internal/generate"
+	"github.com/javorszky/go-comments/openapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerated(t *testing.T) {
+	doc, err := openapi.Load()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	src, err := generate.Client(doc)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	current, err := os.ReadFile("client_gen.go")
+	if assert.NoError(t, err) {
+		assert.Equal(t, string(src), string(current), "client_gen.go is out of date with the OpenAPI document, run go generate")
+	}
+}
+
+func TestClient(t *testing.T) {
+	var got *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode([]APIComment{{ID: 5, Status: "pending"}})
+	}))
+	defer server.Close()
+
+	c := New(server.URL+"/", "gct_token")
+	comments, err := c.ListSiteComments(context.Background(), 3, ListSiteCommentsParams{Status: "pending", Limit: 10})
+
+	if assert.NoError(t, err) && assert.Len(t, comments, 1) {
+		assert.Equal(t, 5, comments[0].ID)
+	}
+	assert.Equal(t, "/api/v1/sites/3/comments", got.URL.Path)
+	assert.Equal(t, "limit=10&status=pending", got.URL.RawQuery)
+	assert.Equal(t, "Bearer gct_token", got.Header.Get("Authorization"))
+}
+
+func TestClientError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(Error{Error: "The API token needs the comments:moderate scope."})
+	}))
+	defer server.Close()
+
+	_, err := New(server.URL, "gct_token").ApproveComment(context.Background(), 3, 5)
+
+	if statusErr, ok := err.(*StatusError); assert.True(t, ok) {
+		assert.Equal(t, http.StatusForbidden, statusErr.StatusCode)
+		assert.Equal(t, "The API token needs the comments:moderate scope.", statusErr.Message)
+	}
+}
@@ -0,0 +1,28 @@
+//go:build ignore
+
+// gen.go writes client_gen.go from the OpenAPI document. Run it with go generate.
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/javorszky/go-comments/client/internal/generate"
+	"github.com/javorszky/go-comments/openapi"
+)
+
+func main() {
+	doc, err := openapi.Load()
+	if err != nil {
+		log.Fatalf("reading the OpenAPI document: %v", err)
+	}
+
+	src, err := generate.Client(doc)
+	if err != nil {
+		log.Fatalf("generating the client: %v", err)
+	}
+
+	if err := os.WriteFile("client_gen.go", src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,302 @@
+/*
+Package generate writes the typed Go client of the API from its OpenAPI
+document: a struct for every schema, and a method on Client for every
+operation. Only the parts of OpenAPI the document uses are understood.
+*/
+package generate
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/javorszky/go-comments/openapi"
+)
+
+// Header starts the generated file.
+const Header = "// Code generated by go run gen.go; DO NOT EDIT.\n"
+
+// initialisms are the words Go spells in capitals.
+var initialisms = map[string]bool{"API": true, "HTML": true, "ID": true, "IP": true, "SSO": true, "URL": true}
+
+// Client returns the formatted source of the client of the document.
+func Client(doc openapi.Document) ([]byte, error) {
+	var b bytes.Buffer
+
+	var names []string
+	for name := range doc.Components.Schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := writeSchema(&b, name, doc.Components.Schemas[name]); err != nil {
+			return nil, err
+		}
+	}
+
+	var paths []string
+	for p := range doc.Paths {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		for _, method := range openapi.Methods {
+			op, ok := doc.Paths[p][method]
+			if !ok {
+				continue
+			}
+			if err := writeOperation(&b, p, method, op); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var src bytes.Buffer
+
+	src.WriteString(Header)
+	src.WriteString("\npackage client\n\nimport (\n\t\"context\"\n\t\"net/url\"\n")
+	for _, pkg := range []string{"fmt", "strconv", "time"} {
+		if bytes.Contains(b.Bytes(), []byte(pkg+".")) {
+			fmt.Fprintf(&src, "\t%q\n", pkg)
+		}
+	}
+	src.WriteString(")\n")
+	src.Write(b.Bytes())
+
+	return format.Source(src.Bytes())
+}
+
+// writeSchema writes the struct of an object schema.
+func writeSchema(b *bytes.Buffer, name string, s *openapi.Schema) error {
+	if s.Type != "object" {
+		return fmt.Errorf("schema %s: only objects can be components", name)
+	}
+
+	fmt.Fprintf(b, "\n%stype %s struct {\n", comment(name+" is "+lowerFirst(s.Description), ""), name)
+
+	var properties []string
+	for p := range s.Properties {
+		properties = append(properties, p)
+	}
+	sort.Slice(properties, func(i, j int) bool {
+		return fieldName(properties[i], s.Properties[properties[i]]) < fieldName(properties[j], s.Properties[properties[j]])
+	})
+
+	for _, p := range properties {
+		prop := s.Properties[p]
+		typ, err := goType(prop)
+		if err != nil {
+			return fmt.Errorf("schema %s, property %s: %v", name, p, err)
+		}
+
+		tag := p
+		if !s.IsRequired(p) {
+			tag += ",omitempty"
+		}
+
+		if prop.Description != "" {
+			b.WriteString(comment(prop.Description, "\t"))
+		}
+		fmt.Fprintf(b, "\t%s %s `json:%q`\n", fieldName(p, prop), typ, tag)
+	}
+
+	b.WriteString("}\n")
+	return nil
+}
+
+// writeOperation writes the method of an operation, and the struct of its query parameters if it has any.
+func writeOperation(b *bytes.Buffer, p, method string, op openapi.Operation) error {
+	name := exported(op.OperationID)
+
+	args := []string{"ctx context.Context"}
+	var pathArgs []string
+	pathFormat := p
+	var query []openapi.Parameter
+
+	for _, param := range op.Parameters {
+		switch param.In {
+		case "path":
+			typ, err := goType(param.Schema)
+			if err != nil {
+				return fmt.Errorf("operation %s, parameter %s: %v", op.OperationID, param.Name, err)
+			}
+			args = append(args, param.Name+" "+typ)
+
+			verb, arg := "%d", param.Name
+			if typ == "string" {
+				verb, arg = "%s", "url.PathEscape("+param.Name+")"
+			}
+			pathFormat = strings.Replace(pathFormat, "{"+param.Name+"}", verb, 1)
+			pathArgs = append(pathArgs, arg)
+		case "query":
+			query = append(query, param)
+		default:
+			return fmt.Errorf("operation %s: parameters in %s aren't supported", op.OperationID, param.In)
+		}
+	}
+
+	if len(query) > 0 {
+		fmt.Fprintf(b, "\n// %sParams are the query parameters of %s.\ntype %sParams struct {\n", name, name, name)
+		for _, param := range query {
+			typ, err := goType(param.Schema)
+			if err != nil {
+				return fmt.Errorf("operation %s, parameter %s: %v", op.OperationID, param.Name, err)
+			}
+			b.WriteString(comment(param.Description, "\t"))
+			fmt.Fprintf(b, "\t%s %s\n", fieldName(param.Name, param.Schema), typ)
+		}
+		b.WriteString("}\n")
+		args = append(args, "params "+name+"Params")
+	}
+
+	body := "nil"
+	if op.RequestBody != nil {
+		typ, err := goType(op.RequestBody.JSON())
+		if err != nil {
+			return fmt.Errorf("operation %s, request body: %v", op.OperationID, err)
+		}
+		args = append(args, "body "+typ)
+		body = "body"
+	}
+
+	result := ""
+	for code, response := range op.Responses {
+		if strings.HasPrefix(code, "2") && response.Content != nil {
+			typ, err := goType(response.JSON())
+			if err != nil {
+				return fmt.Errorf("operation %s, response %s: %v", op.OperationID, code, err)
+			}
+			result = typ
+		}
+	}
+
+	fmt.Fprintf(b, "\n%s", comment(fmt.Sprintf("%s calls %s %s: %s", name, strings.ToUpper(method), p, op.Summary), ""))
+	if result == "" {
+		fmt.Fprintf(b, "func (c *Client) %s(%s) error {\n", name, strings.Join(args, ", "))
+	} else {
+		fmt.Fprintf(b, "func (c *Client) %s(%s) (%s, error) {\n", name, strings.Join(args, ", "), result)
+	}
+
+	b.WriteString("\tquery := url.Values{}\n")
+	for _, param := range query {
+		field := "params." + fieldName(param.Name, param.Schema)
+		switch param.Schema.Type {
+		case "integer":
+			fmt.Fprintf(b, "\tif %s != 0 {\n\t\tquery.Set(%q, strconv.Itoa(%s))\n\t}\n", field, param.Name, field)
+		case "string":
+			fmt.Fprintf(b, "\tif %s != \"\" {\n\t\tquery.Set(%q, %s)\n\t}\n", field, param.Name, field)
+		default:
+			return fmt.Errorf("operation %s, parameter %s: %s query parameters aren't supported", op.OperationID, param.Name, param.Schema.Type)
+		}
+	}
+
+	path := fmt.Sprintf("%q", pathFormat)
+	if len(pathArgs) > 0 {
+		path = fmt.Sprintf("fmt.Sprintf(%q, %s)", pathFormat, strings.Join(pathArgs, ", "))
+	}
+
+	if result == "" {
+		fmt.Fprintf(b, "\treturn c.do(ctx, %q, %s, query, %s, nil)\n}\n", strings.ToUpper(method), path, body)
+		return nil
+	}
+
+	fmt.Fprintf(b, "\tvar out %s\n", result)
+	fmt.Fprintf(b, "\terr := c.do(ctx, %q, %s, query, %s, &out)\n", strings.ToUpper(method), path, body)
+	b.WriteString("\treturn out, err\n}\n")
+	return nil
+}
+
+// goType returns the Go type of a schema.
+func goType(s *openapi.Schema) (string, error) {
+	if s == nil {
+		return "", fmt.Errorf("no schema")
+	}
+
+	var typ string
+
+	switch {
+	case s.Ref != "":
+		typ = openapi.RefName(s.Ref)
+	case s.Type == "string" && s.Format == "date-time":
+		typ = "time.Time"
+	case s.Type == "string":
+		typ = "string"
+	case s.Type == "integer":
+		typ = "int"
+	case s.Type == "boolean":
+		typ = "bool"
+	case s.Type == "array":
+		items, err := goType(s.Items)
+		if err != nil {
+			return "", err
+		}
+		typ = "[]" + items
+	case s.Type == "object" && s.AdditionalProperties != nil:
+		values, err := goType(s.AdditionalProperties)
+		if err != nil {
+			return "", err
+		}
+		typ = "map[string]" + values
+	case s.Type == "object" && len(s.Properties) == 0:
+		typ = "map[string]interface{}"
+	default:
+		return "", fmt.Errorf("%s schemas aren't supported here", s.Type)
+	}
+
+	if s.Nullable {
+		typ = "*" + typ
+	}
+	return typ, nil
+}
+
+// fieldName returns the Go name of a property or parameter.
+func fieldName(name string, s *openapi.Schema) string {
+	if s != nil && s.GoName != "" {
+		return s.GoName
+	}
+	return exported(name)
+}
+
+// exported turns a camelCase name into an exported Go name: parentId becomes ParentID.
+func exported(name string) string {
+	var words []string
+	start := 0
+	runes := []rune(name)
+	for i := 1; i < len(runes); i++ {
+		if unicode.IsUpper(runes[i]) && unicode.IsLower(runes[i-1]) {
+			words = append(words, string(runes[start:i]))
+			start = i
+		}
+	}
+	words = append(words, string(runes[start:]))
+
+	for i, w := range words {
+		if initialisms[strings.ToUpper(w)] {
+			words[i] = strings.ToUpper(w)
+			continue
+		}
+		words[i] = strings.ToUpper(w[:1]) + w[1:]
+	}
+	return strings.Join(words, "")
+}
+
+// lowerFirst makes the first letter of a sentence lower case, to follow a name.
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}
+
+// comment turns text into a line comment with the indent.
+func comment(text, indent string) string {
+	if text == "" {
+		return ""
+	}
+	return indent + "// " + text + "\n"
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+)
+
+// Commenter policies of a site: who may comment on it.
+const (
+	// PolicyAnonymous lets anyone comment, without even a name.
+	PolicyAnonymous = "anonymous"
+	// PolicyEmail asks guests for their name and email address.
+	PolicyEmail = "email"
+	// PolicyLogin only lets commenters who signed in comment.
+	PolicyLogin = "login"
+)
+
+// Kinds of commenters.
+const (
+	// KindGuest is a commenter who is only known by their cookie.
+	KindGuest = "guest"
+)
+
+// commenterCookie is the name of the cookie that identifies commenters.
+const commenterCookie = "gocomments_commenter"
+
+// commenterCookieLifetime is how long the commenter cookie is valid for.
+const commenterCookieLifetime = 365 * 24 * time.Hour
+
+/*
+Commenter model definition. Commenters are the people who leave comments on
+sites. They are not Users, who are the people running the sites.
+
+Guests are only known by the signed cookie they get when they first comment,
+and by whatever name, email and website they chose to give.
+*/
+type Commenter struct {
+	gorm.Model
+	Kind      string `gorm:"type:varchar(16)"`
+	Name      string `gorm:"type:varchar(191)"`
+	Email     string `gorm:"type:varchar(191);index:commenter_email"`
+	Website   string `gorm:"type:varchar(191)"`
+	AvatarURL string `gorm:"type:varchar(191)"`
+}
+
+// randomToken returns n random bytes, hex encoded.
+func randomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("reading random bytes failed: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+// sign returns the HMAC of value with the app's secret key.
+func (h *Handlers) sign(value string) string {
+	mac := hmac.New(sha256.New, []byte(h.cfg.SecretKey))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks that signature is the HMAC of value.
+func (h *Handlers) verify(value, signature string) bool {
+	return hmac.Equal([]byte(h.sign(value)), []byte(signature))
+}
+
+/*
+setCommenterCookie identifies the commenter to our API from now on. The
+cookie is read from within other sites' pages, so it has to be SameSite=None.
+*/
+func (h *Handlers) setCommenterCookie(c echo.Context, commenter Commenter) {
+	expires := time.Now().Add(commenterCookieLifetime)
+	value := fmt.Sprintf("%d|%d", commenter.ID, expires.Unix())
+
+	c.SetCookie(&http.Cookie{
+		Name:     commenterCookie,
+		Value:    value + "|" + h.sign(value),
+		Path:     "/api/",
+		Expires:  expires,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteNoneMode,
+	})
+}
+
+// currentCommenter returns the commenter the request's cookie belongs to, if
+// the cookie is there, signed by us, and not expired.
+func (h *Handlers) currentCommenter(c echo.Context) (Commenter, bool) {
+	commenter := Commenter{}
+
+	cookie, err := c.Cookie(commenterCookie)
+	if err != nil {
+		return commenter, false
+	}
+
+	parts := strings.Split(cookie.Value, "|")
+	if len(parts) != 3 || !h.verify(parts[0]+"|"+parts[1], parts[2]) {
+		return commenter, false
+	}
+
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return commenter, false
+	}
+
+	if h.db.Where("id = ?", parts[0]).First(&commenter).RecordNotFound() {
+		return commenter, false
+	}
+
+	return commenter, true
+}
+
+/*
+signedInFor tells whether the commenter signed in with one of the ways the
+site offers: its own single sign-on, or one of its OpenID Connect providers.
+Anyone can make a site and sign in there as whoever they like, so an identity
+from another site means nothing here.
+*/
+func (h *Handlers) signedInFor(site Site, commenter Commenter) bool {
+	issuers := []string{ssoIssuer(site)}
+	for _, p := range h.providers(site) {
+		issuers = append(issuers, p.Issuer)
+	}
+
+	count := 0
+	h.db.Model(&CommenterIdentity{}).Where("commenter_id = ? AND issuer IN (?)", commenter.ID, issuers).Count(&count)
+	return count > 0
+}
+
+/*
+commenterFor works out who is posting a comment. Commenters with a cookie
+keep their identity, if they signed in for this site, and guests get their
+name, email and website updated to what they sent this time. Everyone else
+becomes a new guest. Guests
+aren't saved here, so a comment that turns out to be invalid doesn't leave
+one behind: the caller saves them along with the comment.
+
+The site's policy decides what guests need to give, and whether they can
+comment at all.
+*/
+func (h *Handlers) commenterFor(c echo.Context, site Site, req CommentRequest) (Commenter, int, error) {
+	commenter, found := h.currentCommenter(c)
+
+	if found && commenter.Kind != KindGuest {
+		if h.signedInFor(site, commenter) {
+			return commenter, http.StatusOK, nil
+		}
+		commenter = Commenter{}
+	}
+
+	switch site.CommenterPolicy {
+	case PolicyLogin:
+		return commenter, http.StatusForbidden, fmt.Errorf("Sign in to comment.")
+	case PolicyEmail:
+		if strings.TrimSpace(req.Author) == "" || req.Email == "" {
+			return commenter, http.StatusUnprocessableEntity, fmt.Errorf("Name and email are required.")
+		}
+	}
+
+	if req.Email != "" && !isEmail(req.Email) {
+		return commenter, http.StatusUnprocessableEntity, fmt.Errorf("Passed email is not an email format.")
+	}
+
+	if req.Website != "" {
+		u, err := url.Parse(req.Website)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(req.Website) > 191 {
+			return commenter, http.StatusUnprocessableEntity, fmt.Errorf("Website has to be an http or https address.")
+		}
+	}
+
+	if utf8.RuneCountInString(req.Author) > maxAuthorLength {
+		return commenter, http.StatusUnprocessableEntity, fmt.Errorf("Name is longer than %d characters.", maxAuthorLength)
+	}
+
+	commenter.Kind = KindGuest
+	commenter.Name = strings.TrimSpace(req.Author)
+	commenter.Email = req.Email
+	commenter.Website = req.Website
+
+	return commenter, http.StatusOK, nil
+}
+
+// ownComment looks up a comment on the site that was written by the current
+// commenter less than the site's edit window ago.
+func (h *Handlers) ownComment(c echo.Context, site Site) (Comment, int, error) {
+	comment := Comment{}
+
+	commenter, ok := h.currentCommenter(c)
+	if !ok {
+		return comment, http.StatusUnauthorized, fmt.Errorf("Only the author can change a comment.")
+	}
+
+	if h.db.Where("id = ? AND site_id = ?", c.Param("comment"), site.ID).First(&comment).RecordNotFound() {
+		return comment, http.StatusNotFound, fmt.Errorf("No such comment.")
+	}
+
+	if comment.CommenterID == nil || *comment.CommenterID != commenter.ID {
+		return comment, http.StatusForbidden, fmt.Errorf("Only the author can change a comment.")
+	}
+
+	if time.Since(comment.CreatedAt) > site.EditWindow() {
+		return comment, http.StatusForbidden, fmt.Errorf("Comments can only be changed for %v after posting.", site.EditWindow())
+	}
+
+	return comment, http.StatusOK, nil
+}
+
+// CommentsPut handles PUT /api/sites/:site/comments/:comment for authors to change their
+// comment. What it said before is kept as a revision. The new text goes through the spam
+// checks, and an approved comment waits for a moderator again, so nothing gets published
+// that they didn't see.
+func (h *Handlers) CommentsPut(c echo.Context) error {
+	site, ok := c.Get("model.site").(Site)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	comment, code, err := h.ownComment(c, site)
+	if err != nil {
+		return c.JSON(code, ResponseError{err.Error()})
+	}
+
+	req := CommentRequest{}
+
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ResponseError{"Could not read the comment."})
+	}
+
+	if err := validateBody(req.Body); err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, ResponseError{err.Error()})
+	}
+
+	if req.Body == comment.Body {
+		return c.JSON(http.StatusOK, publicComment(comment, comment.CommenterID))
+	}
+
+	submission := h.submission(comment)
+	submission.Body = req.Body
+	submission.Referrer = c.Request().Referer()
+
+	status, reasons := comment.Status, comment.SpamReasons
+	if status == StatusApproved {
+		status = StatusPending
+	}
+	if verdict := h.checkSpam(c, submission); verdict.Spam {
+		status, reasons = StatusSpam, strings.Join(verdict.Reasons, "; ")
+	}
+
+	comment, err = h.editComment(comment, site, req.Body, status, reasons, EditorAuthor, *comment.CommenterID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, ResponseError{"Something failed while saving."})
+	}
+
+	// Spammers don't get to find out what gives them away.
+	public := publicComment(comment, comment.CommenterID)
+	if comment.Status == StatusSpam {
+		h.trigger(c, site, EventCommentFlagged, comment)
+		public.Status = StatusPending
+	}
+
+	return c.JSON(http.StatusOK, public)
+}
+
+// CommentsDelete handles DELETE /api/sites/:site/comments/:comment for authors to remove their comment.
+func (h *Handlers) CommentsDelete(c echo.Context) error {
+	site, ok := c.Get("model.site").(Site)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	comment, code, err := h.ownComment(c, site)
+	if err != nil {
+		return c.JSON(code, ResponseError{err.Error()})
+	}
+
+	if result := h.db.Delete(&comment); result.Error != nil {
+		return c.JSON(http.StatusInternalServerError, ResponseError{"Something failed while deleting."})
+	}
+
+	h.trigger(c, site, EventCommentDeleted, comment)
+
+	return c.NoContent(http.StatusNoContent)
+}
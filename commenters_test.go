@@ -0,0 +1,230 @@
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	mocket "github.com/selvatico/go-mocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommenterCookie(t *testing.T) {
+	mocket.Catcher.Reset().NewMock().WithQuery(`FROM "commenters"`).WithReply([]map[string]interface{}{
+		{"id": 12, "kind": KindGuest, "name": "Jane"},
+	})
+	defer mocket.Catcher.Reset()
+
+	rec := httptest.NewRecorder()
+	h.setCommenterCookie(e.NewContext(httptest.NewRequest(http.MethodPost, "/", nil), rec), Commenter{Name: "Jane"})
+
+	cookie := rec.Result().Cookies()[0]
+	assert.True(t, cookie.Secure)
+	assert.True(t, cookie.HttpOnly)
+	assert.Equal(t, http.SameSiteNoneMode, cookie.SameSite)
+
+	expires := time.Now().Add(time.Hour).Unix()
+	valid := fmt.Sprintf("12|%d", expires)
+	expired := fmt.Sprintf("12|%d", time.Now().Add(-time.Hour).Unix())
+
+	pairs := []struct {
+		Value string
+		Found bool
+	}{
+		{valid + "|" + h.sign(valid), true},
+		{fmt.Sprintf("13|%d|", expires) + h.sign(valid), false},
+		{valid + "|" + strings.Repeat("0", 64), false},
+		{expired + "|" + h.sign(expired), false},
+		{"12", false},
+	}
+
+	for _, p := range pairs {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(&http.Cookie{Name: commenterCookie, Value: p.Value})
+
+		commenter, found := h.currentCommenter(e.NewContext(req, httptest.NewRecorder()))
+		assert.Equal(t, p.Found, found, p.Value)
+		if p.Found {
+			assert.Equal(t, "Jane", commenter.Name)
+		}
+	}
+}
+
+func TestCommentsPostPolicies(t *testing.T) {
+	pairs := []struct {
+		Policy       string
+		Body         string
+		ExpectedCode int
+	}{
+		{PolicyEmail, `{"url":"https://example.com/post","author":"Jane","body":"hi"}`, http.StatusUnprocessableEntity},
+		{PolicyEmail, `{"url":"https://example.com/post","author":"Jane","email":"jane","body":"hi"}`, http.StatusUnprocessableEntity},
+		{PolicyEmail, `{"url":"https://example.com/post","author":"Jane","email":"jane@example.com","body":"hi"}`, http.StatusCreated},
+		{PolicyAnonymous, `{"url":"https://example.com/post","website":"javascript:alert(1)","body":"hi"}`, http.StatusUnprocessableEntity},
+		{PolicyAnonymous, `{"url":"https://example.com/post","body":"hi"}`, http.StatusCreated},
+		{PolicyLogin, `{"url":"https://example.com/post","author":"Jane","email":"jane@example.com","body":"hi"}`, http.StatusForbidden},
+	}
+
+	for _, p := range pairs {
+		site := mockSite
+		site.CommenterPolicy = p.Policy
+
+		req := httptest.NewRequest(http.MethodPost, "/api/sites/3/comments", strings.NewReader(p.Body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("model.site", site)
+
+		if assert.NoError(t, h.CommentsPost(c)) {
+			assert.Equal(t, p.ExpectedCode, rec.Code, p.Policy+" "+p.Body)
+		}
+	}
+}
+
+func TestCommentsPostSavesGuestWithComment(t *testing.T) {
+	pairs := []struct {
+		Body         string
+		ExpectedCode int
+	}{
+		// The comment it replies to isn't there, so there's nothing to keep the guest for.
+		{`{"url":"https://example.com/post","author":"Jane","email":"jane@example.com","body":"hi","parentId":99}`, http.StatusUnprocessableEntity},
+		{`{"url":"https://example.com/post","author":"Jane","email":"jane@example.com","body":""}`, http.StatusUnprocessableEntity},
+		{`{"url":"https://example.com/post","author":"Jane","email":"jane@example.com","body":"hi"}`, http.StatusCreated},
+	}
+
+	for _, p := range pairs {
+		mocket.Catcher.Reset()
+
+		saved := false
+		mocket.Catcher.NewMock().WithQuery(`INSERT INTO "commenters"`).WithCallback(func(_ string, _ []driver.NamedValue) {
+			saved = true
+		})
+
+		req := httptest.NewRequest(http.MethodPost, "/api/sites/3/comments", strings.NewReader(p.Body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("model.site", mockSite)
+
+		if assert.NoError(t, h.CommentsPost(c)) {
+			assert.Equal(t, p.ExpectedCode, rec.Code, p.Body)
+			assert.Equal(t, p.ExpectedCode == http.StatusCreated, saved, p.Body)
+		}
+	}
+
+	mocket.Catcher.Reset()
+}
+
+func TestCommentsPostSignedInElsewhere(t *testing.T) {
+	pairs := []struct {
+		Identities   int
+		ExpectedCode int
+	}{
+		{0, http.StatusForbidden},
+		{1, http.StatusCreated},
+	}
+
+	expires := time.Now().Add(time.Hour).Unix()
+	value := fmt.Sprintf("12|%d", expires)
+
+	for _, p := range pairs {
+		mocket.Catcher.Reset()
+		mocket.Catcher.NewMock().WithQuery(`FROM "commenters"`).WithReply([]map[string]interface{}{
+			{"id": 12, "kind": KindSSO, "name": "Jane", "email": "jane@example.com"},
+		})
+		mocket.Catcher.NewMock().WithQuery(`FROM "commenter_identities"`).WithReply([]map[string]interface{}{{"count(*)": p.Identities}})
+
+		site := mockSite
+		site.CommenterPolicy = PolicyLogin
+
+		req := httptest.NewRequest(http.MethodPost, "/api/sites/3/comments", strings.NewReader(`{"url":"https://example.com/post","body":"hi"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.AddCookie(&http.Cookie{Name: commenterCookie, Value: value + "|" + h.sign(value)})
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("model.site", site)
+
+		if assert.NoError(t, h.CommentsPost(c)) {
+			assert.Equal(t, p.ExpectedCode, rec.Code, p.Identities)
+		}
+	}
+
+	mocket.Catcher.Reset()
+}
+
+func TestCommentsPostConfirmsSSOEmail(t *testing.T) {
+	mocket.Catcher.Reset()
+	mocket.Catcher.NewMock().WithQuery(`FROM "commenters"`).WithReply([]map[string]interface{}{
+		{"id": 12, "kind": KindSSO, "name": "Jane", "email": "jane@example.com"},
+	})
+	mocket.Catcher.NewMock().WithQuery(`FROM "commenter_identities"`).WithReply([]map[string]interface{}{{"count(*)": 1}})
+
+	var notify driver.Value
+	mocket.Catcher.NewMock().WithQuery(`INSERT INTO "comments"`).WithCallback(func(query string, args []driver.NamedValue) {
+		notify = insertedValues(query, args)["notify_replies"]
+	})
+	defer mocket.Catcher.Reset()
+
+	outbox.messages = nil
+
+	expires := time.Now().Add(time.Hour).Unix()
+	value := fmt.Sprintf("12|%d", expires)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/sites/3/comments", strings.NewReader(`{"url":"https://example.com/post","body":"hi","notify":true}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.AddCookie(&http.Cookie{Name: commenterCookie, Value: value + "|" + h.sign(value)})
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.Set("model.site", mockSite)
+
+	if assert.NoError(t, h.CommentsPost(c)) {
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		assert.Equal(t, false, notify)
+		if assert.Len(t, outbox.messages, 1) {
+			assert.Equal(t, "jane@example.com", outbox.messages[0].To)
+			assert.Contains(t, outbox.messages[0].Text, "/notifications/confirm/")
+		}
+	}
+}
+
+func TestCommentsPutNeedsAuthor(t *testing.T) {
+	mocket.Catcher.Reset().NewMock().WithQuery(`FROM "comments"`).WithReply([]map[string]interface{}{
+		{"id": 5, "site_id": 3, "commenter_id": 12, "created_at": time.Now()},
+	})
+	defer mocket.Catcher.Reset()
+
+	pairs := []struct {
+		CommenterID  int
+		ExpectedCode int
+	}{
+		{0, http.StatusUnauthorized},
+		{13, http.StatusForbidden},
+	}
+
+	for _, p := range pairs {
+		req := httptest.NewRequest(http.MethodPut, "/api/sites/3/comments/5", strings.NewReader(`{"body":"changed"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+
+		if p.CommenterID != 0 {
+			mocket.Catcher.NewMock().WithQuery(`FROM "commenters"`).WithReply([]map[string]interface{}{
+				{"id": p.CommenterID, "kind": KindGuest},
+			})
+			value := fmt.Sprintf("%d|%d", p.CommenterID, time.Now().Add(time.Hour).Unix())
+			req.AddCookie(&http.Cookie{Name: commenterCookie, Value: value + "|" + h.sign(value)})
+		}
+
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("model.site", mockSite)
+		c.SetParamNames("comment")
+		c.SetParamValues("5")
+
+		if assert.NoError(t, h.CommentsPut(c)) {
+			assert.Equal(t, p.ExpectedCode, rec.Code, rec.Body.String())
+		}
+	}
+}
@@ -1,13 +1,16 @@
 package main
 
 import (
-	"fmt"
+	"context"
 	"github.com/javorszky/go-comments/config"
 	database "github.com/javorszky/go-comments/db"
+	"github.com/javorszky/go-comments/mail"
 	_ "github.com/jinzhu/gorm/dialects/mysql"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
-	"log"
+	"log/slog"
+	"os"
+	"strings"
 )
 
 func main() {
@@ -15,29 +18,50 @@ func main() {
 	localConfig, err := config.Get()
 
 	if err != nil {
-		log.Fatalf("Failed getting config: %v", err)
+		fatal("Failed getting config", err)
+	}
+
+	logger := NewLogger(localConfig.LogLevel)
+	slog.SetDefault(logger)
+
+	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
+		os.Exit(Healthcheck(localConfig))
 	}
 
 	db, err := database.GetInstance(localConfig)
 	if err != nil {
-		log.Fatalf("failed to connect to database: %v", err)
+		fatal("Failed to connect to database", err)
 	}
 
+	db.SetLogger(GormLogger{logger})
 	db.LogMode(localConfig.DatabaseDebug)
-
-	defer db.Close()
+	InstrumentDB(db)
 
 	m := database.RunMigrations(db)
 
 	if err = m; err != nil {
-		log.Fatalf("Could not migrate: %v", err)
+		fatal("Could not migrate", err)
 	}
-	log.Printf("Migration did run successfully")
+	logger.Info("Migration did run successfully", "migration", database.LatestMigrationID())
 
 	e := echo.New()
 	e.Pre(middleware.RemoveTrailingSlash())
+	e.HideBanner = true
+	e.Use(MetricsMiddleware)
+	e.Use(middleware.RequestID())
+	e.Use(LoggerMiddleware(logger, localConfig.TrustedProxies))
 	e.Use(middleware.Gzip())
 	e.Use(middleware.CSRFWithConfig(middleware.CSRFConfig{
+		// The public API is called from the sites' own pages, which can't
+		// have our token. SiteCheck checks their origin against the site
+		// instead, and the admin API under /api/v1 takes no cookies.
+		// Unsubscribe links are posted to by mail clients, and their
+		// signed token is what proves they're genuine, like the one of
+		// links that confirm reply notifications.
+		Skipper: func(c echo.Context) bool {
+			path := c.Request().URL.Path
+			return strings.HasPrefix(path, "/api/") || strings.HasPrefix(path, "/unsubscribe/") || strings.HasPrefix(path, "/notifications/")
+		},
 		TokenLookup:  "form:csrf",
 		TokenLength:  128,
 		CookieName:   "_csrf",
@@ -58,8 +82,36 @@ func main() {
 		keyLength:   32,
 	}
 	pwc := PwChecker{}
-	pwh := NewArgon2(pwhParams)
-	h := NewHandler(pwc, pwh, db)
+	pwh := InstrumentedHasher{NewArgon2(pwhParams)}
+	if localConfig.SecretKey == "" {
+		logger.Warn("SECRET_KEY is not set, using a random one. Commenters will lose their identity when the app restarts.")
+		localConfig.SecretKey = randomToken(32)
+	}
+
+	limitStore, err := NewRateLimitStore(localConfig.RateLimitStore, db)
+	if err != nil {
+		fatal("Setting up rate limits failed", err)
+	}
+
+	mailer, err := NewMailer(localConfig, logger)
+	if err != nil {
+		fatal("Setting up email failed", err)
+	}
+	mailQueue := mail.NewQueue(mailer, 1000, logger)
+
+	h := NewHandler(pwc, pwh, NewSpamPipeline(localConfig, db), NewRateLimits(limitStore), mailQueue, db, logger, localConfig)
+
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		os.Exit(h.ImportCommand(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		os.Exit(h.ExportCommand(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		os.Exit(h.AdminCommand(os.Args[2:]))
+	}
 
 	e.GET("/", h.Index)
 
@@ -70,18 +122,31 @@ func main() {
 	e.POST("/register", h.RegisterPost)
 
 	e.GET("/logout", h.Logout)
+	e.GET("/auth/oidc/callback", h.OIDCCallback)
+	e.GET("/auth/oidc/:site/:provider", h.OIDCStart)
 
 	e.GET("/register", h.Register)
 
+	e.GET("/unsubscribe/:commenter/:token", h.Unsubscribe)
+	e.POST("/unsubscribe/:commenter/:token", h.UnsubscribePost)
+	e.GET("/notifications/confirm/:comment/:token", h.NotificationsConfirm)
+	e.POST("/notifications/confirm/:comment/:token", h.NotificationsConfirmPost)
+
 	e.GET("/:id/js", h.ServeJS)
 
-	e.GET("/request", h.Request)
+	e.GET("/healthz", h.Healthz)
+	e.GET("/readyz", h.Readyz)
+	e.GET("/version", h.Version)
+	e.GET("/metrics", MetricsHandler(localConfig.MetricsToken))
+
 	port := localConfig.Port
 	if port == "" {
-		fmt.Print("Port not in env, setting it to 8090")
+		logger.Info("Port not in env, setting it to 8090")
 		port = "8090"
 	}
 
+	h.registerAPI(e)
+
 	// Admin routes
 	g := e.Group("/admin")
 	g.Use(h.SessionCheck)
@@ -89,10 +154,110 @@ func main() {
 	g.GET("/sites", h.AdminSites)
 	g.GET("/sites/new", h.AdminSitesNew)
 	g.POST("/sites/new", h.AdminSitesNewPost)
+	g.GET("/sites/:id/edit", h.AdminSitesEdit)
+	g.POST("/sites/:id/edit", h.AdminSitesEditPost)
+	g.GET("/sites/:id/comments", h.AdminComments)
+	g.POST("/sites/:id/comments/:comment/approve", h.AdminCommentApprove)
+	g.POST("/sites/:id/comments/:comment/reject", h.AdminCommentReject)
+	g.POST("/sites/:id/comments/:comment/spam", h.AdminCommentSpam)
+	g.GET("/sites/:id/comments/:comment/edit", h.AdminCommentEdit)
+	g.POST("/sites/:id/comments/:comment/edit", h.AdminCommentEditPost)
+	g.POST("/sites/:id/sso", h.AdminSiteSSOPost)
+	g.GET("/sites/:id/providers", h.AdminProviders)
+	g.POST("/sites/:id/providers", h.AdminProvidersPost)
+	g.POST("/sites/:id/providers/:provider/delete", h.AdminProviderDelete)
+	g.GET("/sites/:id/webhooks", h.AdminWebhooks)
+	g.POST("/sites/:id/webhooks", h.AdminWebhooksPost)
+	g.POST("/sites/:id/webhooks/:webhook/delete", h.AdminWebhookDelete)
+	g.POST("/sites/:id/webhooks/deliveries/:delivery/redeliver", h.AdminWebhookRedeliver)
+	g.GET("/sites/:id/import", h.AdminImport)
+	g.POST("/sites/:id/import", h.AdminImportPost)
+	g.GET("/sites/:id/exports", h.AdminExports)
+	g.POST("/sites/:id/exports", h.AdminExportsPost)
+	g.GET("/sites/:id/exports/:export/download", h.AdminExportDownload)
+	g.GET("/sites/:id/members", h.AdminMembers)
+	g.POST("/sites/:id/members", h.AdminMembersInvite)
+	g.POST("/sites/:id/members/:member/role", h.AdminMemberRole)
+	g.POST("/sites/:id/members/:member/delete", h.AdminMemberDelete)
+	g.POST("/sites/:id/invitations/:invitation/delete", h.AdminInvitationDelete)
+	g.POST("/sites/:id/transfer", h.AdminSiteTransfer, h.Unimpersonated)
+	g.GET("/invitations/:token", h.AdminInvitation)
+	g.POST("/invitations/:token", h.AdminInvitationAccept)
+
+	g.GET("/commenters", h.AdminCommenters)
+	g.GET("/commenters/export", h.AdminCommentersExport)
+	g.POST("/commenters/erase", h.AdminCommentersErasePost)
+	g.POST("/commenters/anonymize", h.AdminCommentersAnonymizePost)
 
 	g.GET("/sessions", h.AdminSessions)
 	g.GET("/sessions/delete/:id", h.DeleteSession)
 
-	// e.Logger.Fatal(e.Start(":" + port))
-	e.Logger.Fatal(e.StartTLS(":1323", "cert.crt", "key.key"))
+	g.GET("/password", h.AdminPassword)
+	g.POST("/password", h.AdminPasswordPost, h.Unimpersonated)
+	g.GET("/audit", h.AdminAudit)
+	g.GET("/tokens", h.AdminTokens)
+	g.POST("/tokens", h.AdminTokensPost, h.Unimpersonated)
+	g.POST("/tokens/:token/delete", h.AdminTokenDelete)
+	g.GET("/account", h.AdminAccount)
+	g.GET("/account/export", h.AdminAccountExport)
+	g.POST("/account/delete", h.AdminAccountDeletePost, h.Unimpersonated)
+	g.POST("/account/restore", h.AdminAccountRestorePost)
+	g.POST("/impersonation/stop", h.AdminImpersonationStop)
+
+	sa := g.Group("/superadmin", h.SuperadminCheck)
+	sa.GET("", h.AdminSuperadmin)
+	sa.POST("/registration", h.AdminSuperadminRegistration)
+	sa.GET("/users", h.AdminSuperadminUsers)
+	sa.POST("/users/:id/disable", h.AdminSuperadminDisable)
+	sa.POST("/users/:id/enable", h.AdminSuperadminEnable)
+	sa.POST("/users/:id/impersonate", h.AdminSuperadminImpersonate)
+	sa.GET("/sites", h.AdminSuperadminSites)
+
+	// The dump shows every request header, so only superadmins get to see it.
+	if localConfig.Debug {
+		sa.GET("/debug/request", h.Request)
+	}
+
+	tlsConfig, certManager, err := NewTLSConfig(localConfig)
+	if err != nil {
+		fatal("Could not set up TLS", err)
+	}
+
+	if localConfig.PublicURL == "" {
+		logger.Error("PUBLIC_URL is not set, so links in emails may not work; set it to where browsers reach the app")
+	}
+
+	workers := NewWorkers()
+	workers.Go(SweepRateLimits(limitStore, logger))
+	workers.Go(mailQueue.Run)
+	workers.Go(h.Digests)
+	workers.Go(h.Webhooks)
+	workers.Go(h.Exports)
+	workers.Go(h.AccountDeletions)
+
+	server := &Server{
+		Echo:            e,
+		Redirect:        RedirectHandler(certManager, localConfig.TLSPort),
+		TLSConfig:       tlsConfig,
+		HTTPAddr:        ":" + port,
+		TLSAddr:         ":" + localConfig.TLSPort,
+		ShutdownTimeout: localConfig.ShutdownTimeout,
+	}
+
+	if err := server.Run(); err != nil {
+		logger.Error("Server stopped", "error", err)
+	}
+
+	// Requests have been drained at this point, so whatever they queued up
+	// for the background workers is there to finish before the database goes.
+	ctx, cancel := context.WithTimeout(context.Background(), localConfig.ShutdownTimeout)
+	defer cancel()
+
+	if err := workers.Stop(ctx); err != nil {
+		logger.Error("Background workers did not stop in time", "error", err)
+	}
+
+	if err := db.Close(); err != nil {
+		logger.Error("Closing the database failed", "error", err)
+	}
 }
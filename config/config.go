@@ -3,8 +3,11 @@ package config
 import (
 	"fmt"
 	"github.com/joho/godotenv"
+	"net"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
@@ -16,6 +19,76 @@ type Config struct {
 	DatabaseAddress      string
 	Port                 string
 	DatabaseDebug        bool
+	Debug                bool
+	MetricsToken         string
+	LogLevel             string
+	// SecretKey signs the cookies that are not backed by a database
+	// session, like the ones that identify guest commenters.
+	SecretKey string
+	// PublicURL is where browsers reach the app, like https://comments.example.com.
+	// OpenID Connect providers redirect commenters back to it.
+	PublicURL string
+
+	// A global OpenID Connect provider every site can offer its commenters,
+	// next to the ones the site has itself.
+	OIDCName         string
+	OIDCIssuer       string
+	OIDCClientID     string
+	OIDCClientSecret string
+
+	// Spam filtering. Comments with more than SpamMaxLinks links, any of the
+	// blocked words or domains, or that were sent less than SpamMinTime after
+	// the form was shown are held as spam.
+	SpamMaxLinks      int
+	SpamWords         []string
+	SpamDomains       []string
+	SpamMinTime       time.Duration
+	SpamRequireTiming bool
+	SpamBayes         bool
+	AkismetKey        string
+	AkismetEndpoint   string
+
+	// TLS settings. When TLSHosts is empty the server falls back to the
+	// certificate and key files.
+	TLSPort         string
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSHosts        []string
+	TLSCacheDir     string
+	ACMEDirectory   string
+	ACMEEmail       string
+	ACMECARoot      string
+	ACMERenewBefore time.Duration
+
+	// RateLimitStore is where rate limits are counted: memory, or database
+	// when more than one instance of the app runs.
+	RateLimitStore string
+
+	// Email. Mailer is log, smtp, or file to write messages to MailDir.
+	// MailFrom is the address they're sent from.
+	Mailer       string
+	MailFrom     string
+	SMTPAddr     string
+	SMTPUsername string
+	SMTPPassword string
+	MailDir      string
+
+	// WebhookAllowPrivate lets webhooks be sent to, and the sign in
+	// providers site owners add be reached at, loopback and private network
+	// addresses, which is only safe when site owners are trusted.
+	WebhookAllowPrivate bool
+
+	// TrustedProxies are the addresses of the reverse proxies in front of
+	// the app. The X-Forwarded-For header is only believed when a request
+	// comes from one of them.
+	TrustedProxies []*net.IPNet
+
+	// ExportDir is where site exports are written until they expire.
+	ExportDir string
+
+	// ShutdownTimeout is how long in-flight requests and background workers
+	// get to finish when the server is stopped.
+	ShutdownTimeout time.Duration
 }
 
 // Get returns a config object that is built from environment variables
@@ -30,6 +103,51 @@ func Get() (*Config, error) {
 		debug = false
 	}
 
+	debugMode, err := strconv.ParseBool(getenv("DEBUG", "0"))
+	if err != nil {
+		debugMode = false
+	}
+
+	renewBefore, err := time.ParseDuration(getenv("ACME_RENEW_BEFORE", "0s"))
+	if err != nil {
+		return nil, fmt.Errorf("ACME_RENEW_BEFORE is not a duration: %v", err)
+	}
+
+	shutdownTimeout, err := time.ParseDuration(getenv("SHUTDOWN_TIMEOUT", "30s"))
+	if err != nil {
+		return nil, fmt.Errorf("SHUTDOWN_TIMEOUT is not a duration: %v", err)
+	}
+
+	spamMaxLinks, err := strconv.Atoi(getenv("SPAM_MAX_LINKS", "3"))
+	if err != nil {
+		return nil, fmt.Errorf("SPAM_MAX_LINKS is not a number: %v", err)
+	}
+
+	spamMinTime, err := time.ParseDuration(getenv("SPAM_MIN_TIME", "3s"))
+	if err != nil {
+		return nil, fmt.Errorf("SPAM_MIN_TIME is not a duration: %v", err)
+	}
+
+	spamRequireTiming, err := strconv.ParseBool(getenv("SPAM_REQUIRE_TIMING", "0"))
+	if err != nil {
+		spamRequireTiming = false
+	}
+
+	spamBayes, err := strconv.ParseBool(getenv("SPAM_BAYES", "1"))
+	if err != nil {
+		spamBayes = true
+	}
+
+	webhookAllowPrivate, err := strconv.ParseBool(getenv("WEBHOOK_ALLOW_PRIVATE", "0"))
+	if err != nil {
+		webhookAllowPrivate = false
+	}
+
+	trustedProxies, err := getnets("TRUSTED_PROXIES")
+	if err != nil {
+		return nil, fmt.Errorf("TRUSTED_PROXIES is not a list of addresses: %v", err)
+	}
+
 	c := &Config{
 		DatabaseUser:         getenv("DB_USER", ""),
 		DatabaseRootUser:     getenv("DB_ROOT_USER", ""),
@@ -39,6 +157,43 @@ func Get() (*Config, error) {
 		DatabaseAddress:      getenv("DB_ADDRESS", ""),
 		Port:                 getenv("PORT", ""),
 		DatabaseDebug:        debug,
+		Debug:                debugMode,
+		MetricsToken:         getenv("METRICS_TOKEN", ""),
+		LogLevel:             getenv("LOG_LEVEL", "info"),
+		SecretKey:            getenv("SECRET_KEY", ""),
+		PublicURL:            strings.TrimRight(getenv("PUBLIC_URL", ""), "/"),
+		OIDCName:             getenv("OIDC_NAME", "OpenID Connect"),
+		OIDCIssuer:           getenv("OIDC_ISSUER", ""),
+		OIDCClientID:         getenv("OIDC_CLIENT_ID", ""),
+		OIDCClientSecret:     getenv("OIDC_CLIENT_SECRET", ""),
+		SpamMaxLinks:         spamMaxLinks,
+		SpamWords:            getlist("SPAM_WORDS"),
+		SpamDomains:          getlist("SPAM_DOMAINS"),
+		SpamMinTime:          spamMinTime,
+		SpamRequireTiming:    spamRequireTiming,
+		SpamBayes:            spamBayes,
+		AkismetKey:           getenv("AKISMET_KEY", ""),
+		AkismetEndpoint:      getenv("AKISMET_ENDPOINT", ""),
+		TLSPort:              getenv("TLS_PORT", "1323"),
+		TLSCertFile:          getenv("TLS_CERT_FILE", "cert.crt"),
+		TLSKeyFile:           getenv("TLS_KEY_FILE", "key.key"),
+		TLSHosts:             getlist("TLS_HOSTS"),
+		TLSCacheDir:          getenv("TLS_CACHE_DIR", "certs"),
+		ACMEDirectory:        getenv("ACME_DIRECTORY", ""),
+		ACMEEmail:            getenv("ACME_EMAIL", ""),
+		ACMECARoot:           getenv("ACME_CA_ROOT", ""),
+		ACMERenewBefore:      renewBefore,
+		RateLimitStore:       getenv("RATE_LIMIT_STORE", "memory"),
+		Mailer:               getenv("MAILER", "log"),
+		MailFrom:             getenv("MAIL_FROM", "Go Comments <comments@localhost>"),
+		SMTPAddr:             getenv("SMTP_ADDR", ""),
+		SMTPUsername:         getenv("SMTP_USERNAME", ""),
+		SMTPPassword:         getenv("SMTP_PASSWORD", ""),
+		MailDir:              getenv("MAIL_DIR", "mail"),
+		WebhookAllowPrivate:  webhookAllowPrivate,
+		TrustedProxies:       trustedProxies,
+		ExportDir:            getenv("EXPORT_DIR", "exports"),
+		ShutdownTimeout:      shutdownTimeout,
 	}
 
 	return c, nil
@@ -51,3 +206,42 @@ func getenv(key string, fallback string) string {
 	}
 	return val
 }
+
+// getlist splits a comma separated environment variable into its trimmed,
+// non-empty parts.
+func getlist(key string) []string {
+	var list []string
+	for _, item := range strings.Split(getenv(key, ""), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// getnets parses a comma separated environment variable of IP addresses and
+// CIDR ranges. A lone address is a range of its own.
+func getnets(key string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range getlist(key) {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP address", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+)
+
+// errCommenterQuery is returned when a data request isn't an email address or a commenter ID.
+var errCommenterQuery = errors.New("Look commenters up by their email address or their ID")
+
+/*
+CommenterData is what a data request about a commenter finds on a user's
+sites: the commenters with that email address or ID, and their comments.
+Comments the commenter deleted are included, as they're still kept.
+
+Commenters aren't tied to a site, so a commenter is only part of it if they
+commented on one of the user's sites; the user never gets to see, change or
+remove anything on anyone else's.
+*/
+type CommenterData struct {
+	// UserID is the user whose sites were looked in.
+	UserID     uint
+	Commenters []Commenter
+	Comments   []Comment
+}
+
+// CommenterIDs returns the IDs of the commenters.
+func (d CommenterData) CommenterIDs() []uint {
+	ids := []uint{}
+	for _, commenter := range d.Commenters {
+		ids = append(ids, commenter.ID)
+	}
+	return ids
+}
+
+// CommentIDs returns the IDs of the comments.
+func (d CommenterData) CommentIDs() []uint {
+	ids := []uint{}
+	for _, comment := range d.Comments {
+		ids = append(ids, comment.ID)
+	}
+	return ids
+}
+
+// SiteIDs returns the IDs of the sites the comments are on.
+func (d CommenterData) SiteIDs() []uint {
+	ids := []uint{}
+	seen := map[uint]bool{}
+	for _, comment := range d.Comments {
+		if !seen[comment.SiteID] {
+			seen[comment.SiteID] = true
+			ids = append(ids, comment.SiteID)
+		}
+	}
+	return ids
+}
+
+/*
+CommenterExport is the answer to a commenter asking for their data: who they
+are, and what they wrote on the user's sites, with where and from which
+address, and what their comments said before they were edited.
+*/
+type CommenterExport struct {
+	Commenters []ExportCommenter   `json:"commenters"`
+	Comments   []CommenterComment  `json:"comments"`
+	Revisions  []CommenterRevision `json:"revisions"`
+}
+
+// CommenterComment is a comment in a CommenterExport.
+type CommenterComment struct {
+	ID            uint       `json:"id"`
+	CommenterID   *uint      `json:"commenterId"`
+	SiteID        uint       `json:"siteId"`
+	URL           string     `json:"url"`
+	ParentID      *uint      `json:"parentId"`
+	AuthorName    string     `json:"authorName"`
+	AuthorWebsite string     `json:"authorWebsite"`
+	Body          string     `json:"body"`
+	Status        string     `json:"status"`
+	IP            string     `json:"ip"`
+	UserAgent     string     `json:"userAgent"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	EditedAt      *time.Time `json:"editedAt"`
+	DeletedAt     *time.Time `json:"deletedAt"`
+}
+
+// CommenterRevision is what a comment in a CommenterExport said before it was edited.
+type CommenterRevision struct {
+	CommentID uint      `json:"commentId"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ownedSiteIDs returns a subquery of the IDs of the sites the user owns.
+func (h *Handlers) ownedSiteIDs(userID uint) interface{} {
+	return h.db.Table("sites").Select("id").Where("user_id = ?", userID).QueryExpr()
+}
+
+// commenterData looks up the commenters query is about, and their comments on the user's sites.
+func (h *Handlers) commenterData(userID uint, query string) (CommenterData, error) {
+	data := CommenterData{UserID: userID}
+	query = strings.TrimSpace(query)
+
+	var commenters []Commenter
+	if id, err := strconv.ParseUint(query, 10, 64); err == nil {
+		h.db.Unscoped().Where("id = ?", id).Find(&commenters)
+	} else if isEmail(query) {
+		h.db.Unscoped().Where("email = ?", query).Find(&commenters)
+	} else {
+		return data, errCommenterQuery
+	}
+
+	if len(commenters) == 0 {
+		return data, nil
+	}
+
+	data.Commenters = commenters
+	h.db.Unscoped().Where("commenter_id IN (?) AND site_id IN (?)", data.CommenterIDs(), h.ownedSiteIDs(userID)).Order("created_at").Find(&data.Comments)
+
+	commented := map[uint]bool{}
+	for _, comment := range data.Comments {
+		commented[*comment.CommenterID] = true
+	}
+
+	data.Commenters = nil
+	for _, commenter := range commenters {
+		if commented[commenter.ID] {
+			data.Commenters = append(data.Commenters, commenter)
+		}
+	}
+
+	return data, nil
+}
+
+// commenterExport collects the data for the commenters' export.
+func (h *Handlers) commenterExport(data CommenterData) CommenterExport {
+	export := CommenterExport{
+		Commenters: []ExportCommenter{},
+		Comments:   []CommenterComment{},
+		Revisions:  []CommenterRevision{},
+	}
+
+	for _, commenter := range data.Commenters {
+		export.Commenters = append(export.Commenters, ExportCommenter{
+			Type:      "commenter",
+			ID:        commenter.ID,
+			Kind:      commenter.Kind,
+			Name:      commenter.Name,
+			Email:     commenter.Email,
+			Website:   commenter.Website,
+			CreatedAt: commenter.CreatedAt,
+		})
+	}
+
+	if len(data.Comments) == 0 {
+		return export
+	}
+
+	var threads []Thread
+	h.db.Unscoped().Where("id IN (SELECT thread_id FROM comments WHERE id IN (?))", data.CommentIDs()).Find(&threads)
+
+	urls := map[uint]string{}
+	for _, thread := range threads {
+		urls[thread.ID] = thread.URL
+	}
+
+	for _, comment := range data.Comments {
+		export.Comments = append(export.Comments, CommenterComment{
+			ID:            comment.ID,
+			CommenterID:   comment.CommenterID,
+			SiteID:        comment.SiteID,
+			URL:           urls[comment.ThreadID],
+			ParentID:      comment.ParentID,
+			AuthorName:    comment.AuthorName,
+			AuthorWebsite: comment.AuthorWebsite,
+			Body:          comment.Body,
+			Status:        comment.Status,
+			IP:            comment.IP,
+			UserAgent:     comment.UserAgent,
+			CreatedAt:     comment.CreatedAt,
+			EditedAt:      comment.EditedAt,
+			DeletedAt:     comment.DeletedAt,
+		})
+	}
+
+	var revisions []Revision
+	h.db.Where("comment_id IN (?)", data.CommentIDs()).Order("created_at").Find(&revisions)
+
+	for _, revision := range revisions {
+		export.Revisions = append(export.Revisions, CommenterRevision{
+			CommentID: revision.CommentID,
+			Body:      revision.Body,
+			CreatedAt: revision.CreatedAt,
+		})
+	}
+
+	return export
+}
+
+/*
+eraseCommenterData deletes the comments for good, along with their revisions
+and votes, and the webhook deliveries about them. Replies to them stay,
+without a parent. It returns how many of the commenters were deleted too;
+see pruneCommenters, and dropExports for what happens to exports.
+*/
+func (h *Handlers) eraseCommenterData(data CommenterData) (int, error) {
+	tx := h.db.Begin()
+
+	if err := h.forgetVotes(tx, data); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if err := redactDeliveries(tx, data, true); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if err := tx.Unscoped().Where("id IN (?)", data.CommentIDs()).Delete(&Comment{}).Error; err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	pruned, err := pruneCommenters(tx, data.CommenterIDs())
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return 0, err
+	}
+
+	h.dropExports(data)
+	return pruned, nil
+}
+
+/*
+anonymizeCommenterData keeps what the comments say, but not who said it:
+their commenter, name, website, avatar, IP address and user agent are
+removed, and so is the commenter who made the edits in their revisions, the
+author in the webhook deliveries about them, and who cast the commenter's
+votes. It returns how many of the commenters were deleted too; see
+pruneCommenters, and dropExports for what happens to exports.
+*/
+func (h *Handlers) anonymizeCommenterData(data CommenterData) (int, error) {
+	tx := h.db.Begin()
+
+	if err := tx.Unscoped().Model(&Comment{}).Where("id IN (?)", data.CommentIDs()).UpdateColumns(map[string]interface{}{
+		"commenter_id":   nil,
+		"author_name":    "",
+		"author_website": "",
+		"author_avatar":  "",
+		"ip":             "",
+		"user_agent":     "",
+		"notify_replies": false,
+	}).Error; err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if err := tx.Model(&Revision{}).Where("comment_id IN (?) AND editor_kind = ?", data.CommentIDs(), EditorAuthor).UpdateColumn("editor_id", 0).Error; err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if err := h.forgetVotes(tx, data); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if err := redactDeliveries(tx, data, false); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	pruned, err := pruneCommenters(tx, data.CommenterIDs())
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return 0, err
+	}
+
+	h.dropExports(data)
+	return pruned, nil
+}
+
+/*
+forgetVotes gives the votes the commenters cast on the user's sites a voter
+nobody is known by. They still count, but can't be told to be theirs.
+*/
+func (h *Handlers) forgetVotes(tx *gorm.DB, data CommenterData) error {
+	for _, id := range data.CommenterIDs() {
+		result := tx.Model(&Vote{}).
+			Where("voter = ? AND comment_id IN (SELECT id FROM comments WHERE site_id IN (?))", fmt.Sprintf("commenter:%d", id), h.ownedSiteIDs(data.UserID)).
+			UpdateColumn("voter", "forgotten:"+randomToken(16))
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+	return nil
+}
+
+/*
+redactDeliveries goes through the webhook deliveries about the comments,
+which carry their author's name and website. The ones about erased comments
+are deleted, and the others lose their author, also if they are still to be
+sent.
+*/
+func redactDeliveries(tx *gorm.DB, data CommenterData, erase bool) error {
+	var deliveries []WebhookDelivery
+	hooks := tx.Table("webhooks").Select("id").Where("site_id IN (?)", data.SiteIDs()).QueryExpr()
+	if err := tx.Where("webhook_id IN (?)", hooks).Find(&deliveries).Error; err != nil {
+		return err
+	}
+
+	comments := map[uint]bool{}
+	for _, id := range data.CommentIDs() {
+		comments[id] = true
+	}
+
+	for _, delivery := range deliveries {
+		payload := WebhookPayload{}
+		if err := json.Unmarshal([]byte(delivery.Payload), &payload); err != nil || !comments[payload.Comment.ID] {
+			continue
+		}
+
+		if erase {
+			if err := tx.Delete(&delivery).Error; err != nil {
+				return err
+			}
+			continue
+		}
+
+		payload.Comment.Author, payload.Comment.Website = "", ""
+		redacted, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(&delivery).UpdateColumn("payload", string(redacted)).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+dropExports removes the exports of the sites the comments are on, and their
+files, since they still have what was just erased or anonymized. Exports
+that are waiting to be made are kept, as they'll be made without it, and the
+ones being made right now throw their file away once they find they're gone.
+*/
+func (h *Handlers) dropExports(data CommenterData) {
+	var exports []Export
+	h.db.Where("site_id IN (?) AND status <> ?", data.SiteIDs(), ExportQueued).Find(&exports)
+
+	for _, x := range exports {
+		if err := h.db.Delete(&x).Error; err != nil {
+			h.log.Error("Dropping an export after a data request failed", "export", x.ID, "error", err)
+			continue
+		}
+		if err := os.Remove(h.exportPath(x)); err != nil && !os.IsNotExist(err) {
+			h.log.Error("Removing an export after a data request failed", "export", x.ID, "error", err)
+		}
+	}
+}
+
+/*
+pruneCommenters deletes the commenters who have no comments left anywhere,
+and with them the identities they sign in with. The ones who still have
+comments on other people's sites are kept for those.
+*/
+func pruneCommenters(tx *gorm.DB, ids []uint) (int, error) {
+	pruned := 0
+
+	for _, id := range ids {
+		count := 0
+		if err := tx.Unscoped().Model(&Comment{}).Where("commenter_id = ?", id).Count(&count).Error; err != nil {
+			return pruned, err
+		}
+		if count > 0 {
+			continue
+		}
+
+		if err := tx.Unscoped().Delete(&Commenter{}, "id = ?", id).Error; err != nil {
+			return pruned, err
+		}
+		pruned++
+	}
+
+	return pruned, nil
+}
+
+// joinIDs returns the IDs as a comma separated list.
+func joinIDs(ids []uint) string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = fmt.Sprint(id)
+	}
+	return strings.Join(s, ",")
+}
+
+// AdminCommenters handles GET /admin/commenters to look up a commenter's data on the user's sites.
+func (h *Handlers) AdminCommenters(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	data := CommenterData{}
+	query := c.QueryParam("q")
+
+	if query != "" {
+		var err error
+		if data, err = h.commenterData(user.ID, query); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+	}
+
+	return c.Render(http.StatusOK, "admincommenters", struct {
+		Csrf  interface{}
+		Query string
+		Data  CommenterData
+	}{
+		Csrf:  c.Get("csrf"),
+		Query: query,
+		Data:  data,
+	})
+}
+
+// AdminCommentersExport handles GET /admin/commenters/export to download a commenter's data on the user's sites as JSON.
+func (h *Handlers) AdminCommentersExport(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	data, err := h.commenterData(user.ID, c.QueryParam("q"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	if len(data.Commenters) == 0 {
+		return c.String(http.StatusNotFound, "No such commenter on your sites")
+	}
+
+	export := h.commenterExport(data)
+	h.audit(c, user.ID, auditCommenterExport, fmt.Sprintf("commenters %s: %d comments", joinIDs(data.CommenterIDs()), len(data.Comments)))
+
+	name := fmt.Sprintf("commenter-%s-%s.json", joinIDs(data.CommenterIDs()), time.Now().Format("2006-01-02"))
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", name))
+
+	return c.JSONPretty(http.StatusOK, export, "  ")
+}
+
+// AdminCommentersErasePost handles POST /admin/commenters/erase to delete a commenter's comments on the user's sites.
+func (h *Handlers) AdminCommentersErasePost(c echo.Context) error {
+	return h.commenterRequest(c, auditCommenterErase, h.eraseCommenterData)
+}
+
+// AdminCommentersAnonymizePost handles POST /admin/commenters/anonymize to strip a commenter's identity from their comments on the user's sites.
+func (h *Handlers) AdminCommentersAnonymizePost(c echo.Context) error {
+	return h.commenterRequest(c, auditCommenterAnonymize, h.anonymizeCommenterData)
+}
+
+/*
+commenterRequest runs fn on the data of the commenter in the q form field,
+and audits it as action. The form has to repeat q in confirm, as neither can
+be undone.
+*/
+func (h *Handlers) commenterRequest(c echo.Context, action string, fn func(CommenterData) (int, error)) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	query := c.FormValue("q")
+	if c.FormValue("confirm") != query {
+		return c.String(http.StatusBadRequest, "Type the email address or ID again to confirm")
+	}
+
+	data, err := h.commenterData(user.ID, query)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	if len(data.Commenters) == 0 {
+		return c.String(http.StatusNotFound, "No such commenter on your sites")
+	}
+
+	pruned, err := fn(data)
+	if err != nil {
+		h.logger(c).Error("Data request failed", "action", action, "commenters", data.CommenterIDs(), "error", err)
+		return c.String(http.StatusInternalServerError, "Something failed while saving")
+	}
+
+	h.audit(c, user.ID, action, fmt.Sprintf("commenters %s: %d comments, %d commenters deleted", joinIDs(data.CommenterIDs()), len(data.Comments), pruned))
+
+	return c.Redirect(http.StatusFound, "/admin/commenters?q="+url.QueryEscape(query))
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	mocket "github.com/selvatico/go-mocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockCommenterData has two commenters with the same email, only one of whom commented on the user's sites.
+func mockCommenterData() {
+	mocket.Catcher.NewMock().WithQuery(`SELECT * FROM "commenters"`).WithReply([]map[string]interface{}{
+		{"id": 6, "kind": KindGuest, "name": "Jane", "email": "jane@example.com"},
+		{"id": 8, "kind": KindGuest, "name": "Jane elsewhere", "email": "jane@example.com"},
+	})
+	mocket.Catcher.NewMock().WithQuery(`SELECT * FROM "comments"`).WithReply([]map[string]interface{}{
+		{"id": 10, "site_id": 3, "thread_id": 1, "commenter_id": 6, "author_name": "Jane", "body": "First", "ip": "192.0.2.1"},
+	})
+}
+
+func TestCommenterData(t *testing.T) {
+	mocket.Catcher.Reset()
+	defer mocket.Catcher.Reset()
+	mockCommenterData()
+
+	data, err := h.commenterData(7, " jane@example.com ")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []uint{6}, data.CommenterIDs())
+		assert.Equal(t, []uint{10}, data.CommentIDs())
+	}
+
+	_, err = h.commenterData(7, "Jane")
+	assert.Equal(t, errCommenterQuery, err)
+}
+
+func TestAdminCommentersExport(t *testing.T) {
+	mocket.Catcher.Reset()
+	defer mocket.Catcher.Reset()
+	mockCommenterData()
+	mocket.Catcher.NewMock().WithQuery(`FROM "threads"`).WithReply([]map[string]interface{}{{"id": 1, "site_id": 3, "url": "https://example.com/post"}})
+	mocket.Catcher.NewMock().WithQuery(`FROM "revisions"`).WithReply([]map[string]interface{}{{"id": 1, "comment_id": 10, "body": "Frist"}})
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/commenters/export?q=jane%40example.com", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.Set("model.user", User{Model: mockSite.Model, Email: "owner@example.com"})
+
+	if !assert.NoError(t, h.AdminCommentersExport(c)) {
+		return
+	}
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get(echo.HeaderContentDisposition), "commenter-6-")
+
+	export := CommenterExport{}
+	if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &export)) {
+		if assert.Len(t, export.Commenters, 1) {
+			assert.Equal(t, "Jane", export.Commenters[0].Name)
+		}
+		if assert.Len(t, export.Comments, 1) {
+			assert.Equal(t, "https://example.com/post", export.Comments[0].URL)
+			assert.Equal(t, "192.0.2.1", export.Comments[0].IP)
+		}
+		if assert.Len(t, export.Revisions, 1) {
+			assert.Equal(t, "Frist", export.Revisions[0].Body)
+		}
+	}
+}
+
+func TestAdminCommentersErasePost(t *testing.T) {
+	pairs := []struct {
+		Form         string
+		ExpectedCode int
+	}{
+		{"q=jane%40example.com&confirm=", http.StatusBadRequest},
+		{"q=Jane&confirm=Jane", http.StatusBadRequest},
+		{"q=jane%40example.com&confirm=jane%40example.com", http.StatusFound},
+	}
+
+	for _, p := range pairs {
+		mocket.Catcher.Reset()
+		mocket.Catcher.NewMock().WithQuery(`SELECT count(*) FROM "comments"`).WithReply([]map[string]interface{}{{"count(*)": 0}})
+		mockCommenterData()
+
+		var erased, pruned []driver.NamedValue
+		mocket.Catcher.NewMock().WithQuery(`DELETE FROM "comments"`).WithCallback(func(_ string, args []driver.NamedValue) {
+			erased = args
+		})
+		mocket.Catcher.NewMock().WithQuery(`DELETE FROM "commenters"`).WithCallback(func(_ string, args []driver.NamedValue) {
+			pruned = args
+		})
+
+		var audited map[string]driver.Value
+		mocket.Catcher.NewMock().WithQuery(`INSERT INTO "audit_events"`).WithCallback(func(query string, args []driver.NamedValue) {
+			audited = insertedValues(query, args)
+		})
+
+		req := httptest.NewRequest(http.MethodPost, "/admin/commenters/erase", strings.NewReader(p.Form))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("model.user", User{Model: gorm.Model{ID: 7}})
+
+		if !assert.NoError(t, h.AdminCommentersErasePost(c)) {
+			continue
+		}
+
+		assert.Equal(t, p.ExpectedCode, rec.Code, p.Form)
+		if p.ExpectedCode != http.StatusFound {
+			assert.Nil(t, erased, p.Form)
+			continue
+		}
+
+		if assert.Len(t, erased, 1) {
+			assert.EqualValues(t, 10, erased[0].Value)
+		}
+		if assert.Len(t, pruned, 1) {
+			assert.EqualValues(t, 6, pruned[0].Value)
+		}
+		assert.Equal(t, auditCommenterErase, audited["action"])
+		assert.Equal(t, "commenters 6: 1 comments, 1 commenters deleted", audited["detail"])
+	}
+
+	mocket.Catcher.Reset()
+}
+
+func TestAdminCommentersAnonymizePost(t *testing.T) {
+	mocket.Catcher.Reset()
+	defer mocket.Catcher.Reset()
+	// Jane has comments on someone else's site too.
+	mocket.Catcher.NewMock().WithQuery(`SELECT count(*) FROM "comments"`).WithReply([]map[string]interface{}{{"count(*)": 2}})
+	mockCommenterData()
+
+	var anonymized []driver.NamedValue
+	mocket.Catcher.NewMock().WithQuery(`UPDATE "comments" SET`).WithCallback(func(_ string, args []driver.NamedValue) {
+		anonymized = args
+	})
+
+	var pruned bool
+	mocket.Catcher.NewMock().WithQuery(`DELETE FROM "commenters"`).WithCallback(func(_ string, _ []driver.NamedValue) {
+		pruned = true
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/commenters/anonymize", strings.NewReader("q=6&confirm=6"))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.Set("model.user", User{Model: gorm.Model{ID: 7}})
+
+	if assert.NoError(t, h.AdminCommentersAnonymizePost(c)) {
+		assert.Equal(t, http.StatusFound, rec.Code)
+		assert.Equal(t, "/admin/commenters?q=6", rec.Header().Get(echo.HeaderLocation))
+	}
+
+	// author_avatar, author_name, author_website, commenter_id, ip, notify_replies, user_agent, id
+	if assert.Len(t, anonymized, 8) {
+		assert.Nil(t, anonymized[3].Value)
+		assert.Equal(t, "", anonymized[4].Value)
+		assert.EqualValues(t, 10, anonymized[7].Value)
+	}
+	assert.False(t, pruned)
+}
+
+func TestCommenterDataLeavesNothingBehind(t *testing.T) {
+	dir, err := os.MkdirTemp("", "exports")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	h.cfg.ExportDir = dir
+	defer func() { h.cfg.ExportDir = "" }()
+
+	data := CommenterData{
+		UserID:     7,
+		Commenters: []Commenter{{Model: gorm.Model{ID: 6}}},
+		Comments:   []Comment{{Model: gorm.Model{ID: 10}, SiteID: 3}},
+	}
+
+	pairs := []struct {
+		Name string
+		Fn   func(CommenterData) (int, error)
+	}{
+		{"erase", h.eraseCommenterData},
+		{"anonymize", h.anonymizeCommenterData},
+	}
+
+	for _, p := range pairs {
+		file := filepath.Join(dir, "export-9.jsonl")
+		if !assert.NoError(t, os.WriteFile(file, []byte("{}\n"), 0600)) {
+			return
+		}
+
+		mocket.Catcher.Reset()
+		mocket.Catcher.NewMock().WithQuery(`SELECT count(*) FROM "comments"`).WithReply([]map[string]interface{}{{"count(*)": 1}})
+
+		var votes []driver.NamedValue
+		mocket.Catcher.NewMock().WithQuery(`UPDATE "votes" SET "voter"`).WithCallback(func(_ string, args []driver.NamedValue) {
+			votes = args
+		})
+
+		mocket.Catcher.NewMock().WithQuery(`SELECT * FROM "webhook_deliveries"`).WithReply([]map[string]interface{}{
+			{"id": 1, "webhook_id": 2, "payload": `{"event":"comment.created","comment":{"id":10,"author":"Jane","website":"https://jane.example"}}`},
+			{"id": 2, "webhook_id": 2, "payload": `{"event":"comment.created","comment":{"id":11,"author":"Joe"}}`},
+		})
+
+		var deletedDeliveries, redacted []driver.NamedValue
+		mocket.Catcher.NewMock().WithQuery(`DELETE FROM "webhook_deliveries"`).WithCallback(func(_ string, args []driver.NamedValue) {
+			deletedDeliveries = append(deletedDeliveries, args...)
+		})
+		mocket.Catcher.NewMock().WithQuery(`UPDATE "webhook_deliveries" SET "payload"`).WithCallback(func(_ string, args []driver.NamedValue) {
+			redacted = append(redacted, args...)
+		})
+
+		mocket.Catcher.NewMock().WithQuery(`FROM "exports"  WHERE (site_id IN (3) AND status <> queued)`).WithReply([]map[string]interface{}{
+			{"id": 9, "site_id": 3, "format": ExportJSONL, "status": ExportDone},
+		})
+
+		var droppedExports []driver.NamedValue
+		mocket.Catcher.NewMock().WithQuery(`DELETE FROM "exports"`).WithCallback(func(_ string, args []driver.NamedValue) {
+			droppedExports = args
+		})
+
+		if _, err := p.Fn(data); !assert.NoError(t, err, p.Name) {
+			continue
+		}
+
+		// voter, the commenter's voter, the user
+		if assert.Len(t, votes, 3, p.Name) {
+			assert.True(t, strings.HasPrefix(votes[0].Value.(string), "forgotten:"), p.Name)
+			assert.Equal(t, "commenter:6", votes[1].Value, p.Name)
+			assert.EqualValues(t, 7, votes[2].Value, p.Name)
+		}
+
+		if p.Name == "erase" {
+			if assert.Len(t, deletedDeliveries, 1, p.Name) {
+				assert.EqualValues(t, 1, deletedDeliveries[0].Value)
+			}
+			assert.Empty(t, redacted, p.Name)
+		} else {
+			assert.Empty(t, deletedDeliveries, p.Name)
+			if assert.Len(t, redacted, 2, p.Name) {
+				assert.NotContains(t, redacted[0].Value, "Jane", p.Name)
+				assert.Contains(t, redacted[0].Value, `"id":10`, p.Name)
+				assert.EqualValues(t, 1, redacted[1].Value, p.Name)
+			}
+		}
+
+		if assert.Len(t, droppedExports, 1, p.Name) {
+			assert.EqualValues(t, 9, droppedExports[0].Value, p.Name)
+		}
+		_, err := os.Stat(file)
+		assert.True(t, os.IsNotExist(err), p.Name)
+	}
+
+	mocket.Catcher.Reset()
+}
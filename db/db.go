@@ -5,6 +5,7 @@ import (
 	"github.com/javorszky/go-comments/config"
 	"github.com/jinzhu/gorm"
 	"gopkg.in/gormigrate.v1"
+	"log/slog"
 	"time"
 )
 
@@ -17,7 +18,7 @@ func GetInstance(config *config.Config) (db *gorm.DB, err error) {
 
 		db, err = gorm.Open("mysql", fmt.Sprintf("%v:%v@%v/?charset=utf8mb4&parseTime=True&loc=Local", config.DatabaseRootUser, config.DatabaseRootPassword, config.DatabaseAddress))
 		if err == nil {
-			fmt.Println(fmt.Sprintf("Connected to %s, creating database %s.", fmt.Sprintf("%v:%v@%v/?charset=utf8mb4&parseTime=True&loc=Local", config.DatabaseUser, config.DatabasePassword, config.DatabaseAddress), config.DatabaseTable))
+			slog.Info("Connected to database server, creating database", "address", config.DatabaseAddress, "database", config.DatabaseTable)
 
 			db.Exec(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`", config.DatabaseTable))
 			db.Exec(fmt.Sprintf("USE `%s`", config.DatabaseTable))
@@ -27,125 +28,813 @@ func GetInstance(config *config.Config) (db *gorm.DB, err error) {
 			return db, nil
 		}
 
-		fmt.Println(fmt.Sprintf("Database not open yet on %v, sleeping for 2 seconds.", fmt.Sprintf("%v:%v@%v/?charset=utf8mb4&parseTime=True&loc=Local", config.DatabaseUser, config.DatabasePassword, config.DatabaseAddress)))
+		slog.Info("Database not open yet, sleeping for 2 seconds", "address", config.DatabaseAddress, "error", err)
 		time.Sleep(2 * time.Second)
 	}
 
 	return nil, fmt.Errorf("could not connect to database in 10 seconds: %v", err)
 }
 
+// migrations is the ordered list of schema changes. New migrations go at the end.
+var migrations = []*gormigrate.Migration{
+	// create persons table
+	{
+		ID: "201903032031",
+		Migrate: func(tx *gorm.DB) error {
+			// it's a good practice to copy the struct inside the function,
+			// so side effects are prevented if the original struct changes during the time
+			type User struct {
+				gorm.Model
+				Email          string `json:"email" form:"email" gorm:"type:varchar(191);unique_index:email"`
+				PasswordOne    string `form:"password1" gorm:"-" json:"-"`
+				PasswordTwo    string `form:"password2" gorm:"-" json:"-"`
+				HashedPassword string `json:"passwordHash" gorm:"type:varchar(255)"`
+			}
+			return tx.AutoMigrate(&User{}).Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.DropTable("users").Error
+		},
+	},
+	{
+		ID: "201903231810",
+		Migrate: func(tx *gorm.DB) error {
+			type Session struct {
+				ID        string `gorm:"type:varchar(36);primary_key"`
+				UserID    uint
+				CreatedAt time.Time `gorm:"index:created_at"`
+				IP        string
+				UserAgent string
+			}
+
+			type User struct {
+				gorm.Model
+				Email          string    `json:"email" form:"email" gorm:"type:varchar(191);unique_index:email"`
+				PasswordOne    string    `form:"password1" gorm:"-" json:"-"`
+				PasswordTwo    string    `form:"password2" gorm:"-" json:"-"`
+				HashedPassword string    `json:"passwordHash" gorm:"type:varchar(255)"`
+				Sessions       []Session `gorm:"auto_preload"`
+			}
+			tx.AutoMigrate(&User{}, &Session{})
+
+			return tx.Model(&Session{}).AddForeignKey("user_id", "users(id)", "CASCADE", "RESTRICT").Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.DropTable("sessions").Error
+		},
+	},
+	{
+		ID: "201903251327",
+		Migrate: func(tx *gorm.DB) error {
+			type Session struct {
+				ID        string `gorm:"type:varchar(36);primary_key"`
+				UserID    uint
+				CreatedAt time.Time `gorm:"index:created_at"`
+				IP        string
+				UserAgent string
+				Hash      string
+			}
+
+			return tx.AutoMigrate(&Session{}).Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			type Session struct {
+				ID        string `gorm:"type:varchar(36);primary_key"`
+				UserID    uint
+				CreatedAt time.Time `gorm:"index:created_at"`
+				IP        string
+				UserAgent string
+				Hash      string
+			}
+			return tx.Model(&Session{}).DropColumn("hash").Error
+		},
+	},
+	{
+		ID: "201904201411",
+		Migrate: func(tx *gorm.DB) error {
+			type Site struct {
+				gorm.Model
+				UserID      uint
+				Designation string `gorm:"type:varchar(191);not null;unique"`
+				Domains     string `gorm:"type:text"`
+			}
+
+			type Session struct {
+				ID        string `gorm:"type:varchar(36);primary_key"`
+				UserID    uint
+				CreatedAt time.Time `gorm:"index:created_at"`
+				IP        string
+				UserAgent string
+				Hash      string
+			}
+
+			type User struct {
+				gorm.Model
+				Email          string `json:"email" form:"email" gorm:"type:varchar(191);unique_index:email"`
+				PasswordOne    string `form:"password1" gorm:"-" json:"-"`
+				PasswordTwo    string `form:"password2" gorm:"-" json:"-"`
+				HashedPassword string `json:"passwordHash" gorm:"type:varchar(255)"`
+				Sessions       []Session
+				Sites          []Site
+			}
+
+			tx.AutoMigrate(&Site{})
+
+			return tx.Model(&Site{}).AddForeignKey("user_id", "users(id)", "CASCADE", "RESTRICT").Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.DropTable("sites").Error
+		},
+	},
+	{
+		ID: "202610191000",
+		Migrate: func(tx *gorm.DB) error {
+			type AuditEvent struct {
+				ID        uint      `gorm:"primary_key"`
+				CreatedAt time.Time `gorm:"index:audit_created_at"`
+				UserID    *uint
+				Action    string `gorm:"type:varchar(64);index:audit_action"`
+				Detail    string `gorm:"type:text"`
+				IP        string
+				UserAgent string
+				RequestID string `gorm:"type:varchar(64)"`
+			}
+
+			if err := tx.AutoMigrate(&AuditEvent{}).Error; err != nil {
+				return err
+			}
+
+			return tx.Model(&AuditEvent{}).AddForeignKey("user_id", "users(id)", "SET NULL", "RESTRICT").Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.DropTable("audit_events").Error
+		},
+	},
+	{
+		ID: "202610191100",
+		Migrate: func(tx *gorm.DB) error {
+			type Site struct {
+				gorm.Model
+				UserID           uint
+				Designation      string `gorm:"type:varchar(191);not null;unique"`
+				Domains          string `gorm:"type:varchar(191)"`
+				MarkdownFeatures string `gorm:"type:varchar(191)"`
+			}
+
+			type Thread struct {
+				gorm.Model
+				SiteID uint   `gorm:"unique_index:thread_site_url"`
+				URL    string `gorm:"type:varchar(191);unique_index:thread_site_url"`
+			}
+
+			type Comment struct {
+				gorm.Model
+				SiteID     uint `gorm:"index:comment_site"`
+				ThreadID   uint `gorm:"index:comment_thread"`
+				ParentID   *uint
+				AuthorName string `gorm:"type:varchar(191)"`
+				Body       string `gorm:"type:text"`
+				BodyHTML   string `gorm:"type:text"`
+				Status     string `gorm:"type:varchar(16);index:comment_status"`
+				IP         string
+				UserAgent  string
+			}
+
+			if err := tx.AutoMigrate(&Site{}, &Thread{}, &Comment{}).Error; err != nil {
+				return err
+			}
+
+			// Sites that exist already get every feature.
+			if err := tx.Model(&Site{}).Update("markdown_features", "emphasis,links,code,quotes,lists").Error; err != nil {
+				return err
+			}
+
+			if err := tx.Model(&Thread{}).AddForeignKey("site_id", "sites(id)", "CASCADE", "RESTRICT").Error; err != nil {
+				return err
+			}
+
+			if err := tx.Model(&Comment{}).AddForeignKey("site_id", "sites(id)", "CASCADE", "RESTRICT").Error; err != nil {
+				return err
+			}
+
+			if err := tx.Model(&Comment{}).AddForeignKey("thread_id", "threads(id)", "CASCADE", "RESTRICT").Error; err != nil {
+				return err
+			}
+
+			return tx.Model(&Comment{}).AddForeignKey("parent_id", "comments(id)", "SET NULL", "RESTRICT").Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			type Site struct {
+				gorm.Model
+				MarkdownFeatures string `gorm:"type:varchar(191)"`
+			}
+
+			if err := tx.DropTable("comments", "threads").Error; err != nil {
+				return err
+			}
+
+			return tx.Model(&Site{}).DropColumn("markdown_features").Error
+		},
+	},
+	{
+		ID: "202610191200",
+		Migrate: func(tx *gorm.DB) error {
+			type Site struct {
+				gorm.Model
+				CommenterPolicy   string `gorm:"type:varchar(16);not null;default:'anonymous'"`
+				EditWindowMinutes int    `gorm:"not null;default:15"`
+			}
+
+			type Commenter struct {
+				gorm.Model
+				Kind    string `gorm:"type:varchar(16)"`
+				Name    string `gorm:"type:varchar(191)"`
+				Email   string `gorm:"type:varchar(191);index:commenter_email"`
+				Website string `gorm:"type:varchar(191)"`
+			}
+
+			type Comment struct {
+				gorm.Model
+				CommenterID   *uint  `gorm:"index:comment_commenter"`
+				AuthorWebsite string `gorm:"type:varchar(191)"`
+			}
+
+			if err := tx.AutoMigrate(&Site{}, &Commenter{}, &Comment{}).Error; err != nil {
+				return err
+			}
+
+			return tx.Model(&Comment{}).AddForeignKey("commenter_id", "commenters(id)", "SET NULL", "RESTRICT").Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			type Site struct {
+				gorm.Model
+			}
+
+			type Comment struct {
+				gorm.Model
+			}
+
+			if err := tx.Model(&Comment{}).RemoveForeignKey("commenter_id", "commenters(id)").Error; err != nil {
+				return err
+			}
+
+			if err := tx.Model(&Comment{}).DropColumn("commenter_id").DropColumn("author_website").Error; err != nil {
+				return err
+			}
+
+			if err := tx.Model(&Site{}).DropColumn("commenter_policy").DropColumn("edit_window_minutes").Error; err != nil {
+				return err
+			}
+
+			return tx.DropTable("commenters").Error
+		},
+	},
+	{
+		ID: "202610191300",
+		Migrate: func(tx *gorm.DB) error {
+			type OIDCProvider struct {
+				gorm.Model
+				SiteID       uint   `gorm:"index:oidc_provider_site"`
+				Name         string `gorm:"type:varchar(191)"`
+				Issuer       string `gorm:"type:varchar(191)"`
+				ClientID     string `gorm:"type:varchar(191)"`
+				ClientSecret string `gorm:"type:varchar(191)"`
+			}
+
+			type CommenterIdentity struct {
+				gorm.Model
+				CommenterID uint   `gorm:"index:commenter_identity_commenter"`
+				Issuer      string `gorm:"type:varchar(191);unique_index:commenter_identity"`
+				Subject     string `gorm:"type:varchar(191);unique_index:commenter_identity"`
+			}
+
+			// Without a TableName method gorm would call the table o_id_c_providers.
+			if err := tx.Table("oidc_providers").AutoMigrate(&OIDCProvider{}).Error; err != nil {
+				return err
+			}
+
+			if err := tx.AutoMigrate(&CommenterIdentity{}).Error; err != nil {
+				return err
+			}
+
+			if err := tx.Table("oidc_providers").AddForeignKey("site_id", "sites(id)", "CASCADE", "RESTRICT").Error; err != nil {
+				return err
+			}
+
+			return tx.Model(&CommenterIdentity{}).AddForeignKey("commenter_id", "commenters(id)", "CASCADE", "RESTRICT").Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.DropTable("commenter_identities", "oidc_providers").Error
+		},
+	},
+	{
+		ID: "202610191400",
+		Migrate: func(tx *gorm.DB) error {
+			type Site struct {
+				gorm.Model
+				SSOSecret string `gorm:"type:varchar(191)"`
+			}
+
+			type Commenter struct {
+				gorm.Model
+				AvatarURL string `gorm:"type:varchar(191)"`
+			}
+
+			type Comment struct {
+				gorm.Model
+				AuthorAvatar string `gorm:"type:varchar(191)"`
+			}
+
+			type UsedPayload struct {
+				ID        uint      `gorm:"primary_key"`
+				SiteID    uint      `gorm:"unique_index:used_payload_signature"`
+				Signature string    `gorm:"type:varchar(64);unique_index:used_payload_signature"`
+				ExpiresAt time.Time `gorm:"index:used_payload_expires"`
+			}
+
+			if err := tx.AutoMigrate(&Site{}, &Commenter{}, &Comment{}, &UsedPayload{}).Error; err != nil {
+				return err
+			}
+
+			return tx.Model(&UsedPayload{}).AddForeignKey("site_id", "sites(id)", "CASCADE", "RESTRICT").Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			type Site struct {
+				gorm.Model
+			}
+
+			type Commenter struct {
+				gorm.Model
+			}
+
+			type Comment struct {
+				gorm.Model
+			}
+
+			if err := tx.DropTable("used_payloads").Error; err != nil {
+				return err
+			}
+
+			if err := tx.Model(&Comment{}).DropColumn("author_avatar").Error; err != nil {
+				return err
+			}
+
+			if err := tx.Model(&Commenter{}).DropColumn("avatar_url").Error; err != nil {
+				return err
+			}
+
+			return tx.Model(&Site{}).DropColumn("sso_secret").Error
+		},
+	},
+	{
+		ID: "202610191500",
+		Migrate: func(tx *gorm.DB) error {
+			type Comment struct {
+				gorm.Model
+				SpamReasons string `gorm:"type:text"`
+				TrainedAs   string `gorm:"type:varchar(8)"`
+			}
+
+			type SpamToken struct {
+				SiteID uint   `gorm:"primary_key;auto_increment:false"`
+				Token  string `gorm:"type:varchar(191);primary_key"`
+				Spam   int
+				Ham    int
+			}
+
+			if err := tx.AutoMigrate(&Comment{}, &SpamToken{}).Error; err != nil {
+				return err
+			}
+
+			return tx.Model(&SpamToken{}).AddForeignKey("site_id", "sites(id)", "CASCADE", "RESTRICT").Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			type Comment struct {
+				gorm.Model
+			}
+
+			if err := tx.DropTable("spam_tokens").Error; err != nil {
+				return err
+			}
+
+			return tx.Model(&Comment{}).DropColumn("spam_reasons").DropColumn("trained_as").Error
+		},
+	},
+	{
+		ID: "202610191600",
+		Migrate: func(tx *gorm.DB) error {
+			type RateLimit struct {
+				LimitKey    string `gorm:"type:varchar(191);primary_key"`
+				Count       int
+				WindowStart int64 `gorm:"index:rate_limit_window_start"`
+				LockedUntil int64
+			}
+
+			return tx.AutoMigrate(&RateLimit{}).Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.DropTable("rate_limits").Error
+		},
+	},
+	{
+		ID: "202610191700",
+		Migrate: func(tx *gorm.DB) error {
+			type Site struct {
+				gorm.Model
+				Reactions string `gorm:"type:varchar(191)"`
+			}
+
+			type Comment struct {
+				gorm.Model
+				Upvotes     int
+				Downvotes   int
+				Score       int     `gorm:"index:comment_score"`
+				Controversy float64 `gorm:"index:comment_controversy"`
+				Reactions   string  `gorm:"type:text"`
+			}
+
+			type Vote struct {
+				ID        uint `gorm:"primary_key"`
+				CreatedAt time.Time
+				CommentID uint   `gorm:"unique_index:vote_comment_voter"`
+				Voter     string `gorm:"type:varchar(80);unique_index:vote_comment_voter"`
+				Reaction  string `gorm:"type:varchar(32);unique_index:vote_comment_voter"`
+				Value     int
+			}
+
+			if err := tx.AutoMigrate(&Site{}, &Comment{}, &Vote{}).Error; err != nil {
+				return err
+			}
+
+			if err := tx.Model(&Vote{}).AddForeignKey("comment_id", "comments(id)", "CASCADE", "RESTRICT").Error; err != nil {
+				return err
+			}
+
+			// Existing sites get the reactions new ones start with.
+			return tx.Model(&Site{}).UpdateColumn("reactions", "👍,❤️,😄,🎉,😕").Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			type Site struct {
+				gorm.Model
+			}
+
+			type Comment struct {
+				gorm.Model
+			}
+
+			if err := tx.DropTable("votes").Error; err != nil {
+				return err
+			}
+
+			if err := tx.Model(&Comment{}).DropColumn("upvotes").DropColumn("downvotes").DropColumn("score").DropColumn("controversy").DropColumn("reactions").Error; err != nil {
+				return err
+			}
+
+			return tx.Model(&Site{}).DropColumn("reactions").Error
+		},
+	},
+	{
+		ID: "202610191800",
+		Migrate: func(tx *gorm.DB) error {
+			type Comment struct {
+				gorm.Model
+				EditedAt *time.Time
+			}
+
+			type Revision struct {
+				ID         uint `gorm:"primary_key"`
+				CreatedAt  time.Time
+				CommentID  uint   `gorm:"index:revision_comment"`
+				Body       string `gorm:"type:text"`
+				Status     string `gorm:"type:varchar(16)"`
+				EditorKind string `gorm:"type:varchar(16)"`
+				EditorID   uint
+			}
+
+			if err := tx.AutoMigrate(&Comment{}, &Revision{}).Error; err != nil {
+				return err
+			}
+
+			return tx.Model(&Revision{}).AddForeignKey("comment_id", "comments(id)", "CASCADE", "RESTRICT").Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			type Comment struct {
+				gorm.Model
+			}
+
+			if err := tx.DropTable("revisions").Error; err != nil {
+				return err
+			}
+
+			return tx.Model(&Comment{}).DropColumn("edited_at").Error
+		},
+	},
+	{
+		ID: "202610191900",
+		Migrate: func(tx *gorm.DB) error {
+			type Site struct {
+				gorm.Model
+				OwnerNotify  string `gorm:"type:varchar(16);not null;default:'off'"`
+				DigestSentAt *time.Time
+			}
+
+			type Comment struct {
+				gorm.Model
+				NotifyReplies bool
+			}
+
+			return tx.AutoMigrate(&Site{}, &Comment{}).Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			type Site struct {
+				gorm.Model
+			}
+
+			type Comment struct {
+				gorm.Model
+			}
+
+			if err := tx.Model(&Comment{}).DropColumn("notify_replies").Error; err != nil {
+				return err
+			}
+
+			return tx.Model(&Site{}).DropColumn("owner_notify").DropColumn("digest_sent_at").Error
+		},
+	},
+	{
+		ID: "202610192000",
+		Migrate: func(tx *gorm.DB) error {
+			type Webhook struct {
+				gorm.Model
+				SiteID uint   `gorm:"index:webhook_site"`
+				URL    string `gorm:"type:varchar(191)"`
+				Secret string `gorm:"type:varchar(64)"`
+				Events string `gorm:"type:varchar(191)"`
+			}
+
+			type WebhookDelivery struct {
+				ID            uint `gorm:"primary_key"`
+				CreatedAt     time.Time
+				WebhookID     uint   `gorm:"index:webhook_delivery_webhook"`
+				Event         string `gorm:"type:varchar(32)"`
+				Payload       string `gorm:"type:text"`
+				Attempts      int
+				StatusCode    int
+				Response      string     `gorm:"type:text"`
+				Error         string     `gorm:"type:text"`
+				NextAttemptAt *time.Time `gorm:"index:webhook_delivery_next_attempt"`
+				DeliveredAt   *time.Time
+			}
+
+			if err := tx.AutoMigrate(&Webhook{}, &WebhookDelivery{}).Error; err != nil {
+				return err
+			}
+
+			if err := tx.Model(&Webhook{}).AddForeignKey("site_id", "sites(id)", "CASCADE", "RESTRICT").Error; err != nil {
+				return err
+			}
+
+			return tx.Model(&WebhookDelivery{}).AddForeignKey("webhook_id", "webhooks(id)", "CASCADE", "RESTRICT").Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			if err := tx.DropTable("webhook_deliveries").Error; err != nil {
+				return err
+			}
+
+			return tx.DropTable("webhooks").Error
+		},
+	},
+	{
+		ID: "202610192100",
+		Migrate: func(tx *gorm.DB) error {
+			type Comment struct {
+				gorm.Model
+				ImportID string `gorm:"type:varchar(64);index:comment_import"`
+			}
+
+			return tx.AutoMigrate(&Comment{}).Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			type Comment struct {
+				gorm.Model
+			}
+
+			return tx.Model(&Comment{}).DropColumn("import_id").Error
+		},
+	},
+	{
+		ID: "202610192200",
+		Migrate: func(tx *gorm.DB) error {
+			type Export struct {
+				ID         uint `gorm:"primary_key"`
+				CreatedAt  time.Time
+				SiteID     uint `gorm:"index:export_site"`
+				UserID     uint
+				Format     string `gorm:"type:varchar(16)"`
+				Status     string `gorm:"type:varchar(16);index:export_status"`
+				Size       int64
+				Error      string `gorm:"type:text"`
+				StartedAt  *time.Time
+				FinishedAt *time.Time
+			}
+
+			if err := tx.AutoMigrate(&Export{}).Error; err != nil {
+				return err
+			}
+
+			if err := tx.Model(&Export{}).AddForeignKey("site_id", "sites(id)", "CASCADE", "RESTRICT").Error; err != nil {
+				return err
+			}
+
+			return tx.Model(&Export{}).AddForeignKey("user_id", "users(id)", "CASCADE", "RESTRICT").Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.DropTable("exports").Error
+		},
+	},
+	{
+		ID: "202610192300",
+		Migrate: func(tx *gorm.DB) error {
+			type User struct {
+				gorm.Model
+				DeletionRequestedAt *time.Time `gorm:"index:user_deletion_requested_at"`
+			}
+
+			return tx.AutoMigrate(&User{}).Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			type User struct {
+				gorm.Model
+			}
+
+			return tx.Model(&User{}).DropColumn("deletion_requested_at").Error
+		},
+	},
+	{
+		ID: "202610200000",
+		Migrate: func(tx *gorm.DB) error {
+			type Membership struct {
+				ID        uint `gorm:"primary_key"`
+				CreatedAt time.Time
+				SiteID    uint   `gorm:"unique_index:membership_site_user"`
+				UserID    uint   `gorm:"unique_index:membership_site_user;index:membership_user"`
+				Role      string `gorm:"type:varchar(16)"`
+			}
+
+			type Invitation struct {
+				ID        uint `gorm:"primary_key"`
+				CreatedAt time.Time
+				SiteID    uint `gorm:"index:invitation_site"`
+				InvitedBy uint
+				Email     string `gorm:"type:varchar(191)"`
+				Role      string `gorm:"type:varchar(16)"`
+				Hash      string `gorm:"type:varchar(64);unique_index:invitation_hash"`
+				ExpiresAt time.Time
+			}
+
+			if err := tx.AutoMigrate(&Membership{}, &Invitation{}).Error; err != nil {
+				return err
+			}
+
+			if err := tx.Model(&Membership{}).AddForeignKey("site_id", "sites(id)", "CASCADE", "RESTRICT").Error; err != nil {
+				return err
+			}
+
+			if err := tx.Model(&Membership{}).AddForeignKey("user_id", "users(id)", "CASCADE", "RESTRICT").Error; err != nil {
+				return err
+			}
+
+			return tx.Model(&Invitation{}).AddForeignKey("site_id", "sites(id)", "CASCADE", "RESTRICT").Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			if err := tx.DropTable("invitations").Error; err != nil {
+				return err
+			}
+
+			return tx.DropTable("memberships").Error
+		},
+	},
+	{
+		ID: "202610200100",
+		Migrate: func(tx *gorm.DB) error {
+			type APIToken struct {
+				ID         uint `gorm:"primary_key"`
+				CreatedAt  time.Time
+				UserID     uint   `gorm:"index:api_token_user"`
+				Name       string `gorm:"type:varchar(100)"`
+				Hash       string `gorm:"type:varchar(64);unique_index:api_token_hash"`
+				Scopes     string `gorm:"type:varchar(191)"`
+				ExpiresAt  time.Time
+				LastUsedAt *time.Time
+				LastUsedIP string
+			}
+
+			if err := tx.AutoMigrate(&APIToken{}).Error; err != nil {
+				return err
+			}
+
+			return tx.Model(&APIToken{}).AddForeignKey("user_id", "users(id)", "CASCADE", "RESTRICT").Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.DropTable("api_tokens").Error
+		},
+	},
+	{
+		ID: "202610200200",
+		Migrate: func(tx *gorm.DB) error {
+			type User struct {
+				gorm.Model
+				Superadmin bool `gorm:"not null;default:false"`
+			}
+
+			return tx.AutoMigrate(&User{}).Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			type User struct {
+				gorm.Model
+			}
+
+			return tx.Model(&User{}).DropColumn("superadmin").Error
+		},
+	},
+	{
+		ID: "202610200300",
+		Migrate: func(tx *gorm.DB) error {
+			type User struct {
+				gorm.Model
+				DisabledAt *time.Time
+			}
+
+			type Session struct {
+				ID              string `gorm:"type:varchar(36);primary_key"`
+				ImpersonatingID *uint
+			}
+
+			type Setting struct {
+				Name      string `gorm:"type:varchar(64);primary_key"`
+				Value     string `gorm:"type:varchar(191)"`
+				UpdatedAt time.Time
+			}
+
+			if err := tx.AutoMigrate(&User{}, &Session{}, &Setting{}).Error; err != nil {
+				return err
+			}
+
+			return tx.Model(&Session{}).AddForeignKey("impersonating_id", "users(id)", "SET NULL", "RESTRICT").Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			type User struct {
+				gorm.Model
+			}
+
+			type Session struct {
+				ID string `gorm:"type:varchar(36);primary_key"`
+			}
+
+			if err := tx.Model(&Session{}).RemoveForeignKey("impersonating_id", "users(id)").Error; err != nil {
+				return err
+			}
+
+			if err := tx.Model(&Session{}).DropColumn("impersonating_id").Error; err != nil {
+				return err
+			}
+
+			if err := tx.Model(&User{}).DropColumn("disabled_at").Error; err != nil {
+				return err
+			}
+
+			return tx.DropTable("settings").Error
+		},
+	},
+}
+
+// RunMigrations applies every migration that has not run yet.
 func RunMigrations(db *gorm.DB) error {
-	m := gormigrate.New(db, gormigrate.DefaultOptions, []*gormigrate.Migration{
-		// create persons table
-		{
-			ID: "201903032031",
-			Migrate: func(tx *gorm.DB) error {
-				// it's a good practice to copy the struct inside the function,
-				// so side effects are prevented if the original struct changes during the time
-				type User struct {
-					gorm.Model
-					Email          string `json:"email" form:"email" gorm:"type:varchar(191);unique_index:email"`
-					PasswordOne    string `form:"password1" gorm:"-" json:"-"`
-					PasswordTwo    string `form:"password2" gorm:"-" json:"-"`
-					HashedPassword string `json:"passwordHash" gorm:"type:varchar(255)"`
-				}
-				return tx.AutoMigrate(&User{}).Error
-			},
-			Rollback: func(tx *gorm.DB) error {
-				return tx.DropTable("users").Error
-			},
-		},
-		{
-			ID: "201903231810",
-			Migrate: func(tx *gorm.DB) error {
-				type Session struct {
-					ID        string `gorm:"type:varchar(36);primary_key"`
-					UserID    uint
-					CreatedAt time.Time `gorm:"index:created_at"`
-					IP        string
-					UserAgent string
-				}
-
-				type User struct {
-					gorm.Model
-					Email          string    `json:"email" form:"email" gorm:"type:varchar(191);unique_index:email"`
-					PasswordOne    string    `form:"password1" gorm:"-" json:"-"`
-					PasswordTwo    string    `form:"password2" gorm:"-" json:"-"`
-					HashedPassword string    `json:"passwordHash" gorm:"type:varchar(255)"`
-					Sessions       []Session `gorm:"auto_preload"`
-				}
-				tx.AutoMigrate(&User{}, &Session{})
-
-				return tx.Model(&Session{}).AddForeignKey("user_id", "users(id)", "CASCADE", "RESTRICT").Error
-			},
-			Rollback: func(tx *gorm.DB) error {
-				return tx.DropTable("sessions").Error
-			},
-		},
-		{
-			ID: "201903251327",
-			Migrate: func(tx *gorm.DB) error {
-				type Session struct {
-					ID        string `gorm:"type:varchar(36);primary_key"`
-					UserID    uint
-					CreatedAt time.Time `gorm:"index:created_at"`
-					IP        string
-					UserAgent string
-					Hash      string
-				}
-
-				return tx.AutoMigrate(&Session{}).Error
-			},
-			Rollback: func(tx *gorm.DB) error {
-				type Session struct {
-					ID        string `gorm:"type:varchar(36);primary_key"`
-					UserID    uint
-					CreatedAt time.Time `gorm:"index:created_at"`
-					IP        string
-					UserAgent string
-					Hash      string
-				}
-				return tx.Model(&Session{}).DropColumn("hash").Error
-			},
-		},
-		{
-			ID: "201904201411",
-			Migrate: func(tx *gorm.DB) error {
-				type Site struct {
-					gorm.Model
-					UserID      uint
-					Designation string `gorm:"type:varchar(191);not null;unique"`
-					Domains     string `gorm:"type:text"`
-				}
-
-				type Session struct {
-					ID        string `gorm:"type:varchar(36);primary_key"`
-					UserID    uint
-					CreatedAt time.Time `gorm:"index:created_at"`
-					IP        string
-					UserAgent string
-					Hash      string
-				}
-
-				type User struct {
-					gorm.Model
-					Email          string `json:"email" form:"email" gorm:"type:varchar(191);unique_index:email"`
-					PasswordOne    string `form:"password1" gorm:"-" json:"-"`
-					PasswordTwo    string `form:"password2" gorm:"-" json:"-"`
-					HashedPassword string `json:"passwordHash" gorm:"type:varchar(255)"`
-					Sessions       []Session
-					Sites          []Site
-				}
-
-				tx.AutoMigrate(&Site{})
-
-				return tx.Model(&Site{}).AddForeignKey("user_id", "users(id)", "CASCADE", "RESTRICT").Error
-			},
-			Rollback: func(tx *gorm.DB) error {
-				return tx.DropTable("sites").Error
-			},
-		},
-	})
+	m := gormigrate.New(db, gormigrate.DefaultOptions, migrations)
 
 	return m.Migrate()
 }
+
+// LatestMigrationID returns the ID of the last migration this build knows about.
+func LatestMigrationID() string {
+	return migrations[len(migrations)-1].ID
+}
+
+// AppliedMigrationID returns the ID of the last migration that ran on the database.
+func AppliedMigrationID(db *gorm.DB) (string, error) {
+	var row struct {
+		ID string
+	}
+
+	result := db.Table(gormigrate.DefaultOptions.TableName).
+		Select(gormigrate.DefaultOptions.IDColumnName).
+		Order(gormigrate.DefaultOptions.IDColumnName + " desc").
+		Limit(1).
+		Scan(&row)
+
+	if result.Error != nil && !result.RecordNotFound() {
+		return "", result.Error
+	}
+
+	return row.ID, nil
+}
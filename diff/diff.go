@@ -0,0 +1,157 @@
+/*
+Package diff finds what changed between two versions of a text, word by
+word, so edits to comments can be shown the way they were made.
+*/
+package diff
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Op is what happened to a piece of text.
+type Op string
+
+// The things that can happen to a piece of text.
+const (
+	Equal  Op = "equal"
+	Insert Op = "insert"
+	Delete Op = "delete"
+)
+
+// maxCells caps the size of the table the diff is worked out in. Texts that
+// differ too much for it are shown as one deletion and one insertion.
+const maxCells = 4 << 20
+
+// Change is a piece of text that was kept, inserted or deleted.
+type Change struct {
+	Op   Op     `json:"op"`
+	Text string `json:"text"`
+}
+
+/*
+Words returns the changes that turn a into b. Words and the whitespace
+between them are kept or changed as a whole, and the changes put back
+together give a with the deletions, or b with the insertions.
+*/
+func Words(a, b string) []Change {
+	x, y := tokens(a), tokens(b)
+
+	prefix := 0
+	for prefix < len(x) && prefix < len(y) && x[prefix] == y[prefix] {
+		prefix++
+	}
+
+	suffix := 0
+	for suffix < len(x)-prefix && suffix < len(y)-prefix && x[len(x)-1-suffix] == y[len(y)-1-suffix] {
+		suffix++
+	}
+
+	var changes []Change
+	changes = add(changes, Equal, x[:prefix]...)
+	changes = append(changes, middle(x[prefix:len(x)-suffix], y[prefix:len(y)-suffix])...)
+	return merge(add(changes, Equal, x[len(x)-suffix:]...))
+}
+
+// middle diffs what's left between the common prefix and suffix, with the
+// longest common subsequence of their tokens.
+func middle(x, y []string) []Change {
+	if len(x)*len(y) > maxCells {
+		return add(add(nil, Delete, x...), Insert, y...)
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of x[i:] and y[j:].
+	lcs := make([][]int32, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			switch {
+			case x[i] == y[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var changes []Change
+	i, j := 0, 0
+	for i < len(x) && j < len(y) {
+		switch {
+		case x[i] == y[j]:
+			changes = add(changes, Equal, x[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			changes = add(changes, Delete, x[i])
+			i++
+		default:
+			changes = add(changes, Insert, y[j])
+			j++
+		}
+	}
+
+	return add(add(changes, Delete, x[i:]...), Insert, y[j:]...)
+}
+
+// add appends a change for each of the tokens.
+func add(changes []Change, op Op, tokens ...string) []Change {
+	for _, t := range tokens {
+		changes = append(changes, Change{op, t})
+	}
+	return changes
+}
+
+// merge joins neighbouring changes of the same kind.
+func merge(changes []Change) []Change {
+	merged := []Change{}
+	for _, c := range changes {
+		if n := len(merged); n > 0 && merged[n-1].Op == c.Op {
+			merged[n-1].Text += c.Text
+			continue
+		}
+		merged = append(merged, c)
+	}
+	return merged
+}
+
+// tokens splits s into runs of whitespace and runs of everything else.
+func tokens(s string) []string {
+	var list []string
+	start, space := 0, false
+	for i, r := range s {
+		if i > start && unicode.IsSpace(r) != space {
+			list = append(list, s[start:i])
+			start = i
+		}
+		space = unicode.IsSpace(r)
+	}
+	if start < len(s) {
+		list = append(list, s[start:])
+	}
+	return list
+}
+
+// Old puts back together the text the changes start from.
+func Old(changes []Change) string {
+	return join(changes, Insert)
+}
+
+// New puts back together the text the changes end with.
+func New(changes []Change) string {
+	return join(changes, Delete)
+}
+
+func join(changes []Change, skip Op) string {
+	var b strings.Builder
+	for _, c := range changes {
+		if c.Op != skip {
+			b.WriteString(c.Text)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,41 @@
+package diff
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWords(t *testing.T) {
+	pairs := []struct {
+		Name     string
+		Old      string
+		New      string
+		Expected []Change
+	}{
+		{"same", "hello world", "hello world", []Change{{Equal, "hello world"}}},
+		{"empty", "", "", []Change{}},
+		{"changed word", "the quick fox", "the slow fox", []Change{{Equal, "the "}, {Delete, "quick"}, {Insert, "slow"}, {Equal, " fox"}}},
+		{"appended", "hi", "hi there", []Change{{Equal, "hi"}, {Insert, " there"}}},
+		{"removed", "hi there", "there", []Change{{Delete, "hi "}, {Equal, "there"}}},
+		{"unicode", "szia világ", "szia él világ", []Change{{Equal, "szia "}, {Insert, "él "}, {Equal, "világ"}}},
+	}
+
+	for _, p := range pairs {
+		changes := Words(p.Old, p.New)
+		assert.Equal(t, p.Expected, changes, p.Name)
+		assert.Equal(t, p.Old, Old(changes), p.Name)
+		assert.Equal(t, p.New, New(changes), p.Name)
+	}
+}
+
+func TestWordsTooDifferent(t *testing.T) {
+	a := strings.Repeat("a ", 3000)
+	b := strings.Repeat("b ", 3000)
+
+	changes := Words(a, b)
+	assert.Equal(t, []Change{{Delete, strings.TrimSuffix(a, " ")}, {Insert, strings.TrimSuffix(b, " ")}, {Equal, " "}}, changes)
+	assert.Equal(t, a, Old(changes))
+	assert.Equal(t, b, New(changes))
+}
@@ -0,0 +1,273 @@
+/*
+Package disqus reads the XML exports Disqus makes of a forum: its categories,
+its threads, which are the pages comments were left on, and its posts, which
+are the comments.
+
+A Reader goes through the export one element at a time, so exports of any
+size can be read without holding them in memory. A Writer writes exports the
+same way, in the format Disqus imports.
+*/
+package disqus
+
+import (
+	"encoding/xml"
+	"io"
+	"time"
+)
+
+// Ref points to another element of the export by its dsq:id.
+type Ref struct {
+	ID string `xml:"http://disqus.com/disqus-internals id,attr"`
+}
+
+// Author is who wrote a thread or post.
+type Author struct {
+	Email     string `xml:"email"`
+	Name      string `xml:"name"`
+	Username  string `xml:"username"`
+	Anonymous bool   `xml:"isAnonymous"`
+}
+
+// Category groups threads in a forum.
+type Category struct {
+	ID      string `xml:"http://disqus.com/disqus-internals id,attr"`
+	Forum   string `xml:"forum"`
+	Title   string `xml:"title"`
+	Default bool   `xml:"isDefault"`
+}
+
+// Thread is a page comments were left on.
+type Thread struct {
+	ID        string    `xml:"http://disqus.com/disqus-internals id,attr"`
+	Forum     string    `xml:"forum"`
+	Category  Ref       `xml:"category"`
+	Link      string    `xml:"link"`
+	Title     string    `xml:"title"`
+	CreatedAt time.Time `xml:"createdAt"`
+	Author    Author    `xml:"author"`
+	Closed    bool      `xml:"isClosed"`
+	Deleted   bool      `xml:"isDeleted"`
+}
+
+// Post is a comment. Its message is HTML. Parent is empty for comments that aren't replies.
+type Post struct {
+	ID        string    `xml:"http://disqus.com/disqus-internals id,attr"`
+	Message   string    `xml:"message"`
+	CreatedAt time.Time `xml:"createdAt"`
+	Deleted   bool      `xml:"isDeleted"`
+	Spam      bool      `xml:"isSpam"`
+	Author    Author    `xml:"author"`
+	IPAddress string    `xml:"ipAddress"`
+	Thread    Ref       `xml:"thread"`
+	Parent    Ref       `xml:"parent"`
+}
+
+// Reader reads the categories, threads and posts of an export.
+type Reader struct {
+	dec *xml.Decoder
+}
+
+// NewReader returns a Reader for the export in r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{dec: xml.NewDecoder(r)}
+}
+
+/*
+Next returns the next Category, Thread or Post in the export, in the order
+they come in. It returns io.EOF when there are no more.
+*/
+func (r *Reader) Next() (interface{}, error) {
+	for {
+		token, err := r.dec.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch start.Name.Local {
+		case "category":
+			category := Category{}
+			if err := r.dec.DecodeElement(&category, &start); err != nil {
+				return nil, err
+			}
+			return category, nil
+		case "thread":
+			thread := Thread{}
+			if err := r.dec.DecodeElement(&thread, &start); err != nil {
+				return nil, err
+			}
+			return thread, nil
+		case "post":
+			post := Post{}
+			if err := r.dec.DecodeElement(&post, &start); err != nil {
+				return nil, err
+			}
+			return post, nil
+		}
+	}
+}
+
+// Namespaces of the elements and attributes of exports.
+const (
+	namespace = "http://disqus.com"
+	internals = "http://disqus.com/disqus-internals"
+)
+
+// xmlRef, xmlAuthor, xmlCategory, xmlThread, xmlCDATA and xmlPost are how categories,
+// threads and posts are written, in the order and with the dsq prefix
+// Disqus's importer expects.
+type xmlRef struct {
+	ID string `xml:"dsq:id,attr"`
+}
+
+type xmlAuthor struct {
+	Email     string `xml:"email,omitempty"`
+	Name      string `xml:"name"`
+	Anonymous bool   `xml:"isAnonymous"`
+	Username  string `xml:"username,omitempty"`
+}
+
+type xmlCategory struct {
+	XMLName xml.Name `xml:"category"`
+	ID      string   `xml:"dsq:id,attr"`
+	Forum   string   `xml:"forum"`
+	Title   string   `xml:"title"`
+	Default bool     `xml:"isDefault"`
+}
+
+type xmlThread struct {
+	XMLName   xml.Name  `xml:"thread"`
+	ID        string    `xml:"dsq:id,attr"`
+	Forum     string    `xml:"forum"`
+	Category  xmlRef    `xml:"category"`
+	Link      string    `xml:"link"`
+	Title     string    `xml:"title"`
+	Message   string    `xml:"message"`
+	CreatedAt string    `xml:"createdAt"`
+	Author    xmlAuthor `xml:"author"`
+	Closed    bool      `xml:"isClosed"`
+	Deleted   bool      `xml:"isDeleted"`
+}
+
+type xmlCDATA struct {
+	Text string `xml:",cdata"`
+}
+
+type xmlPost struct {
+	XMLName   xml.Name  `xml:"post"`
+	ID        string    `xml:"dsq:id,attr"`
+	Message   xmlCDATA  `xml:"message"`
+	CreatedAt string    `xml:"createdAt"`
+	Deleted   bool      `xml:"isDeleted"`
+	Spam      bool      `xml:"isSpam"`
+	Author    xmlAuthor `xml:"author"`
+	IPAddress string    `xml:"ipAddress,omitempty"`
+	Thread    xmlRef    `xml:"thread"`
+	Parent    *xmlRef   `xml:"parent"`
+}
+
+func author(a Author) xmlAuthor {
+	return xmlAuthor{Email: a.Email, Name: a.Name, Anonymous: a.Anonymous, Username: a.Username}
+}
+
+// Writer writes an export: the categories first, then the threads, then the posts.
+type Writer struct {
+	w       io.Writer
+	enc     *xml.Encoder
+	started bool
+}
+
+// NewWriter returns a Writer that writes an export to w.
+func NewWriter(w io.Writer) *Writer {
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return &Writer{w: w, enc: enc}
+}
+
+// start writes the XML declaration and opens the root element, the first time it's called.
+func (w *Writer) start() error {
+	if w.started {
+		return nil
+	}
+	w.started = true
+
+	if _, err := io.WriteString(w.w, xml.Header); err != nil {
+		return err
+	}
+
+	return w.enc.EncodeToken(xml.StartElement{
+		Name: xml.Name{Local: "disqus"},
+		Attr: []xml.Attr{
+			{Name: xml.Name{Local: "xmlns"}, Value: namespace},
+			{Name: xml.Name{Local: "xmlns:dsq"}, Value: internals},
+		},
+	})
+}
+
+// Category writes a category.
+func (w *Writer) Category(c Category) error {
+	if err := w.start(); err != nil {
+		return err
+	}
+	return w.enc.Encode(xmlCategory{ID: c.ID, Forum: c.Forum, Title: c.Title, Default: c.Default})
+}
+
+// Thread writes a thread.
+func (w *Writer) Thread(t Thread) error {
+	if err := w.start(); err != nil {
+		return err
+	}
+	return w.enc.Encode(xmlThread{
+		ID:        t.ID,
+		Forum:     t.Forum,
+		Category:  xmlRef{t.Category.ID},
+		Link:      t.Link,
+		Title:     t.Title,
+		CreatedAt: t.CreatedAt.UTC().Format(time.RFC3339),
+		Author:    author(t.Author),
+		Closed:    t.Closed,
+		Deleted:   t.Deleted,
+	})
+}
+
+// Post writes a post. Its thread has to have been written before.
+func (w *Writer) Post(p Post) error {
+	if err := w.start(); err != nil {
+		return err
+	}
+
+	post := xmlPost{
+		ID:        p.ID,
+		Message:   xmlCDATA{p.Message},
+		CreatedAt: p.CreatedAt.UTC().Format(time.RFC3339),
+		Deleted:   p.Deleted,
+		Spam:      p.Spam,
+		Author:    author(p.Author),
+		IPAddress: p.IPAddress,
+		Thread:    xmlRef{p.Thread.ID},
+	}
+	if p.Parent.ID != "" {
+		post.Parent = &xmlRef{p.Parent.ID}
+	}
+
+	return w.enc.Encode(post)
+}
+
+// Close ends the export. It doesn't close the io.Writer the export is written to.
+func (w *Writer) Close() error {
+	if err := w.start(); err != nil {
+		return err
+	}
+	if err := w.enc.EncodeToken(xml.EndElement{Name: xml.Name{Local: "disqus"}}); err != nil {
+		return err
+	}
+	if err := w.enc.Flush(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w.w, "\n")
+	return err
+}
@@ -0,0 +1,161 @@
+package disqus
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const export = `<?xml version="1.0" encoding="utf-8"?>
+<disqus xmlns="http://disqus.com" xmlns:dsq="http://disqus.com/disqus-internals" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+  <category dsq:id="11">
+    <forum>blog</forum>
+    <title>General</title>
+    <isDefault>true</isDefault>
+  </category>
+  <thread dsq:id="21">
+    <id />
+    <forum>blog</forum>
+    <category dsq:id="11" />
+    <link>https://example.com/post</link>
+    <title>A post</title>
+    <message />
+    <createdAt>2014-03-01T10:00:00Z</createdAt>
+    <author>
+      <email>owner@example.com</email>
+      <name>Owner</name>
+      <isAnonymous>false</isAnonymous>
+      <username>owner</username>
+    </author>
+    <isClosed>false</isClosed>
+    <isDeleted>false</isDeleted>
+  </thread>
+  <post dsq:id="31">
+    <id />
+    <message><![CDATA[<p>First!</p>]]></message>
+    <createdAt>2014-03-01T11:00:00Z</createdAt>
+    <isDeleted>false</isDeleted>
+    <isSpam>false</isSpam>
+    <author>
+      <email>jane@example.com</email>
+      <name>Jane</name>
+      <isAnonymous>false</isAnonymous>
+      <username>jane</username>
+    </author>
+    <ipAddress>192.0.2.1</ipAddress>
+    <thread dsq:id="21" />
+  </post>
+  <post dsq:id="32">
+    <id />
+    <message><![CDATA[<p>Second</p>]]></message>
+    <createdAt>2014-03-01T12:00:00Z</createdAt>
+    <isDeleted>false</isDeleted>
+    <isSpam>true</isSpam>
+    <author>
+      <name>Guest</name>
+      <isAnonymous>true</isAnonymous>
+    </author>
+    <thread dsq:id="21" />
+    <parent dsq:id="31" />
+  </post>
+</disqus>`
+
+func TestReader(t *testing.T) {
+	r := NewReader(strings.NewReader(export))
+
+	var elements []interface{}
+	for {
+		element, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(t, err) {
+			return
+		}
+		elements = append(elements, element)
+	}
+
+	if !assert.Len(t, elements, 4) {
+		return
+	}
+
+	assert.Equal(t, Category{ID: "11", Forum: "blog", Title: "General", Default: true}, elements[0])
+
+	thread := elements[1].(Thread)
+	assert.Equal(t, "21", thread.ID)
+	assert.Equal(t, "https://example.com/post", thread.Link)
+	assert.Equal(t, "11", thread.Category.ID)
+	assert.True(t, thread.CreatedAt.Equal(time.Date(2014, 3, 1, 10, 0, 0, 0, time.UTC)))
+
+	first := elements[2].(Post)
+	assert.Equal(t, "31", first.ID)
+	assert.Equal(t, "<p>First!</p>", first.Message)
+	assert.Equal(t, "21", first.Thread.ID)
+	assert.Equal(t, "", first.Parent.ID)
+	assert.Equal(t, Author{Email: "jane@example.com", Name: "Jane", Username: "jane"}, first.Author)
+	assert.Equal(t, "192.0.2.1", first.IPAddress)
+
+	second := elements[3].(Post)
+	assert.Equal(t, "31", second.Parent.ID)
+	assert.True(t, second.Spam)
+	assert.True(t, second.Author.Anonymous)
+}
+
+func TestReaderBrokenExport(t *testing.T) {
+	r := NewReader(strings.NewReader(`<disqus><post dsq:id="1"><createdAt>yesterday</createdAt></post></disqus>`))
+
+	_, err := r.Next()
+	assert.Error(t, err)
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	created := time.Date(2014, 3, 1, 10, 0, 0, 0, time.UTC)
+	elements := []interface{}{
+		Category{ID: "1", Forum: "blog", Title: "General", Default: true},
+		Thread{ID: "21", Forum: "blog", Category: Ref{"1"}, Link: "https://example.com/post?a=1&b=2", Title: "A <post>", CreatedAt: created, Author: Author{Anonymous: true}},
+		Post{ID: "31", Message: "<p>First ]]> post</p>", CreatedAt: created, Author: Author{Name: "Jane", Email: "jane@example.com", Username: "jane"}, Thread: Ref{"21"}},
+		Post{ID: "32", Message: "<p>Reply</p>", CreatedAt: created, Spam: true, Deleted: true, Author: Author{Name: "Guest", Anonymous: true}, IPAddress: "192.0.2.1", Thread: Ref{"21"}, Parent: Ref{"31"}},
+	}
+
+	var b strings.Builder
+	w := NewWriter(&b)
+	for _, element := range elements {
+		var err error
+		switch e := element.(type) {
+		case Category:
+			err = w.Category(e)
+		case Thread:
+			err = w.Thread(e)
+		case Post:
+			err = w.Post(e)
+		}
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, w.Close())
+
+	assert.Contains(t, b.String(), `<thread dsq:id="21">`)
+	assert.Contains(t, b.String(), `xmlns:dsq="http://disqus.com/disqus-internals"`)
+
+	r := NewReader(strings.NewReader(b.String()))
+	for _, expected := range elements {
+		element, err := r.Next()
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, expected, element)
+	}
+
+	_, err := r.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestWriterEmpty(t *testing.T) {
+	var b strings.Builder
+	assert.NoError(t, NewWriter(&b).Close())
+
+	_, err := NewReader(strings.NewReader(b.String())).Next()
+	assert.Equal(t, io.EOF, err)
+}
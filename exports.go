@@ -0,0 +1,565 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/javorszky/go-comments/disqus"
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+)
+
+// Formats sites can be exported in.
+const (
+	ExportJSONL  = "jsonl"
+	ExportDisqus = "disqus"
+)
+
+// Export statuses. Exports wait as queued until the background worker gets to them.
+const (
+	ExportQueued  = "queued"
+	ExportRunning = "running"
+	ExportDone    = "done"
+	ExportFailed  = "failed"
+)
+
+// exportLifetime is how long finished exports can be downloaded for.
+const exportLifetime = 7 * 24 * time.Hour
+
+// exportStale is how long an export can be running before it's taken to be left behind by a process that stopped, and run again.
+const exportStale = time.Hour
+
+/*
+Export model definition. Exports of a site are made in the background, and
+written to a file in the export directory that the site's owner can download
+until it expires.
+*/
+type Export struct {
+	ID         uint `gorm:"primary_key"`
+	CreatedAt  time.Time
+	SiteID     uint `gorm:"index:export_site"`
+	UserID     uint
+	Format     string `gorm:"type:varchar(16)"`
+	Status     string `gorm:"type:varchar(16);index:export_status"`
+	Size       int64
+	Error      string `gorm:"type:text"`
+	StartedAt  *time.Time
+	FinishedAt *time.Time
+}
+
+// extension returns the file extension of the export's format.
+func (x Export) extension() string {
+	if x.Format == ExportDisqus {
+		return "xml"
+	}
+	return "jsonl"
+}
+
+// ExpiresAt returns when the export is removed.
+func (x Export) ExpiresAt() time.Time {
+	return x.CreatedAt.Add(exportLifetime)
+}
+
+// validExportFormat tells whether format is one sites can be exported in.
+func validExportFormat(format string) bool {
+	return format == ExportJSONL || format == ExportDisqus
+}
+
+// exportPath returns where the file of the export is written.
+func (h *Handlers) exportPath(x Export) string {
+	return filepath.Join(h.cfg.ExportDir, fmt.Sprintf("export-%d.%s", x.ID, x.extension()))
+}
+
+/*
+The lines of JSON Lines exports. Every line has a type: first the site, then
+its threads, the commenters who commented on it, the comments, and the
+revisions of the comments that were edited. IP addresses and user agents
+aren't exported.
+*/
+type (
+	ExportSite struct {
+		Type              string    `json:"type"`
+		ID                uint      `json:"id"`
+		Designation       string    `json:"designation"`
+		Domains           []string  `json:"domains"`
+		CommenterPolicy   string    `json:"commenterPolicy"`
+		MarkdownFeatures  string    `json:"markdownFeatures"`
+		EditWindowMinutes int       `json:"editWindowMinutes"`
+		Reactions         []string  `json:"reactions"`
+		CreatedAt         time.Time `json:"createdAt"`
+	}
+
+	ExportThread struct {
+		Type      string    `json:"type"`
+		ID        uint      `json:"id"`
+		URL       string    `json:"url"`
+		CreatedAt time.Time `json:"createdAt"`
+	}
+
+	ExportCommenter struct {
+		Type      string    `json:"type"`
+		ID        uint      `json:"id"`
+		Kind      string    `json:"kind"`
+		Name      string    `json:"name"`
+		Email     string    `json:"email"`
+		Website   string    `json:"website"`
+		CreatedAt time.Time `json:"createdAt"`
+	}
+
+	ExportComment struct {
+		Type          string         `json:"type"`
+		ID            uint           `json:"id"`
+		ThreadID      uint           `json:"threadId"`
+		ParentID      *uint          `json:"parentId"`
+		CommenterID   *uint          `json:"commenterId"`
+		AuthorName    string         `json:"authorName"`
+		AuthorWebsite string         `json:"authorWebsite"`
+		Body          string         `json:"body"`
+		Status        string         `json:"status"`
+		SpamReasons   string         `json:"spamReasons,omitempty"`
+		TrainedAs     string         `json:"trainedAs,omitempty"`
+		Upvotes       int            `json:"upvotes"`
+		Downvotes     int            `json:"downvotes"`
+		Reactions     map[string]int `json:"reactions,omitempty"`
+		ImportID      string         `json:"importId,omitempty"`
+		CreatedAt     time.Time      `json:"createdAt"`
+		EditedAt      *time.Time     `json:"editedAt"`
+	}
+
+	ExportRevision struct {
+		Type       string    `json:"type"`
+		CommentID  uint      `json:"commentId"`
+		Body       string    `json:"body"`
+		Status     string    `json:"status"`
+		EditorKind string    `json:"editorKind"`
+		CreatedAt  time.Time `json:"createdAt"`
+	}
+)
+
+// exportSite returns the line a site is exported as.
+func exportSite(site Site) ExportSite {
+	return ExportSite{
+		Type:              "site",
+		ID:                site.ID,
+		Designation:       site.Designation,
+		Domains:           site.DomainList(),
+		CommenterPolicy:   site.CommenterPolicy,
+		MarkdownFeatures:  site.MarkdownFeatures,
+		EditWindowMinutes: site.EditWindowMinutes,
+		Reactions:         site.ReactionList(),
+		CreatedAt:         site.CreatedAt,
+	}
+}
+
+/*
+eachRow runs query and scans its rows into dest one at a time, calling fn
+after each, so exports never hold more than a row of a table in memory.
+*/
+func (h *Handlers) eachRow(ctx context.Context, query *gorm.DB, dest interface{}, fn func() error) error {
+	rows, err := query.Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	v := reflect.ValueOf(dest).Elem()
+	for rows.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		v.Set(reflect.Zero(v.Type()))
+		if err := h.db.ScanRows(rows, dest); err != nil {
+			return err
+		}
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// writeExport writes the site's export in format to w.
+func (h *Handlers) writeExport(ctx context.Context, w io.Writer, site Site, format string) error {
+	if format == ExportDisqus {
+		return h.exportDisqus(ctx, w, site)
+	}
+	return h.exportJSONL(ctx, w, site)
+}
+
+// exportJSONL writes the site's JSON Lines export to w.
+func (h *Handlers) exportJSONL(ctx context.Context, w io.Writer, site Site) error {
+	enc := json.NewEncoder(w)
+
+	err := enc.Encode(exportSite(site))
+	if err != nil {
+		return err
+	}
+
+	thread := Thread{}
+	err = h.eachRow(ctx, h.db.Model(&Thread{}).Where("site_id = ?", site.ID).Order("id"), &thread, func() error {
+		return enc.Encode(ExportThread{Type: "thread", ID: thread.ID, URL: thread.URL, CreatedAt: thread.CreatedAt})
+	})
+	if err != nil {
+		return err
+	}
+
+	commenter := Commenter{}
+	commenters := h.db.Model(&Commenter{}).Where("id IN (SELECT commenter_id FROM comments WHERE site_id = ? AND deleted_at IS NULL)", site.ID).Order("id")
+	err = h.eachRow(ctx, commenters, &commenter, func() error {
+		return enc.Encode(ExportCommenter{
+			Type:      "commenter",
+			ID:        commenter.ID,
+			Kind:      commenter.Kind,
+			Name:      commenter.Name,
+			Email:     commenter.Email,
+			Website:   commenter.Website,
+			CreatedAt: commenter.CreatedAt,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	comment := Comment{}
+	err = h.eachRow(ctx, h.db.Model(&Comment{}).Where("site_id = ?", site.ID).Order("id"), &comment, func() error {
+		return enc.Encode(ExportComment{
+			Type:          "comment",
+			ID:            comment.ID,
+			ThreadID:      comment.ThreadID,
+			ParentID:      comment.ParentID,
+			CommenterID:   comment.CommenterID,
+			AuthorName:    comment.AuthorName,
+			AuthorWebsite: comment.AuthorWebsite,
+			Body:          comment.Body,
+			Status:        comment.Status,
+			SpamReasons:   comment.SpamReasons,
+			TrainedAs:     comment.TrainedAs,
+			Upvotes:       comment.Upvotes,
+			Downvotes:     comment.Downvotes,
+			Reactions:     comment.ReactionCounts(),
+			ImportID:      comment.ImportID,
+			CreatedAt:     comment.CreatedAt,
+			EditedAt:      comment.EditedAt,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	revision := Revision{}
+	revisions := h.db.Model(&Revision{}).Where("comment_id IN (SELECT id FROM comments WHERE site_id = ? AND deleted_at IS NULL)", site.ID).Order("id")
+	return h.eachRow(ctx, revisions, &revision, func() error {
+		return enc.Encode(ExportRevision{
+			Type:       "revision",
+			CommentID:  revision.CommentID,
+			Body:       revision.Body,
+			Status:     revision.Status,
+			EditorKind: revision.EditorKind,
+			CreatedAt:  revision.CreatedAt,
+		})
+	})
+}
+
+/*
+exportDisqus writes the site's export in the format Disqus imports. Disqus
+has no way to say a comment is waiting for a moderator, so pending comments
+are left out. Rejected comments are marked as deleted, and everyone is a
+guest with the name and email they gave.
+*/
+func (h *Handlers) exportDisqus(ctx context.Context, w io.Writer, site Site) error {
+	dw := disqus.NewWriter(w)
+
+	if err := dw.Category(disqus.Category{ID: "1", Forum: site.Designation, Title: "General", Default: true}); err != nil {
+		return err
+	}
+
+	thread := Thread{}
+	err := h.eachRow(ctx, h.db.Model(&Thread{}).Where("site_id = ?", site.ID).Order("id"), &thread, func() error {
+		return dw.Thread(disqus.Thread{
+			ID:        fmt.Sprint(thread.ID),
+			Forum:     site.Designation,
+			Category:  disqus.Ref{ID: "1"},
+			Link:      thread.URL,
+			Title:     thread.URL,
+			CreatedAt: thread.CreatedAt,
+			Author:    disqus.Author{Anonymous: true},
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	emails := map[uint]string{}
+	comment := Comment{}
+	comments := h.db.Model(&Comment{}).Where("site_id = ? AND status IN (?)", site.ID, []string{StatusApproved, StatusRejected, StatusSpam}).Order("id")
+	err = h.eachRow(ctx, comments, &comment, func() error {
+		post := disqus.Post{
+			ID:        fmt.Sprint(comment.ID),
+			Message:   comment.BodyHTML,
+			CreatedAt: comment.CreatedAt,
+			Deleted:   comment.Status == StatusRejected,
+			Spam:      comment.Status == StatusSpam,
+			Author:    disqus.Author{Name: comment.AuthorName, Anonymous: true},
+			Thread:    disqus.Ref{ID: fmt.Sprint(comment.ThreadID)},
+		}
+		if comment.ParentID != nil {
+			post.Parent.ID = fmt.Sprint(*comment.ParentID)
+		}
+		if comment.CommenterID != nil {
+			email, ok := emails[*comment.CommenterID]
+			if !ok {
+				commenter := Commenter{}
+				h.db.Where("id = ?", *comment.CommenterID).First(&commenter)
+				email = commenter.Email
+				emails[*comment.CommenterID] = email
+			}
+			post.Author.Email = email
+		}
+		return dw.Post(post)
+	})
+	if err != nil {
+		return err
+	}
+
+	return dw.Close()
+}
+
+// Exports makes the exports site owners asked for, and removes the expired ones, until ctx is done.
+func (h *Handlers) Exports(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	prune := time.NewTicker(time.Hour)
+	defer prune.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			h.runExports(ctx, now)
+		case now := <-prune.C:
+			h.pruneExports(now)
+		}
+	}
+}
+
+// runExports makes the exports that are waiting, and the ones a stopped process left behind.
+func (h *Handlers) runExports(ctx context.Context, now time.Time) {
+	var due []Export
+
+	h.db.Where("status = ? OR (status = ? AND started_at < ?)", ExportQueued, ExportRunning, now.Add(-exportStale)).Order("id").Limit(10).Find(&due)
+
+	for _, x := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		h.runExport(ctx, x, now)
+	}
+}
+
+/*
+runExport makes an export, unless another instance of the app got to it
+first. The file is written under a temporary name, and only gets its own
+once it's complete. If ctx is done before the export is, it's queued again.
+*/
+func (h *Handlers) runExport(ctx context.Context, x Export, now time.Time) {
+	claim := h.db.Model(&Export{}).
+		Where("id = ? AND (status = ? OR (status = ? AND started_at < ?))", x.ID, ExportQueued, ExportRunning, now.Add(-exportStale)).
+		UpdateColumns(map[string]interface{}{"status": ExportRunning, "started_at": now})
+	if claim.Error != nil || claim.RowsAffected != 1 {
+		return
+	}
+
+	err := h.writeExportFile(ctx, x)
+
+	switch {
+	case err == nil:
+		size := int64(0)
+		if info, statErr := os.Stat(h.exportPath(x)); statErr == nil {
+			size = info.Size()
+		}
+		done := h.db.Model(&Export{}).Where("id = ?", x.ID).UpdateColumns(map[string]interface{}{"status": ExportDone, "size": size, "finished_at": time.Now()})
+		if done.Error == nil && done.RowsAffected == 0 {
+			// A data request dropped the export while it was made.
+			os.Remove(h.exportPath(x))
+			return
+		}
+		h.notifyExport(x)
+
+	case ctx.Err() != nil:
+		h.db.Model(&Export{}).Where("id = ?", x.ID).UpdateColumns(map[string]interface{}{"status": ExportQueued, "started_at": nil})
+
+	default:
+		h.log.Error("Export failed", "export", x.ID, "site", x.SiteID, "error", err)
+		h.db.Model(&Export{}).Where("id = ?", x.ID).UpdateColumns(map[string]interface{}{"status": ExportFailed, "error": err.Error(), "finished_at": time.Now()})
+	}
+}
+
+// writeExportFile writes the export's file.
+func (h *Handlers) writeExportFile(ctx context.Context, x Export) error {
+	site := Site{}
+	if h.db.Where("id = ?", x.SiteID).First(&site).RecordNotFound() {
+		return fmt.Errorf("the site is gone")
+	}
+
+	if err := os.MkdirAll(h.cfg.ExportDir, 0700); err != nil {
+		return err
+	}
+
+	path := h.exportPath(x)
+	f, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = h.writeExport(ctx, f, site, x.Format)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// notifyExport tells the owner who asked for an export that it's ready.
+func (h *Handlers) notifyExport(x Export) {
+	owner := User{}
+	if h.db.Where("id = ?", x.UserID).First(&owner).RecordNotFound() {
+		return
+	}
+
+	h.send(owner.Email, "Your export is ready", fmt.Sprintf(
+		"The export you asked for is ready. Download it from %s/admin/sites/%d/exports until %s.\n",
+		h.cfg.PublicURL, x.SiteID, x.ExpiresAt().Format("2 Jan 2006 15:04 MST"),
+	), nil)
+}
+
+// pruneExports removes the exports, and their files, that are older than exportLifetime.
+func (h *Handlers) pruneExports(now time.Time) {
+	var expired []Export
+
+	h.db.Where("created_at < ?", now.Add(-exportLifetime)).Find(&expired)
+
+	for _, x := range expired {
+		if err := os.Remove(h.exportPath(x)); err != nil && !os.IsNotExist(err) {
+			h.log.Error("Removing an expired export failed", "export", x.ID, "error", err)
+			continue
+		}
+		h.db.Delete(&x)
+	}
+}
+
+/*
+ExportCommand runs "export <format> <site id> <file>", which writes the
+site's export to a file right away instead of in the background. It returns
+the exit code for the process.
+*/
+func (h *Handlers) ExportCommand(args []string) int {
+	if len(args) != 3 || !validExportFormat(args[0]) {
+		fmt.Println("Usage: export jsonl|disqus <site id> <file>")
+		return 2
+	}
+
+	site := Site{}
+	if h.db.Where("id = ?", args[1]).First(&site).RecordNotFound() {
+		fmt.Printf("There is no site with the ID %s\n", args[1])
+		return 1
+	}
+
+	f, err := os.Create(args[2])
+	if err != nil {
+		fmt.Printf("Creating the export file failed: %v\n", err)
+		return 1
+	}
+
+	err = h.writeExport(context.Background(), f, site, args[0])
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Printf("Export failed: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// AdminExports handles GET /admin/sites/:id/exports with the site's exports and the form to ask for another.
+func (h *Handlers) AdminExports(c echo.Context) error {
+	site, ok := h.siteFor(c, RoleAdmin)
+	if !ok {
+		return c.String(http.StatusNotFound, "No such site")
+	}
+
+	var exports []Export
+
+	h.db.Where("site_id = ?", site.ID).Order("id desc").Find(&exports)
+
+	return c.Render(http.StatusOK, "adminexports", struct {
+		Csrf    interface{}
+		Site    Site
+		Exports []Export
+	}{
+		Csrf:    c.Get("csrf"),
+		Site:    site,
+		Exports: exports,
+	})
+}
+
+// AdminExportsPost handles POST /admin/sites/:id/exports to queue an export of the site.
+func (h *Handlers) AdminExportsPost(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	site, ok := h.siteFor(c, RoleAdmin)
+	if !ok {
+		return c.String(http.StatusNotFound, "No such site")
+	}
+
+	format := c.FormValue("format")
+	if !validExportFormat(format) {
+		return c.String(http.StatusBadRequest, "Sites can be exported as jsonl or disqus.")
+	}
+
+	export := Export{SiteID: site.ID, UserID: user.ID, Format: format, Status: ExportQueued}
+
+	if result := h.db.Create(&export); result.Error != nil {
+		return c.String(http.StatusInternalServerError, "Something failed while saving")
+	}
+
+	h.audit(c, user.ID, auditSiteExport, fmt.Sprintf("site %d, %s", site.ID, format))
+
+	return c.Redirect(http.StatusFound, fmt.Sprintf("/admin/sites/%d/exports", site.ID))
+}
+
+// AdminExportDownload handles GET /admin/sites/:id/exports/:export/download with the file of a finished export.
+func (h *Handlers) AdminExportDownload(c echo.Context) error {
+	site, ok := h.siteFor(c, RoleAdmin)
+	if !ok {
+		return c.String(http.StatusNotFound, "No such site")
+	}
+
+	x := Export{}
+	if h.db.Where("id = ? AND site_id = ? AND status = ?", c.Param("export"), site.ID, ExportDone).First(&x).RecordNotFound() {
+		return c.String(http.StatusNotFound, "No such export")
+	}
+
+	name := fmt.Sprintf("site-%d-%s.%s", site.ID, x.CreatedAt.Format("2006-01-02"), x.extension())
+
+	return c.Attachment(h.exportPath(x), name)
+}
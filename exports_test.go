@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/javorszky/go-comments/disqus"
+	"github.com/labstack/echo"
+	mocket "github.com/selvatico/go-mocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockExportRows has the rows of a small site to export.
+func mockExportRows() {
+	mocket.Catcher.NewMock().WithQuery(`FROM "threads"`).WithReply([]map[string]interface{}{
+		{"id": 1, "site_id": 3, "url": "https://example.com/post"},
+	})
+	mocket.Catcher.NewMock().WithQuery(`FROM "commenters"`).WithReply([]map[string]interface{}{
+		{"id": 6, "kind": KindGuest, "name": "Jane", "email": "jane@example.com"},
+	})
+	// Every row has every column: mocket only returns the columns of the first one.
+	mocket.Catcher.NewMock().WithQuery(`FROM "comments"`).WithReply([]map[string]interface{}{
+		{"id": 10, "site_id": 3, "thread_id": 1, "parent_id": nil, "commenter_id": 6, "author_name": "Jane", "body": "First", "body_html": "<p>First</p>\n", "status": StatusApproved, "spam_reasons": "", "reactions": `{"👍":2}`},
+		{"id": 11, "site_id": 3, "thread_id": 1, "parent_id": 10, "commenter_id": nil, "author_name": "Spammer", "body": "Buy", "body_html": "<p>Buy</p>\n", "status": StatusSpam, "spam_reasons": "blocklist", "reactions": ""},
+		{"id": 12, "site_id": 3, "thread_id": 1, "parent_id": nil, "commenter_id": nil, "author_name": "Rude", "body": "Go away", "body_html": "<p>Go away</p>\n", "status": StatusRejected, "spam_reasons": "", "reactions": ""},
+	})
+	mocket.Catcher.NewMock().WithQuery(`FROM "revisions"`).WithReply([]map[string]interface{}{
+		{"id": 1, "comment_id": 10, "body": "Frist", "status": StatusApproved, "editor_kind": EditorAuthor},
+	})
+}
+
+func TestExportJSONL(t *testing.T) {
+	mocket.Catcher.Reset()
+	defer mocket.Catcher.Reset()
+	mockExportRows()
+
+	var b strings.Builder
+	if !assert.NoError(t, h.exportJSONL(context.Background(), &b, mockSite)) {
+		return
+	}
+
+	var types []string
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(strings.NewReader(b.String()))
+	for scanner.Scan() {
+		line := map[string]interface{}{}
+		if !assert.NoError(t, json.Unmarshal(scanner.Bytes(), &line)) {
+			return
+		}
+		types = append(types, line["type"].(string))
+		lines = append(lines, line)
+	}
+
+	assert.Equal(t, []string{"site", "thread", "commenter", "comment", "comment", "comment", "revision"}, types)
+	assert.Equal(t, []interface{}{"example.com", "https://secure.example.org"}, lines[0]["domains"])
+	assert.Equal(t, "https://example.com/post", lines[1]["url"])
+	assert.Equal(t, "jane@example.com", lines[2]["email"])
+	assert.Equal(t, map[string]interface{}{"👍": float64(2)}, lines[3]["reactions"])
+	assert.EqualValues(t, 10, lines[4]["parentId"])
+	assert.Equal(t, "blocklist", lines[4]["spamReasons"])
+	assert.Equal(t, "Frist", lines[6]["body"])
+	assert.NotContains(t, b.String(), `"ip"`)
+}
+
+func TestExportDisqus(t *testing.T) {
+	mocket.Catcher.Reset()
+	defer mocket.Catcher.Reset()
+	mockExportRows()
+
+	var b strings.Builder
+	if !assert.NoError(t, h.exportDisqus(context.Background(), &b, mockSite)) {
+		return
+	}
+
+	r := disqus.NewReader(strings.NewReader(b.String()))
+	var elements []interface{}
+	for {
+		element, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(t, err) {
+			return
+		}
+		elements = append(elements, element)
+	}
+
+	if !assert.Len(t, elements, 5) {
+		return
+	}
+
+	thread := elements[1].(disqus.Thread)
+	assert.Equal(t, "1", thread.ID)
+	assert.Equal(t, "https://example.com/post", thread.Link)
+
+	first := elements[2].(disqus.Post)
+	assert.Equal(t, "<p>First</p>\n", first.Message)
+	assert.Equal(t, "jane@example.com", first.Author.Email)
+	assert.Equal(t, "1", first.Thread.ID)
+
+	spam := elements[3].(disqus.Post)
+	assert.True(t, spam.Spam)
+	assert.Equal(t, "10", spam.Parent.ID)
+
+	assert.True(t, elements[4].(disqus.Post).Deleted)
+}
+
+func TestRunExport(t *testing.T) {
+	dir, err := os.MkdirTemp("", "exports")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	h.cfg.ExportDir = dir
+	defer func() { h.cfg.ExportDir = "" }()
+
+	mocket.Catcher.Reset()
+	defer mocket.Catcher.Reset()
+	mockExportRows()
+	mocket.Catcher.NewMock().WithQuery(`FROM "sites"`).WithReply([]map[string]interface{}{{"id": 3, "designation": "blog"}})
+	mocket.Catcher.NewMock().WithQuery(`FROM "users"`).WithReply([]map[string]interface{}{{"id": 7, "email": "owner@example.com"}})
+	mocket.Catcher.NewMock().WithQuery(`UPDATE "exports" SET "started_at"`).WithRowsNum(1).OneTime()
+
+	var finished []driver.NamedValue
+	mocket.Catcher.NewMock().WithQuery(`UPDATE "exports" SET "finished_at"`).WithRowsNum(1).WithCallback(func(_ string, args []driver.NamedValue) {
+		finished = args
+	})
+
+	outbox.messages = nil
+	x := Export{ID: 9, SiteID: 3, UserID: 7, Format: ExportJSONL, Status: ExportQueued, CreatedAt: time.Now()}
+
+	h.runExport(context.Background(), x, time.Now())
+
+	contents, err := os.ReadFile(filepath.Join(dir, "export-9.jsonl"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, strings.HasPrefix(string(contents), `{"type":"site"`))
+
+	// finished_at, size, status, id
+	if assert.Len(t, finished, 4) {
+		assert.EqualValues(t, len(contents), finished[1].Value)
+		assert.Equal(t, ExportDone, finished[2].Value)
+	}
+
+	if assert.Len(t, outbox.messages, 1) {
+		assert.Equal(t, "owner@example.com", outbox.messages[0].To)
+		assert.Contains(t, outbox.messages[0].Text, "/admin/sites/3/exports")
+	}
+
+	// Another instance claimed it in the meantime.
+	finished = nil
+	h.runExport(context.Background(), Export{ID: 10, SiteID: 3, Format: ExportJSONL, Status: ExportQueued}, time.Now())
+
+	assert.Nil(t, finished)
+	_, err = os.Stat(filepath.Join(dir, "export-10.jsonl"))
+	assert.True(t, os.IsNotExist(err))
+
+	// A data request dropped it while it was made.
+	outbox.messages = nil
+	mocket.Catcher.Reset()
+	mockExportRows()
+	mocket.Catcher.NewMock().WithQuery(`FROM "sites"`).WithReply([]map[string]interface{}{{"id": 3, "designation": "blog"}})
+	mocket.Catcher.NewMock().WithQuery(`UPDATE "exports" SET "started_at"`).WithRowsNum(1).OneTime()
+	h.runExport(context.Background(), Export{ID: 11, SiteID: 3, UserID: 7, Format: ExportJSONL, Status: ExportQueued}, time.Now())
+
+	_, err = os.Stat(filepath.Join(dir, "export-11.jsonl"))
+	assert.True(t, os.IsNotExist(err))
+	assert.Empty(t, outbox.messages)
+}
+
+func TestAdminExportsPost(t *testing.T) {
+	pairs := []struct {
+		Form         string
+		ExpectedCode int
+	}{
+		{"format=csv", http.StatusBadRequest},
+		{"format=jsonl", http.StatusFound},
+		{"format=disqus", http.StatusFound},
+	}
+
+	for _, p := range pairs {
+		mocket.Catcher.Reset().NewMock().WithQuery(`FROM "sites"`).WithReply([]map[string]interface{}{{"id": 3, "user_id": 7}})
+
+		var queued []driver.NamedValue
+		mocket.Catcher.NewMock().WithQuery(`INSERT INTO "exports"`).WithCallback(func(_ string, args []driver.NamedValue) {
+			queued = args
+		})
+
+		req := httptest.NewRequest(http.MethodPost, "/admin/sites/3/exports", strings.NewReader(p.Form))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("model.user", User{Model: mockSite.Model, Email: "owner@example.com"})
+		c.SetParamNames("id")
+		c.SetParamValues("3")
+
+		if assert.NoError(t, h.AdminExportsPost(c)) {
+			assert.Equal(t, p.ExpectedCode, rec.Code, p.Form)
+			assert.Equal(t, p.ExpectedCode == http.StatusFound, queued != nil, p.Form)
+		}
+	}
+
+	mocket.Catcher.Reset()
+}
+
+func TestAdminExportDownload(t *testing.T) {
+	mocket.Catcher.Reset().NewMock().WithQuery(`FROM "sites"`).WithReply([]map[string]interface{}{{"id": 3, "user_id": 7}})
+	defer mocket.Catcher.Reset()
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/sites/3/exports/9/download", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.Set("model.user", User{Model: mockSite.Model, Email: "owner@example.com"})
+	c.SetParamNames("id", "export")
+	c.SetParamValues("3", "9")
+
+	if assert.NoError(t, h.AdminExportDownload(c)) {
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	}
+}
@@ -1,16 +1,24 @@
 package main
 
 import (
+	"context"
 	"crypto/sha512"
 	b64 "encoding/base64"
-	"encoding/json"
 	"fmt"
+	"html"
+	"log/slog"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/javorszky/go-comments/config"
+	"github.com/javorszky/go-comments/mail"
+	"github.com/javorszky/go-comments/markdown"
 	rs "github.com/javorszky/go-comments/randomstring"
+	"github.com/javorszky/go-comments/spam"
 	"github.com/jinzhu/gorm"
 	"github.com/labstack/echo"
 	"github.com/masonj88/pwchecker"
@@ -22,17 +30,60 @@ type Site struct {
 	UserID      uint
 	Designation string `form:"designation" gorm:"type:varchar(191);not null;unique"`
 	Domains     string `form:"domains" gorm:"type:varchar(191)"`
+	// MarkdownFeatures is a comma separated list of the Markdown features
+	// comments on the site may use. See the markdown package.
+	MarkdownFeatures string `gorm:"type:varchar(191)"`
+	// CommenterPolicy is who may comment: anonymous, email or login.
+	CommenterPolicy string `gorm:"type:varchar(16);not null;default:'anonymous'"`
+	// EditWindowMinutes is how long commenters can change their comments for.
+	EditWindowMinutes int `gorm:"not null;default:15"`
+	// SSOSecret signs the payloads host pages sign their users in with.
+	// Single sign-on is off while it's empty.
+	SSOSecret string `gorm:"type:varchar(191)"`
+	// Reactions is a comma separated list of the emoji commenters can react
+	// to comments with. There are no reactions while it's empty.
+	Reactions string `gorm:"type:varchar(191)"`
+	// OwnerNotify is what the owner hears about new comments: off, each,
+	// or a daily digest of the ones waiting for them.
+	OwnerNotify  string `gorm:"type:varchar(16);not null;default:'off'"`
+	DigestSentAt *time.Time
 }
 
 // User model definition.
 type User struct {
 	gorm.Model
-	Email          string `json:"email" form:"email" gorm:"type:varchar(191);unique_index:email"`
-	PasswordOne    string `form:"password1" gorm:"-" json:"-"`
-	PasswordTwo    string `form:"password2" gorm:"-" json:"-"`
+	Email          string `json:"email" gorm:"type:varchar(191);unique_index:email"`
 	HashedPassword string `json:"passwordHash" gorm:"type:varchar(255)"`
 	Sessions       []Session
 	Sites          []Site
+	// DeletionRequestedAt is when the user asked for their account to be
+	// deleted. It is deleted for good accountDeletionGrace later.
+	DeletionRequestedAt *time.Time `json:"deletionRequestedAt"`
+	// Superadmin runs the instance. Only the admin command can make someone one.
+	Superadmin bool `json:"superadmin" gorm:"not null;default:false"`
+	// DisabledAt is when a superadmin disabled the account. Disabled users
+	// can't log in or use their API tokens.
+	DisabledAt *time.Time `json:"disabledAt"`
+}
+
+// RegisterRequest is what people register with. It is bound instead of User
+// so nobody can set fields like Superadmin on themselves.
+type RegisterRequest struct {
+	Email       string `json:"email" form:"email"`
+	PasswordOne string `json:"password1" form:"password1"`
+	PasswordTwo string `json:"password2" form:"password2"`
+	// Invitation is the token of an invitation to a site, which lets its
+	// address register while registration is closed.
+	Invitation string `json:"invitation" form:"invitation"`
+}
+
+// Check that passed email is actually an email. Snippet taken from
+// https://www.alexedwards.net/blog/validation-snippets-for-go#email-validation
+var rxEmail = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
+
+// isEmail tells whether the string looks like an email address.
+func isEmail(email string) bool {
+	return len(email) <= 254 && rxEmail.MatchString(email)
 }
 
 // ResponseError is a generic struct to be turned into JSON in responses.
@@ -51,6 +102,17 @@ type PasswordHasher interface {
 	ComparePasswordAndHash(string, string) (bool, error)
 }
 
+// SpamChecker interface to hold spam comments back and learn from moderators. See the spam package.
+type SpamChecker interface {
+	Check(context.Context, spam.Submission) (spam.Verdict, error)
+	Learn(context.Context, spam.Submission, bool, bool) error
+}
+
+// MailQueue interface to send email in the background. See the mail package.
+type MailQueue interface {
+	Enqueue(mail.Message) bool
+}
+
 // PwChecker struct implements haveIbeenpwnd API checker.
 type PwChecker struct{}
 
@@ -64,22 +126,33 @@ func (pw PwChecker) IsPasswordPwnd(password string) (bool, error) {
 	return pwd.Pwnd, nil
 }
 
-// Handlers struct holds db, passwordhasher, and passwordchecker implementations.
+// Handlers struct holds db, passwordhasher, passwordchecker, spamchecker implementations, the rate limits, the logger and the config.
 type Handlers struct {
-	pwc PasswordChecker
-	pwh PasswordHasher
-	db  *gorm.DB
+	pwc    PasswordChecker
+	pwh    PasswordHasher
+	spam   SpamChecker
+	limits *RateLimits
+	mail   MailQueue
+	db     *gorm.DB
+	log    *slog.Logger
+	cfg    *config.Config
 }
 
 // BadRegister is a helper struct to return an error and CSRF token.
 type BadRegister struct {
 	Csrf   interface{}
 	Errors []error
+	// Closed is set when only invited people can register.
+	Closed bool
+	// Invitation is the token of the invitation registering with, and
+	// Email the address it went to.
+	Invitation string
+	Email      string
 }
 
 // NewHandler returns a struct with given implementations.
-func NewHandler(pwc PasswordChecker, pwh PasswordHasher, db *gorm.DB) Handlers {
-	return Handlers{pwc, pwh, db}
+func NewHandler(pwc PasswordChecker, pwh PasswordHasher, sc SpamChecker, rl *RateLimits, mq MailQueue, db *gorm.DB, log *slog.Logger, cfg *config.Config) Handlers {
+	return Handlers{pwc, pwh, sc, rl, mq, db, log, cfg}
 }
 
 // Index handles GET request to /.
@@ -97,11 +170,7 @@ func (h *Handlers) LoginPost(c echo.Context) error {
 	email := c.FormValue("email")
 	password := c.FormValue("password")
 
-	// Check that passed email is actually an email. Snippet taken from
-	// https://www.alexedwards.net/blog/validation-snippets-for-go#email-validation
-	rxEmail := regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
-
-	if len(email) > 254 || !rxEmail.MatchString(email) {
+	if !isEmail(email) {
 		return c.JSON(http.StatusBadRequest, ResponseError{"Passed email is not an email format."})
 	}
 
@@ -110,20 +179,51 @@ func (h *Handlers) LoginPost(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, ResponseError{"Passed password is empty."})
 	}
 
+	ipKey, accountKey := h.loginKeys(c, email)
+	ctx := c.Request().Context()
+
+	if result, err := h.limits.LoginIP.Check(ctx, ipKey); !h.allowed(c, result, err) {
+		return tooManyRequests(c, result.RetryAfter)
+	}
+
+	if result, err := h.limits.LoginAccount.Check(ctx, accountKey); !h.allowed(c, result, err) {
+		return tooManyRequests(c, result.RetryAfter)
+	}
+
 	user := &User{}
 
+	// Unknown addresses get the same answer as wrong passwords, after about as
+	// long, so the login form doesn't tell who has an account.
 	if h.db.Where("email = ?", email).First(user).RecordNotFound() {
-		return c.JSON(http.StatusNotFound, ResponseError{"No user by that email address."})
+		h.pwh.ComparePasswordAndHash(password, h.dummyHash())
+		h.audit(c, 0, auditLoginFailure, "unknown email "+email)
+		return h.loginFailed(c, ipKey, accountKey)
 	}
 
 	match, err := h.pwh.ComparePasswordAndHash(password, user.HashedPassword)
 
 	if err != nil {
+		loginsTotal.Inc("failure")
+		h.logger(c).Error("Checking password failed", "user_id", user.ID, "error", err)
 		return c.JSON(http.StatusBadRequest, ResponseError{"Checking passwords failed."})
 	}
 
 	if !match {
-		return c.JSON(http.StatusUnauthorized, ResponseError{"Passwords do not match."})
+		h.audit(c, user.ID, auditLoginFailure, "wrong password")
+		return h.loginFailed(c, ipKey, accountKey)
+	}
+
+	if user.DisabledAt != nil {
+		loginsTotal.Inc("failure")
+		h.audit(c, user.ID, auditLoginFailure, "account disabled")
+		return c.JSON(http.StatusForbidden, ResponseError{"This account is disabled."})
+	}
+
+	loginsTotal.Inc("success")
+	h.audit(c, user.ID, auditLoginSuccess, "")
+
+	if err := h.limits.LoginAccount.Reset(ctx, accountKey); err != nil {
+		h.logger(c).Warn("rate limit store failed", "error", err)
 	}
 
 	sessionID, err := h.setSession(user, c)
@@ -139,6 +239,38 @@ func (h *Handlers) LoginPost(c echo.Context) error {
 	return cookieError
 }
 
+/*
+loginFailed counts a failed login against the IP address and the account,
+and answers once the delay the limiter asks for is over.
+*/
+func (h *Handlers) loginFailed(c echo.Context, ipKey, accountKey string) error {
+	loginsTotal.Inc("failure")
+
+	ctx := c.Request().Context()
+
+	result, err := h.limits.LoginIP.Hit(ctx, ipKey)
+	h.allowed(c, result, err)
+
+	result, err = h.limits.LoginAccount.Hit(ctx, accountKey)
+	h.allowed(c, result, err)
+
+	return c.JSON(http.StatusUnauthorized, ResponseError{"Email or password is wrong."})
+}
+
+// dummyHash returns a hash to check passwords against when there's no user to check them for.
+func (h *Handlers) dummyHash() string {
+	dummy.once.Do(func() {
+		dummy.hash, _ = h.pwh.GenerateFromPassword(randomToken(16))
+	})
+	return dummy.hash
+}
+
+// dummy is the hash dummyHash returns, made the first time it's needed.
+var dummy struct {
+	once sync.Once
+	hash string
+}
+
 // Logout serves GET to /logout. Destroys cookie
 func (h *Handlers) Logout(c echo.Context) error {
 	err := h.destroySessionCookie(c)
@@ -149,23 +281,43 @@ func (h *Handlers) Logout(c echo.Context) error {
 	return err
 }
 
-// Register handles GET requests to /register.
+// Register handles GET requests to /register, or /register?invitation=<token> to register the address an invitation went to.
 func (h *Handlers) Register(c echo.Context) error {
 	data := BadRegister{
-		c.Get("csrf"),
-		nil,
+		Csrf:   c.Get("csrf"),
+		Closed: !h.registrationOpen(),
+	}
+
+	if invitation, ok := h.invitationByToken(c.QueryParam("invitation")); ok {
+		data.Invitation = c.QueryParam("invitation")
+		data.Email = invitation.Email
 	}
+
 	return c.Render(http.StatusOK, "register", data)
 }
 
 // RegisterPost handles POST requests to /register.
 func (h *Handlers) RegisterPost(c echo.Context) (err error) {
-	u := new(User)
+	if result, err := h.limits.Register.Hit(c.Request().Context(), "register:ip:"+clientIP(c, h.cfg.TrustedProxies)); !h.allowed(c, result, err) {
+		return tooManyRequests(c, result.RetryAfter)
+	}
+
+	u := new(RegisterRequest)
 
 	if err = c.Bind(u); err != nil {
 		return fmt.Errorf("binding user failed")
 	}
 
+	// While registration is closed, only the address an invitation went to
+	// can register, with the token from the invitation.
+	if !h.registrationOpen() {
+		invitation, ok := h.invitationByToken(u.Invitation)
+		if !ok {
+			return c.JSON(http.StatusForbidden, ResponseError{"Registration is closed. Ask for an invitation to a site to get an account."})
+		}
+		u.Email = invitation.Email
+	}
+
 	if u.PasswordOne == "" || u.PasswordTwo == "" {
 		e := ResponseError{Error: "No password was passed."}
 		return c.JSON(http.StatusUnprocessableEntity, e)
@@ -184,25 +336,43 @@ func (h *Handlers) RegisterPost(c echo.Context) (err error) {
 		return c.JSON(http.StatusBadGateway, e)
 	}
 
-	u.HashedPassword = hashedPassword
+	user := User{Email: u.Email, HashedPassword: hashedPassword}
 
-	if result := h.db.Create(&u); result.Error != nil {
+	if result := h.db.Create(&user); result.Error != nil {
 		data := BadRegister{
-			c.Get("csrf"),
-			result.GetErrors(),
+			Csrf:   c.Get("csrf"),
+			Errors: result.GetErrors(),
 		}
 		return c.JSON(http.StatusConflict, data)
 	}
 
-	return c.JSON(http.StatusOK, u)
+	return c.JSON(http.StatusOK, AccountProfile{
+		ID:        user.ID,
+		Email:     user.Email,
+		CreatedAt: user.CreatedAt,
+		UpdatedAt: user.UpdatedAt,
+	})
 }
 
 // Admin serves GET request to /admin
 func (h *Handlers) Admin(c echo.Context) error {
-	return c.Render(http.StatusOK, "admin", nil)
+	user, _ := c.Get("model.user").(User)
+	impersonator, impersonating := c.Get("model.impersonator").(User)
+
+	return c.Render(http.StatusOK, "admin", struct {
+		Csrf          interface{}
+		User          User
+		Impersonating bool
+		Impersonator  User
+	}{
+		Csrf:          c.Get("csrf"),
+		User:          user,
+		Impersonating: impersonating,
+		Impersonator:  impersonator,
+	})
 }
 
-// AdminSites handles GET /admin/sites to list all sites a user has
+// AdminSites handles GET /admin/sites to list all sites a user owns or is a member of
 func (h *Handlers) AdminSites(c echo.Context) error {
 	user, ok := c.Get("model.user").(User)
 
@@ -210,11 +380,7 @@ func (h *Handlers) AdminSites(c echo.Context) error {
 		panic("not okay")
 	}
 
-	var sites []Site
-
-	h.db.Model(&user).Association("Sites").Find(&sites)
-
-	return c.Render(http.StatusOK, "adminsites", sites)
+	return c.Render(http.StatusOK, "adminsites", h.memberSites(user))
 }
 
 // AdminSitesNew handles GET /admin/sites/new to display a form to add new sites.
@@ -230,25 +396,113 @@ func (h *Handlers) AdminSitesNewPost(c echo.Context) error {
 		panic("not okay")
 	}
 
-	domains, err := json.Marshal(strings.Split(c.FormValue("domains"), "\r\n"))
+	site := newSite(user.ID, c.FormValue("designation"), encodeDomains(c.FormValue("domains")))
+
+	if result := h.db.Create(&site); result.Error != nil {
+		return c.String(http.StatusBadRequest, "Something failed while saving")
+	}
+
+	h.audit(c, user.ID, auditSiteCreate, fmt.Sprintf("site %d: %s", site.ID, site.Designation))
+
+	return c.String(http.StatusCreated, "lel")
+}
+
+// newSite returns a site for the user with the default settings.
+func newSite(userID uint, designation, domains string) Site {
+	return Site{
+		Domains:           domains,
+		Designation:       designation,
+		UserID:            userID,
+		MarkdownFeatures:  markdown.All.String(),
+		CommenterPolicy:   PolicyAnonymous,
+		EditWindowMinutes: 15,
+		Reactions:         defaultReactions,
+		OwnerNotify:       OwnerNotifyOff,
+	}
+}
+
+// AdminSitesEdit handles GET /admin/sites/:id/edit to display a form to change a site.
+func (h *Handlers) AdminSitesEdit(c echo.Context) error {
+	site, ok := h.siteFor(c, RoleAdmin)
+	if !ok {
+		return c.String(http.StatusNotFound, "No such site")
+	}
 
+	enabled := map[string]bool{}
+	for _, name := range strings.Split(site.Features().String(), ",") {
+		enabled[name] = true
+	}
+
+	return c.Render(http.StatusOK, "admineditsite", struct {
+		Csrf     interface{}
+		Site     Site
+		Domains  string
+		Features []string
+		Enabled  map[string]bool
+		Policies []string
+		Notify   []string
+	}{
+		Csrf:     c.Get("csrf"),
+		Site:     site,
+		Domains:  strings.Join(site.DomainList(), "\n"),
+		Features: markdown.Names(),
+		Enabled:  enabled,
+		Policies: []string{PolicyAnonymous, PolicyEmail, PolicyLogin},
+		Notify:   []string{OwnerNotifyOff, OwnerNotifyEach, OwnerNotifyDigest},
+	})
+}
+
+// AdminSitesEditPost handles POST /admin/sites/:id/edit to save changes to a site.
+func (h *Handlers) AdminSitesEditPost(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	site, ok := h.siteFor(c, RoleAdmin)
+	if !ok {
+		return c.String(http.StatusNotFound, "No such site")
+	}
+
+	form, err := c.FormParams()
 	if err != nil {
-		panic("Can't split thingies")
+		return c.String(http.StatusBadRequest, "Could not read the form")
 	}
 
-	domainsString := string(domains)
+	site.Domains = encodeDomains(c.FormValue("domains"))
+	site.Designation = c.FormValue("designation")
+	site.MarkdownFeatures = markdown.ParseFeatures(strings.Join(form["markdown"], ",")).String()
 
-	site := Site{
-		Domains:     domainsString,
-		Designation: c.FormValue("designation"),
-		UserID:      user.ID,
+	if !validPolicy(c.FormValue("policy")) {
+		return c.String(http.StatusBadRequest, "Unknown commenter policy")
 	}
+	site.CommenterPolicy = c.FormValue("policy")
 
-	if result := h.db.Create(&site); result.Error != nil {
+	window, err := strconv.Atoi(c.FormValue("editwindow"))
+	if err != nil || window < 0 {
+		return c.String(http.StatusBadRequest, "Edit window has to be a number of minutes")
+	}
+	site.EditWindowMinutes = window
+
+	reactions, err := parseReactions(c.FormValue("reactions"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	site.Reactions = reactions
+
+	if !validOwnerNotify(c.FormValue("notify")) {
+		return c.String(http.StatusBadRequest, "Unknown notification setting")
+	}
+	site.OwnerNotify = c.FormValue("notify")
+
+	if result := h.db.Save(&site); result.Error != nil {
 		return c.String(http.StatusBadRequest, "Something failed while saving")
 	}
 
-	return c.String(http.StatusCreated, "lel")
+	h.audit(c, user.ID, auditSiteUpdate, fmt.Sprintf("site %d: %s", site.ID, site.Designation))
+
+	return c.Redirect(http.StatusFound, "/admin/sites")
 }
 
 func (h *Handlers) AdminSessions(c echo.Context) error {
@@ -276,19 +530,89 @@ func (h *Handlers) AdminSessions(c echo.Context) error {
 	})
 }
 
+// DeleteSession handles GET /admin/sessions/delete/:id to terminate one of the user's sessions.
 func (h *Handlers) DeleteSession(c echo.Context) error {
-	h.db.Delete(Session{}, "ID = ?", c.Param("id"))
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	if result := h.db.Delete(Session{}, "id = ? AND user_id = ?", c.Param("id"), user.ID); result.RowsAffected > 0 {
+		h.audit(c, user.ID, auditSessionDelete, c.Param("id"))
+	}
 
 	return c.Redirect(http.StatusFound, "/admin/sessions")
 }
 
+// AdminPassword handles GET /admin/password to display the password change form.
+func (h *Handlers) AdminPassword(c echo.Context) error {
+	return c.Render(http.StatusOK, "adminpassword", c.Get("csrf"))
+}
+
+/*
+AdminPasswordPost handles POST /admin/password. It needs the current password,
+and terminates every other session of the user once the new one is saved.
+*/
+func (h *Handlers) AdminPasswordPost(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	sessionID, ok := c.Get("model.session").(string)
+	if !ok {
+		panic("Really not okay")
+	}
+
+	match, err := h.pwh.ComparePasswordAndHash(c.FormValue("current"), user.HashedPassword)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ResponseError{"Checking passwords failed."})
+	}
+
+	if !match {
+		return c.JSON(http.StatusUnauthorized, ResponseError{"Current password is wrong."})
+	}
+
+	password, passwordTwo := c.FormValue("password1"), c.FormValue("password2")
+
+	if password == "" {
+		return c.JSON(http.StatusUnprocessableEntity, ResponseError{"No password was passed."})
+	}
+
+	if password != passwordTwo {
+		return c.JSON(http.StatusUnprocessableEntity, ResponseError{"Passwords do not match."})
+	}
+
+	hashedPassword, err := h.pwh.GenerateFromPassword(password)
+	if err != nil {
+		return c.JSON(http.StatusBadGateway, ResponseError{err.Error()})
+	}
+
+	if result := h.db.Model(&user).Update("hashed_password", hashedPassword); result.Error != nil {
+		return c.JSON(http.StatusBadRequest, ResponseError{"Something failed while saving."})
+	}
+
+	h.db.Delete(Session{}, "user_id = ? AND id <> ?", user.ID, sessionID)
+	h.audit(c, user.ID, auditPasswordChange, "")
+
+	return c.Redirect(http.StatusFound, "/admin")
+}
+
 // ServeJS is handling requests to /:id/js.
 func (h *Handlers) ServeJS(c echo.Context) error {
+	// Only count sites that exist, so made up IDs don't add series to the metrics.
+	if !h.db.Select("id").First(&Site{}, "id = ?", c.Param("id")).RecordNotFound() {
+		embedRequestsTotal.Inc(c.Param("id"))
+	}
+
 	c.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationJavaScript)
 	return c.Render(http.StatusOK, "client.js", c.Param("id"))
 }
 
-// Request is a utility function that helps debug connection details.
+// Request is a utility function that helps debug connection details. It is only
+// there with DEBUG set, for superadmins.
 func (h *Handlers) Request(c echo.Context) error {
 	req := c.Request()
 	format := `
@@ -302,7 +626,13 @@ TLS: %v<br>
 TLS Version: %v<br>
 </code>
 `
-	return c.HTML(http.StatusOK, fmt.Sprintf(format, req.Proto, req.Host, req.RemoteAddr, req.Method, req.URL.Path, req.TLS.NegotiatedProtocol, req.TLS.Version))
+	protocol, version := "none", "none"
+	if req.TLS != nil {
+		protocol = req.TLS.NegotiatedProtocol
+		version = fmt.Sprintf("%x", req.TLS.Version)
+	}
+
+	return c.HTML(http.StatusOK, fmt.Sprintf(format, html.EscapeString(req.Proto), html.EscapeString(req.Host), html.EscapeString(req.RemoteAddr), req.Method, html.EscapeString(req.URL.Path), html.EscapeString(protocol), version))
 }
 
 /*
@@ -373,9 +703,11 @@ SessionCheck is a middleware. It takes the context, extracts the cookie,
 and then looks up whether there is a session in the database with the
 details in the cookie.
 
-If there isn't, it redirects to login page with 302.
+If there isn't, or its user is disabled, it redirects to login page with 302.
 
-If there is, it calls the next middleware.
+If there is, it calls the next middleware. When a superadmin is impersonating
+someone with the session, that someone is the user, and the superadmin is
+set as "model.impersonator".
 */
 func (h *Handlers) SessionCheck(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
@@ -398,6 +730,19 @@ func (h *Handlers) SessionCheck(next echo.HandlerFunc) echo.HandlerFunc {
 
 		h.db.Where("id = ?", session.UserID).First(&user)
 
+		if user.DisabledAt != nil {
+			h.db.Delete(Session{}, "user_id = ?", user.ID)
+			return h.destroySessionCookie(c)
+		}
+
+		if session.ImpersonatingID != nil && user.Superadmin {
+			target := User{}
+			if !h.db.Where("id = ?", *session.ImpersonatingID).First(&target).RecordNotFound() {
+				c.Set("model.impersonator", user)
+				user = target
+			}
+		}
+
 		c.Set("model.user", user)
 		c.Set("model.session", session.ID)
 
@@ -2,15 +2,23 @@ package main
 
 import (
 	"bytes"
+	"database/sql/driver"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/javorszky/go-comments/config"
+	database "github.com/javorszky/go-comments/db"
+	"github.com/javorszky/go-comments/mail"
+	"github.com/javorszky/go-comments/ratelimit"
+	"github.com/javorszky/go-comments/spam"
 	"github.com/jinzhu/gorm"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
 	mocket "github.com/selvatico/go-mocket"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"log"
+	"log/slog"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
@@ -26,13 +34,24 @@ var (
 	mockBadUser       = `{"email":"test@example.com","name":"John Doe","password1":"somepassword", "password2":"someotherpass"}`
 	mockBadUserReturn = `{"error":"Passwords do not match."}`
 
-	e    *echo.Echo
-	mpwc MockPasswordChecker
-	pwh  PasswordHasher
-	db   *gorm.DB
-	h    Handlers
+	e      *echo.Echo
+	outbox = &recordingMailQueue{}
+	mpwc   MockPasswordChecker
+	pwh    PasswordHasher
+	db     *gorm.DB
+	h      Handlers
 )
 
+// recordingMailQueue keeps the messages instead of sending them.
+type recordingMailQueue struct {
+	messages []mail.Message
+}
+
+func (q *recordingMailQueue) Enqueue(m mail.Message) bool {
+	q.messages = append(q.messages, m)
+	return true
+}
+
 type MockPasswordChecker struct{}
 type MockPasswordHasher struct{}
 
@@ -90,7 +109,12 @@ func TestMain(m *testing.M) {
 
 	db = DB
 
-	h = NewHandler(mpwc, pwh, db)
+	// Every test posts from the same address, so the shared handler's
+	// comment limit is raised out of their way. TestRateLimits checks it.
+	limits := NewRateLimits(ratelimit.NewMemoryStore())
+	limits.Comments.Rule.Limit = 1000
+
+	h = NewHandler(mpwc, pwh, spam.Pipeline{spam.Honeypot{}}, limits, outbox, db, slog.New(slog.NewTextHandler(io.Discard, nil)), &config.Config{SecretKey: "testsecret"})
 	SetRenderer(e)
 
 	os.Exit(m.Run())
@@ -170,20 +194,55 @@ func TestRegisterPostGood(t *testing.T) {
 		timeNow := time.Now()
 		timeString := fmt.Sprintf("%4d-%02d-%02dT%02d:%02d:%02d", timeNow.Year(), timeNow.Month(), timeNow.Day(), timeNow.Hour(), timeNow.Minute(), timeNow.Second())
 
-		created := strings.HasPrefix(dat["CreatedAt"].(string), timeString)
-		updated := strings.HasPrefix(dat["UpdatedAt"].(string), timeString)
+		created := strings.HasPrefix(dat["createdAt"].(string), timeString)
+		updated := strings.HasPrefix(dat["updatedAt"].(string), timeString)
 
 		assert.True(t, created)
 		assert.True(t, updated)
-		assert.NotNil(t, dat["ID"])
-		assert.Nil(t, dat["DeletedAt"])
-		assert.Equal(t, dat["CreatedAt"], dat["UpdatedAt"])
+		assert.NotNil(t, dat["id"])
+		assert.Equal(t, dat["createdAt"], dat["updatedAt"])
 		assert.Equal(t, origin["email"], dat["email"])
-		assert.Equal(t, "hashedpassword", dat["passwordHash"])
+		assert.NotContains(t, dat, "passwordHash")
 		assert.Equal(t, http.StatusOK, rec.Code)
 	}
 }
 
+func TestRegisterPostCantSetFields(t *testing.T) {
+	pairs := []struct {
+		ContentType string
+		Body        string
+	}{
+		{echo.MIMEApplicationForm, "email=new%40example.com&password1=goodpassword&password2=goodpassword&superadmin=true&Superadmin=true&disabledAt=2026-01-01T00%3A00%3A00Z"},
+		{echo.MIMEApplicationJSON, `{"email":"new@example.com","password1":"goodpassword","password2":"goodpassword","superadmin":true,"Superadmin":true,"passwordHash":"mine"}`},
+	}
+
+	for _, p := range pairs {
+		mocket.Catcher.Reset()
+
+		var created map[string]driver.Value
+		mocket.Catcher.NewMock().WithQuery(`INSERT INTO "users"`).WithCallback(func(query string, args []driver.NamedValue) {
+			created = insertedValues(query, args)
+		})
+
+		req := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(p.Body))
+		req.Header.Set(echo.HeaderContentType, p.ContentType)
+		// Its own address, so the registrations of other tests don't rate limit it.
+		req.RemoteAddr = "192.0.2.49:1234"
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+
+		if assert.NoError(t, h.RegisterPost(c)) && assert.NotNil(t, created, p.ContentType) {
+			assert.Equal(t, http.StatusOK, rec.Code, p.ContentType)
+			assert.Equal(t, "new@example.com", created["email"], p.ContentType)
+			assert.Equal(t, "hashedpassword", created["hashed_password"], p.ContentType)
+			assert.NotEqual(t, true, created["superadmin"], p.ContentType)
+			assert.Nil(t, created["disabled_at"], p.ContentType)
+		}
+	}
+
+	mocket.Catcher.Reset()
+}
+
 func TestRegisterPostPasswordDontMatch(t *testing.T) {
 	var origin map[string]interface{}
 
@@ -216,3 +275,195 @@ func TestRegisterPostPasswordDontMatch(t *testing.T) {
 		assert.Equal(t, mockBadUserReturn, rec.Body.String())
 	}
 }
+
+func TestHealthz(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	if assert.NoError(t, h.Healthz(c)) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, `{"status":"ok"}`, rec.Body.String())
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	pairs := []struct {
+		Applied      []map[string]interface{}
+		ExpectedCode int
+		ExpectedBody string
+	}{
+		{[]map[string]interface{}{{"id": database.LatestMigrationID()}}, http.StatusOK, `{"status":"ok"}`},
+		{[]map[string]interface{}{{"id": "201903032031"}}, http.StatusServiceUnavailable, `{"status":"unavailable","errors":["migrations pending"]}`},
+		{nil, http.StatusServiceUnavailable, `{"status":"unavailable","errors":["migrations pending"]}`},
+	}
+
+	for _, p := range pairs {
+		mocket.Catcher.Reset().NewMock().WithQuery(`FROM "migrations"`).WithReply(p.Applied)
+
+		req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+
+		if assert.NoError(t, h.Readyz(c)) {
+			assert.Equal(t, p.ExpectedCode, rec.Code)
+			assert.JSONEq(t, p.ExpectedBody, rec.Body.String())
+		}
+	}
+
+	mocket.Catcher.Reset()
+}
+
+func TestVersion(t *testing.T) {
+	mocket.Catcher.Reset().NewMock().WithQuery(`FROM "migrations"`).WithReply([]map[string]interface{}{{"id": "201903032031"}})
+	defer mocket.Catcher.Reset()
+
+	req := httptest.NewRequest(http.MethodGet, "/version", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	if assert.NoError(t, h.Version(c)) {
+		var info VersionInfo
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &info))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.NotEmpty(t, info.Commit)
+		assert.Equal(t, database.LatestMigrationID(), info.Migration)
+		assert.Equal(t, "201903032031", info.AppliedMigration)
+	}
+}
+
+func TestRequestWithoutTLS(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/admin/superadmin/debug/request", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	if assert.NoError(t, h.Request(c)) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "TLS: none")
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	pairs := []struct {
+		Token        string
+		Header       string
+		ExpectedCode int
+	}{
+		{"", "", http.StatusOK},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "Bearer secret", http.StatusOK},
+	}
+
+	for _, p := range pairs {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.Header.Set(echo.HeaderAuthorization, p.Header)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+
+		if assert.NoError(t, MetricsHandler(p.Token)(c)) {
+			assert.Equal(t, p.ExpectedCode, rec.Code)
+		}
+	}
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/admin/sessions/delete/5", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetPath("/admin/sessions/delete/:id")
+
+	before := httpRequestDuration.Count(http.MethodGet, "/admin/sessions/delete/:id", "404")
+
+	err := MetricsMiddleware(func(c echo.Context) error {
+		return echo.ErrNotFound
+	})(c)
+
+	assert.Equal(t, echo.ErrNotFound, err)
+	assert.Equal(t, before+1, httpRequestDuration.Count(http.MethodGet, "/admin/sessions/delete/:id", "404"))
+}
+
+func TestLoginPostCountsFailures(t *testing.T) {
+	before := loginsTotal.Value("failure")
+
+	form := "email=nobody%40example.com&password=goodpassword"
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	if assert.NoError(t, h.LoginPost(c)) {
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		assert.Equal(t, before+1, loginsTotal.Value("failure"))
+	}
+}
+
+func TestLoginPostAuditsFailure(t *testing.T) {
+	var audited []driver.NamedValue
+	mocket.Catcher.Reset().NewMock().WithQuery(`INSERT INTO "audit_events"`).WithCallback(func(query string, args []driver.NamedValue) {
+		audited = args
+	})
+	defer mocket.Catcher.Reset()
+
+	form := "email=nobody%40example.com&password=goodpassword"
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	if assert.NoError(t, h.LoginPost(c)) && assert.NotEmpty(t, audited) {
+		values := []interface{}{}
+		for _, a := range audited {
+			values = append(values, a.Value)
+		}
+		assert.Contains(t, values, auditLoginFailure)
+		assert.Contains(t, values, "unknown email nobody@example.com")
+	}
+}
+
+func TestDeleteSessionOnlyOwnSessions(t *testing.T) {
+	var deleted []driver.NamedValue
+	mocket.Catcher.Reset().NewMock().WithQuery(`DELETE FROM "sessions"`).WithCallback(func(query string, args []driver.NamedValue) {
+		deleted = args
+	})
+	defer mocket.Catcher.Reset()
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/sessions/delete/abc", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("id")
+	c.SetParamValues("abc")
+	c.Set("model.user", User{Model: gorm.Model{ID: 7}})
+
+	if assert.NoError(t, h.DeleteSession(c)) && assert.Len(t, deleted, 2) {
+		assert.Equal(t, http.StatusFound, rec.Code)
+		assert.Equal(t, "abc", deleted[0].Value)
+		assert.Equal(t, int64(7), deleted[1].Value)
+	}
+}
+
+func TestAdminPasswordPost(t *testing.T) {
+	pairs := []struct {
+		Form         string
+		ExpectedCode int
+	}{
+		{"current=wrongpassword&password1=a&password2=a", http.StatusUnauthorized},
+		{"current=goodpassword&password1=&password2=", http.StatusUnprocessableEntity},
+		{"current=goodpassword&password1=a&password2=b", http.StatusUnprocessableEntity},
+		{"current=goodpassword&password1=canthashthis&password2=canthashthis", http.StatusBadGateway},
+		{"current=goodpassword&password1=newpassword&password2=newpassword", http.StatusFound},
+	}
+
+	for _, p := range pairs {
+		req := httptest.NewRequest(http.MethodPost, "/admin/password", strings.NewReader(p.Form))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("model.user", User{Model: gorm.Model{ID: 7}, HashedPassword: "hashedpassword"})
+		c.Set("model.session", "current-session")
+
+		if assert.NoError(t, h.AdminPasswordPost(c)) {
+			assert.Equal(t, p.ExpectedCode, rec.Code, p.Form)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/javorszky/go-comments/config"
+	database "github.com/javorszky/go-comments/db"
+	"github.com/labstack/echo"
+)
+
+// commit is the revision the binary was built from. It can be set at build
+// time with -ldflags "-X main.commit=<sha>", otherwise it is read from the
+// version control information the go tool embeds.
+var commit = ""
+
+// HealthStatus is the body of the health, readiness and version endpoints.
+type HealthStatus struct {
+	Status string   `json:"status"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+// VersionInfo describes the running build and the state of the database schema.
+type VersionInfo struct {
+	Commit           string `json:"commit"`
+	Migration        string `json:"migration"`
+	AppliedMigration string `json:"appliedMigration"`
+}
+
+// buildCommit returns the commit the binary was built from, or "unknown".
+func buildCommit() string {
+	if commit != "" {
+		return commit
+	}
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+	}
+
+	return "unknown"
+}
+
+// Healthz handles GET /healthz. It only tells whether the process is up and serving.
+func (h *Handlers) Healthz(c echo.Context) error {
+	return c.JSON(http.StatusOK, HealthStatus{Status: "ok"})
+}
+
+/*
+Readyz handles GET /readyz. The app is ready when the database answers a
+ping, and every migration this build knows about has been applied to it.
+Anyone can call it, so what went wrong is only logged.
+*/
+func (h *Handlers) Readyz(c echo.Context) error {
+	var errs []string
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), 2*time.Second)
+	defer cancel()
+
+	if err := h.db.DB().PingContext(ctx); err != nil {
+		h.log.Error("Readiness check could not reach the database", "error", err)
+		errs = append(errs, "database unavailable")
+	} else if applied, err := database.AppliedMigrationID(h.db); err != nil {
+		h.log.Error("Readiness check could not read the migrations", "error", err)
+		errs = append(errs, "migrations pending")
+	} else if applied != database.LatestMigrationID() {
+		h.log.Error("Readiness check found migrations pending", "applied", applied, "expected", database.LatestMigrationID())
+		errs = append(errs, "migrations pending")
+	}
+
+	if len(errs) > 0 {
+		return c.JSON(http.StatusServiceUnavailable, HealthStatus{Status: "unavailable", Errors: errs})
+	}
+
+	return c.JSON(http.StatusOK, HealthStatus{Status: "ok"})
+}
+
+// Version handles GET /version with the build commit and migration IDs.
+func (h *Handlers) Version(c echo.Context) error {
+	applied, _ := database.AppliedMigrationID(h.db)
+
+	return c.JSON(http.StatusOK, VersionInfo{
+		Commit:           buildCommit(),
+		Migration:        database.LatestMigrationID(),
+		AppliedMigration: applied,
+	})
+}
+
+/*
+Healthcheck asks the server running on this machine whether it is ready, for
+container health checks that have no curl to work with. It returns the exit
+code for the process.
+
+The certificate is not verified: the request never leaves the machine, and
+the certificate is not issued for localhost anyway.
+*/
+func Healthcheck(cfg *config.Config) int {
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	if len(cfg.TLSHosts) > 0 {
+		tlsConfig.ServerName = cfg.TLSHosts[0]
+	}
+
+	client := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+
+	res, err := client.Get(fmt.Sprintf("https://localhost:%s/readyz", cfg.TLSPort))
+	if err != nil {
+		fmt.Printf("Health check failed: %v\n", err)
+		return 1
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		fmt.Printf("Health check failed: %s\n", res.Status)
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/javorszky/go-comments/disqus"
+	"github.com/javorszky/go-comments/markdown"
+	"github.com/javorszky/go-comments/wxr"
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+)
+
+// KindImported is a commenter who came along with comments imported from another system.
+const KindImported = "imported"
+
+// Issuers of the identities imported commenters get, which are also the prefixes of their comments' import IDs.
+const (
+	issuerDisqus    = "disqus"
+	issuerWordPress = "wordpress"
+)
+
+/*
+ImportReport says what an import did, or would do if it's a dry run.
+Comments that were imported before are counted as Existing and left alone,
+so the same export can be imported again.
+*/
+type ImportReport struct {
+	DryRun   bool
+	Threads  int
+	Comments int
+	Existing int
+	// Ignored counts what isn't a comment, like pingbacks.
+	Ignored int
+	// Skipped counts the comments on pages that aren't on the site's domains,
+	// which are listed in Mismatched.
+	Skipped    int
+	Mismatched []string
+	// Orphans counts the replies whose parent wasn't in the export. They are kept as top level comments.
+	Orphans int
+}
+
+// importedComment is a comment from another system, on its way to becoming one of the site's.
+type importedComment struct {
+	// ID and ParentID are prefixed with the system they came from, like "disqus:123".
+	ID        string
+	ParentID  string
+	PageURL   string
+	Body      string
+	Status    string
+	CreatedAt time.Time
+	IP        string
+
+	AuthorName    string
+	AuthorEmail   string
+	AuthorWebsite string
+	// AuthorIssuer and AuthorSubject identify the author in the other system, if they had an account there.
+	AuthorIssuer  string
+	AuthorSubject string
+}
+
+// orphan is an imported reply whose parent hasn't been imported yet.
+type orphan struct {
+	commentID uint
+	parentID  string
+}
+
+/*
+importer adds comments from other systems to a site, one at a time. It only
+remembers the threads and commenters it has seen, and the replies that came
+before their parents, so exports of any size can go through it.
+
+A dry run saves nothing. It remembers the IDs of the comments it would have
+created instead, to tell which replies would find their parents.
+*/
+type importer struct {
+	h          *Handlers
+	site       Site
+	dryRun     bool
+	report     ImportReport
+	threads    map[string]uint
+	commenters map[string]uint
+	mismatched map[string]bool
+	planned    map[string]bool
+	orphans    []orphan
+}
+
+func (h *Handlers) newImporter(site Site, dryRun bool) *importer {
+	return &importer{
+		h:          h,
+		site:       site,
+		dryRun:     dryRun,
+		report:     ImportReport{DryRun: dryRun},
+		threads:    map[string]uint{},
+		commenters: map[string]uint{},
+		mismatched: map[string]bool{},
+		planned:    map[string]bool{},
+	}
+}
+
+// add saves ic as a comment of the site, unless it was imported before or its page isn't on the site.
+func (im *importer) add(ic importedComment) error {
+	existing := Comment{}
+	if !im.h.db.Where("site_id = ? AND import_id = ?", im.site.ID, ic.ID).First(&existing).RecordNotFound() {
+		im.report.Existing++
+		return nil
+	}
+
+	threadID, ok, err := im.thread(ic.PageURL)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		im.report.Skipped++
+		return nil
+	}
+
+	if im.dryRun {
+		im.planned[ic.ID] = true
+		im.report.Comments++
+		if _, found := im.parent(ic.ParentID); ic.ParentID != "" && !found {
+			im.orphans = append(im.orphans, orphan{0, ic.ParentID})
+		}
+		return nil
+	}
+
+	comment := Comment{
+		Model:         gorm.Model{CreatedAt: ic.CreatedAt, UpdatedAt: ic.CreatedAt},
+		SiteID:        im.site.ID,
+		ThreadID:      threadID,
+		AuthorName:    truncate(ic.AuthorName, maxAuthorLength),
+		AuthorWebsite: truncate(ic.AuthorWebsite, 191),
+		Body:          ic.Body,
+		BodyHTML:      renderBody(im.site, ic.Body),
+		Status:        ic.Status,
+		IP:            ic.IP,
+		ImportID:      ic.ID,
+	}
+
+	if ic.AuthorSubject != "" {
+		id, err := im.commenter(ic)
+		if err != nil {
+			return err
+		}
+		comment.CommenterID = &id
+	}
+
+	if parentID, found := im.parent(ic.ParentID); found {
+		comment.ParentID = &parentID
+	}
+
+	if err := im.h.db.Create(&comment).Error; err != nil {
+		return err
+	}
+	im.report.Comments++
+
+	if ic.ParentID != "" && comment.ParentID == nil {
+		im.orphans = append(im.orphans, orphan{comment.ID, ic.ParentID})
+	}
+
+	return nil
+}
+
+/*
+thread returns the ID of the site's thread for pageURL, creating it if it
+isn't there yet. It isn't ok if the page isn't on one of the site's domains.
+Dry runs get 0 for the threads they would have created.
+*/
+func (im *importer) thread(pageURL string) (uint, bool, error) {
+	if id, ok := im.threads[pageURL]; ok {
+		return id, !im.mismatched[pageURL], nil
+	}
+
+	u, err := threadURL(im.site, pageURL)
+	if err != nil {
+		im.mismatched[pageURL] = true
+		im.threads[pageURL] = 0
+		return 0, false, nil
+	}
+
+	thread := Thread{}
+	if im.h.db.Where("site_id = ? AND url = ?", im.site.ID, u).First(&thread).RecordNotFound() {
+		thread = Thread{SiteID: im.site.ID, URL: u}
+		if !im.dryRun {
+			if err := im.h.db.Create(&thread).Error; err != nil {
+				return 0, false, err
+			}
+		}
+		im.report.Threads++
+	}
+
+	im.threads[pageURL] = thread.ID
+	return thread.ID, true, nil
+}
+
+// parent returns the ID of the comment that was imported as importID. Dry runs get 0 for the comments they would have created.
+func (im *importer) parent(importID string) (uint, bool) {
+	if importID == "" {
+		return 0, false
+	}
+	if im.planned[importID] {
+		return 0, true
+	}
+
+	parent := Comment{}
+	if im.h.db.Where("site_id = ? AND import_id = ?", im.site.ID, importID).First(&parent).RecordNotFound() {
+		return 0, false
+	}
+	return parent.ID, true
+}
+
+// commenter returns the ID of the commenter who wrote ic, creating them the first time they come up.
+func (im *importer) commenter(ic importedComment) (uint, error) {
+	key := ic.AuthorIssuer + "|" + ic.AuthorSubject
+	if id, ok := im.commenters[key]; ok {
+		return id, nil
+	}
+
+	commenter, err := im.h.identifiedCommenter(KindImported, ic.AuthorIssuer, ic.AuthorSubject, Commenter{Name: ic.AuthorName, Email: ic.AuthorEmail})
+	if err != nil {
+		return 0, err
+	}
+
+	im.commenters[key] = commenter.ID
+	return commenter.ID, nil
+}
+
+// finish links the replies that came before their parents, and returns the report.
+func (im *importer) finish() (ImportReport, error) {
+	for _, o := range im.orphans {
+		parentID, found := im.parent(o.parentID)
+		if !found {
+			im.report.Orphans++
+			continue
+		}
+		if im.dryRun {
+			continue
+		}
+
+		if err := im.h.db.Model(&Comment{}).Where("id = ?", o.commentID).UpdateColumn("parent_id", parentID).Error; err != nil {
+			return im.report, err
+		}
+	}
+
+	im.report.Mismatched = make([]string, 0, len(im.mismatched))
+	for u := range im.mismatched {
+		// Comments that didn't say which page they're on aren't a page to list.
+		if u != "" {
+			im.report.Mismatched = append(im.report.Mismatched, u)
+		}
+	}
+	sort.Strings(im.report.Mismatched)
+
+	return im.report, nil
+}
+
+/*
+disqus imports the posts of a Disqus export onto the threads of the pages
+they were left on. Spam stays spam, deleted posts are kept as rejected, and
+everything else is approved.
+*/
+func (im *importer) disqus(r io.Reader) error {
+	links := map[string]string{}
+	reader := disqus.NewReader(r)
+
+	for {
+		element, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading the export: %v", err)
+		}
+
+		switch e := element.(type) {
+		case disqus.Thread:
+			links[e.ID] = e.Link
+
+		case disqus.Post:
+			ic := importedComment{
+				ID:         issuerDisqus + ":" + e.ID,
+				PageURL:    links[e.Thread.ID],
+				Body:       markdown.FromHTML(e.Message),
+				Status:     StatusApproved,
+				CreatedAt:  e.CreatedAt,
+				IP:         e.IPAddress,
+				AuthorName: e.Author.Name,
+			}
+			if e.Parent.ID != "" {
+				ic.ParentID = issuerDisqus + ":" + e.Parent.ID
+			}
+			if e.Spam {
+				ic.Status = StatusSpam
+			} else if e.Deleted {
+				ic.Status = StatusRejected
+			}
+			if !e.Author.Anonymous && e.Author.Username != "" {
+				ic.AuthorIssuer, ic.AuthorSubject, ic.AuthorEmail = issuerDisqus, e.Author.Username, e.Author.Email
+			}
+
+			if err := im.add(ic); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// wordPressStatuses maps the approval states of WordPress comments to comment statuses.
+var wordPressStatuses = map[string]string{
+	"1":    StatusApproved,
+	"0":    StatusPending,
+	"spam": StatusSpam,
+}
+
+/*
+wordPress imports the comments of a WordPress export onto the threads of
+the posts' permalinks. Approved, waiting and spam comments keep their status,
+and trashed ones are kept as rejected. Pingbacks and trackbacks are ignored.
+*/
+func (im *importer) wordPress(r io.Reader) error {
+	reader := wxr.NewReader(r)
+
+	for {
+		item, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading the export: %v", err)
+		}
+
+		for _, wc := range item.Comments {
+			if wc.Type == "pingback" || wc.Type == "trackback" {
+				im.report.Ignored++
+				continue
+			}
+
+			created, err := wc.Time()
+			if err != nil {
+				return fmt.Errorf("comment %s: %v", wc.ID, err)
+			}
+
+			status, ok := wordPressStatuses[wc.Approved]
+			if !ok {
+				status = StatusRejected
+			}
+
+			ic := importedComment{
+				ID:            issuerWordPress + ":" + wc.ID,
+				PageURL:       strings.TrimSpace(item.Link),
+				Body:          markdown.FromHTML(wc.HTML()),
+				Status:        status,
+				CreatedAt:     created,
+				IP:            wc.AuthorIP,
+				AuthorName:    wc.Author,
+				AuthorWebsite: wc.AuthorURL,
+			}
+			if wc.Parent != "" && wc.Parent != "0" {
+				ic.ParentID = issuerWordPress + ":" + wc.Parent
+			}
+			if wc.UserID != "" && wc.UserID != "0" {
+				ic.AuthorIssuer, ic.AuthorSubject, ic.AuthorEmail = issuerWordPress, wc.UserID, wc.AuthorEmail
+			}
+
+			if err := im.add(ic); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// importers are the formats exports can be imported from, by the name the admin page and the command use.
+var importers = map[string]func(im *importer, r io.Reader) error{
+	"disqus":    (*importer).disqus,
+	"wordpress": (*importer).wordPress,
+}
+
+/*
+runImport imports the export in r into the site, or only reports what it
+would do for a dry run. Replies are linked to their parents even if the
+export turns out to be broken halfway, so what was imported stays nested.
+*/
+func (h *Handlers) runImport(site Site, format string, r io.Reader, dryRun bool) (ImportReport, error) {
+	im := h.newImporter(site, dryRun)
+
+	err := importers[format](im, r)
+
+	report, finishErr := im.finish()
+	if err == nil {
+		err = finishErr
+	}
+	return report, err
+}
+
+/*
+ImportCommand runs "import [-dry-run] <format> <site id> <file>", which
+imports an export file into a site without going through the admin page.
+It returns the exit code for the process.
+*/
+func (h *Handlers) ImportCommand(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only report what would be imported")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	args = flags.Args()
+	if len(args) != 3 || importers[args[0]] == nil {
+		fmt.Println("Usage: import [-dry-run] disqus|wordpress <site id> <file>")
+		return 2
+	}
+
+	site := Site{}
+	if h.db.Where("id = ?", args[1]).First(&site).RecordNotFound() {
+		fmt.Printf("There is no site with the ID %s\n", args[1])
+		return 1
+	}
+
+	f, err := os.Open(args[2])
+	if err != nil {
+		fmt.Printf("Opening the export failed: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+
+	report, err := h.runImport(site, args[0], f, *dryRun)
+	printImportReport(os.Stdout, report)
+	if err != nil {
+		fmt.Printf("Import stopped: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// printImportReport writes report for the import command.
+func printImportReport(w io.Writer, report ImportReport) {
+	created := "created"
+	if report.DryRun {
+		fmt.Fprintln(w, "Dry run, nothing was saved.")
+		created = "to create"
+	}
+	fmt.Fprintf(w, "Threads %s: %d\n", created, report.Threads)
+	fmt.Fprintf(w, "Comments %s: %d\n", created, report.Comments)
+	fmt.Fprintf(w, "Comments imported before: %d\n", report.Existing)
+	fmt.Fprintf(w, "Pingbacks and trackbacks ignored: %d\n", report.Ignored)
+	fmt.Fprintf(w, "Replies without their parent: %d\n", report.Orphans)
+	fmt.Fprintf(w, "Comments on pages not on the site's domains: %d\n", report.Skipped)
+	for _, u := range report.Mismatched {
+		fmt.Fprintf(w, "  %s\n", u)
+	}
+}
+
+// AdminImport handles GET /admin/sites/:id/import with the form to upload an export.
+func (h *Handlers) AdminImport(c echo.Context) error {
+	site, ok := h.siteFor(c, RoleAdmin)
+	if !ok {
+		return c.String(http.StatusNotFound, "No such site")
+	}
+
+	return h.renderImport(c, http.StatusOK, site, nil, "")
+}
+
+/*
+AdminImportPost handles POST /admin/sites/:id/import to import an uploaded
+export into the site, or only report what would be imported if dry_run is
+set. The upload is read as it's imported, so big exports never have to fit
+in memory.
+*/
+func (h *Handlers) AdminImportPost(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	site, ok := h.siteFor(c, RoleAdmin)
+	if !ok {
+		return c.String(http.StatusNotFound, "No such site")
+	}
+
+	format := c.FormValue("format")
+	if importers[format] == nil {
+		return h.renderImport(c, http.StatusBadRequest, site, nil, "Choose what the export is from.")
+	}
+
+	upload, err := c.FormFile("file")
+	if err != nil {
+		return h.renderImport(c, http.StatusBadRequest, site, nil, "Choose the export file to upload.")
+	}
+
+	f, err := upload.Open()
+	if err != nil {
+		return h.renderImport(c, http.StatusBadRequest, site, nil, "The upload could not be read.")
+	}
+	defer f.Close()
+
+	dryRun := c.FormValue("dry_run") != ""
+
+	report, err := h.runImport(site, format, f, dryRun)
+
+	if !dryRun {
+		h.audit(c, user.ID, auditSiteImport, fmt.Sprintf("site %d, %s export %s: %d comments, %d threads", site.ID, format, upload.Filename, report.Comments, report.Threads))
+	}
+
+	if err != nil {
+		h.logger(c).Warn("import failed", "site", site.ID, "format", format, "error", err)
+		return h.renderImport(c, http.StatusBadRequest, site, &report, "The import stopped: "+err.Error())
+	}
+
+	return h.renderImport(c, http.StatusOK, site, &report, "")
+}
+
+// renderImport renders the import page, with the report of the import that just ran, if there was one.
+func (h *Handlers) renderImport(c echo.Context, code int, site Site, report *ImportReport, message string) error {
+	formats := make([]string, 0, len(importers))
+	for name := range importers {
+		formats = append(formats, name)
+	}
+	sort.Strings(formats)
+
+	return c.Render(code, "adminimport", struct {
+		Csrf    interface{}
+		Site    Site
+		Formats []string
+		Report  *ImportReport
+		Error   string
+	}{
+		Csrf:    c.Get("csrf"),
+		Site:    site,
+		Formats: formats,
+		Report:  report,
+		Error:   message,
+	})
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	mocket "github.com/selvatico/go-mocket"
+	"github.com/stretchr/testify/assert"
+)
+
+const disqusExport = `<?xml version="1.0" encoding="utf-8"?>
+<disqus xmlns="http://disqus.com" xmlns:dsq="http://disqus.com/disqus-internals">
+  <category dsq:id="1"><forum>blog</forum><title>General</title><isDefault>true</isDefault></category>
+  <thread dsq:id="21"><link>https://example.com/post#comments</link><title>A post</title><createdAt>2014-03-01T10:00:00Z</createdAt></thread>
+  <thread dsq:id="22"><link>https://elsewhere.com/post</link><title>Another post</title><createdAt>2014-03-01T10:00:00Z</createdAt></thread>
+  <post dsq:id="31">
+    <message><![CDATA[<p>First <b>post</b></p>]]></message>
+    <createdAt>2014-03-01T11:00:00Z</createdAt>
+    <isDeleted>false</isDeleted><isSpam>false</isSpam>
+    <author><email>jane@example.com</email><name>Jane</name><isAnonymous>false</isAnonymous><username>jane</username></author>
+    <thread dsq:id="21" />
+  </post>
+  <post dsq:id="32">
+    <message><![CDATA[<p>A reply</p>]]></message>
+    <createdAt>2014-03-01T12:00:00Z</createdAt>
+    <isDeleted>false</isDeleted><isSpam>true</isSpam>
+    <author><name>Guest</name><isAnonymous>true</isAnonymous></author>
+    <thread dsq:id="21" />
+    <parent dsq:id="31" />
+  </post>
+  <post dsq:id="33">
+    <message><![CDATA[<p>Gone</p>]]></message>
+    <createdAt>2014-03-01T13:00:00Z</createdAt>
+    <isDeleted>true</isDeleted><isSpam>false</isSpam>
+    <author><name>Guest</name><isAnonymous>true</isAnonymous></author>
+    <thread dsq:id="21" />
+    <parent dsq:id="99" />
+  </post>
+  <post dsq:id="34">
+    <message><![CDATA[<p>Elsewhere</p>]]></message>
+    <createdAt>2014-03-01T13:00:00Z</createdAt>
+    <isDeleted>false</isDeleted><isSpam>false</isSpam>
+    <author><name>Guest</name><isAnonymous>true</isAnonymous></author>
+    <thread dsq:id="22" />
+  </post>
+</disqus>`
+
+// insertedValues returns the values of an INSERT by their column names.
+func insertedValues(query string, args []driver.NamedValue) map[string]driver.Value {
+	start := strings.Index(query, "(")
+	end := strings.Index(query, ")")
+	values := map[string]driver.Value{}
+	for i, column := range strings.Split(query[start+1:end], ",") {
+		values[strings.Trim(strings.TrimSpace(column), `"`)] = args[i].Value
+	}
+	return values
+}
+
+func TestImportDisqus(t *testing.T) {
+	mocket.Catcher.Reset()
+	defer mocket.Catcher.Reset()
+
+	var threads []map[string]driver.Value
+	var comments []map[string]driver.Value
+	var identities []map[string]driver.Value
+
+	mocket.Catcher.NewMock().WithQuery(`INSERT INTO "threads"`).WithID(4).WithCallback(func(query string, args []driver.NamedValue) {
+		threads = append(threads, insertedValues(query, args))
+	})
+	mocket.Catcher.NewMock().WithQuery(`INSERT INTO "commenters"`).WithID(6)
+	mocket.Catcher.NewMock().WithQuery(`INSERT INTO "commenter_identities"`).WithCallback(func(query string, args []driver.NamedValue) {
+		identities = append(identities, insertedValues(query, args))
+	})
+	mocket.Catcher.NewMock().WithQuery(`INSERT INTO "comments"`).WithID(10).WithCallback(func(query string, args []driver.NamedValue) {
+		comments = append(comments, insertedValues(query, args))
+	})
+	// The first post isn't there when it's imported, and is when its reply looks for it.
+	mocket.Catcher.NewMock().WithQuery(`FROM "comments"`).WithArgs(int64(mockSite.ID), "disqus:31").OneTime()
+	mocket.Catcher.NewMock().WithQuery(`FROM "comments"`).WithArgs(int64(mockSite.ID), "disqus:31").WithReply([]map[string]interface{}{{"id": 10}})
+
+	report, err := h.runImport(mockSite, "disqus", strings.NewReader(disqusExport), false)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, ImportReport{Threads: 1, Comments: 3, Skipped: 1, Orphans: 1, Mismatched: []string{"https://elsewhere.com/post"}}, report)
+
+	if assert.Len(t, threads, 1) {
+		assert.Equal(t, "https://example.com/post", threads[0]["url"])
+	}
+
+	if assert.Len(t, identities, 1) {
+		assert.Equal(t, "disqus", identities[0]["issuer"])
+		assert.Equal(t, "jane", identities[0]["subject"])
+	}
+
+	if !assert.Len(t, comments, 3) {
+		return
+	}
+
+	assert.Equal(t, "First **post**", comments[0]["body"])
+	assert.Equal(t, "<p>First <strong>post</strong></p>\n", comments[0]["body_html"])
+	assert.Equal(t, StatusApproved, comments[0]["status"])
+	assert.Equal(t, "disqus:31", comments[0]["import_id"])
+	assert.EqualValues(t, 6, comments[0]["commenter_id"])
+	assert.Equal(t, time.Date(2014, 3, 1, 11, 0, 0, 0, time.UTC), comments[0]["created_at"])
+	assert.Nil(t, comments[0]["parent_id"])
+
+	assert.Equal(t, StatusSpam, comments[1]["status"])
+	assert.EqualValues(t, 10, comments[1]["parent_id"])
+	assert.Nil(t, comments[1]["commenter_id"])
+
+	assert.Equal(t, StatusRejected, comments[2]["status"])
+	assert.Nil(t, comments[2]["parent_id"])
+}
+
+func TestImportDisqusAgain(t *testing.T) {
+	mocket.Catcher.Reset()
+	defer mocket.Catcher.Reset()
+
+	inserts := 0
+	mocket.Catcher.NewMock().WithQuery(`INSERT INTO`).WithCallback(func(string, []driver.NamedValue) {
+		inserts++
+	})
+	mocket.Catcher.NewMock().WithQuery(`FROM "comments"`).WithReply([]map[string]interface{}{{"id": 10}})
+
+	report, err := h.runImport(mockSite, "disqus", strings.NewReader(disqusExport), false)
+	if assert.NoError(t, err) {
+		assert.Equal(t, ImportReport{Existing: 4, Mismatched: []string{}}, report)
+		assert.Zero(t, inserts)
+	}
+}
+
+func TestImportDisqusBrokenExport(t *testing.T) {
+	mocket.Catcher.Reset()
+	defer mocket.Catcher.Reset()
+
+	_, err := h.runImport(mockSite, "disqus", strings.NewReader(`<disqus><post dsq:id="1"><createdAt>soon</createdAt></post>`), false)
+	assert.Error(t, err)
+}
+
+func TestAdminImportPost(t *testing.T) {
+	pairs := []struct {
+		Format       string
+		File         string
+		ExpectedCode int
+		Expected     string
+	}{
+		{"", disqusExport, http.StatusBadRequest, "Choose what the export is from."},
+		{"disqus", "", http.StatusBadRequest, "Choose the export file to upload."},
+		{"disqus", "<disqus><post>", http.StatusBadRequest, "The import stopped"},
+		{"disqus", disqusExport, http.StatusOK, "https://elsewhere.com/post"},
+	}
+
+	for _, p := range pairs {
+		mocket.Catcher.Reset().NewMock().WithQuery(`FROM "sites"`).WithReply([]map[string]interface{}{{"id": 3, "user_id": 7, "domains": mockSite.Domains}})
+		mocket.Catcher.NewMock().WithQuery(`INSERT INTO "threads"`).WithID(4)
+
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField("format", p.Format)
+		if p.File != "" {
+			w, _ := form.CreateFormFile("file", "export.xml")
+			w.Write([]byte(p.File))
+		}
+		form.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/admin/sites/3/import", &body)
+		req.Header.Set(echo.HeaderContentType, form.FormDataContentType())
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("model.user", User{Model: mockSite.Model, Email: "owner@example.com"})
+		c.SetParamNames("id")
+		c.SetParamValues("3")
+
+		if assert.NoError(t, h.AdminImportPost(c)) {
+			assert.Equal(t, p.ExpectedCode, rec.Code, p.Expected)
+			assert.Contains(t, rec.Body.String(), p.Expected)
+		}
+	}
+
+	mocket.Catcher.Reset()
+}
+
+const wordPressExport = `<?xml version="1.0" encoding="UTF-8" ?>
+<rss version="2.0" xmlns:wp="http://wordpress.org/export/1.2/">
+<channel>
+	<item>
+		<title>Hello</title>
+		<link>https://example.com/2014/03/hello/</link>
+		<wp:comment>
+			<wp:comment_id>5</wp:comment_id>
+			<wp:comment_author>Jane</wp:comment_author>
+			<wp:comment_author_email>jane@example.com</wp:comment_author_email>
+			<wp:comment_author_url>https://jane.example.com</wp:comment_author_url>
+			<wp:comment_date_gmt>2014-03-01 11:00:00</wp:comment_date_gmt>
+			<wp:comment_content><![CDATA[Nice <em>post</em>
+thanks]]></wp:comment_content>
+			<wp:comment_approved>1</wp:comment_approved>
+			<wp:comment_parent>0</wp:comment_parent>
+			<wp:comment_user_id>3</wp:comment_user_id>
+		</wp:comment>
+		<wp:comment>
+			<wp:comment_id>6</wp:comment_id>
+			<wp:comment_author>Guest</wp:comment_author>
+			<wp:comment_date_gmt>2014-03-01 12:00:00</wp:comment_date_gmt>
+			<wp:comment_content>Waiting</wp:comment_content>
+			<wp:comment_approved>0</wp:comment_approved>
+			<wp:comment_parent>5</wp:comment_parent>
+			<wp:comment_user_id>0</wp:comment_user_id>
+		</wp:comment>
+		<wp:comment>
+			<wp:comment_id>7</wp:comment_id>
+			<wp:comment_date_gmt>2014-03-01 13:00:00</wp:comment_date_gmt>
+			<wp:comment_content>Binned</wp:comment_content>
+			<wp:comment_approved>trash</wp:comment_approved>
+			<wp:comment_parent>0</wp:comment_parent>
+		</wp:comment>
+		<wp:comment>
+			<wp:comment_id>8</wp:comment_id>
+			<wp:comment_date_gmt>2014-03-01 14:00:00</wp:comment_date_gmt>
+			<wp:comment_content>Linked from elsewhere</wp:comment_content>
+			<wp:comment_approved>1</wp:comment_approved>
+			<wp:comment_type>pingback</wp:comment_type>
+		</wp:comment>
+	</item>
+	<item>
+		<title>Moved</title>
+		<link>https://old.example.net/moved/</link>
+		<wp:comment>
+			<wp:comment_id>9</wp:comment_id>
+			<wp:comment_date_gmt>2014-03-01 15:00:00</wp:comment_date_gmt>
+			<wp:comment_content>Lost</wp:comment_content>
+			<wp:comment_approved>1</wp:comment_approved>
+		</wp:comment>
+	</item>
+</channel>
+</rss>`
+
+func TestImportWordPress(t *testing.T) {
+	mocket.Catcher.Reset()
+	defer mocket.Catcher.Reset()
+
+	var comments []map[string]driver.Value
+	var identities []map[string]driver.Value
+
+	mocket.Catcher.NewMock().WithQuery(`INSERT INTO "threads"`).WithID(4)
+	mocket.Catcher.NewMock().WithQuery(`INSERT INTO "commenters"`).WithID(6)
+	mocket.Catcher.NewMock().WithQuery(`INSERT INTO "commenter_identities"`).WithCallback(func(query string, args []driver.NamedValue) {
+		identities = append(identities, insertedValues(query, args))
+	})
+	mocket.Catcher.NewMock().WithQuery(`INSERT INTO "comments"`).WithID(10).WithCallback(func(query string, args []driver.NamedValue) {
+		comments = append(comments, insertedValues(query, args))
+	})
+	mocket.Catcher.NewMock().WithQuery(`FROM "comments"`).WithArgs(int64(mockSite.ID), "wordpress:5").OneTime()
+	mocket.Catcher.NewMock().WithQuery(`FROM "comments"`).WithArgs(int64(mockSite.ID), "wordpress:5").WithReply([]map[string]interface{}{{"id": 10}})
+
+	report, err := h.runImport(mockSite, "wordpress", strings.NewReader(wordPressExport), false)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, ImportReport{Threads: 1, Comments: 3, Ignored: 1, Skipped: 1, Mismatched: []string{"https://old.example.net/moved/"}}, report)
+
+	if assert.Len(t, identities, 1) {
+		assert.Equal(t, "wordpress", identities[0]["issuer"])
+		assert.Equal(t, "3", identities[0]["subject"])
+	}
+
+	if !assert.Len(t, comments, 3) {
+		return
+	}
+
+	assert.Equal(t, "Nice *post*\nthanks", comments[0]["body"])
+	assert.Equal(t, StatusApproved, comments[0]["status"])
+	assert.Equal(t, "https://jane.example.com", comments[0]["author_website"])
+	assert.Equal(t, "wordpress:5", comments[0]["import_id"])
+	assert.Equal(t, time.Date(2014, 3, 1, 11, 0, 0, 0, time.UTC), comments[0]["created_at"])
+
+	assert.Equal(t, StatusPending, comments[1]["status"])
+	assert.EqualValues(t, 10, comments[1]["parent_id"])
+
+	assert.Equal(t, StatusRejected, comments[2]["status"])
+}
+
+func TestImportWordPressDryRun(t *testing.T) {
+	mocket.Catcher.Reset()
+	defer mocket.Catcher.Reset()
+
+	writes := 0
+	mocket.Catcher.NewMock().WithQuery(`INSERT INTO`).WithCallback(func(string, []driver.NamedValue) {
+		writes++
+	})
+	mocket.Catcher.NewMock().WithQuery(`UPDATE`).WithCallback(func(string, []driver.NamedValue) {
+		writes++
+	})
+
+	report, err := h.runImport(mockSite, "wordpress", strings.NewReader(wordPressExport), true)
+	if assert.NoError(t, err) {
+		assert.Equal(t, ImportReport{DryRun: true, Threads: 1, Comments: 3, Ignored: 1, Skipped: 1, Mismatched: []string{"https://old.example.net/moved/"}}, report)
+		assert.Zero(t, writes)
+	}
+}
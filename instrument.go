@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/javorszky/go-comments/metrics"
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+)
+
+// registry holds every metric the app exposes on /metrics.
+var registry = metrics.NewRegistry()
+
+var (
+	httpRequestDuration = registry.Histogram(
+		"gocomments_http_request_duration_seconds",
+		"Time taken to answer HTTP requests, by method, route and status code.",
+		nil, "method", "route", "status")
+
+	dbQueryDuration = registry.Histogram(
+		"gocomments_db_query_duration_seconds",
+		"Time taken by database queries, by operation and table.",
+		nil, "operation", "table")
+
+	loginsTotal = registry.Counter(
+		"gocomments_logins_total",
+		"Login attempts, by result.",
+		"result")
+
+	passwordHashDuration = registry.Histogram(
+		"gocomments_password_hash_duration_seconds",
+		"Time taken to hash passwords and compare them to hashes.",
+		[]float64{.01, .025, .05, .1, .25, .5, 1, 2.5}, "operation")
+
+	commentsTotal = registry.Counter(
+		"gocomments_comments_total",
+		"Comments posted, approved and rejected, by site.",
+		"site", "action")
+
+	embedRequestsTotal = registry.Counter(
+		"gocomments_embed_requests_total",
+		"Requests for the embed script, by site.",
+		"site")
+)
+
+/*
+MetricsMiddleware records how long each request took. Requests are grouped
+by their route pattern rather than the actual path, so /admin/sessions/delete/:id
+is one series no matter how many sessions get deleted.
+*/
+func MetricsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+
+		status := c.Response().Status
+		if err != nil {
+			status = http.StatusInternalServerError
+			if he, ok := err.(*echo.HTTPError); ok {
+				status = he.Code
+			}
+		}
+
+		route := c.Path()
+		if route == "" {
+			route = "unmatched"
+		}
+
+		httpRequestDuration.Observe(time.Since(start).Seconds(), c.Request().Method, route, strconv.Itoa(status))
+
+		return err
+	}
+}
+
+// MetricsHandler serves the metrics. If token is not empty, requests have to
+// send it as a bearer token.
+func MetricsHandler(token string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if token != "" && c.Request().Header.Get(echo.HeaderAuthorization) != "Bearer "+token {
+			return c.JSON(http.StatusUnauthorized, ResponseError{"Missing or wrong metrics token."})
+		}
+
+		registry.ServeHTTP(c.Response(), c.Request())
+		return nil
+	}
+}
+
+/*
+InstrumentDB times every query made through db, and adds a gauge for the
+number of active sessions. Session cookies are valid for 24 hours, so that's
+what counts as active.
+*/
+func InstrumentDB(db *gorm.DB) {
+	callbacks := db.Callback()
+
+	callbacks.Create().Before("gorm:begin_transaction").Register("metrics:start_create", startQueryTimer)
+	callbacks.Create().After("gorm:commit_or_rollback_transaction").Register("metrics:observe_create", observeQuery("create"))
+	callbacks.Update().Before("gorm:begin_transaction").Register("metrics:start_update", startQueryTimer)
+	callbacks.Update().After("gorm:commit_or_rollback_transaction").Register("metrics:observe_update", observeQuery("update"))
+	callbacks.Delete().Before("gorm:begin_transaction").Register("metrics:start_delete", startQueryTimer)
+	callbacks.Delete().After("gorm:commit_or_rollback_transaction").Register("metrics:observe_delete", observeQuery("delete"))
+	callbacks.Query().Before("gorm:query").Register("metrics:start_query", startQueryTimer)
+	callbacks.Query().After("gorm:after_query").Register("metrics:observe_query", observeQuery("query"))
+	callbacks.RowQuery().Before("gorm:row_query").Register("metrics:start_row_query", startQueryTimer)
+	callbacks.RowQuery().After("gorm:row_query").Register("metrics:observe_row_query", observeQuery("row_query"))
+
+	registry.GaugeFunc("gocomments_active_sessions", "Sessions created in the last 24 hours.", func() float64 {
+		var count int
+		db.Model(&Session{}).Where("created_at > ?", time.Now().Add(-24*time.Hour)).Count(&count)
+		return float64(count)
+	})
+}
+
+func startQueryTimer(scope *gorm.Scope) {
+	scope.Set("metrics:start", time.Now())
+}
+
+func observeQuery(operation string) func(scope *gorm.Scope) {
+	return func(scope *gorm.Scope) {
+		start, ok := scope.Get("metrics:start")
+		if !ok {
+			return
+		}
+		dbQueryDuration.Observe(time.Since(start.(time.Time)).Seconds(), operation, scope.TableName())
+	}
+}
+
+// InstrumentedHasher times the password hasher it wraps.
+type InstrumentedHasher struct {
+	PasswordHasher
+}
+
+// GenerateFromPassword hashes password with the wrapped hasher.
+func (i InstrumentedHasher) GenerateFromPassword(password string) (string, error) {
+	start := time.Now()
+	defer func() {
+		passwordHashDuration.Observe(time.Since(start).Seconds(), "generate")
+	}()
+
+	return i.PasswordHasher.GenerateFromPassword(password)
+}
+
+// ComparePasswordAndHash compares password and hash with the wrapped hasher.
+func (i InstrumentedHasher) ComparePasswordAndHash(password string, hash string) (bool, error) {
+	start := time.Now()
+	defer func() {
+		passwordHashDuration.Observe(time.Since(start).Seconds(), "compare")
+	}()
+
+	return i.PasswordHasher.ComparePasswordAndHash(password, hash)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+/*
+NewLogger returns a logger that writes JSON lines to stdout. Level is one of
+debug, info, warn or error; anything else means info.
+*/
+func NewLogger(level string) *slog.Logger {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		l = slog.LevelInfo
+	}
+
+	return slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: l}))
+}
+
+/*
+LoggerMiddleware gives every request a logger that carries its request ID,
+and logs the request once it has been answered, with the client IP as
+clientIP sees it through the trusted proxies. It expects the request ID
+middleware to have run before it.
+*/
+func LoggerMiddleware(logger *slog.Logger, trusted []*net.IPNet) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			requestLogger := logger.With("request_id", c.Response().Header().Get(echo.HeaderXRequestID))
+			c.Set("logger", requestLogger)
+
+			err := next(c)
+			if err != nil {
+				c.Error(err)
+			}
+
+			level := slog.LevelInfo
+			if c.Response().Status >= 500 {
+				level = slog.LevelError
+			}
+
+			requestLogger.Log(c.Request().Context(), level, "request",
+				"method", c.Request().Method,
+				"path", c.Request().URL.Path,
+				"route", c.Path(),
+				"status", c.Response().Status,
+				"duration_ms", time.Since(start).Milliseconds(),
+				"ip", clientIP(c, trusted),
+				"error", errorString(err),
+			)
+
+			return nil
+		}
+	}
+}
+
+// logger returns the request's logger, or the handler's own one outside of requests.
+func (h *Handlers) logger(c echo.Context) *slog.Logger {
+	if c != nil {
+		if l, ok := c.Get("logger").(*slog.Logger); ok {
+			return l
+		}
+	}
+	return h.log
+}
+
+// GormLogger sends gorm's query log through a structured logger at debug level.
+type GormLogger struct {
+	Logger *slog.Logger
+}
+
+// Print implements gorm's logger interface.
+func (g GormLogger) Print(values ...interface{}) {
+	if len(values) > 3 && values[0] == "sql" {
+		g.Logger.Debug("query", "source", values[1], "duration", values[2], "sql", values[3])
+		return
+	}
+
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprint(v)
+	}
+	g.Logger.Debug(strings.Join(parts, " "))
+}
+
+// fatal logs err and exits, for errors the app can't start without recovering from.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
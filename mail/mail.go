@@ -0,0 +1,108 @@
+/*
+Package mail sends plain text email through a Mailer: an SMTP server, files
+in a directory, or the log. A Queue sends them in the background, so the
+requests that send email don't wait for the mail server.
+*/
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Message is a plain text email.
+type Message struct {
+	From    string
+	To      string
+	Subject string
+	Text    string
+	// Headers are extra headers, like List-Unsubscribe.
+	Headers map[string]string
+}
+
+// Mailer sends messages.
+type Mailer interface {
+	Send(ctx context.Context, m Message) error
+}
+
+/*
+Bytes returns the message the way it goes over the wire: headers, then the
+quoted-printable body, with CRLF line ends. Header values have their line
+breaks taken out, so they can't add headers of their own.
+*/
+func (m Message) Bytes(now time.Time) ([]byte, error) {
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return nil, fmt.Errorf("from address %q: %v", m.From, err)
+	}
+	to, err := mail.ParseAddress(m.To)
+	if err != nil {
+		return nil, fmt.Errorf("to address %q: %v", m.To, err)
+	}
+
+	domain := from.Address[strings.LastIndex(from.Address, "@")+1:]
+
+	headers := map[string]string{
+		"From":                      from.String(),
+		"To":                        to.String(),
+		"Subject":                   mime.QEncoding.Encode("utf-8", clean(m.Subject)),
+		"Date":                      now.Format(time.RFC1123Z),
+		"Message-ID":                fmt.Sprintf("<%s@%s>", random(), domain),
+		"MIME-Version":              "1.0",
+		"Content-Type":              "text/plain; charset=utf-8",
+		"Content-Transfer-Encoding": "quoted-printable",
+	}
+	for k, v := range m.Headers {
+		headers[k] = clean(v)
+	}
+
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s: %s\r\n", k, headers[k])
+	}
+	b.WriteString("\r\n")
+
+	w := quotedprintable.NewWriter(&b)
+	w.Write([]byte(strings.ReplaceAll(m.Text, "\n", "\r\n")))
+	w.Close()
+
+	return b.Bytes(), nil
+}
+
+// clean takes line breaks out of a header value.
+func clean(value string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+}
+
+// random returns a random hex string for message IDs and file names.
+func random() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("reading random bytes failed: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+// address returns the bare email address in an address like "Jane <jane@example.com>".
+func address(a string) (string, error) {
+	parsed, err := mail.ParseAddress(a)
+	if err != nil {
+		return "", err
+	}
+	return parsed.Address, nil
+}
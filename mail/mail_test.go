@@ -0,0 +1,181 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var discard = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func TestMessageBytes(t *testing.T) {
+	m := Message{
+		From:    "Comments <comments@example.com>",
+		To:      "jane@example.com",
+		Subject: "Válasz\r\nBcc: evil@example.com",
+		Text:    "Hello,\nsomeone replied.",
+		Headers: map[string]string{"List-Unsubscribe": "<https://example.com/u>\nX-Evil: 1"},
+	}
+
+	b, err := m.Bytes(time.Now())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	s := string(b)
+	assert.Contains(t, s, "From: \"Comments\" <comments@example.com>\r\n")
+	assert.Contains(t, s, "To: <jane@example.com>\r\n")
+	assert.Contains(t, s, "Subject: =?utf-8?q?")
+	assert.Contains(t, s, "List-Unsubscribe: <https://example.com/u> X-Evil: 1\r\n")
+	assert.NotContains(t, s, "\nBcc:")
+	assert.NotContains(t, s, "\nX-Evil:")
+	assert.Contains(t, s, "\r\n\r\nHello,\r\nsomeone replied.")
+
+	_, err = Message{From: "comments@example.com", To: "not an address"}.Bytes(time.Now())
+	assert.Error(t, err)
+}
+
+func TestFileDrop(t *testing.T) {
+	dir := t.TempDir()
+
+	err := FileDrop{dir}.Send(context.Background(), Message{From: "a@example.com", To: "b@example.com", Subject: "hi", Text: "hello"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if assert.Len(t, files, 1) {
+		b, _ := os.ReadFile(files[0])
+		assert.Contains(t, string(b), "Subject: hi")
+	}
+}
+
+// smtpServer accepts one message and keeps what it got.
+func smtpServer(t *testing.T) (string, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan string, 1)
+
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		reply := func(s string) { io.WriteString(conn, s+"\r\n") }
+		reply("220 test ESMTP")
+
+		var transcript strings.Builder
+		data := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			transcript.WriteString(line)
+
+			switch {
+			case data && line == ".\r\n":
+				data = false
+				reply("250 queued")
+			case data:
+			case strings.HasPrefix(line, "EHLO"):
+				reply("250 test")
+			case strings.HasPrefix(line, "DATA"):
+				data = true
+				reply("354 go on")
+			case strings.HasPrefix(line, "QUIT"):
+				reply("221 bye")
+				got <- transcript.String()
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+
+	return l.Addr().String(), got
+}
+
+func TestSMTP(t *testing.T) {
+	addr, got := smtpServer(t)
+
+	err := SMTP{Addr: addr}.Send(context.Background(), Message{From: "Comments <comments@example.com>", To: "jane@example.com", Subject: "hi", Text: "hello"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	transcript := <-got
+	assert.Contains(t, transcript, "MAIL FROM:<comments@example.com>")
+	assert.Contains(t, transcript, "RCPT TO:<jane@example.com>")
+	assert.Contains(t, transcript, "Subject: hi\r\n")
+}
+
+type flakyMailer struct {
+	mu    sync.Mutex
+	fails int
+	sent  []Message
+}
+
+func (f *flakyMailer) Send(ctx context.Context, m Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.fails > 0 {
+		f.fails--
+		return errors.New("try again")
+	}
+	f.sent = append(f.sent, m)
+	return nil
+}
+
+func TestQueue(t *testing.T) {
+	f := &flakyMailer{fails: 2}
+	q := NewQueue(f, 1, discard)
+	q.Backoff = time.Millisecond
+
+	assert.True(t, q.Enqueue(Message{To: "a@example.com"}))
+	assert.False(t, q.Enqueue(Message{To: "b@example.com"}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		q.Run(ctx)
+		close(done)
+	}()
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		f.mu.Lock()
+		sent := len(f.sent)
+		f.mu.Unlock()
+		if sent == 1 {
+			break
+		}
+	}
+
+	// What's left in the queue is sent when it stops.
+	q.Enqueue(Message{To: "c@example.com"})
+	cancel()
+	<-done
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	assert.Equal(t, "a@example.com", f.sent[0].To)
+	assert.Equal(t, "c@example.com", f.sent[len(f.sent)-1].To)
+}
@@ -0,0 +1,95 @@
+package mail
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+/*
+Queue sends messages in the background. Enqueue never blocks: when the queue
+is full the message is dropped and logged, so a slow mail server can't slow
+down the requests that send email.
+
+Messages that fail are tried again, up to Attempts times, waiting twice as
+long as the last time between tries.
+*/
+type Queue struct {
+	Mailer   Mailer
+	Logger   *slog.Logger
+	Attempts int
+	Backoff  time.Duration
+
+	messages chan Message
+}
+
+// NewQueue returns a queue that holds up to size messages for m.
+func NewQueue(m Mailer, size int, logger *slog.Logger) *Queue {
+	return &Queue{
+		Mailer:   m,
+		Logger:   logger,
+		Attempts: 3,
+		Backoff:  time.Second,
+		messages: make(chan Message, size),
+	}
+}
+
+// Enqueue adds m to the queue, and tells whether there was room for it.
+func (q *Queue) Enqueue(m Message) bool {
+	select {
+	case q.messages <- m:
+		return true
+	default:
+		q.Logger.Error("Mail queue is full, dropping message", "to", m.To, "subject", m.Subject)
+		return false
+	}
+}
+
+/*
+Run sends messages until ctx is done. Whatever is still queued then is sent
+without retries, as long as the process waits for it.
+*/
+func (q *Queue) Run(ctx context.Context) {
+	for {
+		select {
+		case m := <-q.messages:
+			q.send(ctx, m, q.Attempts)
+		case <-ctx.Done():
+			for {
+				select {
+				case m := <-q.messages:
+					q.send(context.Background(), m, 1)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// send tries to send m up to attempts times.
+func (q *Queue) send(ctx context.Context, m Message, attempts int) {
+	wait := q.Backoff
+
+	for attempt := 1; ; attempt++ {
+		err := q.Mailer.Send(ctx, m)
+		if err == nil {
+			return
+		}
+
+		if attempt >= attempts {
+			q.Logger.Error("Sending email failed", "to", m.To, "subject", m.Subject, "attempts", attempt, "error", err)
+			return
+		}
+
+		q.Logger.Warn("Sending email failed, trying again", "to", m.To, "subject", m.Subject, "in", wait, "error", err)
+
+		select {
+		case <-time.After(wait):
+			wait *= 2
+		case <-ctx.Done():
+			q.Logger.Error("Sending email failed", "to", m.To, "subject", m.Subject, "attempts", attempt, "error", err)
+			return
+		}
+	}
+}
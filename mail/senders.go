@@ -0,0 +1,136 @@
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+SMTP sends messages through an SMTP server. The connection is upgraded with
+STARTTLS when the server offers it, and the username and password are only
+sent over TLS, or to localhost.
+*/
+type SMTP struct {
+	// Addr is the host:port of the server.
+	Addr     string
+	Username string
+	Password string
+	// Timeout is how long sending a message may take, 30 seconds if it's 0.
+	Timeout time.Duration
+}
+
+// Send sends m.
+func (s SMTP) Send(ctx context.Context, m Message) error {
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	body, err := m.Bytes(time.Now())
+	if err != nil {
+		return err
+	}
+	from, _ := address(m.From)
+	to, _ := address(m.To)
+
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return fmt.Errorf("smtp address %q: %v", s.Addr, err)
+	}
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+
+	if s.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// FileDrop writes every message to a file of its own in Dir, for trying
+// things out locally, or for another program to pick them up.
+type FileDrop struct {
+	Dir string
+}
+
+// Send writes m to a new .eml file.
+func (f FileDrop) Send(ctx context.Context, m Message) error {
+	now := time.Now()
+
+	body, err := m.Bytes(now)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(f.Dir, 0o700); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%s.eml", now.UTC().Format("20060102T150405"), random())
+	tmp := filepath.Join(f.Dir, "."+name)
+
+	// Other programs only ever see whole messages.
+	if err := os.WriteFile(tmp, body, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(f.Dir, name))
+}
+
+// Log logs messages instead of sending them. It's what runs when no mailer is set up.
+type Log struct {
+	Logger *slog.Logger
+}
+
+// Send logs m.
+func (l Log) Send(ctx context.Context, m Message) error {
+	l.Logger.Info("email", "to", m.To, "subject", m.Subject, "text", m.Text)
+	return nil
+}
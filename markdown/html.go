@@ -0,0 +1,170 @@
+package markdown
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var (
+	spaces     = regexp.MustCompile(`[ \t\r\n\f]+`)
+	blankLines = regexp.MustCompile(`\n{3,}`)
+)
+
+/*
+FromHTML turns HTML written for other comment systems into the Markdown this
+package renders: paragraphs, line breaks, links, emphasis, code, quotes and
+lists. Other tags are dropped, and only their text is kept. Links that
+aren't http, https or mailto lose their target.
+*/
+func FromHTML(src string) string {
+	body := &html.Node{Type: html.ElementNode, DataAtom: atom.Body, Data: "body"}
+
+	nodes, err := html.ParseFragment(strings.NewReader(src), body)
+	if err != nil {
+		return strings.TrimSpace(src)
+	}
+
+	var b strings.Builder
+	for _, n := range nodes {
+		convertNode(&b, n)
+	}
+	return tidy(b.String())
+}
+
+// convertNode writes the Markdown for n and everything in it.
+func convertNode(b *strings.Builder, n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		b.WriteString(spaces.ReplaceAllString(n.Data, " "))
+		return
+	case html.ElementNode:
+	default:
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Script, atom.Style, atom.Head, atom.Title:
+
+	case atom.Br:
+		b.WriteString("\n")
+
+	case atom.P, atom.Div, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		b.WriteString("\n\n" + convertChildren(n) + "\n\n")
+
+	case atom.Strong, atom.B:
+		b.WriteString(wrap(convertChildren(n), "**"))
+
+	case atom.Em, atom.I:
+		b.WriteString(wrap(convertChildren(n), "*"))
+
+	case atom.Code, atom.Tt:
+		b.WriteString(wrap(strings.Replace(textOf(n), "`", "'", -1), "`"))
+
+	case atom.Pre:
+		b.WriteString("\n\n```\n" + strings.Trim(textOf(n), "\n") + "\n```\n\n")
+
+	case atom.A:
+		text := strings.TrimSpace(convertChildren(n))
+		href := strings.TrimSpace(attr(n, "href"))
+		if text == "" {
+			text = href
+		}
+		if safeURL(href) && !strings.ContainsAny(text, "[]") && !strings.Contains(href, ")") {
+			b.WriteString("[" + text + "](" + href + ")")
+		} else {
+			b.WriteString(text)
+		}
+
+	case atom.Blockquote:
+		lines := strings.Split(tidy(convertChildren(n)), "\n")
+		for i, line := range lines {
+			lines[i] = strings.TrimSpace("> " + line)
+		}
+		b.WriteString("\n\n" + strings.Join(lines, "\n") + "\n\n")
+
+	case atom.Ul, atom.Ol:
+		b.WriteString("\n\n")
+		number := 0
+		for li := n.FirstChild; li != nil; li = li.NextSibling {
+			if li.Type != html.ElementNode || li.DataAtom != atom.Li {
+				continue
+			}
+			number++
+			marker := "- "
+			if n.DataAtom == atom.Ol {
+				marker = strconv.Itoa(number) + ". "
+			}
+			item := strings.Join(strings.Fields(tidy(convertChildren(li))), " ")
+			b.WriteString(marker + item + "\n")
+		}
+		b.WriteString("\n")
+
+	default:
+		b.WriteString(convertChildren(n))
+	}
+}
+
+// convertChildren returns the Markdown for everything in n.
+func convertChildren(n *html.Node) string {
+	var b strings.Builder
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		convertNode(&b, child)
+	}
+	return b.String()
+}
+
+// textOf returns the text in n, as it is.
+func textOf(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+
+	var b strings.Builder
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		b.WriteString(textOf(child))
+	}
+	return b.String()
+}
+
+// wrap puts delim around s, outside of the spaces at its ends, so it still reads as markup.
+func wrap(s, delim string) string {
+	trimmed := strings.TrimSpace(s)
+	if trimmed == "" {
+		return s
+	}
+
+	start := strings.Index(s, trimmed)
+	return s[:start] + delim + trimmed + delim + s[start+len(trimmed):]
+}
+
+// attr returns the value of the attribute key of n.
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+/*
+tidy trims the spaces around every line outside of code blocks, and leaves
+at most one blank line between blocks.
+*/
+func tidy(s string) string {
+	lines := strings.Split(s, "\n")
+	code := false
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			code = !code
+		} else if code {
+			continue
+		}
+		lines[i] = strings.TrimSpace(line)
+	}
+	return strings.TrimSpace(blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+}
@@ -0,0 +1,29 @@
+package markdown
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromHTML(t *testing.T) {
+	pairs := []struct {
+		Source   string
+		Expected string
+	}{
+		{"Hello", "Hello"},
+		{"<p>one<br>two</p><p>three</p>", "one\ntwo\n\nthree"},
+		{"<p>Some <b>bold</b> and <i>slanted </i>text</p>", "Some **bold** and *slanted* text"},
+		{`<a href="https://example.com/page" rel="nofollow">a page</a>`, "[a page](https://example.com/page)"},
+		{`<a href="javascript:alert(1)">click</a>`, "click"},
+		{"<blockquote><p>quoted</p><p>twice</p></blockquote><p>reply</p>", "> quoted\n>\n> twice\n\nreply"},
+		{"<ul><li>one</li><li><p>two</p></li></ul><ol><li>first</li></ol>", "- one\n- two\n\n1. first"},
+		{"<pre><code>if a &lt; b {\n    return\n}</code></pre>", "```\nif a < b {\n    return\n}\n```"},
+		{"use <code>go vet</code>", "use `go vet`"},
+		{"<script>alert(1)</script><p>text\n  with   spaces</p>", "text with spaces"},
+	}
+
+	for _, p := range pairs {
+		assert.Equal(t, p.Expected, FromHTML(p.Source), p.Source)
+	}
+}
@@ -0,0 +1,334 @@
+/*
+Package markdown turns the small subset of Markdown that comments may use
+into HTML that is safe to put on someone else's page.
+
+It never passes through any HTML from the source. Everything is escaped
+first, and the only tags in the output are the ones the renderer writes
+itself: p, br, em, strong, code, pre, blockquote, ul, ol, li and a. Links
+only ever get an href, which has to be an http, https or mailto URL, and a
+fixed rel attribute.
+*/
+package markdown
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Features is a set of Markdown features that are turned into HTML. Syntax
+// for features that aren't in the set is left as plain, escaped text.
+type Features uint8
+
+// The features that can be turned on.
+const (
+	Emphasis Features = 1 << iota
+	Links
+	Code
+	Quotes
+	Lists
+
+	None Features = 0
+	All           = Emphasis | Links | Code | Quotes | Lists
+)
+
+// LinkRel is the rel attribute every link gets.
+const LinkRel = "nofollow ugc noopener"
+
+// maxQuoteDepth stops quotes nested deeper than this from being parsed further.
+const maxQuoteDepth = 5
+
+var featureNames = []struct {
+	feature Features
+	name    string
+}{
+	{Emphasis, "emphasis"},
+	{Links, "links"},
+	{Code, "code"},
+	{Quotes, "quotes"},
+	{Lists, "lists"},
+}
+
+var (
+	unorderedItem = regexp.MustCompile(`^\s{0,3}[-*+]\s+(.*)$`)
+	orderedItem   = regexp.MustCompile(`^\s{0,3}\d{1,9}[.)]\s+(.*)$`)
+)
+
+// ParseFeatures reads a comma separated list of feature names, ignoring
+// the ones it doesn't know.
+func ParseFeatures(list string) Features {
+	var f Features
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		for _, fn := range featureNames {
+			if fn.name == name {
+				f |= fn.feature
+			}
+		}
+	}
+	return f
+}
+
+// String returns the comma separated names of the features in the set.
+func (f Features) String() string {
+	var names []string
+	for _, fn := range featureNames {
+		if f.Has(fn.feature) {
+			names = append(names, fn.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// Has tells whether every feature in other is in the set.
+func (f Features) Has(other Features) bool {
+	return f&other == other
+}
+
+// Names returns the names of every feature that exists, in a stable order.
+func Names() []string {
+	names := make([]string, len(featureNames))
+	for i, fn := range featureNames {
+		names[i] = fn.name
+	}
+	return names
+}
+
+// Render turns src into HTML using only the given features.
+func Render(src string, f Features) string {
+	src = strings.Replace(src, "\r\n", "\n", -1)
+	src = strings.Replace(src, "\r", "\n", -1)
+
+	var b strings.Builder
+	renderBlocks(&b, strings.Split(src, "\n"), f, 0)
+	return b.String()
+}
+
+// renderBlocks writes paragraphs, code blocks, quotes and lists.
+func renderBlocks(b *strings.Builder, lines []string, f Features, depth int) {
+	var paragraph []string
+
+	flush := func() {
+		if len(paragraph) == 0 {
+			return
+		}
+		b.WriteString("<p>")
+		for i, line := range paragraph {
+			if i > 0 {
+				b.WriteString("<br>\n")
+			}
+			b.WriteString(renderInline(strings.TrimSpace(line), f))
+		}
+		b.WriteString("</p>\n")
+		paragraph = nil
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case trimmed == "":
+			flush()
+
+		case f.Has(Code) && strings.HasPrefix(trimmed, "```"):
+			flush()
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+				code = append(code, lines[i])
+			}
+			b.WriteString("<pre><code>")
+			b.WriteString(html.EscapeString(strings.Join(code, "\n")))
+			b.WriteString("</code></pre>\n")
+
+		case f.Has(Quotes) && depth < maxQuoteDepth && strings.HasPrefix(trimmed, ">"):
+			flush()
+			var quoted []string
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				q := strings.TrimPrefix(strings.TrimSpace(lines[i]), ">")
+				quoted = append(quoted, strings.TrimPrefix(q, " "))
+			}
+			i--
+			b.WriteString("<blockquote>\n")
+			renderBlocks(b, quoted, f, depth+1)
+			b.WriteString("</blockquote>\n")
+
+		case f.Has(Lists) && (unorderedItem.MatchString(line) || orderedItem.MatchString(line)):
+			flush()
+			pattern, tag := unorderedItem, "ul"
+			if orderedItem.MatchString(line) {
+				pattern, tag = orderedItem, "ol"
+			}
+			b.WriteString("<" + tag + ">\n")
+			for ; i < len(lines) && pattern.MatchString(lines[i]); i++ {
+				b.WriteString("<li>")
+				b.WriteString(renderInline(strings.TrimSpace(pattern.FindStringSubmatch(lines[i])[1]), f))
+				b.WriteString("</li>\n")
+			}
+			i--
+			b.WriteString("</" + tag + ">\n")
+
+		default:
+			paragraph = append(paragraph, line)
+		}
+	}
+
+	flush()
+}
+
+// renderInline handles code spans, emphasis and links within a line.
+func renderInline(s string, f Features) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); {
+		rest := s[i:]
+
+		if f.Has(Code) && rest[0] == '`' {
+			if end := strings.IndexByte(rest[1:], '`'); end > 0 {
+				b.WriteString("<code>" + html.EscapeString(rest[1:end+1]) + "</code>")
+				i += end + 2
+				continue
+			}
+		}
+
+		if f.Has(Links) && rest[0] == '[' {
+			if text, href, n, ok := parseLink(rest); ok {
+				b.WriteString(anchor(href, renderInline(text, f&^Links)))
+				i += n
+				continue
+			}
+		}
+
+		if f.Has(Links) && wordStart(s, i) && (strings.HasPrefix(rest, "http://") || strings.HasPrefix(rest, "https://")) {
+			if href := bareURL(rest); safeURL(href) {
+				b.WriteString(anchor(href, html.EscapeString(href)))
+				i += len(href)
+				continue
+			}
+		}
+
+		if f.Has(Emphasis) {
+			if inner, n, ok := delimited(s, i, "**"); ok {
+				b.WriteString("<strong>" + renderInline(inner, f) + "</strong>")
+				i += n
+				continue
+			}
+			if inner, n, ok := delimited(s, i, "__"); ok {
+				b.WriteString("<strong>" + renderInline(inner, f) + "</strong>")
+				i += n
+				continue
+			}
+			if inner, n, ok := delimited(s, i, "*"); ok {
+				b.WriteString("<em>" + renderInline(inner, f) + "</em>")
+				i += n
+				continue
+			}
+			if inner, n, ok := delimited(s, i, "_"); ok {
+				b.WriteString("<em>" + renderInline(inner, f) + "</em>")
+				i += n
+				continue
+			}
+		}
+
+		// Copy everything up to the next character that could start markup.
+		next := len(rest)
+		if j := strings.IndexAny(rest[1:], "`[*_hH"); j >= 0 {
+			next = j + 1
+		}
+		b.WriteString(html.EscapeString(rest[:next]))
+		i += next
+	}
+
+	return b.String()
+}
+
+/*
+delimited checks whether s has text wrapped in delim starting at i, like
+*this*. The text can't start or end with a space, and underscores only count
+at word boundaries, so snake_case_names stay as they are.
+*/
+func delimited(s string, i int, delim string) (inner string, n int, ok bool) {
+	rest := s[i:]
+	if !strings.HasPrefix(rest, delim) || len(rest) <= 2*len(delim) {
+		return "", 0, false
+	}
+	if delim[0] == '_' && !wordStart(s, i) {
+		return "", 0, false
+	}
+
+	end := strings.Index(rest[len(delim):], delim)
+	if end <= 0 {
+		return "", 0, false
+	}
+
+	inner = rest[len(delim) : len(delim)+end]
+	if strings.TrimSpace(inner) != inner {
+		return "", 0, false
+	}
+
+	n = len(delim)*2 + end
+	if delim[0] == '_' && i+n < len(s) && isWordChar(s[i+n]) {
+		return "", 0, false
+	}
+
+	return inner, n, true
+}
+
+// parseLink reads [text](href) at the start of s.
+func parseLink(s string) (text, href string, n int, ok bool) {
+	closeText := strings.Index(s, "](")
+	if closeText < 1 {
+		return "", "", 0, false
+	}
+
+	closeHref := strings.IndexByte(s[closeText+2:], ')')
+	if closeHref < 0 {
+		return "", "", 0, false
+	}
+
+	text = s[1:closeText]
+	href = strings.TrimSpace(s[closeText+2 : closeText+2+closeHref])
+	if strings.ContainsAny(text, "[]") || !safeURL(href) {
+		return "", "", 0, false
+	}
+
+	return text, href, closeText + 3 + closeHref, true
+}
+
+// bareURL returns the URL at the start of s, without trailing punctuation.
+func bareURL(s string) string {
+	end := strings.IndexAny(s, " \t\n<>\"'`")
+	if end < 0 {
+		end = len(s)
+	}
+	return strings.TrimRight(s[:end], ".,;:!?)]*_")
+}
+
+// safeURL allows absolute http and https URLs, and mailto links.
+func safeURL(href string) bool {
+	u, err := url.Parse(href)
+	if err != nil {
+		return false
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		return u.Host != ""
+	case "mailto":
+		return u.Opaque != ""
+	}
+	return false
+}
+
+func anchor(href, inner string) string {
+	return `<a href="` + html.EscapeString(href) + `" rel="` + LinkRel + `">` + inner + "</a>"
+}
+
+func wordStart(s string, i int) bool {
+	return i == 0 || !isWordChar(s[i-1])
+}
+
+func isWordChar(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
@@ -0,0 +1,107 @@
+package markdown
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRender(t *testing.T) {
+	pairs := []struct {
+		Source   string
+		Features Features
+		Expected string
+	}{
+		{"Hello", All, "<p>Hello</p>\n"},
+		{"one\ntwo\n\nthree", All, "<p>one<br>\ntwo</p>\n<p>three</p>\n"},
+		{"*em* and **strong** and _em_ and __strong__", All, "<p><em>em</em> and <strong>strong</strong> and <em>em</em> and <strong>strong</strong></p>\n"},
+		{"snake_case_name and 2 * 3 * 4", All, "<p>snake_case_name and 2 * 3 * 4</p>\n"},
+		{"*em*", None, "<p>*em*</p>\n"},
+		{"use `a < b` here", All, "<p>use <code>a &lt; b</code> here</p>\n"},
+		{"```\n<b>code</b>\n  indented\n```\nafter", All, "<pre><code>&lt;b&gt;code&lt;/b&gt;\n  indented</code></pre>\n<p>after</p>\n"},
+		{"> quoted *text*\n> more\n\nnot quoted", All, "<blockquote>\n<p>quoted <em>text</em><br>\nmore</p>\n</blockquote>\n<p>not quoted</p>\n"},
+		{"> quoted", All &^ Quotes, "<p>&gt; quoted</p>\n"},
+		{"- one\n- two\n\n1. first\n2. second", All, "<ul>\n<li>one</li>\n<li>two</li>\n</ul>\n<ol>\n<li>first</li>\n<li>second</li>\n</ol>\n"},
+		{"- one", All &^ Lists, "<p>- one</p>\n"},
+		{"[a *link*](https://example.com/?a=1&b=2)", All, `<p><a href="https://example.com/?a=1&amp;b=2" rel="nofollow ugc noopener">a <em>link</em></a></p>` + "\n"},
+		{"see https://example.com/page.", All, `<p>see <a href="https://example.com/page" rel="nofollow ugc noopener">https://example.com/page</a>.</p>` + "\n"},
+		{"[mail me](mailto:me@example.com)", All, `<p><a href="mailto:me@example.com" rel="nofollow ugc noopener">mail me</a></p>` + "\n"},
+		{"[text](https://example.com)", All &^ Links, "<p>[text](https://example.com)</p>\n"},
+		{"Ünïcödé *ëm*", All, "<p>Ünïcödé <em>ëm</em></p>\n"},
+	}
+
+	for _, p := range pairs {
+		assert.Equal(t, p.Expected, Render(p.Source, p.Features), p.Source)
+	}
+}
+
+// TestRenderXSS feeds the renderer a set of well known injection attempts.
+// None of them may produce a tag or attribute the renderer didn't write.
+func TestRenderXSS(t *testing.T) {
+	attacks := []string{
+		`<script>alert(1)</script>`,
+		`<img src=x onerror=alert(1)>`,
+		`[click](javascript:alert(1))`,
+		`[click](JaVaScRiPt:alert(1))`,
+		`[click]( javascript:alert(1))`,
+		`[click](data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==)`,
+		`[click](&#106;avascript:alert(1))`,
+		`[click](vbscript:msgbox(1))`,
+		`[click](//evil.example.com)`,
+		`[click](https://example.com/"onmouseover="alert(1))`,
+		`https://example.com/"onmouseover="alert(1)`,
+		"`<script>`",
+		"```\n</code></pre><script>alert(1)</script>\n```",
+		`> <iframe src="https://evil.example.com"></iframe>`,
+		`- <a href="javascript:alert(1)">x</a>`,
+		`**<svg onload=alert(1)>**`,
+		`[<img src=x onerror=alert(1)>](https://example.com)`,
+		`<<script>script>alert(1)<</script>/script>`,
+		`"><script>alert(1)</script>`,
+	}
+
+	allowed := map[string]bool{
+		"p": true, "br": true, "em": true, "strong": true, "code": true, "pre": true,
+		"blockquote": true, "ul": true, "ol": true, "li": true, "a": true,
+	}
+
+	for _, attack := range attacks {
+		out := Render(attack, All)
+
+		for _, tag := range tags(out) {
+			name := strings.TrimPrefix(strings.Fields(tag)[0], "/")
+			assert.True(t, allowed[name], "%q rendered a %s tag: %s", attack, name, out)
+
+			if name == "a" && !strings.HasPrefix(tag, "/") {
+				assert.Regexp(t, `^a href="(https?://[^"]+|mailto:[^"]+)" rel="nofollow ugc noopener"$`, tag, attack)
+			}
+		}
+	}
+}
+
+func TestFeatures(t *testing.T) {
+	assert.Equal(t, Emphasis|Code, ParseFeatures(" code, emphasis ,unknown"))
+	assert.Equal(t, "emphasis,links,code,quotes,lists", All.String())
+	assert.Equal(t, All, ParseFeatures(All.String()))
+	assert.Equal(t, "", None.String())
+	assert.True(t, All.Has(Links|Code))
+	assert.False(t, Emphasis.Has(Links))
+}
+
+// tags returns what is between every < and > in s.
+func tags(s string) []string {
+	var found []string
+	for {
+		start := strings.IndexByte(s, '<')
+		if start < 0 {
+			return found
+		}
+		end := strings.IndexByte(s[start:], '>')
+		if end < 0 {
+			return found
+		}
+		found = append(found, s[start+1:start+end])
+		s = s[start+end+1:]
+	}
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Roles a user can have on a site. Each can do everything the ones after it can.
+const (
+	// RoleOwner is the user the site belongs to. They manage its members,
+	// and are the only one who can hand the site over to someone else.
+	RoleOwner = "owner"
+	// RoleAdmin changes the site's settings, sign in, webhooks, imports and exports.
+	RoleAdmin = "admin"
+	// RoleModerator approves, rejects and edits comments.
+	RoleModerator = "moderator"
+)
+
+// invitationLifetime is how long an invitation to a site can be accepted for.
+const invitationLifetime = 7 * 24 * time.Hour
+
+// Membership gives a user who doesn't own a site a role on it.
+type Membership struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	SiteID    uint   `gorm:"unique_index:membership_site_user"`
+	UserID    uint   `gorm:"unique_index:membership_site_user;index:membership_user"`
+	Role      string `gorm:"type:varchar(16)"`
+}
+
+/*
+Invitation asks whoever has the email address to join a site with a role.
+Only the hash of its token is kept; the token itself is in the link that was
+emailed. Accepting it turns it into a Membership.
+*/
+type Invitation struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	SiteID    uint `gorm:"index:invitation_site"`
+	InvitedBy uint
+	Email     string `gorm:"type:varchar(191)"`
+	Role      string `gorm:"type:varchar(16)"`
+	Hash      string `gorm:"type:varchar(64);unique_index:invitation_hash"`
+	ExpiresAt time.Time
+}
+
+// Member is a membership along with the email address of the user.
+type Member struct {
+	Membership
+	Email string
+}
+
+// MemberSite is a site along with the role the user has on it.
+type MemberSite struct {
+	Site
+	Role string
+}
+
+// Can tells whether the role lets the user do what needs role.
+func (s MemberSite) Can(role string) bool {
+	for _, r := range rolesFrom(role) {
+		if r == s.Role {
+			return true
+		}
+	}
+	return s.Role == RoleOwner
+}
+
+// validMemberRole tells whether role is one users can be invited with.
+func validMemberRole(role string) bool {
+	return role == RoleAdmin || role == RoleModerator
+}
+
+// rolesFrom returns the member roles that can do what needs role.
+func rolesFrom(role string) []string {
+	switch role {
+	case RoleModerator:
+		return []string{RoleAdmin, RoleModerator}
+	case RoleAdmin:
+		return []string{RoleAdmin}
+	}
+	return []string{}
+}
+
+// memberSiteIDs returns a subquery of the IDs of the sites the user is a member of with one of the roles.
+func (h *Handlers) memberSiteIDs(userID uint, roles []string) interface{} {
+	return h.db.Table("memberships").Select("site_id").Where("user_id = ? AND role IN (?)", userID, roles).QueryExpr()
+}
+
+// siteRole returns the role the user has on the site, or "" if they have none.
+func (h *Handlers) siteRole(site Site, userID uint) string {
+	if site.UserID == userID {
+		return RoleOwner
+	}
+
+	membership := Membership{}
+	if h.db.Where("site_id = ? AND user_id = ?", site.ID, userID).First(&membership).RecordNotFound() {
+		return ""
+	}
+	return membership.Role
+}
+
+// memberSites returns the sites the user owns or is a member of, with their role on each.
+func (h *Handlers) memberSites(user User) []MemberSite {
+	var sites []Site
+	h.db.Where("user_id = ? OR id IN (?)", user.ID, h.memberSiteIDs(user.ID, rolesFrom(RoleModerator))).Order("id").Find(&sites)
+
+	var memberships []Membership
+	h.db.Where("user_id = ?", user.ID).Find(&memberships)
+
+	roles := map[uint]string{}
+	for _, m := range memberships {
+		roles[m.SiteID] = m.Role
+	}
+
+	list := []MemberSite{}
+	for _, site := range sites {
+		role := roles[site.ID]
+		if site.UserID == user.ID {
+			role = RoleOwner
+		}
+		list = append(list, MemberSite{Site: site, Role: role})
+	}
+
+	return list
+}
+
+// invitationURL returns the link to accept an invitation with the token.
+func (h *Handlers) invitationURL(token string) string {
+	return fmt.Sprintf("%s/admin/invitations/%s", h.cfg.PublicURL, token)
+}
+
+// registerURL returns the link to register an account with the invitation token, even while registration is closed.
+func (h *Handlers) registerURL(token string) string {
+	return fmt.Sprintf("%s/register?invitation=%s", h.cfg.PublicURL, token)
+}
+
+// invitationByToken looks up the invitation with the token, as long as it hasn't expired.
+func (h *Handlers) invitationByToken(token string) (Invitation, bool) {
+	invitation := Invitation{}
+
+	if token == "" || h.db.Where("hash = ? AND expires_at > ?", h.hashString(token), time.Now()).First(&invitation).RecordNotFound() {
+		return invitation, false
+	}
+
+	return invitation, true
+}
+
+// invitation looks up the invitation in the :token route parameter, as long as it hasn't expired.
+func (h *Handlers) invitation(c echo.Context) (Invitation, Site, bool) {
+	site := Site{}
+
+	invitation, ok := h.invitationByToken(c.Param("token"))
+	if !ok {
+		return invitation, site, false
+	}
+
+	if h.db.Where("id = ?", invitation.SiteID).First(&site).RecordNotFound() {
+		return invitation, site, false
+	}
+
+	return invitation, site, true
+}
+
+// AdminMembers handles GET /admin/sites/:id/members to list the members of a site and the invitations waiting.
+func (h *Handlers) AdminMembers(c echo.Context) error {
+	site, ok := h.siteFor(c, RoleOwner)
+	if !ok {
+		return c.String(http.StatusNotFound, "No such site")
+	}
+
+	var memberships []Membership
+	h.db.Where("site_id = ?", site.ID).Order("id").Find(&memberships)
+
+	ids := []uint{}
+	for _, m := range memberships {
+		ids = append(ids, m.UserID)
+	}
+
+	var users []User
+	if len(ids) > 0 {
+		h.db.Where("id IN (?)", ids).Find(&users)
+	}
+
+	emails := map[uint]string{}
+	for _, u := range users {
+		emails[u.ID] = u.Email
+	}
+
+	members := []Member{}
+	for _, m := range memberships {
+		members = append(members, Member{Membership: m, Email: emails[m.UserID]})
+	}
+
+	var invitations []Invitation
+	h.db.Where("site_id = ? AND expires_at > ?", site.ID, time.Now()).Order("id").Find(&invitations)
+
+	return c.Render(http.StatusOK, "adminmembers", struct {
+		Csrf        interface{}
+		Site        Site
+		Members     []Member
+		Invitations []Invitation
+		Roles       []string
+	}{
+		Csrf:        c.Get("csrf"),
+		Site:        site,
+		Members:     members,
+		Invitations: invitations,
+		Roles:       []string{RoleAdmin, RoleModerator},
+	})
+}
+
+// AdminMembersInvite handles POST /admin/sites/:id/members to email someone an invitation to the site.
+func (h *Handlers) AdminMembersInvite(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	site, ok := h.siteFor(c, RoleOwner)
+	if !ok {
+		return c.String(http.StatusNotFound, "No such site")
+	}
+
+	email := strings.TrimSpace(c.FormValue("email"))
+	if !isEmail(email) {
+		return c.String(http.StatusBadRequest, "That is not an email address")
+	}
+
+	role := c.FormValue("role")
+	if !validMemberRole(role) {
+		return c.String(http.StatusBadRequest, "Unknown role")
+	}
+
+	token := randomToken(32)
+	invitation := Invitation{
+		SiteID:    site.ID,
+		InvitedBy: user.ID,
+		Email:     email,
+		Role:      role,
+		Hash:      h.hashString(token),
+		ExpiresAt: time.Now().Add(invitationLifetime),
+	}
+
+	// Inviting someone again replaces the invitation they had.
+	h.db.Delete(Invitation{}, "site_id = ? AND email = ?", site.ID, email)
+
+	if result := h.db.Create(&invitation); result.Error != nil {
+		return c.String(http.StatusBadRequest, "Something failed while saving")
+	}
+
+	h.send(email, fmt.Sprintf("You're invited to %s", site.Designation), fmt.Sprintf(
+		"%s invited you to help run %s as %s.\n\nAccept the invitation at %s until %s. You need an account with this email address; if you don't have one yet, register it at %s first.\n",
+		user.Email, site.Designation, role, h.invitationURL(token), invitation.ExpiresAt.Format("2 Jan 2006 15:04 MST"), h.registerURL(token),
+	), nil)
+
+	h.audit(c, user.ID, auditSiteInvite, fmt.Sprintf("site %d: %s as %s", site.ID, email, role))
+
+	return c.Redirect(http.StatusFound, fmt.Sprintf("/admin/sites/%d/members", site.ID))
+}
+
+// AdminInvitationDelete handles POST /admin/sites/:id/invitations/:invitation/delete to take back an invitation.
+func (h *Handlers) AdminInvitationDelete(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	site, ok := h.siteFor(c, RoleOwner)
+	if !ok {
+		return c.String(http.StatusNotFound, "No such site")
+	}
+
+	if result := h.db.Delete(Invitation{}, "id = ? AND site_id = ?", c.Param("invitation"), site.ID); result.RowsAffected > 0 {
+		h.audit(c, user.ID, auditSiteInviteRevoke, fmt.Sprintf("site %d: invitation %s", site.ID, c.Param("invitation")))
+	}
+
+	return c.Redirect(http.StatusFound, fmt.Sprintf("/admin/sites/%d/members", site.ID))
+}
+
+// AdminMemberRole handles POST /admin/sites/:id/members/:member/role to change what a member can do.
+func (h *Handlers) AdminMemberRole(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	site, ok := h.siteFor(c, RoleOwner)
+	if !ok {
+		return c.String(http.StatusNotFound, "No such site")
+	}
+
+	role := c.FormValue("role")
+	if !validMemberRole(role) {
+		return c.String(http.StatusBadRequest, "Unknown role")
+	}
+
+	membership := Membership{}
+	if h.db.Where("id = ? AND site_id = ?", c.Param("member"), site.ID).First(&membership).RecordNotFound() {
+		return c.String(http.StatusNotFound, "No such member")
+	}
+
+	if result := h.db.Model(&membership).Update("role", role); result.Error != nil {
+		return c.String(http.StatusBadRequest, "Something failed while saving")
+	}
+
+	h.audit(c, user.ID, auditSiteMemberRole, fmt.Sprintf("site %d: user %d as %s", site.ID, membership.UserID, role))
+
+	return c.Redirect(http.StatusFound, fmt.Sprintf("/admin/sites/%d/members", site.ID))
+}
+
+// AdminMemberDelete handles POST /admin/sites/:id/members/:member/delete to take a member off the site.
+func (h *Handlers) AdminMemberDelete(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	site, ok := h.siteFor(c, RoleOwner)
+	if !ok {
+		return c.String(http.StatusNotFound, "No such site")
+	}
+
+	membership := Membership{}
+	if h.db.Where("id = ? AND site_id = ?", c.Param("member"), site.ID).First(&membership).RecordNotFound() {
+		return c.String(http.StatusNotFound, "No such member")
+	}
+
+	if result := h.db.Delete(&membership); result.Error != nil {
+		return c.String(http.StatusBadRequest, "Something failed while saving")
+	}
+
+	h.audit(c, user.ID, auditSiteMemberRemove, fmt.Sprintf("site %d: user %d", site.ID, membership.UserID))
+
+	return c.Redirect(http.StatusFound, fmt.Sprintf("/admin/sites/%d/members", site.ID))
+}
+
+/*
+AdminSiteTransfer handles POST /admin/sites/:id/transfer, which makes one of
+the site's members its owner. It needs the owner's password. The owner stays
+on as an admin, and the new owner can take them off.
+*/
+func (h *Handlers) AdminSiteTransfer(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	site, ok := h.siteFor(c, RoleOwner)
+	if !ok {
+		return c.String(http.StatusNotFound, "No such site")
+	}
+
+	match, err := h.pwh.ComparePasswordAndHash(c.FormValue("password"), user.HashedPassword)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Checking passwords failed")
+	}
+
+	if !match {
+		return c.String(http.StatusUnauthorized, "Password is wrong")
+	}
+
+	membership := Membership{}
+	if h.db.Where("id = ? AND site_id = ?", c.FormValue("member"), site.ID).First(&membership).RecordNotFound() {
+		return c.String(http.StatusNotFound, "No such member")
+	}
+
+	owner := User{}
+	if h.db.Where("id = ?", membership.UserID).First(&owner).RecordNotFound() {
+		return c.String(http.StatusNotFound, "No such member")
+	}
+
+	tx := h.db.Begin()
+
+	if err := tx.Model(&site).UpdateColumn("user_id", owner.ID).Error; err != nil {
+		tx.Rollback()
+		return c.String(http.StatusBadRequest, "Something failed while saving")
+	}
+
+	if err := tx.Delete(&membership).Error; err != nil {
+		tx.Rollback()
+		return c.String(http.StatusBadRequest, "Something failed while saving")
+	}
+
+	if err := tx.Create(&Membership{SiteID: site.ID, UserID: user.ID, Role: RoleAdmin}).Error; err != nil {
+		tx.Rollback()
+		return c.String(http.StatusBadRequest, "Something failed while saving")
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return c.String(http.StatusBadRequest, "Something failed while saving")
+	}
+
+	h.audit(c, user.ID, auditSiteTransfer, fmt.Sprintf("site %d: to user %d", site.ID, owner.ID))
+
+	h.send(owner.Email, fmt.Sprintf("%s is yours now", site.Designation), fmt.Sprintf(
+		"%s made you the owner of %s. They stay on as an admin; you can change that at %s/admin/sites/%d/members.\n",
+		user.Email, site.Designation, h.cfg.PublicURL, site.ID,
+	), nil)
+
+	return c.Redirect(http.StatusFound, "/admin/sites")
+}
+
+// AdminInvitation handles GET /admin/invitations/:token to show an invitation to the user it was sent to.
+func (h *Handlers) AdminInvitation(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	invitation, site, ok := h.invitation(c)
+	if !ok {
+		return c.String(http.StatusNotFound, "This invitation is no longer valid")
+	}
+
+	return c.Render(http.StatusOK, "admininvitation", struct {
+		Csrf       interface{}
+		Token      string
+		Site       Site
+		Invitation Invitation
+		Mismatch   bool
+	}{
+		Csrf:       c.Get("csrf"),
+		Token:      c.Param("token"),
+		Site:       site,
+		Invitation: invitation,
+		Mismatch:   !strings.EqualFold(invitation.Email, user.Email),
+	})
+}
+
+/*
+AdminInvitationAccept handles POST /admin/invitations/:token to join the site
+with the invitation's role. Only the user with the address it was sent to
+can accept it. Someone who is a member already gets the invitation's role.
+*/
+func (h *Handlers) AdminInvitationAccept(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	invitation, site, ok := h.invitation(c)
+	if !ok {
+		return c.String(http.StatusNotFound, "This invitation is no longer valid")
+	}
+
+	if !strings.EqualFold(invitation.Email, user.Email) {
+		return c.String(http.StatusForbidden, "This invitation was sent to someone else")
+	}
+
+	if site.UserID == user.ID {
+		return c.String(http.StatusBadRequest, "You own this site already")
+	}
+
+	membership := Membership{}
+	h.db.Where("site_id = ? AND user_id = ?", site.ID, user.ID).First(&membership)
+	membership.SiteID = site.ID
+	membership.UserID = user.ID
+	membership.Role = invitation.Role
+
+	if result := h.db.Save(&membership); result.Error != nil {
+		return c.String(http.StatusBadRequest, "Something failed while saving")
+	}
+
+	h.db.Delete(&invitation)
+	h.audit(c, user.ID, auditSiteJoin, fmt.Sprintf("site %d as %s", site.ID, invitation.Role))
+
+	return c.Redirect(http.StatusFound, "/admin/sites")
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	mocket "github.com/selvatico/go-mocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemberSiteCan(t *testing.T) {
+	pairs := []struct {
+		Role     string
+		Needs    string
+		Expected bool
+	}{
+		{RoleOwner, RoleOwner, true},
+		{RoleOwner, RoleModerator, true},
+		{RoleAdmin, RoleOwner, false},
+		{RoleAdmin, RoleAdmin, true},
+		{RoleAdmin, RoleModerator, true},
+		{RoleModerator, RoleAdmin, false},
+		{RoleModerator, RoleModerator, true},
+		{"", RoleModerator, false},
+	}
+
+	for _, p := range pairs {
+		assert.Equal(t, p.Expected, MemberSite{Role: p.Role}.Can(p.Needs), p.Role+" "+p.Needs)
+	}
+}
+
+func TestSiteFor(t *testing.T) {
+	pairs := []struct {
+		Role    string
+		Members bool
+		Args    []interface{}
+	}{
+		{RoleOwner, false, []interface{}{"3", int64(7)}},
+		{RoleAdmin, true, []interface{}{"3", int64(7), int64(7), RoleAdmin}},
+		{RoleModerator, true, []interface{}{"3", int64(7), int64(7), RoleAdmin, RoleModerator}},
+	}
+
+	for _, p := range pairs {
+		var query string
+		var args []interface{}
+		mocket.Catcher.Reset().NewMock().WithQuery(`FROM "sites"`).WithCallback(func(q string, a []driver.NamedValue) {
+			query = q
+			for _, arg := range a {
+				args = append(args, arg.Value)
+			}
+		}).WithReply([]map[string]interface{}{{"id": 3, "user_id": 9}})
+
+		c := e.NewContext(httptest.NewRequest(http.MethodGet, "/admin/sites/3/edit", nil), httptest.NewRecorder())
+		c.Set("model.user", User{Model: gorm.Model{ID: 7}})
+		c.SetParamNames("id")
+		c.SetParamValues("3")
+
+		site, ok := h.siteFor(c, p.Role)
+
+		assert.True(t, ok, p.Role)
+		assert.EqualValues(t, 3, site.ID, p.Role)
+		assert.Equal(t, p.Members, strings.Contains(query, "memberships"), p.Role)
+		assert.Equal(t, p.Args, args, p.Role)
+	}
+
+	mocket.Catcher.Reset()
+}
+
+func TestAdminMembersInvite(t *testing.T) {
+	pairs := []struct {
+		Form         string
+		ExpectedCode int
+	}{
+		{"email=nobody&role=admin", http.StatusBadRequest},
+		{"email=mod%40example.com&role=owner", http.StatusBadRequest},
+		{"email=mod%40example.com&role=moderator", http.StatusFound},
+	}
+
+	for _, p := range pairs {
+		mocket.Catcher.Reset().NewMock().WithQuery(`FROM "sites"`).WithReply([]map[string]interface{}{{"id": 3, "user_id": 7, "designation": "blog"}})
+		outbox.messages = nil
+
+		var invited map[string]driver.Value
+		mocket.Catcher.NewMock().WithQuery(`INSERT INTO "invitations"`).WithCallback(func(query string, args []driver.NamedValue) {
+			invited = insertedValues(query, args)
+		})
+
+		req := httptest.NewRequest(http.MethodPost, "/admin/sites/3/members", strings.NewReader(p.Form))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("model.user", User{Model: gorm.Model{ID: 7}, Email: "owner@example.com"})
+		c.SetParamNames("id")
+		c.SetParamValues("3")
+
+		if !assert.NoError(t, h.AdminMembersInvite(c)) {
+			continue
+		}
+
+		assert.Equal(t, p.ExpectedCode, rec.Code, p.Form)
+		if p.ExpectedCode != http.StatusFound {
+			assert.Nil(t, invited, p.Form)
+			assert.Empty(t, outbox.messages, p.Form)
+			continue
+		}
+
+		assert.Equal(t, "mod@example.com", invited["email"])
+		assert.Equal(t, RoleModerator, invited["role"])
+
+		if assert.Len(t, outbox.messages, 1) {
+			text := outbox.messages[0].Text
+			start := strings.Index(text, "/admin/invitations/") + len("/admin/invitations/")
+			token := text[start : start+64]
+			assert.Equal(t, h.hashString(token), invited["hash"])
+		}
+	}
+
+	mocket.Catcher.Reset()
+}
+
+func TestAdminInvitationAccept(t *testing.T) {
+	pairs := []struct {
+		Email        string
+		ExpectedCode int
+	}{
+		{"someone@example.com", http.StatusForbidden},
+		{"Mod@example.com", http.StatusFound},
+	}
+
+	for _, p := range pairs {
+		mocket.Catcher.Reset()
+		mocket.Catcher.NewMock().WithQuery(`SELECT * FROM "invitations"`).WithReply([]map[string]interface{}{{"id": 2, "site_id": 3, "email": "mod@example.com", "role": RoleModerator}})
+		mocket.Catcher.NewMock().WithQuery(`FROM "sites"`).WithReply([]map[string]interface{}{{"id": 3, "user_id": 9}})
+
+		var joined map[string]driver.Value
+		mocket.Catcher.NewMock().WithQuery(`INSERT INTO "memberships"`).WithCallback(func(query string, args []driver.NamedValue) {
+			joined = insertedValues(query, args)
+		})
+
+		var accepted bool
+		mocket.Catcher.NewMock().WithQuery(`DELETE FROM "invitations"`).WithCallback(func(_ string, _ []driver.NamedValue) {
+			accepted = true
+		})
+
+		req := httptest.NewRequest(http.MethodPost, "/admin/invitations/token", nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("model.user", User{Model: gorm.Model{ID: 7}, Email: p.Email})
+		c.SetParamNames("token")
+		c.SetParamValues("token")
+
+		if !assert.NoError(t, h.AdminInvitationAccept(c)) {
+			continue
+		}
+
+		assert.Equal(t, p.ExpectedCode, rec.Code, p.Email)
+		assert.Equal(t, p.ExpectedCode == http.StatusFound, accepted, p.Email)
+
+		if p.ExpectedCode == http.StatusFound {
+			assert.EqualValues(t, 3, joined["site_id"])
+			assert.EqualValues(t, 7, joined["user_id"])
+			assert.Equal(t, RoleModerator, joined["role"])
+		}
+	}
+
+	mocket.Catcher.Reset()
+}
+
+func TestAdminSiteTransfer(t *testing.T) {
+	pairs := []struct {
+		Form         string
+		ExpectedCode int
+	}{
+		{"member=4&password=wrongpassword", http.StatusUnauthorized},
+		{"member=4&password=goodpassword", http.StatusFound},
+	}
+
+	for _, p := range pairs {
+		mocket.Catcher.Reset()
+		outbox.messages = nil
+		mocket.Catcher.NewMock().WithQuery(`FROM "sites"`).WithReply([]map[string]interface{}{{"id": 3, "user_id": 7, "designation": "blog"}})
+		mocket.Catcher.NewMock().WithQuery(`SELECT * FROM "memberships"`).WithReply([]map[string]interface{}{{"id": 4, "site_id": 3, "user_id": 9, "role": RoleAdmin}})
+		mocket.Catcher.NewMock().WithQuery(`FROM "users"`).WithReply([]map[string]interface{}{{"id": 9, "email": "new@example.com"}})
+
+		var owner []driver.NamedValue
+		mocket.Catcher.NewMock().WithQuery(`UPDATE "sites" SET "user_id"`).WithCallback(func(_ string, args []driver.NamedValue) {
+			owner = args
+		})
+
+		var stays map[string]driver.Value
+		mocket.Catcher.NewMock().WithQuery(`INSERT INTO "memberships"`).WithCallback(func(query string, args []driver.NamedValue) {
+			stays = insertedValues(query, args)
+		})
+
+		req := httptest.NewRequest(http.MethodPost, "/admin/sites/3/transfer", strings.NewReader(p.Form))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("model.user", User{Model: gorm.Model{ID: 7}, Email: "owner@example.com", HashedPassword: "hashedpassword"})
+		c.SetParamNames("id")
+		c.SetParamValues("3")
+
+		if !assert.NoError(t, h.AdminSiteTransfer(c)) {
+			continue
+		}
+
+		assert.Equal(t, p.ExpectedCode, rec.Code, p.Form)
+		if p.ExpectedCode != http.StatusFound {
+			assert.Nil(t, owner, p.Form)
+			continue
+		}
+
+		if assert.NotEmpty(t, owner) {
+			assert.EqualValues(t, 9, owner[0].Value)
+		}
+		assert.EqualValues(t, 7, stays["user_id"])
+		assert.Equal(t, RoleAdmin, stays["role"])
+		if assert.Len(t, outbox.messages, 1) {
+			assert.Equal(t, "new@example.com", outbox.messages[0].To)
+		}
+	}
+
+	mocket.Catcher.Reset()
+}
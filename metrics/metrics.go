@@ -0,0 +1,301 @@
+/*
+Package metrics keeps counters, gauges and histograms in memory and writes
+them out in the Prometheus text exposition format.
+
+It covers only what the app needs: metrics are created on a Registry with a
+fixed set of label names, and every distinct combination of label values is
+tracked as its own series.
+*/
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// labelEscaper escapes label values the way the exposition format expects.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// DefaultBuckets are histogram buckets in seconds, suitable for request latencies.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds a set of metrics and writes them out in the order they were created.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) add(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// Write writes every metric in the registry to w.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	collectors := make([]collector, len(r.collectors))
+	copy(collectors, r.collectors)
+	r.mu.Unlock()
+
+	buf := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(buf)
+	}
+	return buf.Flush()
+}
+
+// ServeHTTP serves the registry as a Prometheus scrape target.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Write(w)
+}
+
+// series holds the label values of one series, and the key it is stored under.
+type series struct {
+	key    string
+	values []string
+}
+
+// newSeries checks the number of values against the label names.
+func newSeries(name string, labels, values []string) series {
+	if len(labels) != len(values) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, got %d values", name, len(labels), len(values)))
+	}
+	return series{key: strings.Join(values, "\xff"), values: values}
+}
+
+// CounterVec is a counter that only goes up, partitioned by its labels.
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]series
+	values map[string]float64
+}
+
+// Counter creates a counter on the registry.
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		series: map[string]series{},
+		values: map[string]float64{},
+	}
+	r.add(c)
+	return c
+}
+
+// Inc adds one to the series with the given label values.
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds delta, which must not be negative, to the series with the given label values.
+func (c *CounterVec) Add(delta float64, values ...string) {
+	if delta < 0 {
+		panic(fmt.Sprintf("metrics: counter %s cannot decrease", c.name))
+	}
+
+	s := newSeries(c.name, c.labels, values)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.series[s.key] = s
+	c.values[s.key] += delta
+}
+
+// Value returns the current value of the series with the given label values.
+func (c *CounterVec) Value(values ...string) float64 {
+	s := newSeries(c.name, c.labels, values)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[s.key]
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeHeader(w, c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.series) {
+		writeSample(w, c.name, c.labels, c.series[key].values, nil, c.values[key])
+	}
+}
+
+// GaugeFunc is a gauge whose value is read when the registry is written out.
+type GaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+// GaugeFunc creates a gauge on the registry that calls fn for its value.
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, fn: fn}
+	r.add(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	writeSample(w, g.name, nil, nil, nil, g.fn())
+}
+
+// HistogramVec counts observations into buckets, partitioned by its labels.
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]series
+	values map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Histogram creates a histogram on the registry. The buckets are upper bounds
+// in increasing order; DefaultBuckets is used when none are given.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("metrics: buckets of %s are not sorted", name))
+	}
+
+	hv := &HistogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  map[string]series{},
+		values:  map[string]*histogram{},
+	}
+	r.add(hv)
+	return hv
+}
+
+// Observe records v in the series with the given label values.
+func (hv *HistogramVec) Observe(v float64, values ...string) {
+	s := newSeries(hv.name, hv.labels, values)
+
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+
+	h, ok := hv.values[s.key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(hv.buckets))}
+		hv.series[s.key] = s
+		hv.values[s.key] = h
+	}
+
+	for i, upper := range hv.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// Count returns how many observations the series with the given label values has.
+func (hv *HistogramVec) Count(values ...string) uint64 {
+	s := newSeries(hv.name, hv.labels, values)
+
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+	if h, ok := hv.values[s.key]; ok {
+		return h.count
+	}
+	return 0
+}
+
+func (hv *HistogramVec) write(w *bufio.Writer) {
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+
+	writeHeader(w, hv.name, hv.help, "histogram")
+	for _, key := range sortedKeys(hv.series) {
+		values := hv.series[key].values
+		h := hv.values[key]
+
+		for i, upper := range hv.buckets {
+			writeSample(w, hv.name+"_bucket", hv.labels, values, []string{"le", formatFloat(upper)}, float64(h.counts[i]))
+		}
+		writeSample(w, hv.name+"_bucket", hv.labels, values, []string{"le", "+Inf"}, float64(h.count))
+		writeSample(w, hv.name+"_sum", hv.labels, values, nil, h.sum)
+		writeSample(w, hv.name+"_count", hv.labels, values, nil, float64(h.count))
+	}
+}
+
+func writeHeader(w *bufio.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+// writeSample writes one line. extra is an optional name and value pair
+// appended to the labels, used for the le label of histogram buckets.
+func writeSample(w *bufio.Writer, name string, labels, values, extra []string, v float64) {
+	w.WriteString(name)
+
+	if len(labels) > 0 || len(extra) > 0 {
+		pairs := make([]string, 0, len(labels)+1)
+		for i, label := range labels {
+			pairs = append(pairs, label+`="`+labelEscaper.Replace(values[i])+`"`)
+		}
+		if len(extra) == 2 {
+			pairs = append(pairs, extra[0]+`="`+labelEscaper.Replace(extra[1])+`"`)
+		}
+		w.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+
+	w.WriteString(" " + formatFloat(v) + "\n")
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]series) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounter(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("test_total", "A counter.", "site", "action")
+
+	c.Inc("1", "posted")
+	c.Inc("1", "posted")
+	c.Add(3, "2", "approved")
+
+	assert.Equal(t, float64(2), c.Value("1", "posted"))
+	assert.Equal(t, float64(0), c.Value("1", "rejected"))
+
+	var buf bytes.Buffer
+	assert.NoError(t, r.Write(&buf))
+	assert.Equal(t, `# HELP test_total A counter.
+# TYPE test_total counter
+test_total{site="1",action="posted"} 2
+test_total{site="2",action="approved"} 3
+`, buf.String())
+}
+
+func TestCounterPanics(t *testing.T) {
+	c := NewRegistry().Counter("test_total", "A counter.", "site")
+
+	assert.Panics(t, func() { c.Inc() })
+	assert.Panics(t, func() { c.Add(-1, "1") })
+}
+
+func TestHistogram(t *testing.T) {
+	r := NewRegistry()
+	h := r.Histogram("test_seconds", "A histogram.", []float64{0.1, 1}, "route")
+
+	h.Observe(0.05, "/")
+	h.Observe(0.5, "/")
+	h.Observe(5, "/")
+
+	assert.Equal(t, uint64(3), h.Count("/"))
+
+	var buf bytes.Buffer
+	assert.NoError(t, r.Write(&buf))
+	assert.Equal(t, `# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{route="/",le="0.1"} 1
+test_seconds_bucket{route="/",le="1"} 2
+test_seconds_bucket{route="/",le="+Inf"} 3
+test_seconds_sum{route="/"} 5.55
+test_seconds_count{route="/"} 3
+`, buf.String())
+}
+
+func TestGaugeFuncAndEscaping(t *testing.T) {
+	r := NewRegistry()
+	r.GaugeFunc("test_sessions", "A gauge.", func() float64 { return 7 })
+	r.Counter("test_escaped_total", "Escaped.", "value").Inc("a \"quoted\"\nvalue\\")
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Equal(t, `# HELP test_sessions A gauge.
+# TYPE test_sessions gauge
+test_sessions 7
+# HELP test_escaped_total Escaped.
+# TYPE test_escaped_total counter
+test_escaped_total{value="a \"quoted\"\nvalue\\"} 1
+`, rec.Body.String())
+}
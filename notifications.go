@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/javorszky/go-comments/config"
+	"github.com/javorszky/go-comments/mail"
+	"github.com/labstack/echo"
+)
+
+// What site owners hear about new comments.
+const (
+	OwnerNotifyOff    = "off"
+	OwnerNotifyEach   = "each"
+	OwnerNotifyDigest = "digest"
+)
+
+// digestInterval is how often site owners who asked for a digest get one.
+const digestInterval = 24 * time.Hour
+
+// maxDigestComments is how many comments a digest lists. It says how many more there are.
+const maxDigestComments = 20
+
+// NewMailer returns the mailer the config asks for: log, smtp, or file.
+func NewMailer(cfg *config.Config, logger *slog.Logger) (mail.Mailer, error) {
+	switch cfg.Mailer {
+	case "", "log":
+		return mail.Log{Logger: logger}, nil
+	case "smtp":
+		if cfg.SMTPAddr == "" {
+			return nil, fmt.Errorf("SMTP_ADDR is not set")
+		}
+		return mail.SMTP{Addr: cfg.SMTPAddr, Username: cfg.SMTPUsername, Password: cfg.SMTPPassword}, nil
+	case "file":
+		return mail.FileDrop{Dir: cfg.MailDir}, nil
+	}
+	return nil, fmt.Errorf("unknown mailer %q", cfg.Mailer)
+}
+
+// validOwnerNotify tells whether notify is one of the ways site owners can hear about comments.
+func validOwnerNotify(notify string) bool {
+	switch notify {
+	case OwnerNotifyOff, OwnerNotifyEach, OwnerNotifyDigest:
+		return true
+	}
+	return false
+}
+
+// send queues a message from the app's address.
+func (h *Handlers) send(to, subject, text string, headers map[string]string) {
+	h.mail.Enqueue(mail.Message{
+		From:    h.cfg.MailFrom,
+		To:      to,
+		Subject: subject,
+		Text:    text,
+		Headers: headers,
+	})
+}
+
+// unsubscribeURL returns the link that stops reply notifications to the commenter.
+func (h *Handlers) unsubscribeURL(base string, commenterID uint) string {
+	id := fmt.Sprint(commenterID)
+	return fmt.Sprintf("%s/unsubscribe/%s/%s", base, id, h.sign("unsubscribe|"+id))
+}
+
+// confirmURL returns the link that turns on reply notifications for the comment.
+func (h *Handlers) confirmURL(base string, commentID uint) string {
+	id := fmt.Sprint(commentID)
+	return fmt.Sprintf("%s/notifications/confirm/%s/%s", base, id, h.sign("confirm|"+id))
+}
+
+/*
+askToConfirm emails a guest who asked to hear about replies a link to turn
+it on. Anyone can type any address, so nothing else is sent to it until
+they follow the link.
+*/
+func (h *Handlers) askToConfirm(c echo.Context, site Site, comment Comment, commenter Commenter, pageURL string) {
+	h.send(commenter.Email, fmt.Sprintf("Confirm emails about replies on %s", site.Designation), fmt.Sprintf(
+		"Someone commented on %s with this address and asked to hear about replies.\n\nIf it was you, confirm it at %s\n\nIf it wasn't, ignore this email and you won't get any others.\n",
+		pageURL, h.confirmURL(h.publicURL(c), comment.ID),
+	), nil)
+}
+
+/*
+notifyOwner tells the site's owner about a new comment waiting for them, if
+they want to hear about each one.
+*/
+func (h *Handlers) notifyOwner(c echo.Context, site Site, comment Comment, pageURL string) {
+	if site.OwnerNotify != OwnerNotifyEach || comment.Status != StatusPending {
+		return
+	}
+
+	owner := User{}
+	if h.db.Where("id = ?", site.UserID).First(&owner).RecordNotFound() {
+		return
+	}
+
+	h.send(owner.Email, fmt.Sprintf("New comment on %s", site.Designation), fmt.Sprintf(
+		"%s commented on %s:\n\n%s\n\nIt's waiting for you to approve it: %s/admin/sites/%d/comments\n",
+		authorOrAnonymous(comment.AuthorName), pageURL, comment.Body, h.publicURL(c), site.ID,
+	), nil)
+}
+
+/*
+notifyReply tells the author of the comment a newly approved reply answers,
+if they asked to hear about replies and left an email address. Nobody hears
+about their own replies.
+*/
+func (h *Handlers) notifyReply(c echo.Context, site Site, reply Comment) {
+	if reply.ParentID == nil {
+		return
+	}
+
+	parent := Comment{}
+	if h.db.Where("id = ?", *reply.ParentID).First(&parent).RecordNotFound() || !parent.NotifyReplies || parent.CommenterID == nil {
+		return
+	}
+
+	if reply.CommenterID != nil && *reply.CommenterID == *parent.CommenterID {
+		return
+	}
+
+	commenter := Commenter{}
+	if h.db.Where("id = ?", *parent.CommenterID).First(&commenter).RecordNotFound() || commenter.Email == "" {
+		return
+	}
+
+	thread := Thread{}
+	h.db.Where("id = ?", reply.ThreadID).First(&thread)
+
+	unsubscribe := h.unsubscribeURL(h.publicURL(c), commenter.ID)
+
+	h.send(commenter.Email, fmt.Sprintf("New reply to your comment on %s", site.Designation), fmt.Sprintf(
+		"%s replied to your comment on %s#comment-%d:\n\n%s\n\nTo stop getting emails about replies: %s\n",
+		authorOrAnonymous(reply.AuthorName), thread.URL, reply.ID, reply.Body, unsubscribe,
+	), map[string]string{
+		"List-Unsubscribe":      "<" + unsubscribe + ">",
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	})
+}
+
+// authorOrAnonymous returns the name of a comment's author, or says they didn't give one.
+func authorOrAnonymous(name string) string {
+	if name == "" {
+		return "Someone"
+	}
+	return name
+}
+
+// unsubscriber returns the commenter in the unsubscribe link, if its token is right.
+func (h *Handlers) unsubscriber(c echo.Context) (Commenter, bool) {
+	commenter := Commenter{}
+
+	if !h.verify("unsubscribe|"+c.Param("commenter"), c.Param("token")) {
+		return commenter, false
+	}
+
+	return commenter, !h.db.Where("id = ?", c.Param("commenter")).First(&commenter).RecordNotFound()
+}
+
+// Unsubscribe handles GET /unsubscribe/:commenter/:token with a button to stop reply notifications.
+func (h *Handlers) Unsubscribe(c echo.Context) error {
+	if _, ok := h.unsubscriber(c); !ok {
+		return c.String(http.StatusNotFound, "This link doesn't work.")
+	}
+
+	return c.Render(http.StatusOK, "unsubscribe", struct {
+		Done bool
+	}{false})
+}
+
+/*
+UnsubscribePost handles POST /unsubscribe/:commenter/:token to stop reply
+notifications to a commenter, for all of their comments. Mail clients post
+here for one-click unsubscribes, so the token is all it checks.
+*/
+func (h *Handlers) UnsubscribePost(c echo.Context) error {
+	commenter, ok := h.unsubscriber(c)
+	if !ok {
+		return c.String(http.StatusNotFound, "This link doesn't work.")
+	}
+
+	if result := h.db.Model(&Comment{}).Where("commenter_id = ?", commenter.ID).UpdateColumn("notify_replies", false); result.Error != nil {
+		return c.String(http.StatusInternalServerError, "Something failed while saving")
+	}
+
+	return c.Render(http.StatusOK, "unsubscribe", struct {
+		Done bool
+	}{true})
+}
+
+// confirmable returns the comment in the confirmation link, if its token is right.
+func (h *Handlers) confirmable(c echo.Context) (Comment, bool) {
+	comment := Comment{}
+
+	if !h.verify("confirm|"+c.Param("comment"), c.Param("token")) {
+		return comment, false
+	}
+
+	return comment, !h.db.Where("id = ?", c.Param("comment")).First(&comment).RecordNotFound()
+}
+
+// NotificationsConfirm handles GET /notifications/confirm/:comment/:token with a button to turn on reply notifications.
+func (h *Handlers) NotificationsConfirm(c echo.Context) error {
+	if _, ok := h.confirmable(c); !ok {
+		return c.String(http.StatusNotFound, "This link doesn't work.")
+	}
+
+	return c.Render(http.StatusOK, "confirmnotifications", struct {
+		Done bool
+	}{false})
+}
+
+/*
+NotificationsConfirmPost handles POST /notifications/confirm/:comment/:token
+to turn on reply notifications for the comment. Only the address the link
+went to has the token, so that's what it checks.
+*/
+func (h *Handlers) NotificationsConfirmPost(c echo.Context) error {
+	comment, ok := h.confirmable(c)
+	if !ok {
+		return c.String(http.StatusNotFound, "This link doesn't work.")
+	}
+
+	if result := h.db.Model(&comment).UpdateColumn("notify_replies", true); result.Error != nil {
+		return c.String(http.StatusInternalServerError, "Something failed while saving")
+	}
+
+	return c.Render(http.StatusOK, "confirmnotifications", struct {
+		Done bool
+	}{true})
+}
+
+/*
+Digests sends site owners who asked for one a digest of the comments
+waiting for them, until ctx is done. They link to the admin area, so
+without PUBLIC_URL none are sent.
+*/
+func (h *Handlers) Digests(ctx context.Context) {
+	if h.cfg.PublicURL == "" {
+		h.log.Error("PUBLIC_URL is not set, so digests can't link to the admin area; not sending them")
+		return
+	}
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			h.sendDigests(now)
+		}
+	}
+}
+
+/*
+sendDigests sends the digests that are due: one a day to the owner of each
+site that asked for them, as long as there are comments waiting.
+*/
+func (h *Handlers) sendDigests(now time.Time) {
+	var sites []Site
+
+	h.db.Where("owner_notify = ? AND (digest_sent_at IS NULL OR digest_sent_at < ?)", OwnerNotifyDigest, now.Add(-digestInterval)).Find(&sites)
+
+	for _, site := range sites {
+		if err := h.db.Model(&site).UpdateColumn("digest_sent_at", now).Error; err != nil {
+			h.log.Error("Saving when the digest was sent failed", "site", site.ID, "error", err)
+			continue
+		}
+
+		var waiting []Comment
+		var count int
+
+		h.db.Model(&Comment{}).Where("site_id = ? AND status = ?", site.ID, StatusPending).Count(&count)
+		if count == 0 {
+			continue
+		}
+		h.db.Where("site_id = ? AND status = ?", site.ID, StatusPending).Order("created_at asc").Limit(maxDigestComments).Find(&waiting)
+
+		owner := User{}
+		if h.db.Where("id = ?", site.UserID).First(&owner).RecordNotFound() {
+			continue
+		}
+
+		var b strings.Builder
+		fmt.Fprintf(&b, "%d comments on %s are waiting for you:\n\n", count, site.Designation)
+		for _, cm := range waiting {
+			fmt.Fprintf(&b, "%s, %s:\n%s\n\n", authorOrAnonymous(cm.AuthorName), cm.CreatedAt.Format("2 Jan 15:04"), truncate(cm.Body, 200))
+		}
+		if count > len(waiting) {
+			fmt.Fprintf(&b, "And %d more.\n\n", count-len(waiting))
+		}
+		fmt.Fprintf(&b, "Approve or reject them: %s/admin/sites/%d/comments\n", h.cfg.PublicURL, site.ID)
+
+		h.send(owner.Email, fmt.Sprintf("%d comments waiting on %s", count, site.Designation), b.String(), nil)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	mocket "github.com/selvatico/go-mocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotifyReplyOnApproval(t *testing.T) {
+	mocket.Catcher.Reset()
+	mocket.Catcher.NewMock().WithQuery(`FROM "sites"`).WithReply([]map[string]interface{}{{"id": 3, "user_id": 7, "designation": "blog"}})
+	mocket.Catcher.NewMock().WithQuery(`FROM "comments"`).WithArgs("9", int64(3)).WithReply([]map[string]interface{}{
+		{"id": 9, "site_id": 3, "thread_id": 1, "parent_id": 5, "commenter_id": 13, "author_name": "Joe", "body": "I disagree", "status": StatusPending},
+	})
+	mocket.Catcher.NewMock().WithQuery(`FROM "comments"`).WithArgs(int64(5)).WithReply([]map[string]interface{}{
+		{"id": 5, "site_id": 3, "thread_id": 1, "commenter_id": 12, "notify_replies": true, "status": StatusApproved},
+	})
+	mocket.Catcher.NewMock().WithQuery(`FROM "commenters"`).WithReply([]map[string]interface{}{
+		{"id": 12, "kind": KindGuest, "email": "jane@example.com"},
+	})
+	mocket.Catcher.NewMock().WithQuery(`FROM "threads"`).WithReply([]map[string]interface{}{
+		{"id": 1, "url": "https://example.com/post"},
+	})
+	defer mocket.Catcher.Reset()
+
+	outbox.messages = nil
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/sites/3/comments/9/approve", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.Set("model.user", User{Model: mockSite.Model, Email: "owner@example.com"})
+	c.SetParamNames("id", "comment")
+	c.SetParamValues("3", "9")
+
+	if !assert.NoError(t, h.AdminCommentApprove(c)) || !assert.Len(t, outbox.messages, 1) {
+		return
+	}
+
+	m := outbox.messages[0]
+	assert.Equal(t, "jane@example.com", m.To)
+	assert.Contains(t, m.Text, "Joe replied to your comment on https://example.com/post#comment-9")
+	assert.Contains(t, m.Text, "I disagree")
+	assert.Equal(t, "List-Unsubscribe=One-Click", m.Headers["List-Unsubscribe-Post"])
+
+	unsubscribe, err := url.Parse(strings.Trim(m.Headers["List-Unsubscribe"], "<>"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(unsubscribe.Path, "/unsubscribe/"), "/")
+
+	var updated []driver.NamedValue
+	mocket.Catcher.NewMock().WithQuery(`UPDATE "comments" SET "notify_replies"`).WithCallback(func(_ string, args []driver.NamedValue) {
+		updated = args
+	})
+
+	pairs := []struct {
+		Token        string
+		ExpectedCode int
+	}{
+		{strings.Repeat("0", 64), http.StatusNotFound},
+		{parts[1], http.StatusOK},
+	}
+
+	for _, p := range pairs {
+		req := httptest.NewRequest(http.MethodPost, "/unsubscribe/12/"+p.Token, nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("commenter", "token")
+		c.SetParamValues(parts[0], p.Token)
+
+		if assert.NoError(t, h.UnsubscribePost(c)) {
+			assert.Equal(t, p.ExpectedCode, rec.Code)
+		}
+	}
+
+	if assert.Len(t, updated, 2) {
+		assert.Equal(t, false, updated[0].Value)
+	}
+}
+
+func TestConfirmNotifications(t *testing.T) {
+	mocket.Catcher.Reset()
+
+	var created map[string]driver.Value
+	mocket.Catcher.NewMock().WithQuery(`INSERT INTO "comments"`).WithCallback(func(query string, args []driver.NamedValue) {
+		created = insertedValues(query, args)
+	})
+	defer mocket.Catcher.Reset()
+
+	outbox.messages = nil
+
+	req := httptest.NewRequest(http.MethodPost, "/api/sites/3/comments", strings.NewReader(`{"url":"https://example.com/post","body":"hi","email":"jane@example.com","notify":true}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.Set("model.site", mockSite)
+
+	if !assert.NoError(t, h.CommentsPost(c)) || !assert.Equal(t, http.StatusCreated, rec.Code) || !assert.Len(t, outbox.messages, 1) {
+		return
+	}
+
+	// Guests are only subscribed once they follow the link.
+	assert.Equal(t, false, created["notify_replies"])
+
+	m := outbox.messages[0]
+	assert.Equal(t, "jane@example.com", m.To)
+
+	link, err := url.Parse(strings.Fields(m.Text[strings.Index(m.Text, "confirm it at ")+len("confirm it at "):])[0])
+	if !assert.NoError(t, err) {
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(link.Path, "/notifications/confirm/"), "/")
+	if !assert.Len(t, parts, 2) {
+		return
+	}
+
+	mocket.Catcher.NewMock().WithQuery(`FROM "comments"`).WithReply([]map[string]interface{}{{"id": 5, "site_id": 3}})
+
+	var updated []driver.NamedValue
+	mocket.Catcher.NewMock().WithQuery(`UPDATE "comments" SET "notify_replies"`).WithCallback(func(_ string, args []driver.NamedValue) {
+		updated = args
+	})
+
+	pairs := []struct {
+		Token        string
+		ExpectedCode int
+	}{
+		{strings.Repeat("0", 64), http.StatusNotFound},
+		{parts[1], http.StatusOK},
+	}
+
+	for _, p := range pairs {
+		req := httptest.NewRequest(http.MethodPost, "/notifications/confirm/"+parts[0]+"/"+p.Token, nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("comment", "token")
+		c.SetParamValues(parts[0], p.Token)
+
+		if assert.NoError(t, h.NotificationsConfirmPost(c)) {
+			assert.Equal(t, p.ExpectedCode, rec.Code)
+		}
+	}
+
+	if assert.NotEmpty(t, updated) {
+		assert.Equal(t, true, updated[0].Value)
+	}
+}
+
+func TestDigestsNeedPublicURL(t *testing.T) {
+	done := make(chan struct{})
+	go func() {
+		h.Digests(context.Background())
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Digests run without PUBLIC_URL")
+	}
+}
+
+func TestNotifyOwner(t *testing.T) {
+	mocket.Catcher.Reset().NewMock().WithQuery(`FROM "users"`).WithReply([]map[string]interface{}{
+		{"id": 7, "email": "owner@example.com"},
+	})
+	defer mocket.Catcher.Reset()
+
+	pairs := []struct {
+		Notify   string
+		Body     string
+		Messages int
+	}{
+		{OwnerNotifyOff, `{"url":"https://example.com/post","body":"hi"}`, 0},
+		{OwnerNotifyDigest, `{"url":"https://example.com/post","body":"hi"}`, 0},
+		{OwnerNotifyEach, `{"url":"https://example.com/post","body":"hi","hp":"bot"}`, 0},
+		{OwnerNotifyEach, `{"url":"https://example.com/post","body":"hi"}`, 1},
+	}
+
+	for _, p := range pairs {
+		outbox.messages = nil
+
+		site := mockSite
+		site.OwnerNotify = p.Notify
+
+		req := httptest.NewRequest(http.MethodPost, "/api/sites/3/comments", strings.NewReader(p.Body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("model.site", site)
+
+		if assert.NoError(t, h.CommentsPost(c)) {
+			assert.Equal(t, http.StatusCreated, rec.Code)
+			assert.Len(t, outbox.messages, p.Messages, p.Notify+" "+p.Body)
+		}
+	}
+
+	if assert.Len(t, outbox.messages, 1) {
+		assert.Equal(t, "owner@example.com", outbox.messages[0].To)
+		assert.Contains(t, outbox.messages[0].Text, "Someone commented on https://example.com/post")
+	}
+}
+
+func TestSendDigests(t *testing.T) {
+	mocket.Catcher.Reset()
+	mocket.Catcher.NewMock().WithQuery(`FROM "sites"`).WithReply([]map[string]interface{}{
+		{"id": 3, "user_id": 7, "designation": "blog", "owner_notify": OwnerNotifyDigest},
+	})
+	mocket.Catcher.NewMock().WithQuery(`count(*)`).WithReply([]map[string]interface{}{{"count": 21}})
+	mocket.Catcher.NewMock().WithQuery(`FROM "comments"`).WithReply([]map[string]interface{}{
+		{"id": 5, "author_name": "Jane", "body": "first"},
+		{"id": 6, "body": "second"},
+	})
+	mocket.Catcher.NewMock().WithQuery(`FROM "users"`).WithReply([]map[string]interface{}{
+		{"id": 7, "email": "owner@example.com"},
+	})
+	defer mocket.Catcher.Reset()
+
+	outbox.messages = nil
+	h.sendDigests(time.Now())
+
+	if assert.Len(t, outbox.messages, 1) {
+		m := outbox.messages[0]
+		assert.Equal(t, "owner@example.com", m.To)
+		assert.Equal(t, "21 comments waiting on blog", m.Subject)
+		assert.Contains(t, m.Text, "Jane, ")
+		assert.Contains(t, m.Text, "Someone, ")
+		assert.Contains(t, m.Text, "And 19 more.")
+	}
+}
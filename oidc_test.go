@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/javorszky/go-comments/config"
+	"github.com/javorszky/go-comments/ratelimit"
+	"github.com/javorszky/go-comments/spam"
+	"github.com/labstack/echo"
+	mocket "github.com/selvatico/go-mocket"
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+mockIssuer is a minimal OpenID Connect provider. It hands out an ID token for
+any code, as long as the client authenticates and the PKCE verifier matches
+the challenge it was last sent to authorize with.
+*/
+type mockIssuer struct {
+	*httptest.Server
+	key       *rsa.PrivateKey
+	challenge string
+	nonce     string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &mockIssuer{key: key}
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                m.URL,
+			AuthorizationEndpoint: m.URL + "/authorize",
+			TokenEndpoint:         m.URL + "/token",
+			JWKSURI:               m.URL + "/jwks",
+		})
+	})
+
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []jsonWebKey{{
+				Kty: "RSA",
+				Kid: "test",
+				Use: "sig",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+
+		if id != "gocomments" || secret != "s3cret" || base64.RawURLEncoding.EncodeToString(verifier[:]) != m.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"id_token": m.sign(t, jwt.MapClaims{
+				"iss":            m.URL,
+				"sub":            "user-1",
+				"aud":            "gocomments",
+				"exp":            time.Now().Add(time.Hour).Unix(),
+				"nonce":          m.nonce,
+				"name":           "Jane Doe",
+				"email":          "jane@example.com",
+				"email_verified": true,
+			}),
+		})
+	})
+
+	m.Server = httptest.NewServer(mux)
+	return m
+}
+
+func (m *mockIssuer) sign(t *testing.T, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "test"
+
+	signed, err := token.SignedString(m.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestOIDCSignIn(t *testing.T) {
+	issuer := newMockIssuer(t)
+	defer issuer.Close()
+
+	mocket.Catcher.Reset().NewMock().WithQuery(`FROM "sites"`).WithReply([]map[string]interface{}{
+		{"id": 3, "domains": mockSite.Domains},
+	})
+	defer mocket.Catcher.Reset()
+
+	hh := NewHandler(mpwc, pwh, spam.Pipeline{spam.Honeypot{}}, NewRateLimits(ratelimit.NewMemoryStore()), &recordingMailQueue{}, db, slog.New(slog.NewTextHandler(io.Discard, nil)), &config.Config{
+		SecretKey:        "testsecret",
+		PublicURL:        "https://comments.test",
+		OIDCName:         "Test",
+		OIDCIssuer:       issuer.URL,
+		OIDCClientID:     "gocomments",
+		OIDCClientSecret: "s3cret",
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/auth/oidc/3/global?return=https%3A%2F%2Fexample.com%2Fpost", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("site", "provider")
+	c.SetParamValues("3", globalProvider)
+
+	if !assert.NoError(t, hh.OIDCStart(c)) || !assert.Equal(t, http.StatusFound, rec.Code, rec.Body.String()) {
+		return
+	}
+
+	authURL, err := url.Parse(rec.Header().Get(echo.HeaderLocation))
+	assert.NoError(t, err)
+	assert.Equal(t, issuer.URL+"/authorize", authURL.Scheme+"://"+authURL.Host+authURL.Path)
+	assert.Equal(t, "https://comments.test/auth/oidc/callback", authURL.Query().Get("redirect_uri"))
+	assert.Equal(t, "S256", authURL.Query().Get("code_challenge_method"))
+
+	issuer.challenge = authURL.Query().Get("code_challenge")
+	issuer.nonce = authURL.Query().Get("nonce")
+	state := rec.Result().Cookies()[0]
+
+	pairs := []struct {
+		State        string
+		ExpectedCode int
+	}{
+		{"forged", http.StatusBadRequest},
+		{authURL.Query().Get("state"), http.StatusFound},
+	}
+
+	for _, p := range pairs {
+		req = httptest.NewRequest(http.MethodGet, "/auth/oidc/callback?code=abc&state="+p.State, nil)
+		req.AddCookie(state)
+		rec = httptest.NewRecorder()
+
+		if assert.NoError(t, hh.OIDCCallback(e.NewContext(req, rec))) {
+			assert.Equal(t, p.ExpectedCode, rec.Code, rec.Body.String())
+		}
+	}
+
+	assert.Equal(t, "https://example.com/post", rec.Header().Get(echo.HeaderLocation))
+
+	found := false
+	for _, cookie := range rec.Result().Cookies() {
+		found = found || cookie.Name == commenterCookie
+	}
+	assert.True(t, found)
+}
+
+func TestOIDCStartRejectsForeignReturn(t *testing.T) {
+	mocket.Catcher.Reset().NewMock().WithQuery(`FROM "sites"`).WithReply([]map[string]interface{}{
+		{"id": 3, "domains": mockSite.Domains},
+	})
+	defer mocket.Catcher.Reset()
+
+	hh := NewHandler(mpwc, pwh, spam.Pipeline{spam.Honeypot{}}, NewRateLimits(ratelimit.NewMemoryStore()), &recordingMailQueue{}, db, slog.New(slog.NewTextHandler(io.Discard, nil)), &config.Config{SecretKey: "testsecret", OIDCIssuer: "https://issuer.test"})
+
+	req := httptest.NewRequest(http.MethodGet, "/auth/oidc/3/global?return=https%3A%2F%2Fevil.com%2F", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("site", "provider")
+	c.SetParamValues("3", globalProvider)
+
+	if assert.NoError(t, hh.OIDCStart(c)) {
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	issuer := newMockIssuer(t)
+	defer issuer.Close()
+
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	d, err := discover(oidcHTTPClient, issuer.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	claims := func(change func(jwt.MapClaims)) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"iss":   issuer.URL,
+			"sub":   "user-1",
+			"aud":   []string{"someone", "gocomments"},
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": "n",
+		}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+
+	otherSigned, _ := jwt.NewWithClaims(jwt.SigningMethodRS256, claims(nil)).SignedString(other)
+	hmacSigned, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims(nil)).SignedString(issuer.key.N.Bytes())
+
+	pairs := []struct {
+		Name  string
+		Token string
+		Valid bool
+	}{
+		{"valid", issuer.sign(t, claims(nil)), true},
+		{"wrong nonce", issuer.sign(t, claims(func(c jwt.MapClaims) { c["nonce"] = "x" })), false},
+		{"wrong audience", issuer.sign(t, claims(func(c jwt.MapClaims) { c["aud"] = "someone" })), false},
+		{"wrong issuer", issuer.sign(t, claims(func(c jwt.MapClaims) { c["iss"] = "https://evil.com" })), false},
+		{"expired", issuer.sign(t, claims(func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() })), false},
+		{"other key", otherSigned, false},
+		{"hmac", hmacSigned, false},
+	}
+
+	for _, p := range pairs {
+		_, err := verifyIDToken(oidcHTTPClient, p.Token, d, "gocomments", "n")
+		assert.Equal(t, p.Valid, err == nil, p.Name)
+	}
+}
+
+func TestDiscoverChecksIssuer(t *testing.T) {
+	issuer := newMockIssuer(t)
+	defer issuer.Close()
+
+	_, err := discover(oidcHTTPClient, issuer.URL+"/")
+	assert.Error(t, err)
+}
+
+func TestAdminProvidersPostPrivateIssuer(t *testing.T) {
+	issuer := newMockIssuer(t)
+	defer issuer.Close()
+
+	mocket.Catcher.Reset().NewMock().WithQuery(`FROM "sites"`).WithReply([]map[string]interface{}{{"id": 3, "user_id": 7}})
+	defer mocket.Catcher.Reset()
+
+	pairs := []struct {
+		AllowPrivate bool
+		ExpectedCode int
+	}{
+		{false, http.StatusBadRequest},
+		{true, http.StatusFound},
+	}
+
+	for _, p := range pairs {
+		hh := NewHandler(mpwc, pwh, spam.Pipeline{spam.Honeypot{}}, NewRateLimits(ratelimit.NewMemoryStore()), &recordingMailQueue{}, db, slog.New(slog.NewTextHandler(io.Discard, nil)), &config.Config{SecretKey: "testsecret", WebhookAllowPrivate: p.AllowPrivate})
+
+		form := url.Values{"name": {"Mine"}, "issuer": {issuer.URL}, "clientid": {"gocomments"}}
+		req := httptest.NewRequest(http.MethodPost, "/admin/sites/3/providers", strings.NewReader(form.Encode()))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("model.user", User{Model: mockSite.Model, Email: "owner@example.com"})
+		c.SetParamNames("id")
+		c.SetParamValues("3")
+
+		if assert.NoError(t, hh.AdminProvidersPost(c)) {
+			assert.Equal(t, p.ExpectedCode, rec.Code, rec.Body.String())
+			// The answer doesn't tell what is at the address.
+			assert.NotContains(t, rec.Body.String(), "127.0.0.1")
+		}
+	}
+}
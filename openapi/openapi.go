@@ -0,0 +1,136 @@
+/*
+Package openapi has the OpenAPI 3 document of the public API and the admin
+API under /api/v1, which the app serves at /api/openapi.json and the client
+package is generated from.
+
+Only the parts of OpenAPI the document uses are read into Document.
+*/
+package openapi
+
+import (
+	_ "embed"
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// Spec is the document, as it's served.
+//
+//go:embed openapi.json
+var Spec []byte
+
+// Methods are the HTTP methods operations can have, in the order they're listed.
+var Methods = []string{"get", "post", "put", "patch", "delete"}
+
+type (
+	// Document is an OpenAPI document.
+	Document struct {
+		OpenAPI    string                          `json:"openapi"`
+		Paths      map[string]map[string]Operation `json:"paths"`
+		Components Components                      `json:"components"`
+	}
+
+	// Components are the schemas operations refer to.
+	Components struct {
+		Schemas map[string]*Schema `json:"schemas"`
+	}
+
+	// Operation is what a method does on a path.
+	Operation struct {
+		OperationID string                `json:"operationId"`
+		Summary     string                `json:"summary"`
+		Tags        []string              `json:"tags"`
+		Parameters  []Parameter           `json:"parameters"`
+		RequestBody *Body                 `json:"requestBody"`
+		Responses   map[string]Body       `json:"responses"`
+		Security    []map[string][]string `json:"security"`
+	}
+
+	// Parameter is a path or query parameter of an operation.
+	Parameter struct {
+		Name        string  `json:"name"`
+		In          string  `json:"in"`
+		Description string  `json:"description"`
+		Required    bool    `json:"required"`
+		Schema      *Schema `json:"schema"`
+	}
+
+	// Body is a request body or a response. Ref is set on responses that refer to a shared one.
+	Body struct {
+		Ref         string               `json:"$ref"`
+		Description string               `json:"description"`
+		Required    bool                 `json:"required"`
+		Content     map[string]MediaType `json:"content"`
+	}
+
+	// MediaType is the schema of a body in one content type.
+	MediaType struct {
+		Schema *Schema `json:"schema"`
+	}
+
+	// Schema is a JSON schema. GoName is the x-go-name extension, for properties whose name makes a poor Go name.
+	Schema struct {
+		Ref                  string             `json:"$ref"`
+		Type                 string             `json:"type"`
+		Format               string             `json:"format"`
+		Description          string             `json:"description"`
+		Nullable             bool               `json:"nullable"`
+		Enum                 []string           `json:"enum"`
+		Items                *Schema            `json:"items"`
+		Properties           map[string]*Schema `json:"properties"`
+		Required             []string           `json:"required"`
+		AdditionalProperties *Schema            `json:"additionalProperties"`
+		GoName               string             `json:"x-go-name"`
+	}
+)
+
+// Load reads Spec.
+func Load() (Document, error) {
+	doc := Document{}
+	err := json.Unmarshal(Spec, &doc)
+	return doc, err
+}
+
+// Routes returns the method and path of every operation, like "GET /api/v1/sites/:id", in
+// the form echo routes have, sorted.
+func (d Document) Routes() []string {
+	var routes []string
+	for p, ops := range d.Paths {
+		for method := range ops {
+			routes = append(routes, strings.ToUpper(method)+" "+EchoPath(p))
+		}
+	}
+	sort.Strings(routes)
+	return routes
+}
+
+// EchoPath turns the {parameters} of an OpenAPI path into echo's :parameters.
+func EchoPath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			parts[i] = ":" + strings.Trim(part, "{}")
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// RefName returns the name of the schema a $ref refers to.
+func RefName(ref string) string {
+	return ref[strings.LastIndex(ref, "/")+1:]
+}
+
+// IsRequired tells whether the schema's property has to be there.
+func (s *Schema) IsRequired(property string) bool {
+	for _, r := range s.Required {
+		if r == property {
+			return true
+		}
+	}
+	return false
+}
+
+// JSON returns the schema of the body's JSON, if it has any.
+func (b Body) JSON() *Schema {
+	return b.Content["application/json"].Schema
+}
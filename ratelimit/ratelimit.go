@@ -0,0 +1,230 @@
+/*
+Package ratelimit counts attempts at something, like logging in, per key,
+like an IP address or an account, and says when there were too many.
+
+Attempts are counted in fixed windows. Going over the limit in a window
+locks the key out for a while, and attempts past a softer threshold can be
+slowed down with delays that double with every attempt.
+*/
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Rule is how many attempts are allowed and what happens after.
+type Rule struct {
+	// Limit is how many attempts are allowed in a Window.
+	Limit  int
+	Window time.Duration
+	// Lockout is how long a key is refused for once it went over the Limit.
+	Lockout time.Duration
+	// Attempts after the first DelayAfter in a window are delayed by Delay,
+	// doubling every time, up to MaxDelay. No delays when Delay is zero.
+	DelayAfter int
+	Delay      time.Duration
+	MaxDelay   time.Duration
+}
+
+// Entry is what a Store keeps for a key.
+type Entry struct {
+	Count       int
+	WindowStart time.Time
+	LockedUntil time.Time
+}
+
+// Store keeps the entries of the keys.
+type Store interface {
+	// Update loads the entry of the key, passes it to fn and saves what fn
+	// returns, without other updates of the key in between. Keys that were
+	// never seen have an empty entry.
+	Update(ctx context.Context, key string, fn func(Entry) Entry) (Entry, error)
+	// Get returns the entry of the key.
+	Get(ctx context.Context, key string) (Entry, error)
+	// Delete forgets the key.
+	Delete(ctx context.Context, key string) error
+	// Sweep forgets the keys whose window started and lockout ended before the time.
+	Sweep(ctx context.Context, before time.Time) error
+}
+
+// Result is what a Limiter decided about an attempt.
+type Result struct {
+	Allowed bool
+	// RetryAfter is how long until the key is allowed again, when it isn't.
+	RetryAfter time.Duration
+	// Delay is how long to wait before answering the attempt.
+	Delay time.Duration
+}
+
+// Limiter applies a Rule to the keys in a Store.
+type Limiter struct {
+	Store Store
+	Rule  Rule
+	// Now returns the current time. It's time.Now when nil.
+	Now func() time.Time
+}
+
+func (l Limiter) now() time.Time {
+	if l.Now != nil {
+		return l.Now()
+	}
+	return time.Now()
+}
+
+// Check tells whether the keys are allowed, without counting an attempt.
+func (l Limiter) Check(ctx context.Context, keys ...string) (Result, error) {
+	now := l.now()
+	result := Result{Allowed: true}
+
+	for _, key := range keys {
+		entry, err := l.Store.Get(ctx, key)
+		if err != nil {
+			return result, err
+		}
+
+		if entry.LockedUntil.After(now) {
+			result.Allowed = false
+			result.RetryAfter = maxDuration(result.RetryAfter, entry.LockedUntil.Sub(now))
+		}
+	}
+
+	return result, nil
+}
+
+// Hit counts an attempt for each of the keys, and tells whether all of them are still allowed.
+func (l Limiter) Hit(ctx context.Context, keys ...string) (Result, error) {
+	now := l.now()
+	result := Result{Allowed: true}
+
+	for _, key := range keys {
+		entry, err := l.Store.Update(ctx, key, func(e Entry) Entry {
+			if e.LockedUntil.After(now) {
+				return e
+			}
+
+			if now.Sub(e.WindowStart) >= l.Rule.Window {
+				e = Entry{WindowStart: now}
+			}
+
+			e.Count++
+			if e.Count > l.Rule.Limit {
+				e.LockedUntil = now.Add(l.Rule.Lockout)
+			}
+			return e
+		})
+		if err != nil {
+			return result, err
+		}
+
+		if entry.LockedUntil.After(now) {
+			result.Allowed = false
+			result.RetryAfter = maxDuration(result.RetryAfter, entry.LockedUntil.Sub(now))
+			continue
+		}
+
+		result.Delay = maxDuration(result.Delay, l.delay(entry.Count))
+	}
+
+	return result, nil
+}
+
+// Reset forgets the attempts of the keys, like after a successful login.
+func (l Limiter) Reset(ctx context.Context, keys ...string) error {
+	for _, key := range keys {
+		if err := l.Store.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l Limiter) delay(count int) time.Duration {
+	over := count - l.Rule.DelayAfter
+	if l.Rule.Delay == 0 || over <= 0 {
+		return 0
+	}
+
+	d := float64(l.Rule.Delay) * math.Pow(2, float64(over-1))
+	if l.Rule.MaxDelay > 0 && d > float64(l.Rule.MaxDelay) {
+		return l.Rule.MaxDelay
+	}
+	return time.Duration(d)
+}
+
+// Wait sleeps for the delay, or until the context is done.
+func Wait(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// MemoryStore is a Store that keeps the entries in memory, for a single instance of the app.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]Entry
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: map[string]Entry{}}
+}
+
+// Update changes the entry of the key while holding the store's lock.
+func (m *MemoryStore) Update(ctx context.Context, key string, fn func(Entry) Entry) (Entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e := fn(m.entries[key])
+	m.entries[key] = e
+	return e, nil
+}
+
+// Get returns the entry of the key.
+func (m *MemoryStore) Get(ctx context.Context, key string) (Entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.entries[key], nil
+}
+
+// Delete forgets the key.
+func (m *MemoryStore) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.entries, key)
+	return nil
+}
+
+// Sweep forgets the keys that are done with.
+func (m *MemoryStore) Sweep(ctx context.Context, before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, e := range m.entries {
+		if e.WindowStart.Before(before) && e.LockedUntil.Before(before) {
+			delete(m.entries, key)
+		}
+	}
+	return nil
+}
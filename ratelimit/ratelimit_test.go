@@ -0,0 +1,73 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	l := Limiter{
+		Store: NewMemoryStore(),
+		Rule: Rule{
+			Limit:      4,
+			Window:     time.Minute,
+			Lockout:    10 * time.Minute,
+			DelayAfter: 1,
+			Delay:      time.Second,
+			MaxDelay:   3 * time.Second,
+		},
+		Now: func() time.Time { return now },
+	}
+
+	delays := []time.Duration{0, time.Second, 2 * time.Second, 3 * time.Second}
+	for i, d := range delays {
+		r, err := l.Hit(ctx, "ip")
+		assert.NoError(t, err)
+		assert.True(t, r.Allowed, i)
+		assert.Equal(t, d, r.Delay, i)
+	}
+
+	r, _ := l.Hit(ctx, "ip", "other")
+	assert.False(t, r.Allowed)
+	assert.Equal(t, 10*time.Minute, r.RetryAfter)
+
+	r, _ = l.Check(ctx, "other")
+	assert.True(t, r.Allowed, "keys are counted separately")
+
+	// Still locked after the window, until the lockout ends.
+	now = now.Add(5 * time.Minute)
+	r, _ = l.Check(ctx, "ip")
+	assert.False(t, r.Allowed)
+	assert.Equal(t, 5*time.Minute, r.RetryAfter)
+
+	now = now.Add(5 * time.Minute)
+	r, _ = l.Hit(ctx, "ip")
+	assert.True(t, r.Allowed)
+	assert.Equal(t, time.Duration(0), r.Delay, "a new window starts over")
+
+	assert.NoError(t, l.Reset(ctx, "ip"))
+	e, _ := l.Store.Get(ctx, "ip")
+	assert.Equal(t, Entry{}, e)
+}
+
+func TestMemoryStoreSweep(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	m := NewMemoryStore()
+
+	m.Update(ctx, "old", func(Entry) Entry { return Entry{Count: 1, WindowStart: now.Add(-time.Hour)} })
+	m.Update(ctx, "locked", func(Entry) Entry {
+		return Entry{Count: 9, WindowStart: now.Add(-time.Hour), LockedUntil: now.Add(time.Hour)}
+	})
+	m.Update(ctx, "new", func(Entry) Entry { return Entry{Count: 1, WindowStart: now} })
+
+	assert.NoError(t, m.Sweep(ctx, now.Add(-time.Minute)))
+	assert.Len(t, m.entries, 2)
+	assert.NotContains(t, m.entries, "old")
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/javorszky/go-comments/ratelimit"
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+)
+
+// RateLimit model definition. What the database backed rate limit store keeps for a key.
+// Times are Unix milliseconds, so the zero time fits in the column.
+type RateLimit struct {
+	LimitKey    string `gorm:"type:varchar(191);primary_key"`
+	Count       int
+	WindowStart int64 `gorm:"index:rate_limit_window_start"`
+	LockedUntil int64
+}
+
+func (r RateLimit) entry() ratelimit.Entry {
+	return ratelimit.Entry{
+		Count:       r.Count,
+		WindowStart: time.UnixMilli(r.WindowStart),
+		LockedUntil: time.UnixMilli(r.LockedUntil),
+	}
+}
+
+/*
+dbRateLimitStore keeps rate limits in the database, so every instance of the
+app behind a load balancer counts the same attempts. Updates lock the key's
+row for the length of a transaction.
+*/
+type dbRateLimitStore struct {
+	db *gorm.DB
+}
+
+// Update changes the entry of the key in a transaction that holds its row locked.
+func (s dbRateLimitStore) Update(ctx context.Context, key string, fn func(ratelimit.Entry) ratelimit.Entry) (ratelimit.Entry, error) {
+	zero := time.Time{}.UnixMilli()
+
+	tx := s.db.Begin()
+
+	if err := tx.Exec("INSERT IGNORE INTO rate_limits (limit_key, count, window_start, locked_until) VALUES (?, 0, ?, ?)", key, zero, zero).Error; err != nil {
+		tx.Rollback()
+		return ratelimit.Entry{}, err
+	}
+
+	row := RateLimit{}
+	if err := tx.Set("gorm:query_option", "FOR UPDATE").Where("limit_key = ?", key).First(&row).Error; err != nil {
+		tx.Rollback()
+		return ratelimit.Entry{}, err
+	}
+
+	e := fn(row.entry())
+	row = RateLimit{
+		LimitKey:    key,
+		Count:       e.Count,
+		WindowStart: e.WindowStart.UnixMilli(),
+		LockedUntil: e.LockedUntil.UnixMilli(),
+	}
+
+	if err := tx.Save(&row).Error; err != nil {
+		tx.Rollback()
+		return ratelimit.Entry{}, err
+	}
+
+	return e, tx.Commit().Error
+}
+
+// Get returns the entry of the key.
+func (s dbRateLimitStore) Get(ctx context.Context, key string) (ratelimit.Entry, error) {
+	row := RateLimit{}
+
+	result := s.db.Where("limit_key = ?", key).First(&row)
+	if result.RecordNotFound() {
+		return ratelimit.Entry{}, nil
+	}
+
+	return row.entry(), result.Error
+}
+
+// Delete forgets the key.
+func (s dbRateLimitStore) Delete(ctx context.Context, key string) error {
+	return s.db.Where("limit_key = ?", key).Delete(RateLimit{}).Error
+}
+
+// Sweep forgets the keys that are done with.
+func (s dbRateLimitStore) Sweep(ctx context.Context, before time.Time) error {
+	return s.db.Where("window_start < ? AND locked_until < ?", before.UnixMilli(), before.UnixMilli()).Delete(RateLimit{}).Error
+}
+
+/*
+RateLimits are the limiters of the things people could try too often. Failed
+logins are limited per IP address and per account, registrations per IP
+address, comments per IP address and per commenter on each site, and votes
+per voter on each site.
+*/
+type RateLimits struct {
+	LoginIP      ratelimit.Limiter
+	LoginAccount ratelimit.Limiter
+	Register     ratelimit.Limiter
+	Comments     ratelimit.Limiter
+	Votes        ratelimit.Limiter
+}
+
+// NewRateLimits returns the limiters with their default rules, keeping their counts in store.
+func NewRateLimits(store ratelimit.Store) *RateLimits {
+	return &RateLimits{
+		LoginIP: ratelimit.Limiter{Store: store, Rule: ratelimit.Rule{
+			Limit:   20,
+			Window:  15 * time.Minute,
+			Lockout: 15 * time.Minute,
+		}},
+		LoginAccount: ratelimit.Limiter{Store: store, Rule: ratelimit.Rule{
+			Limit:      5,
+			Window:     15 * time.Minute,
+			Lockout:    15 * time.Minute,
+			DelayAfter: 2,
+			Delay:      time.Second,
+			MaxDelay:   4 * time.Second,
+		}},
+		Register: ratelimit.Limiter{Store: store, Rule: ratelimit.Rule{
+			Limit:   5,
+			Window:  time.Hour,
+			Lockout: time.Hour,
+		}},
+		Comments: ratelimit.Limiter{Store: store, Rule: ratelimit.Rule{
+			Limit:   5,
+			Window:  time.Minute,
+			Lockout: 5 * time.Minute,
+		}},
+		Votes: ratelimit.Limiter{Store: store, Rule: ratelimit.Rule{
+			Limit:   30,
+			Window:  time.Minute,
+			Lockout: 5 * time.Minute,
+		}},
+	}
+}
+
+// NewRateLimitStore returns the store the config asks for: memory, or database.
+func NewRateLimitStore(kind string, db *gorm.DB) (ratelimit.Store, error) {
+	switch kind {
+	case "", "memory":
+		return ratelimit.NewMemoryStore(), nil
+	case "database":
+		return dbRateLimitStore{db}, nil
+	}
+	return nil, fmt.Errorf("unknown rate limit store %q", kind)
+}
+
+// SweepRateLimits forgets rate limit keys nobody tried in a day, every ten minutes until ctx is done.
+func SweepRateLimits(store ratelimit.Store, logger *slog.Logger) func(ctx context.Context) {
+	return func(ctx context.Context) {
+		ticker := time.NewTicker(10 * time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				if err := store.Sweep(ctx, now.Add(-24*time.Hour)); err != nil {
+					logger.Warn("Sweeping rate limits failed", "error", err)
+				}
+			}
+		}
+	}
+}
+
+/*
+allowed tells whether a rate limited request may go on, once its delay is
+waited out. If the store failed the request is let through, so a database
+hiccup doesn't lock everyone out.
+*/
+func (h *Handlers) allowed(c echo.Context, result ratelimit.Result, err error) bool {
+	if err != nil {
+		h.logger(c).Warn("rate limit store failed", "error", err)
+		return true
+	}
+
+	if !result.Allowed {
+		return false
+	}
+
+	ratelimit.Wait(c.Request().Context(), result.Delay)
+	return true
+}
+
+// tooManyRequests answers 429 with a Retry-After header.
+func tooManyRequests(c echo.Context, retryAfter time.Duration) error {
+	seconds := int(retryAfter.Round(time.Second) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	c.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+	return c.JSON(http.StatusTooManyRequests, ResponseError{"Too many attempts. Try again later."})
+}
+
+/*
+clientIP returns the address the request came from. That's the other end of
+the connection, unless it is one of the trusted proxies: then X-Forwarded-For
+is read from the right, and the first hop that isn't a trusted proxy is it.
+Anyone can send the header, so it isn't believed from anywhere else.
+*/
+func clientIP(c echo.Context, trusted []*net.IPNet) string {
+	req := c.Request()
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+
+	hops := strings.Split(strings.Join(req.Header[echo.HeaderXForwardedFor], ","), ",")
+	for i := len(hops) - 1; i >= 0 && trustedProxy(ip, trusted); i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+	}
+
+	return ip
+}
+
+// trustedProxy tells whether ip is in any of the trusted ranges.
+func trustedProxy(ip string, trusted []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	for _, n := range trusted {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// loginKeys returns the rate limit keys of a login attempt from the request's IP to the account.
+func (h *Handlers) loginKeys(c echo.Context, email string) (ip, account string) {
+	return "login:ip:" + clientIP(c, h.cfg.TrustedProxies), "login:account:" + strings.ToLower(email)
+}
+
+// commentKeys returns the rate limit keys of posting a comment on the site.
+func (h *Handlers) commentKeys(c echo.Context, site Site, commenter Commenter, found bool) []string {
+	keys := []string{fmt.Sprintf("comment:%d:ip:%s", site.ID, clientIP(c, h.cfg.TrustedProxies))}
+	if found {
+		keys = append(keys, fmt.Sprintf("comment:%d:commenter:%d", site.ID, commenter.ID))
+	}
+	return keys
+}
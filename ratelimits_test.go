@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/javorszky/go-comments/config"
+	"github.com/javorszky/go-comments/ratelimit"
+	"github.com/javorszky/go-comments/spam"
+	"github.com/labstack/echo"
+	mocket "github.com/selvatico/go-mocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func limitedHandler() Handlers {
+	return NewHandler(mpwc, pwh, spam.Pipeline{}, NewRateLimits(ratelimit.NewMemoryStore()), &recordingMailQueue{}, db, slog.New(slog.NewTextHandler(io.Discard, nil)), &config.Config{SecretKey: "testsecret"})
+}
+
+func TestLoginPostSameAnswerForUnknownEmails(t *testing.T) {
+	mocket.Catcher.Reset().NewMock().WithQuery(`FROM "users"`).WithArgs("known@example.com").WithReply([]map[string]interface{}{
+		{"id": 1, "email": "known@example.com", "hashed_password": "hashed"},
+	})
+	defer mocket.Catcher.Reset()
+
+	hh := limitedHandler()
+	var answers []string
+
+	for _, email := range []string{"known%40example.com", "unknown%40example.com"} {
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader("email="+email+"&password=wrongpassword"))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		rec := httptest.NewRecorder()
+
+		if assert.NoError(t, hh.LoginPost(e.NewContext(req, rec))) {
+			assert.Equal(t, http.StatusUnauthorized, rec.Code)
+			answers = append(answers, rec.Body.String())
+		}
+	}
+
+	if assert.Len(t, answers, 2) {
+		assert.Equal(t, answers[0], answers[1])
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	hh := limitedHandler()
+	hh.limits.LoginAccount.Rule.Delay = 0
+
+	login := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader("email=victim%40example.com&password=guess"))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		rec := httptest.NewRecorder()
+		hh.LoginPost(e.NewContext(req, rec))
+		return rec.Code
+	}
+
+	register := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(mockBadUser))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		hh.RegisterPost(e.NewContext(req, rec))
+		return rec.Code
+	}
+
+	comment := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/api/sites/3/comments", strings.NewReader(`{"url":"https://example.com/post","body":"hi"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("model.site", mockSite)
+		hh.CommentsPost(c)
+		return rec.Code
+	}
+
+	pairs := []struct {
+		Name    string
+		Attempt func() int
+		Allowed int
+		Code    int
+	}{
+		{"login", login, hh.limits.LoginAccount.Rule.Limit + 1, http.StatusUnauthorized},
+		{"register", register, hh.limits.Register.Rule.Limit, http.StatusUnprocessableEntity},
+		{"comment", comment, hh.limits.Comments.Rule.Limit, http.StatusCreated},
+	}
+
+	for _, p := range pairs {
+		for i := 0; i < p.Allowed; i++ {
+			assert.Equal(t, p.Code, p.Attempt(), "%s %d", p.Name, i)
+		}
+
+		assert.Equal(t, http.StatusTooManyRequests, p.Attempt(), p.Name)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	trusted := []*net.IPNet{proxies}
+
+	pairs := []struct {
+		RemoteAddr   string
+		ForwardedFor string
+		ExpectedIP   string
+	}{
+		{"192.0.2.1:1234", "", "192.0.2.1"},
+		{"192.0.2.1:1234", "198.51.100.7", "192.0.2.1"},
+		{"10.0.0.2:1234", "", "10.0.0.2"},
+		{"10.0.0.2:1234", "198.51.100.7", "198.51.100.7"},
+		{"10.0.0.2:1234", "203.0.113.9, 198.51.100.7", "198.51.100.7"},
+		{"10.0.0.2:1234", "203.0.113.9, 198.51.100.7, 10.0.0.3", "198.51.100.7"},
+		{"10.0.0.2:1234", "10.0.0.4, 10.0.0.3", "10.0.0.4"},
+		{"10.0.0.2:1234", "nonsense", "10.0.0.2"},
+	}
+
+	for _, p := range pairs {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = p.RemoteAddr
+		if p.ForwardedFor != "" {
+			req.Header.Set(echo.HeaderXForwardedFor, p.ForwardedFor)
+		}
+
+		assert.Equal(t, p.ExpectedIP, clientIP(e.NewContext(req, httptest.NewRecorder()), trusted), "%s %s", p.RemoteAddr, p.ForwardedFor)
+	}
+}
+
+func TestRateLimitsIgnoreSpoofedForwardedFor(t *testing.T) {
+	hh := limitedHandler()
+
+	comment := func(forwardedFor string) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/sites/3/comments", strings.NewReader(`{"url":"https://example.com/post","body":"hi"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(echo.HeaderXForwardedFor, forwardedFor)
+		req.Header.Set(echo.HeaderXRealIP, forwardedFor)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("model.site", mockSite)
+		hh.CommentsPost(c)
+		return rec.Code
+	}
+
+	for i := 0; i < hh.limits.Comments.Rule.Limit; i++ {
+		assert.Equal(t, http.StatusCreated, comment(fmt.Sprintf("198.51.100.%d", i)), i)
+	}
+
+	assert.Equal(t, http.StatusTooManyRequests, comment("203.0.113.1"))
+}
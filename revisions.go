@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/javorszky/go-comments/diff"
+	"github.com/labstack/echo"
+)
+
+// Who can edit comments.
+const (
+	// EditorAuthor is the commenter who wrote the comment, within the site's edit window.
+	EditorAuthor = "author"
+	// EditorModerator is the user who runs the site, at any time.
+	EditorModerator = "moderator"
+)
+
+/*
+Revision model definition. A revision is one edit of a comment: Body is what
+the comment said before it, and the editor is who made it. The first
+revision of a comment holds what it was posted with.
+
+Status is the comment's status at the time, so edits made after a moderator
+approved the comment stand out.
+*/
+type Revision struct {
+	ID         uint `gorm:"primary_key"`
+	CreatedAt  time.Time
+	CommentID  uint   `gorm:"index:revision_comment"`
+	Body       string `gorm:"type:text"`
+	Status     string `gorm:"type:varchar(16)"`
+	EditorKind string `gorm:"type:varchar(16)"`
+	EditorID   uint
+}
+
+// Edit is a revision along with what it changed.
+type Edit struct {
+	Revision
+	Changes []diff.Change
+}
+
+// AfterApproval tells whether the comment was already approved when it was edited.
+func (e Edit) AfterApproval() bool {
+	return e.Status == StatusApproved
+}
+
+// PublicRevision is what readers get to see of an edit.
+type PublicRevision struct {
+	Editor   string        `json:"editor"`
+	EditedAt time.Time     `json:"editedAt"`
+	Changes  []diff.Change `json:"changes"`
+}
+
+/*
+editComment changes the body of a comment, and its status and spam reasons
+to the ones given, and keeps what it said before as a revision. Nothing is
+saved when the body is the same.
+*/
+func (h *Handlers) editComment(comment Comment, site Site, body, status, spamReasons, editorKind string, editorID uint) (Comment, error) {
+	if body == comment.Body {
+		return comment, nil
+	}
+
+	tx := h.db.Begin()
+
+	revision := Revision{
+		CommentID:  comment.ID,
+		Body:       comment.Body,
+		Status:     comment.Status,
+		EditorKind: editorKind,
+		EditorID:   editorID,
+	}
+
+	if err := tx.Create(&revision).Error; err != nil {
+		tx.Rollback()
+		return comment, err
+	}
+
+	now := time.Now()
+	comment.Body = body
+	comment.BodyHTML = renderBody(site, body)
+	comment.EditedAt = &now
+	comment.Status = status
+	comment.SpamReasons = spamReasons
+
+	if err := tx.Model(&comment).Updates(map[string]interface{}{
+		"body":         comment.Body,
+		"body_html":    comment.BodyHTML,
+		"edited_at":    comment.EditedAt,
+		"status":       comment.Status,
+		"spam_reasons": comment.SpamReasons,
+	}).Error; err != nil {
+		tx.Rollback()
+		return comment, err
+	}
+
+	return comment, tx.Commit().Error
+}
+
+// history returns the edits of the comment, oldest first, with what each of them changed.
+func (h *Handlers) history(comment Comment) []Edit {
+	var revisions []Revision
+
+	h.db.Where("comment_id = ?", comment.ID).Order("created_at asc, id asc").Find(&revisions)
+
+	edits := make([]Edit, 0, len(revisions))
+	for i, r := range revisions {
+		after := comment.Body
+		if i+1 < len(revisions) {
+			after = revisions[i+1].Body
+		}
+		edits = append(edits, Edit{r, diff.Words(r.Body, after)})
+	}
+
+	return edits
+}
+
+/*
+CommentsRevisions handles GET /api/sites/:site/comments/:comment/revisions
+with the edits of an approved comment.
+
+Moderators edit comments to take things out of them, so readers don't get
+to see what the comment said before a moderator's edit: the edit is listed
+without its changes, and the ones before it are left out.
+*/
+func (h *Handlers) CommentsRevisions(c echo.Context) error {
+	site, ok := c.Get("model.site").(Site)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	comment := Comment{}
+
+	if h.db.Where("id = ? AND site_id = ? AND status = ?", c.Param("comment"), site.ID, StatusApproved).First(&comment).RecordNotFound() {
+		return c.JSON(http.StatusNotFound, ResponseError{"No such comment."})
+	}
+
+	revisions := []PublicRevision{}
+	for _, e := range h.history(comment) {
+		if e.EditorKind == EditorModerator {
+			revisions = []PublicRevision{{Editor: e.EditorKind, EditedAt: e.CreatedAt, Changes: []diff.Change{}}}
+			continue
+		}
+
+		revisions = append(revisions, PublicRevision{
+			Editor:   e.EditorKind,
+			EditedAt: e.CreatedAt,
+			Changes:  e.Changes,
+		})
+	}
+
+	return c.JSON(http.StatusOK, revisions)
+}
+
+// adminComment looks up the comment in the :comment route parameter on a site the user moderates.
+func (h *Handlers) adminComment(c echo.Context) (Site, Comment, error) {
+	comment := Comment{}
+
+	site, ok := h.siteFor(c, RoleModerator)
+	if !ok {
+		return site, comment, fmt.Errorf("No such site")
+	}
+
+	if h.db.Where("id = ? AND site_id = ?", c.Param("comment"), site.ID).First(&comment).RecordNotFound() {
+		return site, comment, fmt.Errorf("No such comment")
+	}
+
+	return site, comment, nil
+}
+
+// AdminCommentEdit handles GET /admin/sites/:id/comments/:comment/edit to show a comment's history and a form to change it.
+func (h *Handlers) AdminCommentEdit(c echo.Context) error {
+	site, comment, err := h.adminComment(c)
+	if err != nil {
+		return c.String(http.StatusNotFound, err.Error())
+	}
+
+	return c.Render(http.StatusOK, "admineditcomment", struct {
+		Csrf    interface{}
+		Site    Site
+		Comment Comment
+		Edits   []Edit
+	}{
+		Csrf:    c.Get("csrf"),
+		Site:    site,
+		Comment: comment,
+		Edits:   h.history(comment),
+	})
+}
+
+// AdminCommentEditPost handles POST /admin/sites/:id/comments/:comment/edit for moderators to change a comment.
+func (h *Handlers) AdminCommentEditPost(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	site, comment, err := h.adminComment(c)
+	if err != nil {
+		return c.String(http.StatusNotFound, err.Error())
+	}
+
+	body := strings.ReplaceAll(c.FormValue("body"), "\r\n", "\n")
+	if err := validateBody(body); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	if _, err := h.editComment(comment, site, body, comment.Status, comment.SpamReasons, EditorModerator, user.ID); err != nil {
+		return c.String(http.StatusBadRequest, "Something failed while saving")
+	}
+
+	h.audit(c, user.ID, auditCommentEdit, fmt.Sprintf("site %d: comment %d", site.ID, comment.ID))
+
+	return c.Redirect(http.StatusFound, fmt.Sprintf("/admin/sites/%d/comments/%d/edit", site.ID, comment.ID))
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/javorszky/go-comments/diff"
+	"github.com/javorszky/go-comments/spam"
+	"github.com/labstack/echo"
+	mocket "github.com/selvatico/go-mocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommentsPutKeepsRevision(t *testing.T) {
+	mocket.Catcher.Reset()
+	mocket.Catcher.NewMock().WithQuery(`FROM "commenters"`).WithReply([]map[string]interface{}{
+		{"id": 12, "kind": KindGuest},
+	})
+	mocket.Catcher.NewMock().WithQuery(`FROM "comments"`).WithReply([]map[string]interface{}{
+		{"id": 5, "site_id": 3, "commenter_id": 12, "body": "first", "status": StatusApproved, "created_at": time.Now()},
+	})
+	defer mocket.Catcher.Reset()
+
+	var revision []driver.NamedValue
+	mocket.Catcher.NewMock().WithQuery(`INSERT INTO "revisions"`).WithCallback(func(_ string, args []driver.NamedValue) {
+		revision = args
+	})
+
+	req := httptest.NewRequest(http.MethodPut, "/api/sites/3/comments/5", strings.NewReader(`{"body":"*second*"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	value := fmt.Sprintf("12|%d", time.Now().Add(time.Hour).Unix())
+	req.AddCookie(&http.Cookie{Name: commenterCookie, Value: value + "|" + h.sign(value)})
+
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.Set("model.site", mockSite)
+	c.SetParamNames("comment")
+	c.SetParamValues("5")
+
+	if !assert.NoError(t, h.CommentsPut(c)) || !assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String()) {
+		return
+	}
+
+	var comment PublicComment
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &comment))
+	assert.Equal(t, "<p><em>second</em></p>\n", comment.HTML)
+	assert.NotNil(t, comment.EditedAt)
+
+	var values []interface{}
+	for _, arg := range revision {
+		values = append(values, arg.Value)
+	}
+	assert.Contains(t, values, "first")
+	assert.Contains(t, values, StatusApproved)
+	assert.Contains(t, values, EditorAuthor)
+}
+
+func TestCommentsPutModeratesAgain(t *testing.T) {
+	hh := h
+	hh.spam = spam.Pipeline{spam.Links{Max: 0}}
+
+	pairs := []struct {
+		Status         string
+		Body           string
+		ExpectedStatus string
+		ExpectedPublic string
+	}{
+		{StatusApproved, "harmless after all", StatusPending, StatusPending},
+		{StatusApproved, "buy now at https://spam.example.com", StatusSpam, StatusPending},
+		{StatusPending, "still harmless", StatusPending, StatusPending},
+	}
+
+	for _, p := range pairs {
+		mocket.Catcher.Reset()
+		mocket.Catcher.NewMock().WithQuery(`FROM "commenters"`).WithReply([]map[string]interface{}{
+			{"id": 12, "kind": KindGuest},
+		})
+		mocket.Catcher.NewMock().WithQuery(`FROM "comments"`).WithReply([]map[string]interface{}{
+			{"id": 5, "site_id": 3, "commenter_id": 12, "body": "harmless", "status": p.Status, "created_at": time.Now()},
+		})
+
+		var updated []interface{}
+		mocket.Catcher.NewMock().WithQuery(`UPDATE "comments"`).WithCallback(func(_ string, args []driver.NamedValue) {
+			for _, arg := range args {
+				updated = append(updated, arg.Value)
+			}
+		})
+
+		req := httptest.NewRequest(http.MethodPut, "/api/sites/3/comments/5", strings.NewReader(fmt.Sprintf(`{"body":%q}`, p.Body)))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		value := fmt.Sprintf("12|%d", time.Now().Add(time.Hour).Unix())
+		req.AddCookie(&http.Cookie{Name: commenterCookie, Value: value + "|" + h.sign(value)})
+
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("model.site", mockSite)
+		c.SetParamNames("comment")
+		c.SetParamValues("5")
+
+		if !assert.NoError(t, hh.CommentsPut(c)) || !assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String()) {
+			continue
+		}
+
+		assert.Contains(t, updated, p.ExpectedStatus, p.Body)
+
+		var comment PublicComment
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &comment))
+		assert.Equal(t, p.ExpectedPublic, comment.Status, p.Body)
+	}
+
+	mocket.Catcher.Reset()
+}
+
+func TestCommentsRevisionsHidesModeratedText(t *testing.T) {
+	mocket.Catcher.Reset()
+	mocket.Catcher.NewMock().WithQuery(`FROM "comments"`).WithReply([]map[string]interface{}{
+		{"id": 5, "site_id": 3, "body": "sorry everyone", "status": StatusApproved},
+	})
+	mocket.Catcher.NewMock().WithQuery(`FROM "revisions"`).WithReply([]map[string]interface{}{
+		{"id": 1, "comment_id": 5, "body": "hello", "editor_kind": EditorAuthor},
+		{"id": 2, "comment_id": 5, "body": "hello you idiots", "editor_kind": EditorModerator},
+		{"id": 3, "comment_id": 5, "body": "hello [removed]", "editor_kind": EditorAuthor},
+	})
+	defer mocket.Catcher.Reset()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/sites/3/comments/5/revisions", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.Set("model.site", mockSite)
+	c.SetParamNames("comment")
+	c.SetParamValues("5")
+
+	if !assert.NoError(t, h.CommentsRevisions(c)) || !assert.Equal(t, http.StatusOK, rec.Code) {
+		return
+	}
+
+	assert.NotContains(t, rec.Body.String(), "idiots")
+
+	var revisions []PublicRevision
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &revisions))
+
+	if assert.Len(t, revisions, 2) {
+		assert.Equal(t, EditorModerator, revisions[0].Editor)
+		assert.Empty(t, revisions[0].Changes)
+		assert.Equal(t, "hello [removed]", diff.Old(revisions[1].Changes))
+		assert.Equal(t, "sorry everyone", diff.New(revisions[1].Changes))
+	}
+}
+
+func TestAdminCommentEditPost(t *testing.T) {
+	mocket.Catcher.Reset()
+	mocket.Catcher.NewMock().WithQuery(`FROM "sites"`).WithReply([]map[string]interface{}{{"id": 3, "user_id": 7}})
+	mocket.Catcher.NewMock().WithQuery(`FROM "comments"`).WithReply([]map[string]interface{}{
+		{"id": 5, "site_id": 3, "body": "line one\nline two", "status": StatusApproved, "created_at": time.Now().Add(-48 * time.Hour)},
+	})
+	defer mocket.Catcher.Reset()
+
+	var inserts int
+	mocket.Catcher.NewMock().WithQuery(`INSERT INTO "revisions"`).WithCallback(func(_ string, args []driver.NamedValue) {
+		inserts++
+	})
+
+	pairs := []struct {
+		Body         string
+		ExpectedCode int
+		Inserts      int
+	}{
+		{"", http.StatusBadRequest, 0},
+		// Browsers send textareas with CRLF line ends, which aren't an edit.
+		{"line one\r\nline two", http.StatusFound, 0},
+		{"line one", http.StatusFound, 1},
+	}
+
+	for _, p := range pairs {
+		req := httptest.NewRequest(http.MethodPost, "/admin/sites/3/comments/5/edit", strings.NewReader("body="+strings.NewReplacer("\r", "%0D", "\n", "%0A").Replace(p.Body)))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("model.user", User{Model: mockSite.Model, Email: "owner@example.com"})
+		c.SetParamNames("id", "comment")
+		c.SetParamValues("3", "5")
+
+		if assert.NoError(t, h.AdminCommentEditPost(c)) {
+			assert.Equal(t, p.ExpectedCode, rec.Code, p.Body)
+			assert.Equal(t, p.Inserts, inserts, p.Body)
+		}
+	}
+}
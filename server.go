@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// listenFDsEnv tells a restarted process how many listening sockets it
+// inherited from its parent. They start at file descriptor 3.
+const listenFDsEnv = "GOCOMMENTS_LISTEN_FDS"
+
+/*
+Server runs the app over https, and the redirect handler over plain http.
+
+Run blocks until the process receives SIGINT or SIGTERM, then stops accepting
+connections and waits up to ShutdownTimeout for the requests in flight to
+finish.
+
+On SIGHUP the listening sockets are handed to a fresh copy of the binary
+before shutting down the same way, so a restart does not drop connections:
+the kernel queues them until the new process starts accepting.
+*/
+type Server struct {
+	Echo            *echo.Echo
+	Redirect        http.Handler
+	TLSConfig       *tls.Config
+	HTTPAddr        string
+	TLSAddr         string
+	ShutdownTimeout time.Duration
+
+	redirect  *http.Server
+	listeners []*net.TCPListener
+}
+
+// Run starts both servers and blocks until they have been shut down.
+func (s *Server) Run() error {
+	listeners, err := listen(s.HTTPAddr, s.TLSAddr)
+	if err != nil {
+		return err
+	}
+	s.listeners = listeners
+
+	errs := make(chan error, 2)
+
+	s.redirect = &http.Server{Handler: s.Redirect}
+	go func() {
+		errs <- s.redirect.Serve(listeners[0])
+	}()
+
+	s.Echo.TLSServer.TLSConfig = s.TLSConfig
+	s.Echo.TLSListener = tls.NewListener(listeners[1], s.TLSConfig)
+	go func() {
+		errs <- s.Echo.StartServer(s.Echo.TLSServer)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	return s.wait(errs, signals)
+}
+
+/*
+wait serves until a server fails or a signal arrives. A failed restart is
+logged, and the process keeps serving until the next signal.
+*/
+func (s *Server) wait(errs chan error, signals chan os.Signal) error {
+	for {
+		select {
+		case err := <-errs:
+			s.shutdown()
+			return err
+		case sig := <-signals:
+			if sig != syscall.SIGHUP {
+				slog.Info("Shutting down", "signal", sig.String())
+				return s.shutdown()
+			}
+			if err := s.handOff(); err != nil {
+				slog.Error("Restart failed, keeping this process running", "error", err)
+				continue
+			}
+			slog.Info("Started new process, shutting this one down")
+			return s.shutdown()
+		}
+	}
+}
+
+// shutdown stops both servers, letting in-flight requests finish within the
+// shutdown timeout.
+func (s *Server) shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+	defer cancel()
+
+	redirectErr := s.redirect.Shutdown(ctx)
+	if err := s.Echo.Shutdown(ctx); err != nil {
+		return fmt.Errorf("shutting down https server failed: %v", err)
+	}
+	if redirectErr != nil {
+		return fmt.Errorf("shutting down http server failed: %v", redirectErr)
+	}
+
+	return nil
+}
+
+// handOff starts a new copy of the running binary with the same arguments,
+// and passes it the listening sockets.
+func (s *Server) handOff() error {
+	files := make([]*os.File, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		f, err := l.File()
+		if err != nil {
+			return fmt.Errorf("getting file for listener %v failed: %v", l.Addr(), err)
+		}
+		defer f.Close()
+		files = append(files, f)
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d", listenFDsEnv, len(files)))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+
+	return cmd.Start()
+}
+
+/*
+listen returns a TCP listener for each address. If the process was started
+by handOff, the inherited sockets are used instead, in the same order.
+*/
+func listen(addrs ...string) ([]*net.TCPListener, error) {
+	inherited, _ := strconv.Atoi(os.Getenv(listenFDsEnv))
+	os.Unsetenv(listenFDsEnv)
+
+	listeners := make([]*net.TCPListener, 0, len(addrs))
+	for i, addr := range addrs {
+		var l net.Listener
+		var err error
+
+		if inherited == len(addrs) {
+			f := os.NewFile(uintptr(3+i), fmt.Sprintf("listener-%d", i))
+			l, err = net.FileListener(f)
+			f.Close()
+		} else {
+			l, err = net.Listen("tcp", addr)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("listening on %s failed: %v", addr, err)
+		}
+
+		tcp, ok := l.(*net.TCPListener)
+		if !ok {
+			return nil, fmt.Errorf("listener on %s is not a TCP listener", addr)
+		}
+		listeners = append(listeners, tcp)
+	}
+
+	return listeners, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkersStop(t *testing.T) {
+	w := NewWorkers()
+	stopped := false
+
+	w.Go(func(ctx context.Context) {
+		<-ctx.Done()
+		stopped = true
+	})
+
+	assert.NoError(t, w.Stop(context.Background()))
+	assert.True(t, stopped)
+}
+
+func TestWorkersStopTimeout(t *testing.T) {
+	w := NewWorkers()
+	release := make(chan struct{})
+	defer close(release)
+
+	w.Go(func(ctx context.Context) {
+		<-release
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	assert.Equal(t, context.DeadlineExceeded, w.Stop(ctx))
+}
+
+// TestServerDrainsOnSIGTERM checks that a request that is in flight when the
+// process is told to stop still gets its response.
+func TestServerDrainsOnSIGTERM(t *testing.T) {
+	started := make(chan struct{})
+	srv := echo.New()
+	srv.HideBanner = true
+	srv.HidePort = true
+	srv.GET("/slow", func(c echo.Context) error {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		return c.String(http.StatusOK, "done")
+	})
+
+	tlsAddr := freeAddr(t)
+	s := &Server{
+		Echo:            srv,
+		Redirect:        RedirectHandler(nil, ""),
+		TLSConfig:       &tls.Config{Certificates: []tls.Certificate{selfSigned(t)}},
+		HTTPAddr:        freeAddr(t),
+		TLSAddr:         tlsAddr,
+		ShutdownTimeout: 5 * time.Second,
+	}
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- s.Run()
+	}()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	responses := make(chan *http.Response)
+	go func() {
+		for {
+			res, err := client.Get("https://" + tlsAddr + "/slow")
+			if err == nil {
+				responses <- res
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	<-started
+	assert.NoError(t, syscall.Kill(syscall.Getpid(), syscall.SIGTERM))
+
+	res := <-responses
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.NoError(t, <-stopped)
+}
+
+// freeAddr returns a local address nothing is listening on.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// selfSigned returns a throwaway certificate for localhost.
+func selfSigned(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
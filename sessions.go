@@ -14,6 +14,8 @@ type Session struct {
 	IP        string
 	UserAgent string
 	Hash      string
+	// ImpersonatingID is the user a superadmin is acting as with this session, if any.
+	ImpersonatingID *uint
 }
 
 // BeforeCreate is a hook function gorm uses. We create a uuidv4 as an ID for the model.
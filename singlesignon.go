@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/javorszky/go-comments/sso"
+	"github.com/labstack/echo"
+)
+
+// KindSSO is a commenter the host site signed in with a signed payload.
+const KindSSO = "sso"
+
+/*
+UsedPayload model definition. The signatures of the single sign-on payloads
+that were accepted, kept until the payloads expire so none of them can be
+used twice.
+*/
+type UsedPayload struct {
+	ID        uint      `gorm:"primary_key"`
+	SiteID    uint      `gorm:"unique_index:used_payload_signature"`
+	Signature string    `gorm:"type:varchar(64);unique_index:used_payload_signature"`
+	ExpiresAt time.Time `gorm:"index:used_payload_expires"`
+}
+
+// SSORequest is what the embed sends with the payload from the host page.
+type SSORequest struct {
+	Payload string `json:"payload" form:"payload"`
+}
+
+// PublicCommenter is what commenters get to see of their own profile.
+type PublicCommenter struct {
+	Name   string `json:"name"`
+	Avatar string `json:"avatar,omitempty"`
+}
+
+// ssoIssuer is what single sign-on identities of a site are kept under.
+func ssoIssuer(site Site) string {
+	return fmt.Sprintf("sso:%d", site.ID)
+}
+
+/*
+SSOLogin handles POST /api/sites/:site/sso. The host page signs who its
+user is with the site's SSO secret, and the embed passes that on here to
+sign them in as a commenter. Every payload can only be used once.
+*/
+func (h *Handlers) SSOLogin(c echo.Context) error {
+	site, ok := c.Get("model.site").(Site)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	req := SSORequest{}
+
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ResponseError{"Could not read the payload."})
+	}
+
+	now := time.Now()
+
+	user, signature, err := sso.Verify(site.SSOSecret, req.Payload, now)
+	if err != nil {
+		h.logger(c).Info("sso payload refused", "site", site.ID, "error", err)
+		return c.JSON(http.StatusUnauthorized, ResponseError{"The sign in payload is not valid."})
+	}
+
+	h.db.Where("expires_at < ?", now).Delete(UsedPayload{})
+
+	used := UsedPayload{
+		SiteID:    site.ID,
+		Signature: signature,
+		ExpiresAt: now.Add(2 * sso.MaxAge),
+	}
+
+	if result := h.db.Create(&used); result.Error != nil {
+		h.logger(c).Info("sso payload refused", "site", site.ID, "error", result.Error)
+		return c.JSON(http.StatusUnauthorized, ResponseError{"The sign in payload was used already."})
+	}
+
+	commenter, err := h.identifiedCommenter(KindSSO, ssoIssuer(site), user.ID, Commenter{
+		Name:      user.Name,
+		Email:     user.Email,
+		AvatarURL: user.Avatar,
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, ResponseError{"Something failed while saving."})
+	}
+
+	h.setCommenterCookie(c, commenter)
+
+	return c.JSON(http.StatusOK, PublicCommenter{
+		Name:   commenter.Name,
+		Avatar: commenter.AvatarURL,
+	})
+}
+
+// AdminSiteSSOPost handles POST /admin/sites/:id/sso to make a new SSO secret for the site, or to turn SSO off.
+func (h *Handlers) AdminSiteSSOPost(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	site, ok := h.siteFor(c, RoleAdmin)
+	if !ok {
+		return c.String(http.StatusNotFound, "No such site")
+	}
+
+	secret, detail := randomToken(32), "new sso secret"
+	if c.FormValue("action") == "disable" {
+		secret, detail = "", "sso turned off"
+	}
+
+	if result := h.db.Model(&site).Update("sso_secret", secret); result.Error != nil {
+		return c.String(http.StatusBadRequest, "Something failed while saving")
+	}
+
+	h.audit(c, user.ID, auditSiteUpdate, fmt.Sprintf("site %d: %s", site.ID, detail))
+
+	return c.Redirect(http.StatusFound, fmt.Sprintf("/admin/sites/%d/edit", site.ID))
+}
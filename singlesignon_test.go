@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/javorszky/go-comments/sso"
+	"github.com/labstack/echo"
+	mocket "github.com/selvatico/go-mocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSSOLogin(t *testing.T) {
+	site := mockSite
+	site.SSOSecret = "ssosecret"
+
+	valid, _ := sso.Sign(site.SSOSecret, sso.User{ID: "42", Name: "Jane", Avatar: "https://example.com/jane.png"}, time.Now())
+	forged, _ := sso.Sign("guessed", sso.User{ID: "42", Name: "Jane"}, time.Now())
+
+	pairs := []struct {
+		Name         string
+		Site         Site
+		Payload      string
+		Replayed     bool
+		ExpectedCode int
+	}{
+		{"valid", site, valid, false, http.StatusOK},
+		{"replayed", site, valid, true, http.StatusUnauthorized},
+		{"forged", site, forged, false, http.StatusUnauthorized},
+		{"sso off", mockSite, valid, false, http.StatusUnauthorized},
+	}
+
+	for _, p := range pairs {
+		mocket.Catcher.Reset()
+		if p.Replayed {
+			mocket.Catcher.NewMock().WithQuery(`INSERT INTO "used_payloads"`).WithError(errors.New("Duplicate entry"))
+		}
+
+		body, _ := json.Marshal(SSORequest{Payload: p.Payload})
+		req := httptest.NewRequest(http.MethodPost, "/api/sites/3/sso", strings.NewReader(string(body)))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("model.site", p.Site)
+
+		if assert.NoError(t, h.SSOLogin(c)) {
+			assert.Equal(t, p.ExpectedCode, rec.Code, p.Name)
+
+			if p.ExpectedCode == http.StatusOK {
+				var commenter PublicCommenter
+				assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &commenter))
+				assert.Equal(t, PublicCommenter{Name: "Jane", Avatar: "https://example.com/jane.png"}, commenter)
+				assert.Contains(t, rec.Header().Get(echo.HeaderSetCookie), commenterCookie+"=")
+			}
+		}
+	}
+
+	mocket.Catcher.Reset()
+}
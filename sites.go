@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/javorszky/go-comments/markdown"
+	"github.com/labstack/echo"
+)
+
+// DomainList returns the domains the site is allowed to be embedded on.
+func (s Site) DomainList() []string {
+	var domains []string
+	json.Unmarshal([]byte(s.Domains), &domains)
+
+	list := domains[:0]
+	for _, d := range domains {
+		if d = strings.TrimSpace(d); d != "" {
+			list = append(list, d)
+		}
+	}
+	return list
+}
+
+/*
+AllowsURL tells whether u points to one of the site's domains. Domains can
+be given as a bare host name, which matches on any port and scheme, or with
+a scheme and port to be matched exactly.
+*/
+func (s Site) AllowsURL(u *url.URL) bool {
+	if u == nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+
+	for _, d := range s.DomainList() {
+		if strings.Contains(d, "://") {
+			allowed, err := url.Parse(d)
+			if err == nil && strings.EqualFold(allowed.Scheme, u.Scheme) && strings.EqualFold(allowed.Host, u.Host) {
+				return true
+			}
+			continue
+		}
+
+		if strings.EqualFold(d, u.Host) || strings.EqualFold(d, u.Hostname()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AllowsOrigin tells whether requests from the given Origin header may use the site's API.
+func (s Site) AllowsOrigin(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return s.AllowsURL(u)
+}
+
+// Features returns the Markdown features comments on the site may use.
+func (s Site) Features() markdown.Features {
+	return markdown.ParseFeatures(s.MarkdownFeatures)
+}
+
+// EditWindow returns how long after posting commenters can still change their comments.
+func (s Site) EditWindow() time.Duration {
+	return time.Duration(s.EditWindowMinutes) * time.Minute
+}
+
+// validPolicy tells whether policy is one of the commenter policies.
+func validPolicy(policy string) bool {
+	switch policy {
+	case PolicyAnonymous, PolicyEmail, PolicyLogin:
+		return true
+	}
+	return false
+}
+
+// encodeDomains turns the one-per-line domains from the site forms into the stored JSON list.
+func encodeDomains(lines string) string {
+	domains, err := json.Marshal(strings.Split(lines, "\r\n"))
+
+	if err != nil {
+		panic("Can't split thingies")
+	}
+
+	return string(domains)
+}
+
+/*
+siteFor looks up the site in the :id route parameter, as long as the logged
+in user owns it or is a member with at least the given role. See memberships.go.
+*/
+func (h *Handlers) siteFor(c echo.Context, role string) (Site, bool) {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	site := Site{}
+	query := h.db.Where("id = ?", c.Param("id"))
+
+	if role == RoleOwner {
+		query = query.Where("user_id = ?", user.ID)
+	} else {
+		query = query.Where("user_id = ? OR id IN (?)", user.ID, h.memberSiteIDs(user.ID, rolesFrom(role)))
+	}
+
+	if query.First(&site).RecordNotFound() {
+		return site, false
+	}
+
+	return site, true
+}
@@ -0,0 +1,115 @@
+package spam
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// AkismetEndpoint is where Akismet's API is.
+const AkismetEndpoint = "https://rest.akismet.com/1.1"
+
+/*
+Akismet asks an Akismet compatible service whether submissions are spam, and
+tells it when moderators disagree. Endpoint is the base URL of the API, and
+Blog is the address of the site the comments are on; when it's empty the
+origin of the page the comment is on is used.
+*/
+type Akismet struct {
+	Key      string
+	Endpoint string
+	Blog     string
+	Client   *http.Client
+}
+
+// Check asks the service about the submission.
+func (a Akismet) Check(ctx context.Context, s Submission) (Verdict, error) {
+	body, err := a.call(ctx, "comment-check", s)
+	if err != nil {
+		return Verdict{}, err
+	}
+
+	switch body {
+	case "true":
+		return Verdict{Spam: true, Reasons: []string{"akismet"}}, nil
+	case "false":
+		return Verdict{}, nil
+	}
+	return Verdict{}, fmt.Errorf("akismet: unexpected answer %q", body)
+}
+
+// Learn tells the service about the moderator's decision.
+func (a Akismet) Learn(ctx context.Context, s Submission, spam, relearn bool) error {
+	method := "submit-ham"
+	if spam {
+		method = "submit-spam"
+	}
+
+	_, err := a.call(ctx, method, s)
+	return err
+}
+
+func (a Akismet) call(ctx context.Context, method string, s Submission) (string, error) {
+	form := url.Values{
+		"api_key":              {a.Key},
+		"blog":                 {a.blog(s)},
+		"user_ip":              {s.IP},
+		"user_agent":           {s.UserAgent},
+		"referrer":             {s.Referrer},
+		"permalink":            {s.PageURL},
+		"comment_type":         {"comment"},
+		"comment_author":       {s.Author},
+		"comment_author_email": {s.Email},
+		"comment_author_url":   {s.Website},
+		"comment_content":      {s.Body},
+	}
+
+	endpoint := a.Endpoint
+	if endpoint == "" {
+		endpoint = AkismetEndpoint
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(endpoint, "/")+"/"+method, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", "go-comments | Akismet/1.0")
+
+	client := a.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("akismet: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return "", fmt.Errorf("akismet: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("akismet: %s %s", resp.Status, resp.Header.Get("X-akismet-debug-help"))
+	}
+
+	return strings.TrimSpace(string(body)), nil
+}
+
+func (a Akismet) blog(s Submission) string {
+	if a.Blog != "" {
+		return a.Blog
+	}
+
+	u, err := url.Parse(s.PageURL)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
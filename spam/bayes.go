@@ -0,0 +1,193 @@
+package spam
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Totals is the token Stores keep the number of learned submissions under.
+const Totals = "*totals*"
+
+// Count is how many spam and ham submissions a token was seen in.
+type Count struct {
+	Spam int
+	Ham  int
+}
+
+// Store keeps the counts a Bayes classifier learned, apart for every site.
+type Store interface {
+	// Counts returns the counts of the tokens on the site. Tokens that were never seen can be left out.
+	Counts(ctx context.Context, site uint, tokens []string) (map[string]Count, error)
+	// Add adds the deltas, which can be negative, to every token's counts on the site.
+	Add(ctx context.Context, site uint, tokens []string, spam, ham int) error
+}
+
+/*
+Bayes is a naive Bayesian classifier in the style of Paul Graham's "A Plan
+for Spam", with Gary Robinson's adjustment for rare tokens. It doesn't say
+anything until it learned at least MinLearned spam and as many ham
+submissions, and calls submissions spam that it thinks are spam with more
+than Threshold probability. Every site has a classifier of its own, since
+what is spam on one can be just what another is about.
+*/
+type Bayes struct {
+	Store      Store
+	Threshold  float64
+	MinLearned int
+}
+
+// maxTokens is how many tokens of a submission are looked at.
+const maxTokens = 200
+
+// maxTokenLength is the longest a token can be in bytes, so Stores can put them in an indexed column.
+const maxTokenLength = 191
+
+// interesting is how many of the tokens furthest from neutral decide.
+const interesting = 15
+
+// Check works out how likely the submission is spam.
+func (b Bayes) Check(ctx context.Context, s Submission) (Verdict, error) {
+	tokens := Tokens(s)
+
+	counts, err := b.Store.Counts(ctx, s.Site, append(tokens, Totals))
+	if err != nil {
+		return Verdict{}, fmt.Errorf("bayes: %v", err)
+	}
+
+	totals := counts[Totals]
+	if totals.Spam < b.MinLearned || totals.Ham < b.MinLearned {
+		return Verdict{}, nil
+	}
+
+	var probabilities []float64
+	for _, t := range tokens {
+		c, ok := counts[t]
+		if !ok {
+			continue
+		}
+
+		spamRate := float64(c.Spam) / float64(totals.Spam)
+		hamRate := float64(c.Ham) / float64(totals.Ham)
+		if spamRate+hamRate == 0 {
+			continue
+		}
+
+		// Robinson: tokens seen only a few times stay close to neutral.
+		n := float64(c.Spam + c.Ham)
+		p := (0.5 + n*spamRate/(spamRate+hamRate)) / (1 + n)
+		probabilities = append(probabilities, math.Min(math.Max(p, 0.01), 0.99))
+	}
+
+	sort.Slice(probabilities, func(i, j int) bool {
+		return math.Abs(probabilities[i]-0.5) > math.Abs(probabilities[j]-0.5)
+	})
+	if len(probabilities) > interesting {
+		probabilities = probabilities[:interesting]
+	}
+
+	var logSpam, logHam float64
+	for _, p := range probabilities {
+		logSpam += math.Log(p)
+		logHam += math.Log(1 - p)
+	}
+	score := 1 / (1 + math.Exp(logHam-logSpam))
+
+	if score > b.Threshold {
+		return Verdict{Spam: true, Reasons: []string{fmt.Sprintf("bayes score %.2f", score)}}, nil
+	}
+	return Verdict{}, nil
+}
+
+// Learn counts the submission's tokens as spam or ham.
+func (b Bayes) Learn(ctx context.Context, s Submission, spam, relearn bool) error {
+	spamDelta, hamDelta := 0, 1
+	if spam {
+		spamDelta, hamDelta = 1, 0
+	}
+
+	if relearn {
+		spamDelta, hamDelta = spamDelta-hamDelta, hamDelta-spamDelta
+	}
+
+	return b.Store.Add(ctx, s.Site, append(Tokens(s), Totals), spamDelta, hamDelta)
+}
+
+/*
+Tokens returns the distinct lower case words of the submission's body and
+author, and the hosts it links to. Words shorter than three or longer than
+forty characters are left out.
+*/
+func Tokens(s Submission) []string {
+	seen := map[string]bool{}
+	var tokens []string
+
+	add := func(t string) {
+		if !seen[t] && len(t) <= maxTokenLength && len(tokens) < maxTokens {
+			seen[t] = true
+			tokens = append(tokens, t)
+		}
+	}
+
+	for _, host := range hostsIn(s) {
+		add("host:" + host)
+	}
+
+	words := strings.FieldsFunc(strings.ToLower(s.Body+" "+s.Author), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\'' && r != '$'
+	})
+	for _, w := range words {
+		if n := len([]rune(w)); n >= 3 && n <= 40 {
+			add(w)
+		}
+	}
+
+	return tokens
+}
+
+// MemoryStore is a Store that keeps the counts in memory.
+type MemoryStore struct {
+	mu     sync.Mutex
+	counts map[uint]map[string]Count
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{counts: map[uint]map[string]Count{}}
+}
+
+// Counts returns the counts of the tokens that were seen on the site.
+func (m *MemoryStore) Counts(ctx context.Context, site uint, tokens []string) (map[string]Count, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counts := map[string]Count{}
+	for _, t := range tokens {
+		if c, ok := m.counts[site][t]; ok {
+			counts[t] = c
+		}
+	}
+	return counts, nil
+}
+
+// Add adds the deltas to the tokens' counts on the site, without letting them go below zero.
+func (m *MemoryStore) Add(ctx context.Context, site uint, tokens []string, spam, ham int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.counts[site] == nil {
+		m.counts[site] = map[string]Count{}
+	}
+
+	for _, t := range tokens {
+		c := m.counts[site][t]
+		c.Spam = max(c.Spam+spam, 0)
+		c.Ham = max(c.Ham+ham, 0)
+		m.counts[site][t] = c
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package spam
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"'()\[\]]+`)
+
+// Links calls submissions with more than Max links in them spam.
+type Links struct {
+	Max int
+}
+
+// Check counts the links in the body.
+func (l Links) Check(ctx context.Context, s Submission) (Verdict, error) {
+	if n := len(linkPattern.FindAllString(s.Body, -1)); n > l.Max {
+		return Verdict{Spam: true, Reasons: []string{fmt.Sprintf("%d links", n)}}, nil
+	}
+	return Verdict{}, nil
+}
+
+/*
+Blocklist calls submissions spam that have any of the Words in them, or link
+to, give an email address at, or name as their website any of the Domains
+or their subdomains. Words are matched regardless of case.
+*/
+type Blocklist struct {
+	Words   []string
+	Domains []string
+}
+
+// Check looks for blocked words and domains.
+func (b Blocklist) Check(ctx context.Context, s Submission) (Verdict, error) {
+	v := Verdict{}
+	text := strings.ToLower(s.Body + " " + s.Author)
+
+	for _, w := range b.Words {
+		if w = strings.ToLower(strings.TrimSpace(w)); w != "" && strings.Contains(text, w) {
+			v.Spam = true
+			v.Reasons = append(v.Reasons, "blocked word "+w)
+		}
+	}
+
+	hosts := hostsIn(s)
+	for _, d := range b.Domains {
+		d = strings.ToLower(strings.TrimSpace(d))
+		for _, host := range hosts {
+			if d != "" && (host == d || strings.HasSuffix(host, "."+d)) {
+				v.Spam = true
+				v.Reasons = append(v.Reasons, "blocked domain "+d)
+				break
+			}
+		}
+	}
+
+	return v, nil
+}
+
+// hostsIn returns the hosts of the links in the body and the website, and the domain of the email address.
+func hostsIn(s Submission) []string {
+	var hosts []string
+
+	links := linkPattern.FindAllString(s.Body, -1)
+	if s.Website != "" {
+		links = append(links, s.Website)
+	}
+
+	for _, link := range links {
+		if !strings.Contains(link, "://") {
+			link = "http://" + link
+		}
+		if u, err := url.Parse(link); err == nil && u.Hostname() != "" {
+			hosts = append(hosts, strings.ToLower(u.Hostname()))
+		}
+	}
+
+	if at := strings.LastIndex(s.Email, "@"); at >= 0 {
+		hosts = append(hosts, strings.ToLower(s.Email[at+1:]))
+	}
+
+	return hosts
+}
+
+// Honeypot calls submissions spam that have the honeypot field filled in.
+type Honeypot struct{}
+
+// Check looks at the honeypot field.
+func (Honeypot) Check(ctx context.Context, s Submission) (Verdict, error) {
+	if s.Honeypot != "" {
+		return Verdict{Spam: true, Reasons: []string{"honeypot filled in"}}, nil
+	}
+	return Verdict{}, nil
+}
+
+/*
+MinTime calls submissions spam that were sent less than Min after the form
+was shown, which people don't manage. Submissions that don't say when the
+form was shown are only spam if Required is set.
+*/
+type MinTime struct {
+	Min      time.Duration
+	Required bool
+}
+
+// Check looks at how long it took to send the form.
+func (m MinTime) Check(ctx context.Context, s Submission) (Verdict, error) {
+	if !s.Timed {
+		if m.Required {
+			return Verdict{Spam: true, Reasons: []string{"form was not timed"}}, nil
+		}
+		return Verdict{}, nil
+	}
+
+	if s.Elapsed < m.Min {
+		return Verdict{Spam: true, Reasons: []string{fmt.Sprintf("sent %v after the form was shown", s.Elapsed.Round(time.Millisecond))}}, nil
+	}
+	return Verdict{}, nil
+}
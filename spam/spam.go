@@ -0,0 +1,100 @@
+/*
+Package spam tells spam comments apart from the rest.
+
+A Pipeline runs a comment past a list of Classifiers, each looking at one
+thing: how many links it has, whether it mentions blocked words or domains,
+whether a bot filled in the honeypot field, how quickly it was sent after the
+form was shown, what a Bayesian classifier trained on moderators' decisions
+thinks of it, or what Akismet thinks of it. The comment is spam as soon as
+one of them says so.
+*/
+package spam
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Submission is a comment and what is known about where it came from.
+type Submission struct {
+	// Site is the ID of the site the comment is on. What classifiers learn
+	// on one site doesn't count on the others.
+	Site uint
+
+	Body      string
+	Author    string
+	Email     string
+	Website   string
+	IP        string
+	UserAgent string
+	Referrer  string
+	PageURL   string
+
+	// Honeypot is the value of a form field people can't see, so only bots fill it in.
+	Honeypot string
+	// Elapsed is how long it took from showing the form to sending it, and
+	// Timed tells whether that's known at all.
+	Elapsed time.Duration
+	Timed   bool
+}
+
+// Verdict is what a classifier thinks of a submission. Reasons say why it's spam.
+type Verdict struct {
+	Spam    bool
+	Reasons []string
+}
+
+// Classifier looks at a submission and decides whether it's spam.
+type Classifier interface {
+	Check(ctx context.Context, s Submission) (Verdict, error)
+}
+
+/*
+Learner is a classifier that gets better when moderators tell it what is
+spam and what isn't. relearn is set when the submission was learned as the
+other one before, so the earlier decision can be taken back.
+*/
+type Learner interface {
+	Learn(ctx context.Context, s Submission, spam, relearn bool) error
+}
+
+// Pipeline runs every classifier in it, and calls the submission spam when any of them does.
+type Pipeline []Classifier
+
+// Check runs the classifiers. Ones that fail don't get a say; their errors are returned together.
+func (p Pipeline) Check(ctx context.Context, s Submission) (Verdict, error) {
+	verdict := Verdict{}
+	var errs []error
+
+	for _, c := range p {
+		v, err := c.Check(ctx, s)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if v.Spam {
+			verdict.Spam = true
+			verdict.Reasons = append(verdict.Reasons, v.Reasons...)
+		}
+	}
+
+	return verdict, errors.Join(errs...)
+}
+
+// Learn passes the moderator's decision on to the classifiers that learn from them.
+func (p Pipeline) Learn(ctx context.Context, s Submission, spam, relearn bool) error {
+	var errs []error
+
+	for _, c := range p {
+		if l, ok := c.(Learner); ok {
+			if err := l.Learn(ctx, s, spam, relearn); err != nil {
+				errs = append(errs, fmt.Errorf("%T: %v", c, err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,157 @@
+package spam
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type failing struct{}
+
+func (failing) Check(ctx context.Context, s Submission) (Verdict, error) {
+	return Verdict{Spam: true}, errors.New("unavailable")
+}
+
+func TestRules(t *testing.T) {
+	blocklist := Blocklist{Words: []string{"Casino"}, Domains: []string{"spam.example"}}
+
+	pairs := []struct {
+		Name       string
+		Classifier Classifier
+		Submission Submission
+		Spam       bool
+	}{
+		{"few links", Links{Max: 2}, Submission{Body: "see https://a.com and www.b.com"}, false},
+		{"many links", Links{Max: 2}, Submission{Body: "https://a.com http://b.com www.c.com"}, true},
+		{"blocked word", blocklist, Submission{Body: "Best CASINO online"}, true},
+		{"blocked subdomain link", blocklist, Submission{Body: "go to https://www.spam.example/x"}, true},
+		{"blocked email", blocklist, Submission{Body: "hi", Email: "bot@spam.example"}, true},
+		{"blocked website", blocklist, Submission{Body: "hi", Website: "http://spam.example"}, true},
+		{"lookalike domain", blocklist, Submission{Body: "https://notspam.example"}, false},
+		{"clean", blocklist, Submission{Body: "Nice post"}, false},
+		{"honeypot empty", Honeypot{}, Submission{}, false},
+		{"honeypot filled", Honeypot{}, Submission{Honeypot: "x"}, true},
+		{"slow", MinTime{Min: 3 * time.Second}, Submission{Timed: true, Elapsed: 10 * time.Second}, false},
+		{"fast", MinTime{Min: 3 * time.Second}, Submission{Timed: true, Elapsed: time.Second}, true},
+		{"untimed", MinTime{Min: 3 * time.Second}, Submission{}, false},
+		{"untimed required", MinTime{Min: 3 * time.Second, Required: true}, Submission{}, true},
+	}
+
+	for _, p := range pairs {
+		v, err := p.Classifier.Check(context.Background(), p.Submission)
+		assert.NoError(t, err, p.Name)
+		assert.Equal(t, p.Spam, v.Spam, p.Name)
+		assert.Equal(t, p.Spam, len(v.Reasons) > 0, p.Name)
+	}
+}
+
+func TestPipelineIgnoresFailures(t *testing.T) {
+	p := Pipeline{failing{}, Honeypot{}}
+
+	v, err := p.Check(context.Background(), Submission{Body: "hi"})
+	assert.Error(t, err)
+	assert.False(t, v.Spam)
+
+	v, _ = p.Check(context.Background(), Submission{Body: "hi", Honeypot: "x"})
+	assert.True(t, v.Spam)
+	assert.Equal(t, []string{"honeypot filled in"}, v.Reasons)
+}
+
+func TestBayes(t *testing.T) {
+	ctx := context.Background()
+	b := Bayes{Store: NewMemoryStore(), Threshold: 0.9, MinLearned: 5}
+
+	spam := Submission{Body: "cheap pills discount pharmacy order now"}
+	ham := Submission{Body: "thanks for the thoughtful article about gardening"}
+
+	v, err := b.Check(ctx, spam)
+	assert.NoError(t, err)
+	assert.False(t, v.Spam, "untrained classifiers stay quiet")
+
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, b.Learn(ctx, spam, true, false))
+		assert.NoError(t, b.Learn(ctx, ham, false, false))
+	}
+
+	v, _ = b.Check(ctx, Submission{Body: "discount pills pharmacy"})
+	assert.True(t, v.Spam)
+
+	v, _ = b.Check(ctx, Submission{Body: "a thoughtful gardening article"})
+	assert.False(t, v.Spam)
+
+	// Moving a submission from spam to ham leaves the totals balanced.
+	assert.NoError(t, b.Learn(ctx, spam, false, true))
+	counts, _ := b.Store.Counts(ctx, 0, []string{Totals, "pills"})
+	assert.Equal(t, Count{Spam: 4, Ham: 6}, counts[Totals])
+	assert.Equal(t, Count{Spam: 4, Ham: 1}, counts["pills"])
+}
+
+func TestBayesKeepsSitesApart(t *testing.T) {
+	ctx := context.Background()
+	b := Bayes{Store: NewMemoryStore(), Threshold: 0.9, MinLearned: 5}
+
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, b.Learn(ctx, Submission{Site: 1, Body: "cheap pills discount pharmacy order now"}, true, false))
+		assert.NoError(t, b.Learn(ctx, Submission{Site: 1, Body: "thanks for the thoughtful article about gardening"}, false, false))
+	}
+
+	v, _ := b.Check(ctx, Submission{Site: 1, Body: "discount pills pharmacy"})
+	assert.True(t, v.Spam)
+
+	v, _ = b.Check(ctx, Submission{Site: 2, Body: "discount pills pharmacy"})
+	assert.False(t, v.Spam, "site 2 learned nothing yet")
+
+	counts, _ := b.Store.Counts(ctx, 2, []string{Totals, "pills"})
+	assert.Empty(t, counts)
+}
+
+func TestAkismet(t *testing.T) {
+	var calls []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.URL.Path)
+
+		if r.FormValue("api_key") != "key" {
+			w.Write([]byte("invalid"))
+			return
+		}
+
+		assert.Equal(t, "https://example.com", r.FormValue("blog"))
+
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/comment-check"):
+			if r.FormValue("comment_author") == "viagra-test-123" {
+				w.Write([]byte("true"))
+				return
+			}
+			w.Write([]byte("false"))
+		default:
+			w.Write([]byte("Thanks for making the web a better place."))
+		}
+	}))
+	defer server.Close()
+
+	a := Akismet{Key: "key", Endpoint: server.URL + "/1.1"}
+	s := Submission{Body: "hi", PageURL: "https://example.com/post"}
+
+	v, err := a.Check(context.Background(), s)
+	assert.NoError(t, err)
+	assert.False(t, v.Spam)
+
+	s.Author = "viagra-test-123"
+	v, err = a.Check(context.Background(), s)
+	assert.NoError(t, err)
+	assert.True(t, v.Spam)
+
+	assert.NoError(t, a.Learn(context.Background(), s, true, false))
+	assert.Equal(t, "/1.1/submit-spam", calls[len(calls)-1])
+
+	_, err = Akismet{Key: "wrong", Endpoint: server.URL}.Check(context.Background(), s)
+	assert.Error(t, err)
+}
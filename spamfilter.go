@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/javorszky/go-comments/config"
+	"github.com/javorszky/go-comments/spam"
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+)
+
+// formTokenHeader is the response header that carries the form token of the comments on a page.
+const formTokenHeader = "X-Comment-Form"
+
+// SpamToken model definition. How many spam and ham comments on a site a word was seen in.
+type SpamToken struct {
+	SiteID uint   `gorm:"primary_key;auto_increment:false"`
+	Token  string `gorm:"type:varchar(191);primary_key"`
+	Spam   int
+	Ham    int
+}
+
+// dbSpamStore keeps what the Bayes classifier learned in the database.
+type dbSpamStore struct {
+	db *gorm.DB
+}
+
+// Counts returns the counts of the tokens that were seen on the site.
+func (s dbSpamStore) Counts(ctx context.Context, site uint, tokens []string) (map[string]spam.Count, error) {
+	var rows []SpamToken
+
+	if result := s.db.Where("site_id = ? AND token IN (?)", site, tokens).Find(&rows); result.Error != nil {
+		return nil, result.Error
+	}
+
+	counts := map[string]spam.Count{}
+	for _, r := range rows {
+		counts[r.Token] = spam.Count{Spam: r.Spam, Ham: r.Ham}
+	}
+	return counts, nil
+}
+
+// Add adds the deltas to every token's counts on the site in one statement, without letting them go below zero.
+func (s dbSpamStore) Add(ctx context.Context, site uint, tokens []string, spamDelta, hamDelta int) error {
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	args := make([]interface{}, 0, 4*len(tokens)+2)
+	for _, t := range tokens {
+		args = append(args, site, t, max(spamDelta, 0), max(hamDelta, 0))
+	}
+	args = append(args, spamDelta, hamDelta)
+
+	query := "INSERT INTO spam_tokens (site_id, token, spam, ham) VALUES " +
+		strings.TrimSuffix(strings.Repeat("(?, ?, ?, ?), ", len(tokens)), ", ") +
+		" ON DUPLICATE KEY UPDATE spam = GREATEST(spam + ?, 0), ham = GREATEST(ham + ?, 0)"
+
+	return s.db.Exec(query, args...).Error
+}
+
+// NewSpamPipeline puts together the spam classifiers the config asks for.
+func NewSpamPipeline(cfg *config.Config, db *gorm.DB) spam.Pipeline {
+	pipeline := spam.Pipeline{
+		spam.Honeypot{},
+		spam.Links{Max: cfg.SpamMaxLinks},
+		spam.Blocklist{Words: cfg.SpamWords, Domains: cfg.SpamDomains},
+		spam.MinTime{Min: cfg.SpamMinTime, Required: cfg.SpamRequireTiming},
+	}
+
+	if cfg.SpamBayes {
+		pipeline = append(pipeline, spam.Bayes{Store: dbSpamStore{db}, Threshold: 0.9, MinLearned: 20})
+	}
+
+	if cfg.AkismetKey != "" {
+		pipeline = append(pipeline, spam.Akismet{
+			Key:      cfg.AkismetKey,
+			Endpoint: cfg.AkismetEndpoint,
+			Client:   &http.Client{Timeout: 5 * time.Second},
+		})
+	}
+
+	return pipeline
+}
+
+// formToken returns a signed timestamp for the embed to send back with a comment.
+func (h *Handlers) formToken(now time.Time) string {
+	value := strconv.FormatInt(now.UnixNano()/int64(time.Millisecond), 10)
+	return value + "." + h.sign("form|"+value)
+}
+
+// formElapsed tells how long ago the form token was handed out, if it's one of ours.
+func (h *Handlers) formElapsed(token string, now time.Time) (time.Duration, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 || !h.verify("form|"+parts[0], parts[1]) {
+		return 0, false
+	}
+
+	ms, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return now.Sub(time.Unix(0, ms*int64(time.Millisecond))), true
+}
+
+// checkSpam runs a new comment past the spam checker. Classifiers that fail are logged and skipped.
+func (h *Handlers) checkSpam(c echo.Context, s spam.Submission) spam.Verdict {
+	verdict, err := h.spam.Check(c.Request().Context(), s)
+	if err != nil {
+		h.logger(c).Warn("spam check failed", "error", err)
+	}
+	return verdict
+}
+
+// submission rebuilds what the spam checker saw of a comment when it was posted.
+func (h *Handlers) submission(comment Comment) spam.Submission {
+	s := spam.Submission{
+		Site:      comment.SiteID,
+		Body:      comment.Body,
+		Author:    comment.AuthorName,
+		Website:   comment.AuthorWebsite,
+		IP:        comment.IP,
+		UserAgent: comment.UserAgent,
+	}
+
+	thread := Thread{}
+	if !h.db.Where("id = ?", comment.ThreadID).First(&thread).RecordNotFound() {
+		s.PageURL = thread.URL
+	}
+
+	if comment.CommenterID != nil {
+		commenter := Commenter{}
+		if !h.db.Where("id = ?", *comment.CommenterID).First(&commenter).RecordNotFound() {
+			s.Email = commenter.Email
+		}
+	}
+
+	return s
+}
+
+/*
+learn tells the spam checker what a moderator decided about a comment, if
+it's something it can learn from: approved comments are ham, and the ones
+marked as spam are spam. A comment is only ever learned once, and learned
+again the other way if the moderator changes their mind.
+*/
+func (h *Handlers) learn(c echo.Context, comment Comment, status string) {
+	class := ""
+	switch status {
+	case StatusApproved:
+		class = "ham"
+	case StatusSpam:
+		class = "spam"
+	default:
+		return
+	}
+
+	if comment.TrainedAs == class {
+		return
+	}
+
+	if err := h.spam.Learn(c.Request().Context(), h.submission(comment), class == "spam", comment.TrainedAs != ""); err != nil {
+		h.logger(c).Warn("spam learning failed", "comment", comment.ID, "error", err)
+	}
+
+	if result := h.db.Model(&comment).Update("trained_as", class); result.Error != nil {
+		h.logger(c).Warn("saving spam learning failed", "comment", comment.ID, "error", result.Error)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/javorszky/go-comments/config"
+	"github.com/javorszky/go-comments/ratelimit"
+	"github.com/javorszky/go-comments/spam"
+	"github.com/labstack/echo"
+	mocket "github.com/selvatico/go-mocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingSpamChecker calls everything with a honeypot spam, and remembers what it was asked and taught.
+type recordingSpamChecker struct {
+	checked []spam.Submission
+	learned []string
+}
+
+func (r *recordingSpamChecker) Check(ctx context.Context, s spam.Submission) (spam.Verdict, error) {
+	r.checked = append(r.checked, s)
+	return spam.Honeypot{}.Check(ctx, s)
+}
+
+func (r *recordingSpamChecker) Learn(ctx context.Context, s spam.Submission, isSpam, relearn bool) error {
+	class := "ham"
+	if isSpam {
+		class = "spam"
+	}
+	if relearn {
+		class = "re" + class
+	}
+	r.learned = append(r.learned, class)
+	return nil
+}
+
+func spamHandler(sc SpamChecker) Handlers {
+	return NewHandler(mpwc, pwh, sc, NewRateLimits(ratelimit.NewMemoryStore()), &recordingMailQueue{}, db, slog.New(slog.NewTextHandler(io.Discard, nil)), &config.Config{SecretKey: "testsecret"})
+}
+
+func TestFormToken(t *testing.T) {
+	now := time.Now()
+	token := h.formToken(now.Add(-5 * time.Second))
+
+	elapsed, ok := h.formElapsed(token, now)
+	assert.True(t, ok)
+	assert.InDelta(t, 5*time.Second, elapsed, float64(time.Millisecond))
+
+	for _, forged := range []string{"", "123", "123.abc", strings.Replace(token, "1", "2", 1)} {
+		_, ok := h.formElapsed(forged, now)
+		assert.False(t, ok, forged)
+	}
+}
+
+func TestCommentsPostChecksSpam(t *testing.T) {
+	sc := &recordingSpamChecker{}
+	hh := spamHandler(sc)
+
+	token := hh.formToken(time.Now().Add(-time.Minute))
+	body := `{"url":"https://example.com/post","body":"hi","hp":"gotcha","formToken":"` + token + `"}`
+
+	req := httptest.NewRequest(http.MethodPost, "/api/sites/3/comments", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.Set("model.site", mockSite)
+
+	if assert.NoError(t, hh.CommentsPost(c)) {
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"status":"pending"`)
+
+		if assert.Len(t, sc.checked, 1) {
+			assert.Equal(t, mockSite.ID, sc.checked[0].Site)
+			assert.Equal(t, "gotcha", sc.checked[0].Honeypot)
+			assert.Equal(t, "https://example.com/post", sc.checked[0].PageURL)
+			assert.True(t, sc.checked[0].Timed)
+		}
+	}
+}
+
+func TestSpamStoreKeepsSitesApart(t *testing.T) {
+	var added []driver.NamedValue
+	mocket.Catcher.Reset().NewMock().WithQuery(`INSERT INTO spam_tokens`).WithCallback(func(_ string, args []driver.NamedValue) {
+		added = args
+	})
+	mocket.Catcher.NewMock().WithQuery(`FROM "spam_tokens"`).WithArgs(int64(3), "pills").WithReply([]map[string]interface{}{
+		{"site_id": 3, "token": "pills", "spam": 5},
+	})
+	defer mocket.Catcher.Reset()
+
+	store := dbSpamStore{db}
+	ctx := context.Background()
+
+	if assert.NoError(t, store.Add(ctx, 3, []string{"pills", "cheap"}, 1, 0)) && assert.Len(t, added, 10) {
+		assert.EqualValues(t, 3, added[0].Value)
+		assert.Equal(t, "pills", added[1].Value)
+		assert.EqualValues(t, 3, added[4].Value)
+	}
+
+	counts, err := store.Counts(ctx, 3, []string{"pills"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, spam.Count{Spam: 5}, counts["pills"])
+	}
+
+	counts, err = store.Counts(ctx, 4, []string{"pills"})
+	if assert.NoError(t, err) {
+		assert.Empty(t, counts)
+	}
+}
+
+func TestModerationTeachesSpamChecker(t *testing.T) {
+	pairs := []struct {
+		TrainedAs string
+		Action    func(*Handlers, echo.Context) error
+		Learned   []string
+	}{
+		{"", (*Handlers).AdminCommentApprove, []string{"ham"}},
+		{"", (*Handlers).AdminCommentSpam, []string{"spam"}},
+		{"spam", (*Handlers).AdminCommentApprove, []string{"reham"}},
+		{"ham", (*Handlers).AdminCommentApprove, nil},
+		{"", (*Handlers).AdminCommentReject, nil},
+	}
+
+	defer mocket.Catcher.Reset()
+
+	for _, p := range pairs {
+		mocket.Catcher.Reset()
+		mocket.Catcher.NewMock().WithQuery(`FROM "sites"`).WithReply([]map[string]interface{}{{"id": 3, "user_id": 7}})
+		mocket.Catcher.NewMock().WithQuery(`FROM "comments"`).WithReply([]map[string]interface{}{{"id": 5, "site_id": 3, "trained_as": p.TrainedAs}})
+
+		sc := &recordingSpamChecker{}
+		hh := spamHandler(sc)
+
+		req := httptest.NewRequest(http.MethodPost, "/admin/sites/3/comments/5/approve", nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("model.user", User{Model: mockSite.Model, Email: "owner@example.com"})
+		c.SetParamNames("id", "comment")
+		c.SetParamValues("3", "5")
+
+		if assert.NoError(t, p.Action(&hh, c)) {
+			assert.Equal(t, http.StatusFound, rec.Code)
+			assert.Equal(t, p.Learned, sc.learned, p.TrainedAs)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package sso
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	now := time.Now()
+	user := User{ID: "42", Name: "Jane", Email: "jane@example.com", Avatar: "https://example.com/jane.png"}
+
+	valid, _ := Sign("secret", user, now)
+	old, _ := Sign("secret", user, now.Add(-MaxAge-time.Second))
+	future, _ := Sign("secret", user, now.Add(2*maxSkew))
+	noID, _ := Sign("secret", User{Name: "Jane"}, now)
+	parts := strings.Split(valid, " ")
+
+	pairs := []struct {
+		Name    string
+		Secret  string
+		Payload string
+		Valid   bool
+	}{
+		{"valid", "secret", valid, true},
+		{"other secret", "other", valid, false},
+		{"no secret", "", valid, false},
+		{"old", "secret", old, false},
+		{"future", "secret", future, false},
+		{"no id", "secret", noID, false},
+		{"changed timestamp", "secret", parts[0] + " " + parts[1] + " " + "1", false},
+		{"changed user", "secret", "eyJpZCI6IjEifQ== " + parts[1] + " " + parts[2], false},
+		{"two parts", "secret", parts[0] + " " + parts[1], false},
+	}
+
+	for _, p := range pairs {
+		got, signature, err := Verify(p.Secret, p.Payload, now)
+		assert.Equal(t, p.Valid, err == nil, p.Name)
+		if p.Valid {
+			assert.Equal(t, user, got)
+			assert.Equal(t, parts[1], signature)
+		}
+	}
+}
+
+func TestVerifyDropsUnsafeAvatars(t *testing.T) {
+	payload, _ := Sign("secret", User{ID: "1", Avatar: "javascript:alert(1)"}, time.Now())
+
+	u, _, err := Verify("secret", payload, time.Now())
+	if assert.NoError(t, err) {
+		assert.Equal(t, "", u.Avatar)
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Setting is an instance-wide setting superadmins can change while the app runs.
+type Setting struct {
+	Name      string `gorm:"type:varchar(64);primary_key"`
+	Value     string `gorm:"type:varchar(191)"`
+	UpdatedAt time.Time
+}
+
+// settingRegistration is whether anyone can register, "open", or only people with an invitation, "closed".
+const settingRegistration = "registration"
+
+// superadminListSize is how many users or sites the superadmin pages list at most.
+const superadminListSize = 200
+
+// setting returns the value of the setting, or fallback if it was never set.
+func (h *Handlers) setting(name, fallback string) string {
+	setting := Setting{}
+	if h.db.Where("name = ?", name).First(&setting).RecordNotFound() {
+		return fallback
+	}
+	return setting.Value
+}
+
+// registrationOpen tells whether anyone can register. It is until a superadmin closes it.
+func (h *Handlers) registrationOpen() bool {
+	return h.setting(settingRegistration, "open") != "closed"
+}
+
+// SuperadminCheck is a middleware that answers 404 to everyone but superadmins, so the pages don't show they exist.
+func (h *Handlers) SuperadminCheck(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, ok := c.Get("model.user").(User)
+		if !ok || !user.Superadmin {
+			return c.String(http.StatusNotFound, "Not found")
+		}
+
+		return next(c)
+	}
+}
+
+/*
+Unimpersonated is a middleware for what only the user themselves can do,
+like changing their password: superadmins impersonating them get a 403.
+*/
+func (h *Handlers) Unimpersonated(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if _, ok := c.Get("model.impersonator").(User); ok {
+			return c.String(http.StatusForbidden, "Only the user themselves can do this, not while impersonating them")
+		}
+
+		return next(c)
+	}
+}
+
+// InstanceStats are the moderation and spam numbers of every site on the instance.
+type InstanceStats struct {
+	Users      int
+	Disabled   int
+	Sites      int
+	Statuses   []statusCount
+	Last24h    int
+	Last7d     int
+	Spam30d    int
+	Reasons    []ReasonCount
+	BusySites  []SiteStats
+	Generated  time.Time
+	OpenSignup bool
+}
+
+// ReasonCount is how many comments a spam check caught.
+type ReasonCount struct {
+	Reason string
+	Count  int
+}
+
+// SiteStats are how many comments of a site wait for a moderator or were caught as spam.
+type SiteStats struct {
+	SiteID      uint
+	Designation string
+	Pending     int
+	Spam        int
+}
+
+// siteStatusCount is a row of the comments, counted by site and status.
+type siteStatusCount struct {
+	SiteID uint
+	Status string
+	Count  int
+}
+
+// instanceStats counts the users, sites and comments of the instance as of now.
+func (h *Handlers) instanceStats(now time.Time) InstanceStats {
+	stats := InstanceStats{Generated: now, OpenSignup: h.registrationOpen()}
+
+	h.db.Model(&User{}).Count(&stats.Users)
+	h.db.Model(&User{}).Where("disabled_at IS NOT NULL").Count(&stats.Disabled)
+	h.db.Model(&Site{}).Count(&stats.Sites)
+	h.db.Model(&Comment{}).Select("status, count(*) as count").Group("status").Order("status").Scan(&stats.Statuses)
+	h.db.Model(&Comment{}).Where("created_at > ?", now.Add(-24*time.Hour)).Count(&stats.Last24h)
+	h.db.Model(&Comment{}).Where("created_at > ?", now.AddDate(0, 0, -7)).Count(&stats.Last7d)
+
+	// The reasons are kept as text on each comment, so they're counted from the latest spam.
+	var spam []Comment
+	h.db.Select("spam_reasons").Where("status = ? AND created_at > ?", StatusSpam, now.AddDate(0, 0, -30)).Order("id desc").Limit(1000).Find(&spam)
+	stats.Spam30d = len(spam)
+
+	reasons := map[string]int{}
+	for _, cm := range spam {
+		for _, r := range strings.Split(cm.SpamReasons, "; ") {
+			if r != "" {
+				reasons[r]++
+			}
+		}
+	}
+	for r, n := range reasons {
+		stats.Reasons = append(stats.Reasons, ReasonCount{r, n})
+	}
+	sort.Slice(stats.Reasons, func(i, j int) bool {
+		if stats.Reasons[i].Count != stats.Reasons[j].Count {
+			return stats.Reasons[i].Count > stats.Reasons[j].Count
+		}
+		return stats.Reasons[i].Reason < stats.Reasons[j].Reason
+	})
+
+	var counts []siteStatusCount
+	h.db.Model(&Comment{}).Select("site_id, status, count(*) as count").Where("status IN (?)", []string{StatusPending, StatusSpam}).Group("site_id, status").Scan(&counts)
+
+	bySite := map[uint]*SiteStats{}
+	for _, sc := range counts {
+		s, ok := bySite[sc.SiteID]
+		if !ok {
+			s = &SiteStats{SiteID: sc.SiteID}
+			bySite[sc.SiteID] = s
+		}
+		if sc.Status == StatusPending {
+			s.Pending = sc.Count
+		} else {
+			s.Spam = sc.Count
+		}
+	}
+
+	var ids []uint
+	for id := range bySite {
+		ids = append(ids, id)
+	}
+	if len(ids) > 0 {
+		var sites []Site
+		h.db.Select("id, designation").Where("id IN (?)", ids).Find(&sites)
+		for _, site := range sites {
+			bySite[site.ID].Designation = site.Designation
+		}
+	}
+
+	for _, s := range bySite {
+		stats.BusySites = append(stats.BusySites, *s)
+	}
+	sort.Slice(stats.BusySites, func(i, j int) bool {
+		a, b := stats.BusySites[i], stats.BusySites[j]
+		if a.Pending+a.Spam != b.Pending+b.Spam {
+			return a.Pending+a.Spam > b.Pending+b.Spam
+		}
+		return a.SiteID < b.SiteID
+	})
+	if len(stats.BusySites) > 20 {
+		stats.BusySites = stats.BusySites[:20]
+	}
+
+	return stats
+}
+
+// AdminSuperadmin handles GET /admin/superadmin with the instance's moderation and spam numbers, and its registration.
+func (h *Handlers) AdminSuperadmin(c echo.Context) error {
+	return c.Render(http.StatusOK, "superadmin", struct {
+		Csrf  interface{}
+		Stats InstanceStats
+	}{
+		Csrf:  c.Get("csrf"),
+		Stats: h.instanceStats(time.Now()),
+	})
+}
+
+// AdminSuperadminRegistration handles POST /admin/superadmin/registration to open or close registration.
+func (h *Handlers) AdminSuperadminRegistration(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	value, action := "open", auditRegistrationOpen
+	if c.FormValue("registration") == "closed" {
+		value, action = "closed", auditRegistrationClose
+	}
+
+	if result := h.db.Save(&Setting{Name: settingRegistration, Value: value}); result.Error != nil {
+		return c.String(http.StatusBadRequest, "Something failed while saving")
+	}
+
+	h.audit(c, user.ID, action, "")
+
+	return c.Redirect(http.StatusFound, "/admin/superadmin")
+}
+
+// AdminSuperadminUsers handles GET /admin/superadmin/users?q= to list the users of the instance, or the ones whose email has q in it.
+func (h *Handlers) AdminSuperadminUsers(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	q := strings.TrimSpace(c.QueryParam("q"))
+
+	query := h.db.Order("id")
+	if q != "" {
+		query = query.Where("email LIKE ?", "%"+q+"%")
+	}
+
+	var users []User
+	query.Limit(superadminListSize).Find(&users)
+
+	return c.Render(http.StatusOK, "superadminusers", struct {
+		Csrf  interface{}
+		Self  User
+		Query string
+		Users []User
+	}{
+		Csrf:  c.Get("csrf"),
+		Self:  user,
+		Query: q,
+		Users: users,
+	})
+}
+
+// InstanceSite is a site on the superadmin's list, with the email address of its owner.
+type InstanceSite struct {
+	Site
+	OwnerEmail string
+}
+
+// AdminSuperadminSites handles GET /admin/superadmin/sites to list the sites of the instance.
+func (h *Handlers) AdminSuperadminSites(c echo.Context) error {
+	var sites []Site
+	h.db.Order("id").Limit(superadminListSize).Find(&sites)
+
+	var ids []uint
+	for _, s := range sites {
+		ids = append(ids, s.UserID)
+	}
+
+	owners := map[uint]string{}
+	if len(ids) > 0 {
+		var users []User
+		h.db.Select("id, email").Where("id IN (?)", ids).Find(&users)
+		for _, u := range users {
+			owners[u.ID] = u.Email
+		}
+	}
+
+	list := []InstanceSite{}
+	for _, s := range sites {
+		list = append(list, InstanceSite{s, owners[s.UserID]})
+	}
+
+	return c.Render(http.StatusOK, "superadminsites", list)
+}
+
+// superadminTarget looks up the user in the :id route parameter, who can't be the superadmin themselves.
+func (h *Handlers) superadminTarget(c echo.Context, self User) (User, error) {
+	target := User{}
+
+	if h.db.Where("id = ?", c.Param("id")).First(&target).RecordNotFound() {
+		return target, fmt.Errorf("No such user")
+	}
+
+	if target.ID == self.ID {
+		return target, fmt.Errorf("Superadmins can't do this to themselves")
+	}
+
+	return target, nil
+}
+
+/*
+AdminSuperadminDisable handles POST /admin/superadmin/users/:id/disable. The
+user is logged out everywhere, and can't log in or use their API tokens
+until they're enabled again. Their sites keep working.
+*/
+func (h *Handlers) AdminSuperadminDisable(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	target, err := h.superadminTarget(c, user)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	if result := h.db.Model(&target).UpdateColumn("disabled_at", time.Now()); result.Error != nil {
+		return c.String(http.StatusBadRequest, "Something failed while saving")
+	}
+
+	h.db.Delete(Session{}, "user_id = ?", target.ID)
+	h.db.Model(&Session{}).Where("impersonating_id = ?", target.ID).UpdateColumn("impersonating_id", nil)
+
+	h.audit(c, user.ID, auditUserDisable, fmt.Sprintf("user %d: %s", target.ID, target.Email))
+	h.audit(c, target.ID, auditUserDisable, fmt.Sprintf("by superadmin %d, %s", user.ID, user.Email))
+
+	return c.Redirect(http.StatusFound, "/admin/superadmin/users")
+}
+
+// AdminSuperadminEnable handles POST /admin/superadmin/users/:id/enable to let a disabled user log in again.
+func (h *Handlers) AdminSuperadminEnable(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	target, err := h.superadminTarget(c, user)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	if result := h.db.Model(&target).UpdateColumn("disabled_at", nil); result.Error != nil {
+		return c.String(http.StatusBadRequest, "Something failed while saving")
+	}
+
+	h.audit(c, user.ID, auditUserEnable, fmt.Sprintf("user %d: %s", target.ID, target.Email))
+	h.audit(c, target.ID, auditUserEnable, fmt.Sprintf("by superadmin %d, %s", user.ID, user.Email))
+
+	return c.Redirect(http.StatusFound, "/admin/superadmin/users")
+}
+
+/*
+AdminSuperadminImpersonate handles POST /admin/superadmin/users/:id/impersonate.
+It needs a reason, and from then on the superadmin's session acts as the
+user, until they stop. Starting and stopping are recorded in the audit logs
+of both, and so is everything audited the superadmin does as the user.
+Other superadmins and disabled users can't be impersonated.
+*/
+func (h *Handlers) AdminSuperadminImpersonate(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	sessionID, ok := c.Get("model.session").(string)
+	if !ok {
+		panic("Really not okay")
+	}
+
+	target, err := h.superadminTarget(c, user)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	if target.Superadmin || target.DisabledAt != nil {
+		return c.String(http.StatusBadRequest, "Superadmins and disabled users can't be impersonated")
+	}
+
+	reason := truncate(strings.TrimSpace(c.FormValue("reason")), 500)
+	if reason == "" {
+		return c.String(http.StatusBadRequest, "Say why you need to impersonate the user")
+	}
+
+	if result := h.db.Model(&Session{}).Where("id = ?", sessionID).UpdateColumn("impersonating_id", target.ID); result.Error != nil {
+		return c.String(http.StatusBadRequest, "Something failed while saving")
+	}
+
+	h.audit(c, user.ID, auditImpersonateStart, fmt.Sprintf("user %d, %s: %s", target.ID, target.Email, reason))
+	h.audit(c, target.ID, auditImpersonateStart, fmt.Sprintf("by superadmin %d, %s: %s", user.ID, user.Email, reason))
+
+	return c.Redirect(http.StatusFound, "/admin")
+}
+
+// AdminImpersonationStop handles POST /admin/impersonation/stop to go back to being the superadmin.
+func (h *Handlers) AdminImpersonationStop(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	sessionID, ok := c.Get("model.session").(string)
+	if !ok {
+		panic("Really not okay")
+	}
+
+	impersonator, ok := c.Get("model.impersonator").(User)
+	if !ok {
+		return c.Redirect(http.StatusFound, "/admin")
+	}
+
+	if result := h.db.Model(&Session{}).Where("id = ?", sessionID).UpdateColumn("impersonating_id", nil); result.Error != nil {
+		return c.String(http.StatusBadRequest, "Something failed while saving")
+	}
+
+	// The impersonation is over, so the audit events don't get the note.
+	c.Set("model.impersonator", nil)
+	h.audit(c, impersonator.ID, auditImpersonateStop, fmt.Sprintf("user %d, %s", user.ID, user.Email))
+	h.audit(c, user.ID, auditImpersonateStop, fmt.Sprintf("by superadmin %d, %s", impersonator.ID, impersonator.Email))
+
+	return c.Redirect(http.StatusFound, "/admin/superadmin/users")
+}
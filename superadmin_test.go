@@ -0,0 +1,256 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	mocket "github.com/selvatico/go-mocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSuperadminCheck(t *testing.T) {
+	pairs := []struct {
+		User         interface{}
+		ExpectedCode int
+	}{
+		{nil, http.StatusNotFound},
+		{User{Model: gorm.Model{ID: 7}}, http.StatusNotFound},
+		{User{Model: gorm.Model{ID: 7}, Superadmin: true}, http.StatusOK},
+	}
+
+	for _, p := range pairs {
+		rec := httptest.NewRecorder()
+		c := e.NewContext(httptest.NewRequest(http.MethodGet, "/admin/superadmin", nil), rec)
+		c.Set("model.user", p.User)
+
+		err := h.SuperadminCheck(func(c echo.Context) error {
+			return c.NoContent(http.StatusOK)
+		})(c)
+
+		if assert.NoError(t, err) {
+			assert.Equal(t, p.ExpectedCode, rec.Code)
+		}
+	}
+}
+
+func TestUnimpersonated(t *testing.T) {
+	rec := httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodPost, "/admin/password", nil), rec)
+	c.Set("model.user", User{Model: gorm.Model{ID: 8}})
+	c.Set("model.impersonator", User{Model: gorm.Model{ID: 7}, Superadmin: true})
+
+	called := false
+	err := h.Unimpersonated(func(c echo.Context) error {
+		called = true
+		return nil
+	})(c)
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+		assert.False(t, called)
+	}
+}
+
+func TestAdminSuperadminDisable(t *testing.T) {
+	mocket.Catcher.Reset()
+	mocket.Catcher.NewMock().WithQuery(`SELECT * FROM "users"`).WithReply([]map[string]interface{}{{"id": 8, "email": "user@example.com"}})
+
+	var disabled []driver.NamedValue
+	mocket.Catcher.NewMock().WithQuery(`UPDATE "users" SET "disabled_at"`).WithCallback(func(_ string, args []driver.NamedValue) {
+		disabled = args
+	})
+
+	var loggedOut []driver.NamedValue
+	mocket.Catcher.NewMock().WithQuery(`DELETE FROM "sessions"`).WithCallback(func(_ string, args []driver.NamedValue) {
+		loggedOut = args
+	})
+
+	var audited []string
+	mocket.Catcher.NewMock().WithQuery(`INSERT INTO "audit_events"`).WithCallback(func(query string, args []driver.NamedValue) {
+		audited = append(audited, insertedValues(query, args)["action"].(string))
+	})
+	defer mocket.Catcher.Reset()
+
+	rec := httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodPost, "/admin/superadmin/users/8/disable", nil), rec)
+	c.SetParamNames("id")
+	c.SetParamValues("8")
+	c.Set("model.user", User{Model: gorm.Model{ID: 7}, Email: "root@example.com", Superadmin: true})
+
+	if assert.NoError(t, h.AdminSuperadminDisable(c)) {
+		assert.Equal(t, http.StatusFound, rec.Code)
+		if assert.NotEmpty(t, disabled) {
+			assert.IsType(t, time.Time{}, disabled[0].Value)
+		}
+		if assert.NotEmpty(t, loggedOut) {
+			assert.EqualValues(t, 8, loggedOut[0].Value)
+		}
+		assert.Equal(t, []string{auditUserDisable, auditUserDisable}, audited)
+	}
+
+	// Superadmins can't lock themselves out.
+	rec = httptest.NewRecorder()
+	c = e.NewContext(httptest.NewRequest(http.MethodPost, "/admin/superadmin/users/8/disable", nil), rec)
+	c.SetParamNames("id")
+	c.SetParamValues("8")
+	c.Set("model.user", User{Model: gorm.Model{ID: 8}, Superadmin: true})
+
+	if assert.NoError(t, h.AdminSuperadminDisable(c)) {
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestAdminSuperadminImpersonate(t *testing.T) {
+	pairs := []struct {
+		Form         string
+		Target       map[string]interface{}
+		ExpectedCode int
+	}{
+		{"reason=", map[string]interface{}{"id": 8, "email": "user@example.com"}, http.StatusBadRequest},
+		{"reason=Support+ticket+42", map[string]interface{}{"id": 8, "email": "root2@example.com", "superadmin": true}, http.StatusBadRequest},
+		{"reason=Support+ticket+42", map[string]interface{}{"id": 8, "email": "user@example.com"}, http.StatusFound},
+	}
+
+	for _, p := range pairs {
+		mocket.Catcher.Reset()
+		mocket.Catcher.NewMock().WithQuery(`SELECT * FROM "users"`).WithReply([]map[string]interface{}{p.Target})
+
+		var impersonating []driver.NamedValue
+		mocket.Catcher.NewMock().WithQuery(`UPDATE "sessions" SET "impersonating_id"`).WithCallback(func(_ string, args []driver.NamedValue) {
+			impersonating = args
+		})
+
+		var details []string
+		mocket.Catcher.NewMock().WithQuery(`INSERT INTO "audit_events"`).WithCallback(func(query string, args []driver.NamedValue) {
+			details = append(details, insertedValues(query, args)["detail"].(string))
+		})
+
+		req := httptest.NewRequest(http.MethodPost, "/admin/superadmin/users/8/impersonate", strings.NewReader(p.Form))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("id")
+		c.SetParamValues("8")
+		c.Set("model.user", User{Model: gorm.Model{ID: 7}, Email: "root@example.com", Superadmin: true})
+		c.Set("model.session", "current-session")
+
+		if !assert.NoError(t, h.AdminSuperadminImpersonate(c)) {
+			continue
+		}
+
+		assert.Equal(t, p.ExpectedCode, rec.Code, p.Form)
+		if p.ExpectedCode != http.StatusFound {
+			assert.Empty(t, impersonating, p.Form)
+			assert.Empty(t, details, p.Form)
+			continue
+		}
+
+		if assert.Len(t, impersonating, 2) {
+			assert.EqualValues(t, 8, impersonating[0].Value)
+			assert.Equal(t, "current-session", impersonating[1].Value)
+		}
+		assert.Equal(t, []string{
+			"user 8, user@example.com: Support ticket 42",
+			"by superadmin 7, root@example.com: Support ticket 42",
+		}, details)
+	}
+
+	mocket.Catcher.Reset()
+}
+
+func TestAuditWhileImpersonating(t *testing.T) {
+	var detail driver.Value
+	mocket.Catcher.Reset().NewMock().WithQuery(`INSERT INTO "audit_events"`).WithCallback(func(query string, args []driver.NamedValue) {
+		detail = insertedValues(query, args)["detail"]
+	})
+	defer mocket.Catcher.Reset()
+
+	c := e.NewContext(httptest.NewRequest(http.MethodPost, "/admin/sites/3/edit", nil), httptest.NewRecorder())
+	c.Set("model.impersonator", User{Model: gorm.Model{ID: 7}, Email: "root@example.com", Superadmin: true})
+
+	h.audit(c, 8, auditSiteUpdate, "site 3")
+
+	assert.Equal(t, "site 3 (by superadmin 7, root@example.com)", detail)
+}
+
+func TestRegisterPostClosed(t *testing.T) {
+	pairs := []struct {
+		Form          string
+		Invitation    bool
+		ExpectedCode  int
+		ExpectedEmail string
+	}{
+		{"email=invited%40example.com", false, http.StatusForbidden, ""},
+		{"email=invited%40example.com&invitation=wrongtoken", false, http.StatusForbidden, ""},
+		{"email=stranger%40example.com&invitation=goodtoken", true, http.StatusOK, "invited@example.com"},
+		{"invitation=goodtoken", true, http.StatusOK, "invited@example.com"},
+	}
+
+	for _, p := range pairs {
+		mocket.Catcher.Reset()
+		mocket.Catcher.NewMock().WithQuery(`SELECT * FROM "settings"`).WithReply([]map[string]interface{}{{"name": settingRegistration, "value": "closed"}})
+		if p.Invitation {
+			mocket.Catcher.NewMock().WithQuery(`SELECT * FROM "invitations"`).WithReply([]map[string]interface{}{{"id": 2, "site_id": 3, "email": "invited@example.com"}})
+		}
+
+		var created map[string]driver.Value
+		mocket.Catcher.NewMock().WithQuery(`INSERT INTO "users"`).WithCallback(func(query string, args []driver.NamedValue) {
+			created = insertedValues(query, args)
+		})
+
+		req := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(p.Form+"&password1=goodpassword&password2=goodpassword"))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		// Its own address, so the registrations of other tests don't rate limit it.
+		req.RemoteAddr = "192.0.2.50:1234"
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+
+		if !assert.NoError(t, h.RegisterPost(c)) {
+			continue
+		}
+
+		assert.Equal(t, p.ExpectedCode, rec.Code, p.Form)
+		if p.ExpectedCode != http.StatusOK {
+			assert.Nil(t, created, p.Form)
+			continue
+		}
+		if assert.NotNil(t, created, p.Form) {
+			assert.Equal(t, p.ExpectedEmail, created["email"], p.Form)
+		}
+	}
+
+	mocket.Catcher.Reset()
+}
+
+func TestLoginPostDisabled(t *testing.T) {
+	mocket.Catcher.Reset()
+	mocket.Catcher.NewMock().WithQuery(`SELECT * FROM "users"`).WithReply([]map[string]interface{}{{
+		"id":              8,
+		"email":           "disabled@example.com",
+		"hashed_password": "hash",
+		"disabled_at":     time.Now(),
+	}})
+
+	var sessions bool
+	mocket.Catcher.NewMock().WithQuery(`INSERT INTO "sessions"`).WithCallback(func(_ string, _ []driver.NamedValue) {
+		sessions = true
+	})
+	defer mocket.Catcher.Reset()
+
+	form := "email=disabled%40example.com&password=goodpassword"
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	if assert.NoError(t, h.LoginPost(c)) {
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+		assert.False(t, sessions)
+	}
+}
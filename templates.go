@@ -7,7 +7,6 @@ import (
 	"path/filepath"
 
 	"github.com/labstack/echo"
-	"github.com/labstack/gommon/log"
 )
 
 // Template struct for working with templates and echo
@@ -50,7 +49,7 @@ func SetRenderer(e *echo.Echo) {
 	files, err := GetTemplateFiles()
 
 	if nil != err {
-		log.Fatalf("Setting the renderer failed: %v", err)
+		fatal("Setting the renderer failed", err)
 	}
 
 	e.Renderer = &Template{
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/javorszky/go-comments/markdown"
+	"github.com/javorszky/go-comments/spam"
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+)
+
+// Comment statuses. New comments wait for a moderator as pending, or as spam
+// if the spam checker thinks they are.
+const (
+	StatusPending  = "pending"
+	StatusApproved = "approved"
+	StatusRejected = "rejected"
+	StatusSpam     = "spam"
+)
+
+// Limits on what commenters can send.
+const (
+	maxCommentLength = 10000
+	maxAuthorLength  = 100
+)
+
+// Thread model definition. A thread is a page on a site, identified by its URL.
+type Thread struct {
+	gorm.Model
+	SiteID   uint   `gorm:"unique_index:thread_site_url"`
+	URL      string `gorm:"type:varchar(191);unique_index:thread_site_url"`
+	Comments []Comment
+}
+
+/*
+Comment model definition. Body is the Markdown as the commenter wrote it,
+BodyHTML is the sanitized HTML it rendered to with the site's Markdown
+features at the time.
+*/
+type Comment struct {
+	gorm.Model
+	SiteID        uint `gorm:"index:comment_site"`
+	ThreadID      uint `gorm:"index:comment_thread"`
+	ParentID      *uint
+	CommenterID   *uint  `gorm:"index:comment_commenter"`
+	AuthorName    string `gorm:"type:varchar(191)"`
+	AuthorWebsite string `gorm:"type:varchar(191)"`
+	AuthorAvatar  string `gorm:"type:varchar(191)"`
+	Body          string `gorm:"type:text"`
+	BodyHTML      string `gorm:"type:text"`
+	Status        string `gorm:"type:varchar(16);index:comment_status"`
+	IP            string
+	UserAgent     string
+	// SpamReasons says why the spam checker held the comment back.
+	SpamReasons string `gorm:"type:text"`
+	// TrainedAs is what the spam checker learned the comment as: spam, ham, or nothing yet.
+	TrainedAs string `gorm:"type:varchar(8)"`
+	// The counts of the comment's votes, kept up to date as they come in.
+	// Reactions is a JSON object of the count of each reaction.
+	Upvotes     int
+	Downvotes   int
+	Score       int     `gorm:"index:comment_score"`
+	Controversy float64 `gorm:"index:comment_controversy"`
+	Reactions   string  `gorm:"type:text"`
+	// EditedAt is when the comment was last edited. Its revisions say by whom.
+	EditedAt *time.Time
+	// NotifyReplies is set when the author wants an email about replies.
+	// Guests have to confirm their address first.
+	NotifyReplies bool
+	// ImportID is where an imported comment came from, like "disqus:123", so it's only imported once.
+	ImportID string `gorm:"type:varchar(64);index:comment_import"`
+}
+
+// SafeHTML marks the rendered body as safe for templates. It only ever
+// holds what the markdown package produced, so it doesn't need escaping.
+func (cm Comment) SafeHTML() template.HTML {
+	return template.HTML(cm.BodyHTML)
+}
+
+/*
+PublicComment is what readers of a site get to see of a comment. Commenters'
+email addresses are never in it. Mine is set on the comments of whoever is
+reading them, so the embed can offer to edit or delete those. Voted and
+Reacted are what the reader voted and reacted on the comment. EditedAt marks
+edited comments, whose revisions are in the API too.
+*/
+type PublicComment struct {
+	ID        uint           `json:"id"`
+	ParentID  *uint          `json:"parentId"`
+	Author    string         `json:"author"`
+	Website   string         `json:"website,omitempty"`
+	Avatar    string         `json:"avatar,omitempty"`
+	HTML      string         `json:"html"`
+	Status    string         `json:"status"`
+	Mine      bool           `json:"mine"`
+	Upvotes   int            `json:"upvotes"`
+	Downvotes int            `json:"downvotes"`
+	Score     int            `json:"score"`
+	Reactions map[string]int `json:"reactions"`
+	Voted     int            `json:"voted,omitempty"`
+	Reacted   []string       `json:"reacted,omitempty"`
+	CreatedAt time.Time      `json:"createdAt"`
+	EditedAt  *time.Time     `json:"editedAt,omitempty"`
+}
+
+// CommentRequest is what the embed sends to post or change a comment.
+type CommentRequest struct {
+	URL      string `json:"url" form:"url"`
+	ParentID uint   `json:"parentId" form:"parentId"`
+	Author   string `json:"author" form:"author"`
+	Email    string `json:"email" form:"email"`
+	Website  string `json:"website" form:"website"`
+	Body     string `json:"body" form:"body"`
+	// FormToken is the X-Comment-Form header of the comments the form was shown with.
+	FormToken string `json:"formToken" form:"formToken"`
+	// Honeypot is a field the embed hides from people. Only bots fill it in.
+	Honeypot string `json:"hp" form:"hp"`
+	// Notify asks for an email when someone replies. It needs an email address.
+	Notify bool `json:"notify" form:"notify"`
+}
+
+// publicComment returns what readers see of cm. viewer is the ID of the
+// commenter reading it, if they are known.
+func publicComment(cm Comment, viewer *uint) PublicComment {
+	return PublicComment{
+		ID:        cm.ID,
+		ParentID:  cm.ParentID,
+		Author:    cm.AuthorName,
+		Website:   cm.AuthorWebsite,
+		Avatar:    cm.AuthorAvatar,
+		HTML:      cm.BodyHTML,
+		Status:    cm.Status,
+		Mine:      viewer != nil && cm.CommenterID != nil && *viewer == *cm.CommenterID,
+		Upvotes:   cm.Upvotes,
+		Downvotes: cm.Downvotes,
+		Score:     cm.Score,
+		Reactions: cm.ReactionCounts(),
+		CreatedAt: cm.CreatedAt,
+		EditedAt:  cm.EditedAt,
+	}
+}
+
+// validateBody checks a comment's Markdown before it's saved.
+func validateBody(body string) error {
+	if strings.TrimSpace(body) == "" {
+		return fmt.Errorf("Comment is empty.")
+	}
+
+	if utf8.RuneCountInString(body) > maxCommentLength {
+		return fmt.Errorf("Comment is longer than %d characters.", maxCommentLength)
+	}
+
+	return nil
+}
+
+// renderBody turns a comment's Markdown into HTML with the site's features.
+func renderBody(site Site, body string) string {
+	return markdown.Render(body, site.Features())
+}
+
+/*
+SiteCheck is a middleware for the public API. It looks up the site in the
+:site route parameter, and answers 404 if there's no such site.
+
+Browsers only get to read the responses on pages that are on one of the
+site's domains: the CORS headers are only sent for those origins. Preflight
+requests are answered here.
+
+Commenters are known by a cookie that is sent along from any page, so the
+requests that change something are turned down unless their Origin, or
+Referer when there's no Origin, is on one of the site's domains, and those
+with a body unless it's JSON, which other pages can't send without asking
+first.
+*/
+func (h *Handlers) SiteCheck(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		site := Site{}
+
+		if h.db.Where("id = ?", c.Param("site")).First(&site).RecordNotFound() {
+			return c.JSON(http.StatusNotFound, ResponseError{"No such site."})
+		}
+
+		header := c.Response().Header()
+		header.Add(echo.HeaderVary, echo.HeaderOrigin)
+
+		if origin := c.Request().Header.Get(echo.HeaderOrigin); origin != "" && site.AllowsOrigin(origin) {
+			header.Set(echo.HeaderAccessControlAllowOrigin, origin)
+			header.Set(echo.HeaderAccessControlAllowCredentials, "true")
+			header.Set(echo.HeaderAccessControlExposeHeaders, formTokenHeader)
+		}
+
+		if c.Request().Method == http.MethodOptions {
+			header.Set(echo.HeaderAccessControlAllowMethods, "GET, POST, PUT, DELETE")
+			header.Set(echo.HeaderAccessControlAllowHeaders, echo.HeaderContentType)
+			header.Set(echo.HeaderAccessControlMaxAge, "86400")
+			return c.NoContent(http.StatusNoContent)
+		}
+
+		if req := c.Request(); !safeMethod(req.Method) {
+			origin := req.Header.Get(echo.HeaderOrigin)
+			if origin == "" {
+				origin = req.Referer()
+			}
+			if !site.AllowsOrigin(origin) {
+				return c.JSON(http.StatusForbidden, ResponseError{"Requests have to come from one of the site's pages."})
+			}
+
+			mediaType, _, _ := mime.ParseMediaType(req.Header.Get(echo.HeaderContentType))
+			if req.Method != http.MethodDelete && mediaType != echo.MIMEApplicationJSON {
+				return c.JSON(http.StatusUnsupportedMediaType, ResponseError{"Requests have to be sent as JSON."})
+			}
+		}
+
+		c.Set("model.site", site)
+
+		return next(c)
+	}
+}
+
+// safeMethod tells whether requests with method only read.
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// Preflight is the handler for OPTIONS routes, which SiteCheck answers before it gets here.
+func (h *Handlers) Preflight(c echo.Context) error {
+	return c.NoContent(http.StatusNoContent)
+}
+
+// threadURL checks that the page URL is on one of the site's domains, and
+// drops the fragment from it.
+func threadURL(site Site, raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil || !site.AllowsURL(u) {
+		return "", fmt.Errorf("page is not on one of the site's domains")
+	}
+
+	u.Fragment = ""
+	return u.String(), nil
+}
+
+/*
+Comments handles GET /api/sites/:site/comments?url=&sort= with the approved
+comments on a page. They are sorted oldest first, unless sort asks for
+newest, top or controversial.
+*/
+func (h *Handlers) Comments(c echo.Context) error {
+	site, ok := c.Get("model.site").(Site)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	pageURL, err := threadURL(site, c.QueryParam("url"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ResponseError{err.Error()})
+	}
+
+	order, ok := sortOrders[c.QueryParam("sort")]
+	if !ok {
+		return c.JSON(http.StatusBadRequest, ResponseError{"Comments can be sorted by oldest, newest, top or controversial."})
+	}
+
+	c.Response().Header().Set(formTokenHeader, h.formToken(time.Now()))
+
+	comments := []PublicComment{}
+	thread := Thread{}
+
+	if h.db.Where("site_id = ? AND url = ?", site.ID, pageURL).First(&thread).RecordNotFound() {
+		return c.JSON(http.StatusOK, comments)
+	}
+
+	var viewer *uint
+	if commenter, ok := h.currentCommenter(c); ok {
+		viewer = &commenter.ID
+	}
+
+	var found []Comment
+
+	h.db.Where("thread_id = ? AND status = ?", thread.ID, StatusApproved).Order(order).Find(&found)
+
+	ids := make([]uint, 0, len(found))
+	for _, cm := range found {
+		ids = append(ids, cm.ID)
+	}
+	votes := h.viewerVotes(h.voterFor(c, viewer), ids)
+
+	for _, cm := range found {
+		comments = append(comments, withVotes(publicComment(cm, viewer), votes[cm.ID]))
+	}
+
+	return c.JSON(http.StatusOK, comments)
+}
+
+/*
+CommentsPost handles POST /api/sites/:site/comments. The body is rendered
+with the site's Markdown features, and the comment waits for a moderator.
+The site's owner gets an email about it if they asked for one.
+
+Whoever posts it gets the commenter cookie, so they can change or delete the
+comment within the site's edit window.
+*/
+func (h *Handlers) CommentsPost(c echo.Context) error {
+	site, ok := c.Get("model.site").(Site)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	req := CommentRequest{}
+
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ResponseError{"Could not read the comment."})
+	}
+
+	pageURL, err := threadURL(site, req.URL)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ResponseError{err.Error()})
+	}
+
+	if err := validateBody(req.Body); err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, ResponseError{err.Error()})
+	}
+
+	known, found := h.currentCommenter(c)
+	if result, err := h.limits.Comments.Hit(c.Request().Context(), h.commentKeys(c, site, known, found)...); !h.allowed(c, result, err) {
+		return tooManyRequests(c, result.RetryAfter)
+	}
+
+	commenter, code, err := h.commenterFor(c, site, req)
+	if err != nil {
+		return c.JSON(code, ResponseError{err.Error()})
+	}
+
+	comment := Comment{
+		SiteID:        site.ID,
+		AuthorName:    commenter.Name,
+		AuthorWebsite: commenter.Website,
+		AuthorAvatar:  commenter.AvatarURL,
+		Body:          req.Body,
+		BodyHTML:      renderBody(site, req.Body),
+		Status:        StatusPending,
+		NotifyReplies: req.Notify && commenter.Email != "" && commenter.Kind == KindOIDC,
+		IP:            clientIP(c, h.cfg.TrustedProxies),
+		UserAgent:     c.Request().UserAgent(),
+	}
+
+	submission := spam.Submission{
+		Site:      site.ID,
+		Body:      req.Body,
+		Author:    commenter.Name,
+		Email:     commenter.Email,
+		Website:   commenter.Website,
+		IP:        comment.IP,
+		UserAgent: comment.UserAgent,
+		Referrer:  c.Request().Referer(),
+		PageURL:   pageURL,
+		Honeypot:  req.Honeypot,
+	}
+	submission.Elapsed, submission.Timed = h.formElapsed(req.FormToken, time.Now())
+
+	if verdict := h.checkSpam(c, submission); verdict.Spam {
+		comment.Status = StatusSpam
+		comment.SpamReasons = strings.Join(verdict.Reasons, "; ")
+	}
+
+	// The thread and a guest are only saved with the comment, so nothing is
+	// left behind when it can't be.
+	tx := h.db.Begin()
+
+	thread := Thread{}
+	if result := tx.Where(Thread{SiteID: site.ID, URL: pageURL}).FirstOrCreate(&thread); result.Error != nil {
+		tx.Rollback()
+		return c.JSON(http.StatusInternalServerError, ResponseError{"Something failed while saving."})
+	}
+	comment.ThreadID = thread.ID
+
+	if req.ParentID != 0 {
+		parent := Comment{}
+		if tx.Where("id = ? AND thread_id = ?", req.ParentID, thread.ID).First(&parent).RecordNotFound() {
+			tx.Rollback()
+			return c.JSON(http.StatusUnprocessableEntity, ResponseError{"The comment this replies to is not on this page."})
+		}
+		comment.ParentID = &parent.ID
+	}
+
+	if commenter.Kind == KindGuest {
+		if result := tx.Save(&commenter); result.Error != nil {
+			tx.Rollback()
+			return c.JSON(http.StatusInternalServerError, ResponseError{"Something failed while saving."})
+		}
+	}
+	comment.CommenterID = &commenter.ID
+
+	if result := tx.Create(&comment); result.Error != nil {
+		tx.Rollback()
+		return c.JSON(http.StatusInternalServerError, ResponseError{"Something failed while saving."})
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, ResponseError{"Something failed while saving."})
+	}
+
+	commentsTotal.Inc(strconv.Itoa(int(site.ID)), "posted")
+
+	h.notifyOwner(c, site, comment, pageURL)
+
+	// Providers only tell us addresses they verified. Guests and the host
+	// sites' single sign-on can say anything, so those are confirmed first.
+	if req.Notify && commenter.Email != "" && commenter.Kind != KindOIDC && comment.Status != StatusSpam {
+		h.askToConfirm(c, site, comment, commenter, pageURL)
+	}
+
+	if comment.Status == StatusSpam {
+		h.trigger(c, site, EventCommentFlagged, comment)
+	} else {
+		h.trigger(c, site, EventCommentCreated, comment)
+	}
+
+	h.setCommenterCookie(c, commenter)
+
+	// Spammers don't get to find out what gives them away.
+	public := publicComment(comment, &commenter.ID)
+	if comment.Status == StatusSpam {
+		commentsTotal.Inc(strconv.Itoa(int(site.ID)), StatusSpam)
+		public.Status = StatusPending
+	}
+
+	return c.JSON(http.StatusCreated, public)
+}
+
+// AdminComments handles GET /admin/sites/:id/comments to list a site's comments by status.
+func (h *Handlers) AdminComments(c echo.Context) error {
+	site, ok := h.siteFor(c, RoleModerator)
+	if !ok {
+		return c.String(http.StatusNotFound, "No such site")
+	}
+
+	status := c.QueryParam("status")
+	if status == "" {
+		status = StatusPending
+	}
+
+	var comments []Comment
+
+	h.db.Where("site_id = ? AND status = ?", site.ID, status).Order("created_at desc").Limit(200).Find(&comments)
+
+	return c.Render(http.StatusOK, "admincomments", struct {
+		Csrf     interface{}
+		Site     Site
+		Status   string
+		Statuses []string
+		Comments []Comment
+	}{
+		Csrf:     c.Get("csrf"),
+		Site:     site,
+		Status:   status,
+		Statuses: []string{StatusPending, StatusSpam, StatusApproved, StatusRejected},
+		Comments: comments,
+	})
+}
+
+// AdminCommentApprove handles POST /admin/sites/:id/comments/:comment/approve.
+func (h *Handlers) AdminCommentApprove(c echo.Context) error {
+	return h.moderate(c, StatusApproved)
+}
+
+// AdminCommentReject handles POST /admin/sites/:id/comments/:comment/reject.
+func (h *Handlers) AdminCommentReject(c echo.Context) error {
+	return h.moderate(c, StatusRejected)
+}
+
+// AdminCommentSpam handles POST /admin/sites/:id/comments/:comment/spam.
+func (h *Handlers) AdminCommentSpam(c echo.Context) error {
+	return h.moderate(c, StatusSpam)
+}
+
+// moderate sets the status of a comment on a site the user moderates.
+func (h *Handlers) moderate(c echo.Context, status string) error {
+	site, ok := h.siteFor(c, RoleModerator)
+	if !ok {
+		return c.String(http.StatusNotFound, "No such site")
+	}
+
+	comment := Comment{}
+
+	if h.db.Where("id = ? AND site_id = ?", c.Param("comment"), site.ID).First(&comment).RecordNotFound() {
+		return c.String(http.StatusNotFound, "No such comment")
+	}
+
+	if err := h.setStatus(c, site, &comment, status); err != nil {
+		return c.String(http.StatusBadRequest, "Something failed while saving")
+	}
+
+	return c.Redirect(http.StatusFound, fmt.Sprintf("/admin/sites/%d/comments", site.ID))
+}
+
+/*
+setStatus saves the moderator's decision about a comment, and teaches it to
+the spam checker. Approving a reply tells the author of the comment it
+answers, if they want to know.
+*/
+func (h *Handlers) setStatus(c echo.Context, site Site, comment *Comment, status string) error {
+	previous := comment.Status
+
+	if result := h.db.Model(comment).Update("status", status); result.Error != nil {
+		return result.Error
+	}
+
+	h.learn(c, *comment, status)
+
+	if status == StatusApproved && previous != StatusApproved {
+		h.notifyReply(c, site, *comment)
+		h.trigger(c, site, EventCommentApproved, *comment)
+	}
+
+	if status == StatusSpam && previous != StatusSpam {
+		h.trigger(c, site, EventCommentFlagged, *comment)
+	}
+
+	commentsTotal.Inc(strconv.Itoa(int(site.ID)), status)
+
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	mocket "github.com/selvatico/go-mocket"
+	"github.com/stretchr/testify/assert"
+)
+
+var mockSite = Site{
+	Model:             gorm.Model{ID: 3},
+	UserID:            7,
+	Designation:       "blog",
+	Domains:           `["example.com","https://secure.example.org"]`,
+	MarkdownFeatures:  "emphasis,links",
+	CommenterPolicy:   PolicyAnonymous,
+	EditWindowMinutes: 15,
+}
+
+func TestSiteAllowsURL(t *testing.T) {
+	pairs := []struct {
+		URL     string
+		Allowed bool
+	}{
+		{"https://example.com/post", true},
+		{"http://example.com:8080/post", true},
+		{"https://EXAMPLE.com/post", true},
+		{"https://secure.example.org/post", true},
+		{"http://secure.example.org/post", false},
+		{"https://evil.com/?example.com", false},
+		{"https://example.com.evil.com/", false},
+		{"javascript://example.com/", false},
+		{"/relative/path", false},
+	}
+
+	for _, p := range pairs {
+		u, _ := url.Parse(p.URL)
+		assert.Equal(t, p.Allowed, mockSite.AllowsURL(u), p.URL)
+	}
+}
+
+func TestSiteCheckPreflight(t *testing.T) {
+	mocket.Catcher.Reset().NewMock().WithQuery(`FROM "sites"`).WithReply([]map[string]interface{}{
+		{"id": 3, "domains": mockSite.Domains},
+	})
+	defer mocket.Catcher.Reset()
+
+	pairs := []struct {
+		Origin  string
+		Allowed string
+	}{
+		{"https://example.com", "https://example.com"},
+		{"https://evil.com", ""},
+	}
+
+	for _, p := range pairs {
+		req := httptest.NewRequest(http.MethodOptions, "/api/sites/3/comments", nil)
+		req.Header.Set(echo.HeaderOrigin, p.Origin)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("site")
+		c.SetParamValues("3")
+
+		if assert.NoError(t, h.SiteCheck(h.Preflight)(c)) {
+			assert.Equal(t, http.StatusNoContent, rec.Code)
+			assert.Equal(t, p.Allowed, rec.Header().Get(echo.HeaderAccessControlAllowOrigin))
+		}
+	}
+}
+
+func TestSiteCheckUnknownSite(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/api/sites/99/comments", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("site")
+	c.SetParamValues("99")
+
+	if assert.NoError(t, h.SiteCheck(h.Comments)(c)) {
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestSiteCheckOrigin(t *testing.T) {
+	mocket.Catcher.Reset().NewMock().WithQuery(`FROM "sites"`).WithReply([]map[string]interface{}{
+		{"id": 3, "domains": mockSite.Domains},
+	})
+	defer mocket.Catcher.Reset()
+
+	pairs := []struct {
+		Method       string
+		Origin       string
+		Referer      string
+		ContentType  string
+		ExpectedCode int
+	}{
+		{http.MethodGet, "https://evil.com", "", "", http.StatusOK},
+		{http.MethodPost, "https://example.com", "", echo.MIMEApplicationJSON, http.StatusOK},
+		{http.MethodPost, "", "https://example.com/post", echo.MIMEApplicationJSONCharsetUTF8, http.StatusOK},
+		{http.MethodDelete, "https://example.com", "", "", http.StatusOK},
+		{http.MethodPost, "https://evil.com", "", echo.MIMEApplicationJSON, http.StatusForbidden},
+		{http.MethodPost, "https://evil.com", "https://example.com/post", echo.MIMEApplicationJSON, http.StatusForbidden},
+		{http.MethodPost, "", "https://evil.com/?example.com", echo.MIMEApplicationJSON, http.StatusForbidden},
+		{http.MethodPost, "", "", echo.MIMEApplicationJSON, http.StatusForbidden},
+		{http.MethodPut, "null", "", echo.MIMEApplicationJSON, http.StatusForbidden},
+		{http.MethodDelete, "https://evil.com", "", "", http.StatusForbidden},
+		{http.MethodPost, "https://example.com", "", echo.MIMEApplicationForm, http.StatusUnsupportedMediaType},
+		{http.MethodPost, "https://example.com", "", echo.MIMETextPlain, http.StatusUnsupportedMediaType},
+	}
+
+	for _, p := range pairs {
+		req := httptest.NewRequest(p.Method, "/api/sites/3/comments", strings.NewReader(`{"url":"https://example.com/post","body":"hi"}`))
+		req.Header.Set(echo.HeaderOrigin, p.Origin)
+		req.Header.Set("Referer", p.Referer)
+		req.Header.Set(echo.HeaderContentType, p.ContentType)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("site")
+		c.SetParamValues("3")
+
+		called := false
+		next := func(c echo.Context) error {
+			called = true
+			return c.NoContent(http.StatusOK)
+		}
+
+		if assert.NoError(t, h.SiteCheck(next)(c)) {
+			assert.Equal(t, p.ExpectedCode, rec.Code, "%s %s %s %s", p.Method, p.Origin, p.Referer, p.ContentType)
+			assert.Equal(t, p.ExpectedCode == http.StatusOK, called, "%s %s %s %s", p.Method, p.Origin, p.Referer, p.ContentType)
+		}
+	}
+}
+
+func TestCommentsPost(t *testing.T) {
+	pairs := []struct {
+		Body         string
+		ExpectedCode int
+		ExpectedHTML string
+	}{
+		{`{"url":"https://evil.com/post","body":"hi"}`, http.StatusBadRequest, ""},
+		{`{"url":"https://example.com/post","body":""}`, http.StatusUnprocessableEntity, ""},
+		{`{"url":"https://example.com/post","body":"` + strings.Repeat("a", maxCommentLength+1) + `"}`, http.StatusUnprocessableEntity, ""},
+		{`{"url":"https://example.com/post","author":"` + strings.Repeat("a", maxAuthorLength+1) + `","body":"hi"}`, http.StatusUnprocessableEntity, ""},
+		{`{"url":"https://example.com/post#comments","author":"Jane","body":"*hi* <script>` + "`x`" + `"}`, http.StatusCreated, "<p><em>hi</em> &lt;script&gt;`x`</p>\n"},
+	}
+
+	for _, p := range pairs {
+		req := httptest.NewRequest(http.MethodPost, "/api/sites/3/comments", strings.NewReader(p.Body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("model.site", mockSite)
+
+		if assert.NoError(t, h.CommentsPost(c)) {
+			assert.Equal(t, p.ExpectedCode, rec.Code, rec.Body.String())
+
+			if p.ExpectedCode == http.StatusCreated {
+				var comment PublicComment
+				assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &comment))
+				assert.Equal(t, p.ExpectedHTML, comment.HTML)
+				assert.Equal(t, StatusPending, comment.Status)
+				assert.Equal(t, "Jane", comment.Author)
+				assert.True(t, comment.Mine)
+				assert.Contains(t, rec.Header().Get(echo.HeaderSetCookie), commenterCookie+"=")
+			}
+		}
+	}
+}
+
+func TestCommentsEmptyThread(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/api/sites/3/comments?url=https%3A%2F%2Fexample.com%2Fpost", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.Set("model.site", mockSite)
+
+	if assert.NoError(t, h.Comments(c)) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "[]", strings.TrimSpace(rec.Body.String()))
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/javorszky/go-comments/config"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+/*
+NewTLSConfig returns the TLS configuration for the https server.
+
+Without TLS hosts the certificate and key files from the config are used and
+the returned manager is nil. Otherwise certificates come from the ACME
+manager, which is returned as well so it can answer http-01 challenges.
+*/
+func NewTLSConfig(cfg *config.Config) (*tls.Config, *autocert.Manager, error) {
+	if len(cfg.TLSHosts) == 0 {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("loading certificate failed: %v", err)
+		}
+
+		return &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{"h2", "http/1.1"},
+		}, nil, nil
+	}
+
+	m, err := NewCertManager(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return m.TLSConfig(), m, nil
+}
+
+/*
+NewCertManager returns an ACME certificate manager for the hosts in the config.
+
+Certificates are issued on the first TLS handshake for a host, cached in the
+TLS cache directory, and renewed in the background before they expire. By
+default the manager talks to Let's Encrypt. Setting ACME_DIRECTORY points it
+at a different CA, such as a local Pebble instance, and ACME_CA_ROOT adds the
+PEM encoded root that CA's directory is served with to the trusted pool.
+*/
+func NewCertManager(cfg *config.Config) (*autocert.Manager, error) {
+	if len(cfg.TLSHosts) == 0 {
+		return nil, fmt.Errorf("no TLS hosts configured")
+	}
+
+	client := &acme.Client{
+		DirectoryURL: cfg.ACMEDirectory,
+	}
+
+	if cfg.ACMECARoot != "" {
+		httpClient, err := trustingClient(cfg.ACMECARoot)
+		if err != nil {
+			return nil, err
+		}
+		client.HTTPClient = httpClient
+	}
+
+	return &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(cfg.TLSCacheDir),
+		HostPolicy:  autocert.HostWhitelist(cfg.TLSHosts...),
+		RenewBefore: cfg.ACMERenewBefore,
+		Client:      client,
+		Email:       cfg.ACMEEmail,
+	}, nil
+}
+
+// trustingClient returns an http client that trusts the system roots and the
+// certificates in the PEM file at path.
+func trustingClient(path string) (*http.Client, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading ACME CA root failed: %v", err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+/*
+RedirectHandler answers ACME http-01 challenges when a manager is given, and
+redirects every other plain HTTP request to the same host and path on the
+HTTPS port.
+*/
+func RedirectHandler(m *autocert.Manager, tlsPort string) http.Handler {
+	redirect := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Use HTTPS", http.StatusBadRequest)
+			return
+		}
+
+		host := stripPort(r.Host)
+		if tlsPort != "" && tlsPort != "443" {
+			host = fmt.Sprintf("%s:%s", host, tlsPort)
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+
+	if m == nil {
+		return redirect
+	}
+
+	return m.HTTPHandler(redirect)
+}
+
+// stripPort removes the port from a host:port pair, leaving bare hosts alone.
+func stripPort(hostport string) string {
+	for i := len(hostport) - 1; i >= 0; i-- {
+		switch hostport[i] {
+		case ':':
+			return hostport[:i]
+		case ']':
+			return hostport
+		}
+	}
+	return hostport
+}
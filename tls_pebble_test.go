@@ -0,0 +1,64 @@
+//go:build pebble
+
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/javorszky/go-comments/config"
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+TestPebbleIssueAndRenew runs against a local Pebble ACME server started with
+PEBBLE_VA_ALWAYS_VALID=1, so no challenge has to be reachable from outside:
+
+	go test -tags pebble -run Pebble .
+
+PEBBLE_DIRECTORY defaults to https://localhost:14000/dir, and PEBBLE_CA_ROOT
+must point at the pebble.minica.pem the directory is served with.
+
+The renewal window is set longer than Pebble's certificate lifetime, so the
+manager renews as soon as it has issued the first certificate.
+*/
+func TestPebbleIssueAndRenew(t *testing.T) {
+	directory := os.Getenv("PEBBLE_DIRECTORY")
+	if directory == "" {
+		directory = "https://localhost:14000/dir"
+	}
+
+	m, err := NewCertManager(&config.Config{
+		TLSHosts:        []string{"comments.test"},
+		TLSCacheDir:     t.TempDir(),
+		ACMEDirectory:   directory,
+		ACMECARoot:      os.Getenv("PEBBLE_CA_ROOT"),
+		ACMERenewBefore: 100 * 365 * 24 * time.Hour,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	hello := &tls.ClientHelloInfo{
+		ServerName:   "comments.test",
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	}
+
+	first, err := m.GetCertificate(hello)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	deadline := time.Now().Add(time.Minute)
+	for time.Now().Before(deadline) {
+		renewed, err := m.GetCertificate(hello)
+		if assert.NoError(t, err) && renewed.Leaf.SerialNumber.Cmp(first.Leaf.SerialNumber) != 0 {
+			return
+		}
+		time.Sleep(time.Second)
+	}
+
+	t.Fatal("certificate was not renewed within a minute")
+}
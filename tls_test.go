@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/javorszky/go-comments/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewCertManagerNeedsHosts(t *testing.T) {
+	_, err := NewCertManager(&config.Config{})
+
+	assert.Error(t, err)
+}
+
+func TestNewCertManagerHostPolicy(t *testing.T) {
+	m, err := NewCertManager(&config.Config{
+		TLSHosts:      []string{"comments.example.com"},
+		TLSCacheDir:   t.TempDir(),
+		ACMEDirectory: "https://localhost:14000/dir",
+	})
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, "https://localhost:14000/dir", m.Client.DirectoryURL)
+		assert.NoError(t, m.HostPolicy(context.Background(), "comments.example.com"))
+		assert.Error(t, m.HostPolicy(context.Background(), "evil.example.com"))
+	}
+}
+
+func TestNewCertManagerBadCARoot(t *testing.T) {
+	_, err := NewCertManager(&config.Config{
+		TLSHosts:   []string{"comments.example.com"},
+		ACMECARoot: "does/not/exist.pem",
+	})
+
+	assert.Error(t, err)
+}
+
+func TestRedirectHandler(t *testing.T) {
+	pairs := []struct {
+		Method   string
+		Target   string
+		TLSPort  string
+		Code     int
+		Location string
+	}{
+		{http.MethodGet, "http://goapp.test/admin?a=b", "443", http.StatusMovedPermanently, "https://goapp.test/admin?a=b"},
+		{http.MethodGet, "http://goapp.test:8090/login", "1323", http.StatusMovedPermanently, "https://goapp.test:1323/login"},
+		{http.MethodHead, "http://goapp.test/", "", http.StatusMovedPermanently, "https://goapp.test/"},
+		{http.MethodPost, "http://goapp.test/login", "443", http.StatusBadRequest, ""},
+	}
+
+	for _, p := range pairs {
+		req := httptest.NewRequest(p.Method, p.Target, nil)
+		rec := httptest.NewRecorder()
+
+		RedirectHandler(nil, p.TLSPort).ServeHTTP(rec, req)
+
+		assert.Equal(t, p.Code, rec.Code)
+		assert.Equal(t, p.Location, rec.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// defaultReactions are the reactions new sites start with.
+const defaultReactions = "👍,❤️,😄,🎉,😕"
+
+// Limits on a site's reactions, so they fit their columns.
+const (
+	maxReactionLength  = 32
+	maxReactionsLength = 191
+)
+
+/*
+sortOrders are the orders readers can ask for the comments on a page in.
+Top and controversial use the counts kept on the comments, so sorting by
+them doesn't have to look at the votes.
+*/
+var sortOrders = map[string]string{
+	"":              "created_at asc",
+	"oldest":        "created_at asc",
+	"newest":        "created_at desc",
+	"top":           "score desc, created_at asc",
+	"controversial": "controversy desc, created_at asc",
+}
+
+/*
+Vote model definition. A vote is an upvote or downvote when Reaction is
+empty, and a reaction otherwise. Every voter has at most one vote and one of
+each reaction on a comment.
+
+Voters are commenters when they have the commenter cookie, and a keyed hash
+of their IP address when they don't.
+*/
+type Vote struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	CommentID uint   `gorm:"unique_index:vote_comment_voter"`
+	Voter     string `gorm:"type:varchar(80);unique_index:vote_comment_voter"`
+	Reaction  string `gorm:"type:varchar(32);unique_index:vote_comment_voter"`
+	Value     int
+}
+
+// VoteRequest is what the embed sends to vote on a comment.
+type VoteRequest struct {
+	// Value is 1 for an upvote, -1 for a downvote, and 0 takes the vote back.
+	Value int `json:"value" form:"value"`
+}
+
+// ReactionRequest is what the embed sends to react to a comment.
+type ReactionRequest struct {
+	Reaction string `json:"reaction" form:"reaction"`
+	// Remove takes the reaction back.
+	Remove bool `json:"remove" form:"remove"`
+}
+
+// voteCount is a row of the votes on a comment, counted by what they are.
+type voteCount struct {
+	Reaction string
+	Value    int
+	Count    int
+}
+
+// ReactionList returns the reactions commenters can leave on the site's comments.
+func (s Site) ReactionList() []string {
+	var list []string
+	for _, r := range strings.Split(s.Reactions, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			list = append(list, r)
+		}
+	}
+	return list
+}
+
+// allowsReaction tells whether reaction is one of the site's reactions.
+func (s Site) allowsReaction(reaction string) bool {
+	for _, r := range s.ReactionList() {
+		if r == reaction {
+			return true
+		}
+	}
+	return false
+}
+
+// parseReactions turns the reactions from the site form into the stored
+// list, leaving out blanks and repeats.
+func parseReactions(raw string) (string, error) {
+	seen := map[string]bool{}
+	var list []string
+
+	for _, r := range strings.FieldsFunc(raw, func(r rune) bool { return r == ',' || r == ' ' || r == '\n' || r == '\r' }) {
+		if seen[r] {
+			continue
+		}
+		if len(r) > maxReactionLength {
+			return "", fmt.Errorf("Reaction %q is too long", r)
+		}
+		seen[r] = true
+		list = append(list, r)
+	}
+
+	joined := strings.Join(list, ",")
+	if len(joined) > maxReactionsLength {
+		return "", fmt.Errorf("Too many reactions")
+	}
+	return joined, nil
+}
+
+// ReactionCounts returns how many of each reaction the comment got.
+func (cm Comment) ReactionCounts() map[string]int {
+	counts := map[string]int{}
+	json.Unmarshal([]byte(cm.Reactions), &counts)
+	return counts
+}
+
+// tally sets the comment's counts from its votes.
+func (cm *Comment) tally(counts []voteCount) {
+	reactions := map[string]int{}
+	cm.Upvotes, cm.Downvotes = 0, 0
+
+	for _, vc := range counts {
+		switch {
+		case vc.Reaction != "":
+			reactions[vc.Reaction] += vc.Count
+		case vc.Value > 0:
+			cm.Upvotes += vc.Count
+		case vc.Value < 0:
+			cm.Downvotes += vc.Count
+		}
+	}
+
+	encoded, _ := json.Marshal(reactions)
+	cm.Reactions = string(encoded)
+	cm.Score = cm.Upvotes - cm.Downvotes
+	cm.Controversy = controversy(cm.Upvotes, cm.Downvotes)
+}
+
+/*
+controversy is high for comments with many votes split evenly between up and
+down. It's the number of votes, to the power of how balanced they are, so a
+comment that nobody disagrees with scores nothing.
+*/
+func controversy(up, down int) float64 {
+	if up <= 0 || down <= 0 {
+		return 0
+	}
+
+	balance := float64(down) / float64(up)
+	if up < down {
+		balance = float64(up) / float64(down)
+	}
+
+	return math.Pow(float64(up+down), balance)
+}
+
+// voterFor returns who is voting: the commenter reading the comments, or the hash
+// of their IP address as clientIP sees it.
+func (h *Handlers) voterFor(c echo.Context, viewer *uint) string {
+	if viewer != nil {
+		return fmt.Sprintf("commenter:%d", *viewer)
+	}
+	return "ip:" + h.sign("vote:" + clientIP(c, h.cfg.TrustedProxies))[:32]
+}
+
+// viewerVotes returns the votes of voter on the comments, by comment.
+func (h *Handlers) viewerVotes(voter string, comments []uint) map[uint][]Vote {
+	byComment := map[uint][]Vote{}
+	if len(comments) == 0 {
+		return byComment
+	}
+
+	var votes []Vote
+	h.db.Where("voter = ? AND comment_id IN (?)", voter, comments).Find(&votes)
+
+	for _, v := range votes {
+		byComment[v.CommentID] = append(byComment[v.CommentID], v)
+	}
+	return byComment
+}
+
+// withVotes marks what the viewer voted and reacted on the comment.
+func withVotes(public PublicComment, votes []Vote) PublicComment {
+	for _, v := range votes {
+		if v.Reaction == "" {
+			public.Voted = v.Value
+			continue
+		}
+		public.Reacted = append(public.Reacted, v.Reaction)
+	}
+	return public
+}
+
+/*
+castVote saves voter's vote on the comment, or takes it back when value is
+0, and counts the comment's votes again. The comment's row is locked while
+that happens, so votes coming in at the same time don't lose each other.
+*/
+func (h *Handlers) castVote(comment Comment, voter, reaction string, value int) (Comment, error) {
+	tx := h.db.Begin()
+
+	if err := tx.Set("gorm:query_option", "FOR UPDATE").Where("id = ?", comment.ID).First(&comment).Error; err != nil {
+		tx.Rollback()
+		return comment, err
+	}
+
+	var err error
+	if value == 0 {
+		err = tx.Where("comment_id = ? AND voter = ? AND reaction = ?", comment.ID, voter, reaction).Delete(Vote{}).Error
+	} else {
+		err = tx.Exec("INSERT INTO votes (created_at, comment_id, voter, reaction, value) VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE value = VALUES(value)", time.Now(), comment.ID, voter, reaction, value).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return comment, err
+	}
+
+	var counts []voteCount
+	if err := tx.Model(Vote{}).Select("reaction, value, count(*) AS count").Where("comment_id = ?", comment.ID).Group("reaction, value").Scan(&counts).Error; err != nil {
+		tx.Rollback()
+		return comment, err
+	}
+
+	comment.tally(counts)
+
+	// Votes aren't changes to the comment, so they leave updated_at alone.
+	if err := tx.Model(&comment).UpdateColumns(map[string]interface{}{
+		"upvotes":     comment.Upvotes,
+		"downvotes":   comment.Downvotes,
+		"score":       comment.Score,
+		"controversy": comment.Controversy,
+		"reactions":   comment.Reactions,
+	}).Error; err != nil {
+		tx.Rollback()
+		return comment, err
+	}
+
+	return comment, tx.Commit().Error
+}
+
+/*
+vote records a vote or reaction from whoever is reading an approved comment
+on the site, and answers with the comment's new counts.
+*/
+func (h *Handlers) vote(c echo.Context, site Site, reaction string, value int) error {
+	comment := Comment{}
+
+	if h.db.Where("id = ? AND site_id = ? AND status = ?", c.Param("comment"), site.ID, StatusApproved).First(&comment).RecordNotFound() {
+		return c.JSON(http.StatusNotFound, ResponseError{"No such comment."})
+	}
+
+	var viewer *uint
+	if commenter, ok := h.currentCommenter(c); ok {
+		viewer = &commenter.ID
+	}
+	voter := h.voterFor(c, viewer)
+
+	if result, err := h.limits.Votes.Hit(c.Request().Context(), fmt.Sprintf("vote:%d:%s", site.ID, voter)); !h.allowed(c, result, err) {
+		return tooManyRequests(c, result.RetryAfter)
+	}
+
+	comment, err := h.castVote(comment, voter, reaction, value)
+	if err != nil {
+		h.logger(c).Error("saving vote failed", "comment", comment.ID, "error", err)
+		return c.JSON(http.StatusInternalServerError, ResponseError{"Something failed while saving."})
+	}
+
+	public := publicComment(comment, viewer)
+	return c.JSON(http.StatusOK, withVotes(public, h.viewerVotes(voter, []uint{comment.ID})[comment.ID]))
+}
+
+// CommentsVote handles POST /api/sites/:site/comments/:comment/vote to upvote or downvote a comment.
+func (h *Handlers) CommentsVote(c echo.Context) error {
+	site, ok := c.Get("model.site").(Site)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	req := VoteRequest{}
+
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ResponseError{"Could not read the vote."})
+	}
+
+	if req.Value < -1 || req.Value > 1 {
+		return c.JSON(http.StatusUnprocessableEntity, ResponseError{"A vote is 1, -1, or 0 to take it back."})
+	}
+
+	return h.vote(c, site, "", req.Value)
+}
+
+// CommentsReact handles POST /api/sites/:site/comments/:comment/reactions to react to a comment.
+func (h *Handlers) CommentsReact(c echo.Context) error {
+	site, ok := c.Get("model.site").(Site)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	req := ReactionRequest{}
+
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ResponseError{"Could not read the reaction."})
+	}
+
+	if !site.allowsReaction(req.Reaction) {
+		return c.JSON(http.StatusUnprocessableEntity, ResponseError{"That's not one of this site's reactions."})
+	}
+
+	value := 1
+	if req.Remove {
+		value = 0
+	}
+
+	return h.vote(c, site, req.Reaction, value)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+	mocket "github.com/selvatico/go-mocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseReactions(t *testing.T) {
+	pairs := []struct {
+		Raw      string
+		Expected string
+		Valid    bool
+	}{
+		{"👍, ❤️,,👍", "👍,❤️", true},
+		{"", "", true},
+		{"+1\r\n-1", "+1,-1", true},
+		{strings.Repeat("x", maxReactionLength+1), "", false},
+		{strings.Repeat("👍,", 60), "👍", true},
+		{strings.Repeat("ab,", 20) + strings.Repeat("cd,", 20) + strings.Repeat("x", 100), "", false},
+	}
+
+	for _, p := range pairs {
+		got, err := parseReactions(p.Raw)
+		assert.Equal(t, p.Valid, err == nil, p.Raw)
+		assert.Equal(t, p.Expected, got, p.Raw)
+	}
+}
+
+func TestTally(t *testing.T) {
+	cm := Comment{Upvotes: 10}
+	cm.tally([]voteCount{
+		{Value: 1, Count: 3},
+		{Value: -1, Count: 1},
+		{Reaction: "👍", Value: 1, Count: 2},
+	})
+
+	assert.Equal(t, 3, cm.Upvotes)
+	assert.Equal(t, 1, cm.Downvotes)
+	assert.Equal(t, 2, cm.Score)
+	assert.Equal(t, map[string]int{"👍": 2}, cm.ReactionCounts())
+
+	// Evenly split comments are more controversial than lopsided ones with
+	// as many votes, and ones nobody disagrees with aren't at all.
+	assert.True(t, controversy(5, 5) > controversy(9, 1))
+	assert.True(t, controversy(50, 50) > controversy(5, 5))
+	assert.Equal(t, float64(0), controversy(10, 0))
+}
+
+func TestCommentsVote(t *testing.T) {
+	mocket.Catcher.Reset()
+	mocket.Catcher.NewMock().WithQuery(`FROM "comments"`).WithArgs("5", int64(mockSite.ID), StatusApproved).WithReply([]map[string]interface{}{
+		{"id": 5, "site_id": 3, "status": StatusApproved},
+	})
+	mocket.Catcher.NewMock().WithQuery(`FOR UPDATE`).WithReply([]map[string]interface{}{
+		{"id": 5, "site_id": 3, "status": StatusApproved},
+	})
+	mocket.Catcher.NewMock().WithQuery(`GROUP BY`).WithReply([]map[string]interface{}{
+		{"reaction": "", "value": 1, "count": 4},
+		{"reaction": "", "value": -1, "count": 2},
+		{"reaction": "🎉", "value": 1, "count": 1},
+	})
+	mocket.Catcher.NewMock().WithQuery(`FROM "votes"`).WithReply([]map[string]interface{}{
+		{"comment_id": 5, "reaction": "", "value": 1},
+	})
+	defer mocket.Catcher.Reset()
+
+	var saved []driver.NamedValue
+	mocket.Catcher.NewMock().WithQuery(`INSERT INTO votes`).WithCallback(func(_ string, args []driver.NamedValue) {
+		saved = args
+	})
+
+	pairs := []struct {
+		Handler      func(*Handlers, echo.Context) error
+		Comment      string
+		Body         string
+		ExpectedCode int
+	}{
+		{(*Handlers).CommentsVote, "5", `{"value":2}`, http.StatusUnprocessableEntity},
+		{(*Handlers).CommentsReact, "5", `{"reaction":"💩"}`, http.StatusUnprocessableEntity},
+		{(*Handlers).CommentsVote, "6", `{"value":1}`, http.StatusNotFound},
+		{(*Handlers).CommentsVote, "5", `{"value":1}`, http.StatusOK},
+	}
+
+	site := mockSite
+	site.Reactions = defaultReactions
+
+	for _, p := range pairs {
+		req := httptest.NewRequest(http.MethodPost, "/api/sites/3/comments/"+p.Comment+"/vote", strings.NewReader(p.Body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("site", "comment")
+		c.SetParamValues("3", p.Comment)
+		c.Set("model.site", site)
+
+		if assert.NoError(t, p.Handler(&h, c)) {
+			assert.Equal(t, p.ExpectedCode, rec.Code, rec.Body.String())
+		}
+
+		if rec.Code == http.StatusOK {
+			var comment PublicComment
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &comment))
+			assert.Equal(t, 4, comment.Upvotes)
+			assert.Equal(t, 2, comment.Downvotes)
+			assert.Equal(t, 2, comment.Score)
+			assert.Equal(t, map[string]int{"🎉": 1}, comment.Reactions)
+			assert.Equal(t, 1, comment.Voted)
+		}
+	}
+
+	if assert.Len(t, saved, 5) {
+		// Readers without the commenter cookie vote as a hash of their IP address.
+		assert.True(t, strings.HasPrefix(saved[2].Value.(string), "ip:"))
+		assert.NotContains(t, saved[2].Value, "192.0.2.1")
+	}
+}
+
+func TestVoterForIgnoresSpoofedForwardedFor(t *testing.T) {
+	voter := func(forwardedFor string) string {
+		req := httptest.NewRequest(http.MethodPost, "/api/sites/3/comments/9/vote", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set(echo.HeaderXForwardedFor, forwardedFor)
+		return h.voterFor(e.NewContext(req, httptest.NewRecorder()), nil)
+	}
+
+	assert.Equal(t, voter("198.51.100.1"), voter("198.51.100.2"))
+}
+
+func TestCommentsSort(t *testing.T) {
+	mocket.Catcher.Reset().NewMock().WithQuery(`FROM "threads"`).WithReply([]map[string]interface{}{
+		{"id": 1, "site_id": 3, "url": "https://example.com/post"},
+	})
+	defer mocket.Catcher.Reset()
+
+	var query string
+	mocket.Catcher.NewMock().WithQuery(`FROM "comments"`).WithCallback(func(q string, _ []driver.NamedValue) {
+		query = q
+	})
+
+	pairs := []struct {
+		Sort         string
+		ExpectedCode int
+		ExpectedSort string
+	}{
+		{"", http.StatusOK, "created_at asc"},
+		{"top", http.StatusOK, "score desc"},
+		{"controversial", http.StatusOK, "controversy desc"},
+		{"random", http.StatusBadRequest, ""},
+	}
+
+	for _, p := range pairs {
+		query = ""
+		req := httptest.NewRequest(http.MethodGet, "/api/sites/3/comments?url=https%3A%2F%2Fexample.com%2Fpost&sort="+p.Sort, nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("model.site", mockSite)
+
+		if assert.NoError(t, h.Comments(c)) {
+			assert.Equal(t, p.ExpectedCode, rec.Code, p.Sort)
+			assert.Contains(t, query, p.ExpectedSort, p.Sort)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+/*
+Package webhook delivers signed JSON payloads to the URLs site owners give.
+
+Every delivery is signed with the webhook's secret: the X-GoComments-Signature
+header is "sha256=" and the hex HMAC-SHA256 of the X-GoComments-Timestamp
+header, a dot, and the body. Receivers should check it with Verify, and
+refuse timestamps that are too old.
+*/
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Headers every delivery is sent with.
+const (
+	HeaderEvent     = "X-GoComments-Event"
+	HeaderDelivery  = "X-GoComments-Delivery"
+	HeaderTimestamp = "X-GoComments-Timestamp"
+	HeaderSignature = "X-GoComments-Signature"
+)
+
+// MaxAttempts is how many times a delivery is tried before it's given up on.
+const MaxAttempts = 8
+
+// maxResponse is how much of the receiver's response is kept.
+const maxResponse = 1024
+
+// Sign returns the signature of body sent at timestamp.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of body sent at timestamp, and that it's no older than maxAge.
+func Verify(secret, signature string, timestamp int64, body []byte, maxAge time.Duration, now time.Time) bool {
+	if d := now.Sub(time.Unix(timestamp, 0)); d > maxAge || d < -maxAge {
+		return false
+	}
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
+
+// Backoff returns how long to wait before trying a delivery again, after it
+// failed attempts times: 30 seconds, doubling every time, up to 6 hours.
+func Backoff(attempts int) time.Duration {
+	wait := 30 * time.Second
+	for i := 1; i < attempts && wait < 6*time.Hour; i++ {
+		wait *= 2
+	}
+	if wait > 6*time.Hour {
+		wait = 6 * time.Hour
+	}
+	return wait
+}
+
+// Result is what came of a delivery attempt.
+type Result struct {
+	StatusCode int
+	Response   string
+	Duration   time.Duration
+}
+
+// OK tells whether the receiver took the delivery.
+func (r Result) OK() bool {
+	return r.StatusCode >= 200 && r.StatusCode < 300
+}
+
+// Deliverer posts payloads.
+type Deliverer struct {
+	Client *http.Client
+}
+
+// Deliver posts body to url, signed with secret. Errors are for when there was no response at all.
+func (d Deliverer) Deliver(ctx context.Context, url, secret, event, id string, body []byte, now time.Time) (Result, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return Result{}, err
+	}
+
+	timestamp := now.Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-comments-webhook")
+	req.Header.Set(HeaderEvent, event)
+	req.Header.Set(HeaderDelivery, id)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(secret, timestamp, body))
+
+	start := time.Now()
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return Result{Duration: time.Since(start)}, err
+	}
+	defer resp.Body.Close()
+
+	response, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponse))
+
+	return Result{StatusCode: resp.StatusCode, Response: string(response), Duration: time.Since(start)}, nil
+}
+
+/*
+NewClient returns the client deliveries are sent with. It doesn't follow
+redirects, and unless allowPrivate is set it refuses to connect to loopback,
+private and link-local addresses, so webhooks can't be pointed at the
+services next to the app.
+*/
+func NewClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !Public(ip) {
+				return fmt.Errorf("webhook address %s is not public", host)
+			}
+			return nil
+		}
+	}
+
+	return &http.Client{
+		Timeout: 15 * time.Second,
+		Transport: &http.Transport{
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// Public tells whether ip is an address on the internet.
+func Public(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast() || ip.IsInterfaceLocalMulticast())
+}
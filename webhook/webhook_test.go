@@ -0,0 +1,85 @@
+package webhook
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	now := time.Now()
+	body := []byte(`{"event":"comment.created"}`)
+	signature := Sign("secret", now.Unix(), body)
+
+	pairs := []struct {
+		Name      string
+		Secret    string
+		Timestamp int64
+		Body      []byte
+		Valid     bool
+	}{
+		{"valid", "secret", now.Unix(), body, true},
+		{"other secret", "other", now.Unix(), body, false},
+		{"other body", "secret", now.Unix(), []byte(`{}`), false},
+		{"other timestamp", "secret", now.Unix() + 1, body, false},
+	}
+
+	for _, p := range pairs {
+		assert.Equal(t, p.Valid, Verify(p.Secret, signature, p.Timestamp, p.Body, 5*time.Minute, now), p.Name)
+	}
+
+	assert.False(t, Verify("secret", signature, now.Unix(), body, 5*time.Minute, now.Add(time.Hour)))
+}
+
+func TestBackoff(t *testing.T) {
+	assert.Equal(t, 30*time.Second, Backoff(1))
+	assert.Equal(t, time.Minute, Backoff(2))
+	assert.Equal(t, 4*time.Minute, Backoff(4))
+	assert.Equal(t, 6*time.Hour, Backoff(20))
+}
+
+func TestDeliver(t *testing.T) {
+	var got *http.Request
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+		io.WriteString(w, "thanks")
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	result, err := Deliverer{NewClient(true)}.Deliver(context.Background(), server.URL, "secret", "comment.created", "7", []byte(`{"a":1}`), now)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.True(t, result.OK())
+	assert.Equal(t, "thanks", result.Response)
+	assert.Equal(t, "comment.created", got.Header.Get(HeaderEvent))
+	assert.Equal(t, "7", got.Header.Get(HeaderDelivery))
+
+	timestamp, _ := strconv.ParseInt(got.Header.Get(HeaderTimestamp), 10, 64)
+	assert.True(t, Verify("secret", got.Header.Get(HeaderSignature), timestamp, body, time.Minute, now))
+}
+
+func TestClientRefusesPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	_, err := Deliverer{NewClient(false)}.Deliver(context.Background(), server.URL, "secret", "comment.created", "7", nil, time.Now())
+	assert.Error(t, err)
+
+	for _, ip := range []string{"127.0.0.1", "10.1.2.3", "192.168.0.1", "169.254.169.254", "::1", "fd00::1"} {
+		assert.False(t, Public(net.ParseIP(ip)), ip)
+	}
+	assert.True(t, Public(net.ParseIP("93.184.216.34")))
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/javorszky/go-comments/webhook"
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+)
+
+// Comment events webhooks can get.
+const (
+	EventCommentCreated  = "comment.created"
+	EventCommentApproved = "comment.approved"
+	EventCommentDeleted  = "comment.deleted"
+	// EventCommentFlagged is for comments the spam checker or a moderator marked as spam.
+	// They don't get a comment.created event.
+	EventCommentFlagged = "comment.flagged"
+)
+
+// webhookEvents are all the events, in the order the admin area shows them.
+var webhookEvents = []string{EventCommentCreated, EventCommentApproved, EventCommentDeleted, EventCommentFlagged}
+
+// webhookDeliveryRetention is how long the delivery log goes back.
+const webhookDeliveryRetention = 30 * 24 * time.Hour
+
+// Webhook model definition. The site's owner gets the events in Events posted to URL, signed with Secret.
+type Webhook struct {
+	gorm.Model
+	SiteID uint   `gorm:"index:webhook_site"`
+	URL    string `gorm:"type:varchar(191)"`
+	Secret string `gorm:"type:varchar(64)"`
+	// Events is a comma separated list of the events it gets.
+	Events string `gorm:"type:varchar(191)"`
+}
+
+// EventList returns the events the webhook gets.
+func (w Webhook) EventList() []string {
+	return strings.Split(w.Events, ",")
+}
+
+// gets tells whether the webhook gets the event.
+func (w Webhook) gets(event string) bool {
+	for _, e := range w.EventList() {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+WebhookDelivery model definition. Deliveries are queued in the database and
+sent by a background worker. Failed ones are tried again later, with
+NextAttemptAt further out every time, and they're done once it's nil.
+*/
+type WebhookDelivery struct {
+	ID            uint `gorm:"primary_key"`
+	CreatedAt     time.Time
+	WebhookID     uint   `gorm:"index:webhook_delivery_webhook"`
+	Event         string `gorm:"type:varchar(32)"`
+	Payload       string `gorm:"type:text"`
+	Attempts      int
+	StatusCode    int
+	Response      string     `gorm:"type:text"`
+	Error         string     `gorm:"type:text"`
+	NextAttemptAt *time.Time `gorm:"index:webhook_delivery_next_attempt"`
+	DeliveredAt   *time.Time
+}
+
+// WebhookPayload is the body of a delivery.
+type WebhookPayload struct {
+	Event      string         `json:"event"`
+	OccurredAt time.Time      `json:"occurredAt"`
+	Site       WebhookSite    `json:"site"`
+	Comment    WebhookComment `json:"comment"`
+}
+
+// WebhookSite is the site an event happened on.
+type WebhookSite struct {
+	ID          uint   `json:"id"`
+	Designation string `json:"designation"`
+}
+
+// WebhookComment is the comment an event happened to. Commenters' email addresses are never in it.
+type WebhookComment struct {
+	ID        uint      `json:"id"`
+	ParentID  *uint     `json:"parentId"`
+	URL       string    `json:"url"`
+	Author    string    `json:"author"`
+	Website   string    `json:"website,omitempty"`
+	Body      string    `json:"body"`
+	HTML      string    `json:"html"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+/*
+trigger queues a delivery of the event to every webhook of the site that
+gets it. The worker picks them up within a couple of seconds.
+*/
+func (h *Handlers) trigger(c echo.Context, site Site, event string, comment Comment) {
+	var hooks []Webhook
+
+	h.db.Where("site_id = ?", site.ID).Find(&hooks)
+
+	var targets []Webhook
+	for _, hook := range hooks {
+		if hook.gets(event) {
+			targets = append(targets, hook)
+		}
+	}
+	if len(targets) == 0 {
+		return
+	}
+
+	thread := Thread{}
+	h.db.Where("id = ?", comment.ThreadID).First(&thread)
+
+	now := time.Now()
+	payload, err := json.Marshal(WebhookPayload{
+		Event:      event,
+		OccurredAt: now,
+		Site:       WebhookSite{site.ID, site.Designation},
+		Comment: WebhookComment{
+			ID:        comment.ID,
+			ParentID:  comment.ParentID,
+			URL:       thread.URL,
+			Author:    comment.AuthorName,
+			Website:   comment.AuthorWebsite,
+			Body:      comment.Body,
+			HTML:      comment.BodyHTML,
+			Status:    comment.Status,
+			CreatedAt: comment.CreatedAt,
+		},
+	})
+	if err != nil {
+		h.logger(c).Error("Encoding webhook payload failed", "event", event, "error", err)
+		return
+	}
+
+	for _, hook := range targets {
+		delivery := WebhookDelivery{WebhookID: hook.ID, Event: event, Payload: string(payload), NextAttemptAt: &now}
+		if err := h.db.Create(&delivery).Error; err != nil {
+			h.logger(c).Error("Queueing webhook delivery failed", "webhook", hook.ID, "event", event, "error", err)
+		}
+	}
+}
+
+// Webhooks sends the webhook deliveries that are due until ctx is done, and forgets old ones.
+func (h *Handlers) Webhooks(ctx context.Context) {
+	d := webhook.Deliverer{Client: webhook.NewClient(h.cfg.WebhookAllowPrivate)}
+
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	pruned := time.Time{}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			h.deliverDue(ctx, d, now)
+
+			if now.Sub(pruned) > time.Hour {
+				h.db.Where("created_at < ? AND next_attempt_at IS NULL", now.Add(-webhookDeliveryRetention)).Delete(WebhookDelivery{})
+				pruned = now
+			}
+		}
+	}
+}
+
+// deliverDue sends the deliveries whose next attempt is due.
+func (h *Handlers) deliverDue(ctx context.Context, d webhook.Deliverer, now time.Time) {
+	var due []WebhookDelivery
+
+	h.db.Where("next_attempt_at <= ?", now).Order("next_attempt_at asc").Limit(20).Find(&due)
+
+	for _, delivery := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		h.deliver(ctx, d, delivery, now)
+	}
+}
+
+/*
+deliver makes an attempt at a delivery. It's claimed first by pushing its
+next attempt a minute out, so other instances of the app leave it alone
+while it's being sent, and it's tried again if this one dies meanwhile.
+*/
+func (h *Handlers) deliver(ctx context.Context, d webhook.Deliverer, delivery WebhookDelivery, now time.Time) {
+	claim := h.db.Model(&WebhookDelivery{}).Where("id = ? AND next_attempt_at <= ?", delivery.ID, now).UpdateColumn("next_attempt_at", now.Add(time.Minute))
+	if claim.Error != nil || claim.RowsAffected != 1 {
+		return
+	}
+
+	updates := map[string]interface{}{"attempts": delivery.Attempts + 1, "next_attempt_at": nil}
+
+	hook := Webhook{}
+	if h.db.Where("id = ?", delivery.WebhookID).First(&hook).RecordNotFound() {
+		updates["error"] = "The webhook was removed."
+		h.db.Model(&WebhookDelivery{}).Where("id = ?", delivery.ID).UpdateColumns(updates)
+		return
+	}
+
+	result, err := d.Deliver(ctx, hook.URL, hook.Secret, delivery.Event, strconv.Itoa(int(delivery.ID)), []byte(delivery.Payload), now)
+
+	updates["status_code"] = result.StatusCode
+	updates["response"] = result.Response
+	updates["error"] = ""
+
+	switch {
+	case err == nil && result.OK():
+		updates["delivered_at"] = now
+	case delivery.Attempts+1 < webhook.MaxAttempts:
+		updates["next_attempt_at"] = now.Add(webhook.Backoff(delivery.Attempts + 1))
+	}
+
+	if err != nil {
+		updates["error"] = err.Error()
+	} else if !result.OK() {
+		updates["error"] = fmt.Sprintf("The webhook answered %d.", result.StatusCode)
+	}
+
+	if err := h.db.Model(&WebhookDelivery{}).Where("id = ?", delivery.ID).UpdateColumns(updates).Error; err != nil {
+		h.log.Error("Saving webhook delivery failed", "delivery", delivery.ID, "error", err)
+	}
+}
+
+// AdminWebhooks handles GET /admin/sites/:id/webhooks to list the site's webhooks and their latest deliveries.
+func (h *Handlers) AdminWebhooks(c echo.Context) error {
+	site, ok := h.siteFor(c, RoleAdmin)
+	if !ok {
+		return c.String(http.StatusNotFound, "No such site")
+	}
+
+	var hooks []Webhook
+	var deliveries []WebhookDelivery
+
+	h.db.Where("site_id = ?", site.ID).Find(&hooks)
+
+	ids := make([]uint, 0, len(hooks))
+	for _, hook := range hooks {
+		ids = append(ids, hook.ID)
+	}
+	if len(ids) > 0 {
+		h.db.Where("webhook_id IN (?)", ids).Order("created_at desc, id desc").Limit(50).Find(&deliveries)
+	}
+
+	return c.Render(http.StatusOK, "adminwebhooks", struct {
+		Csrf       interface{}
+		Site       Site
+		Webhooks   []Webhook
+		Deliveries []WebhookDelivery
+		Events     []string
+	}{
+		Csrf:       c.Get("csrf"),
+		Site:       site,
+		Webhooks:   hooks,
+		Deliveries: deliveries,
+		Events:     webhookEvents,
+	})
+}
+
+// AdminWebhooksPost handles POST /admin/sites/:id/webhooks to add a webhook to the site.
+func (h *Handlers) AdminWebhooksPost(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	site, ok := h.siteFor(c, RoleAdmin)
+	if !ok {
+		return c.String(http.StatusNotFound, "No such site")
+	}
+
+	u, err := url.Parse(c.FormValue("url"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(c.FormValue("url")) > 191 {
+		return c.String(http.StatusBadRequest, "The URL has to be an http or https address")
+	}
+
+	form, err := c.FormParams()
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Could not read the form")
+	}
+
+	var events []string
+	for _, event := range webhookEvents {
+		for _, chosen := range form["events"] {
+			if chosen == event {
+				events = append(events, event)
+			}
+		}
+	}
+	if len(events) == 0 {
+		return c.String(http.StatusBadRequest, "Choose at least one event")
+	}
+
+	hook := Webhook{
+		SiteID: site.ID,
+		URL:    u.String(),
+		Secret: randomToken(24),
+		Events: strings.Join(events, ","),
+	}
+
+	if result := h.db.Create(&hook); result.Error != nil {
+		return c.String(http.StatusBadRequest, "Something failed while saving")
+	}
+
+	h.audit(c, user.ID, auditWebhookCreate, fmt.Sprintf("site %d: webhook %d to %s", site.ID, hook.ID, hook.URL))
+
+	return c.Redirect(http.StatusFound, fmt.Sprintf("/admin/sites/%d/webhooks", site.ID))
+}
+
+// AdminWebhookDelete handles POST /admin/sites/:id/webhooks/:webhook/delete to remove a webhook.
+func (h *Handlers) AdminWebhookDelete(c echo.Context) error {
+	user, ok := c.Get("model.user").(User)
+
+	if !ok {
+		panic("not okay")
+	}
+
+	site, ok := h.siteFor(c, RoleAdmin)
+	if !ok {
+		return c.String(http.StatusNotFound, "No such site")
+	}
+
+	hook := Webhook{}
+
+	if h.db.Where("id = ? AND site_id = ?", c.Param("webhook"), site.ID).First(&hook).RecordNotFound() {
+		return c.String(http.StatusNotFound, "No such webhook")
+	}
+
+	if result := h.db.Delete(&hook); result.Error != nil {
+		return c.String(http.StatusBadRequest, "Something failed while deleting")
+	}
+
+	h.audit(c, user.ID, auditWebhookDelete, fmt.Sprintf("site %d: webhook %d to %s", site.ID, hook.ID, hook.URL))
+
+	return c.Redirect(http.StatusFound, fmt.Sprintf("/admin/sites/%d/webhooks", site.ID))
+}
+
+// AdminWebhookRedeliver handles POST /admin/sites/:id/webhooks/deliveries/:delivery/redeliver
+// to send a delivery's payload again, as a new delivery.
+func (h *Handlers) AdminWebhookRedeliver(c echo.Context) error {
+	site, ok := h.siteFor(c, RoleAdmin)
+	if !ok {
+		return c.String(http.StatusNotFound, "No such site")
+	}
+
+	delivery := WebhookDelivery{}
+	hook := Webhook{}
+
+	if h.db.Where("id = ?", c.Param("delivery")).First(&delivery).RecordNotFound() ||
+		h.db.Where("id = ? AND site_id = ?", delivery.WebhookID, site.ID).First(&hook).RecordNotFound() {
+		return c.String(http.StatusNotFound, "No such delivery")
+	}
+
+	now := time.Now()
+	again := WebhookDelivery{WebhookID: hook.ID, Event: delivery.Event, Payload: delivery.Payload, NextAttemptAt: &now}
+
+	if result := h.db.Create(&again); result.Error != nil {
+		return c.String(http.StatusBadRequest, "Something failed while saving")
+	}
+
+	return c.Redirect(http.StatusFound, fmt.Sprintf("/admin/sites/%d/webhooks", site.ID))
+}
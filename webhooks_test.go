@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/javorszky/go-comments/webhook"
+	"github.com/labstack/echo"
+	mocket "github.com/selvatico/go-mocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTriggerQueuesDeliveries(t *testing.T) {
+	mocket.Catcher.Reset()
+	mocket.Catcher.NewMock().WithQuery(`FROM "webhooks"`).WithReply([]map[string]interface{}{
+		{"id": 1, "site_id": 3, "url": "https://chat.example.com/hook", "events": EventCommentCreated + "," + EventCommentFlagged},
+		{"id": 2, "site_id": 3, "url": "https://ci.example.com/hook", "events": EventCommentApproved},
+	})
+	mocket.Catcher.NewMock().WithQuery(`FROM "threads"`).WithReply([]map[string]interface{}{
+		{"id": 1, "url": "https://example.com/post"},
+	})
+	defer mocket.Catcher.Reset()
+
+	var queued [][]driver.NamedValue
+	mocket.Catcher.NewMock().WithQuery(`INSERT INTO "webhook_deliveries"`).WithCallback(func(_ string, args []driver.NamedValue) {
+		queued = append(queued, args)
+	})
+
+	c := e.NewContext(httptest.NewRequest(http.MethodPost, "/", nil), httptest.NewRecorder())
+	h.trigger(c, mockSite, EventCommentCreated, Comment{ThreadID: 1, AuthorName: "Jane", Body: "hi", Status: StatusPending})
+
+	if !assert.Len(t, queued, 1) {
+		return
+	}
+
+	var payload WebhookPayload
+	for _, arg := range queued[0] {
+		if s, ok := arg.Value.(string); ok && len(s) > 0 && s[0] == '{' {
+			assert.NoError(t, json.Unmarshal([]byte(s), &payload))
+		}
+	}
+
+	assert.Equal(t, EventCommentCreated, payload.Event)
+	assert.Equal(t, "blog", payload.Site.Designation)
+	assert.Equal(t, "https://example.com/post", payload.Comment.URL)
+	assert.Equal(t, "Jane", payload.Comment.Author)
+}
+
+func TestDeliverRetries(t *testing.T) {
+	var codes = []int{http.StatusBadGateway, http.StatusOK}
+	var received []*http.Request
+	var bodies [][]byte
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, r)
+		bodies = append(bodies, body)
+		w.WriteHeader(codes[len(received)-1])
+	}))
+	defer server.Close()
+
+	mocket.Catcher.Reset()
+	mocket.Catcher.NewMock().WithQuery(`FROM "webhooks"`).WithReply([]map[string]interface{}{
+		{"id": 1, "site_id": 3, "url": server.URL, "secret": "s3cret", "events": EventCommentCreated},
+	})
+	defer mocket.Catcher.Reset()
+
+	var results []map[string]driver.Value
+	mocket.Catcher.NewMock().WithQuery(`UPDATE "webhook_deliveries" SET "next_attempt_at"`).WithRowsNum(1)
+	mocket.Catcher.NewMock().WithQuery(`UPDATE "webhook_deliveries" SET "attempts"`).WithCallback(func(_ string, args []driver.NamedValue) {
+		// attempts, delivered_at?, error, next_attempt_at, response, status_code, id
+		values := map[string]driver.Value{"attempts": args[0].Value, "status_code": args[len(args)-2].Value}
+		if len(args) == 7 {
+			values["delivered_at"] = args[1].Value
+			values["next_attempt_at"] = args[3].Value
+		} else {
+			values["next_attempt_at"] = args[2].Value
+		}
+		results = append(results, values)
+	})
+
+	d := webhook.Deliverer{Client: webhook.NewClient(true)}
+	now := time.Now()
+	delivery := WebhookDelivery{ID: 9, WebhookID: 1, Event: EventCommentCreated, Payload: `{"event":"comment.created"}`, NextAttemptAt: &now}
+
+	h.deliver(context.Background(), d, delivery, now)
+	delivery.Attempts++
+	h.deliver(context.Background(), d, delivery, now.Add(time.Minute))
+
+	if !assert.Len(t, received, 2) || !assert.Len(t, results, 2) {
+		return
+	}
+
+	timestamp, _ := strconv.ParseInt(received[0].Header.Get(webhook.HeaderTimestamp), 10, 64)
+	assert.True(t, webhook.Verify("s3cret", received[0].Header.Get(webhook.HeaderSignature), timestamp, bodies[0], time.Minute, now))
+	assert.Equal(t, "9", received[0].Header.Get(webhook.HeaderDelivery))
+
+	assert.EqualValues(t, 1, results[0]["attempts"])
+	assert.EqualValues(t, http.StatusBadGateway, results[0]["status_code"])
+	assert.NotNil(t, results[0]["next_attempt_at"])
+	assert.Nil(t, results[0]["delivered_at"])
+
+	assert.EqualValues(t, 2, results[1]["attempts"])
+	assert.EqualValues(t, http.StatusOK, results[1]["status_code"])
+	assert.Nil(t, results[1]["next_attempt_at"])
+	assert.NotNil(t, results[1]["delivered_at"])
+}
+
+func TestAdminWebhooksPost(t *testing.T) {
+	mocket.Catcher.Reset().NewMock().WithQuery(`FROM "sites"`).WithReply([]map[string]interface{}{{"id": 3, "user_id": 7}})
+	defer mocket.Catcher.Reset()
+
+	pairs := []struct {
+		Form         string
+		ExpectedCode int
+	}{
+		{"url=ftp%3A%2F%2Fexample.com&events=comment.created", http.StatusBadRequest},
+		{"url=https%3A%2F%2Fchat.example.com%2Fhook", http.StatusBadRequest},
+		{"url=https%3A%2F%2Fchat.example.com%2Fhook&events=comment.exploded", http.StatusBadRequest},
+		{"url=https%3A%2F%2Fchat.example.com%2Fhook&events=comment.created&events=comment.flagged", http.StatusFound},
+	}
+
+	for _, p := range pairs {
+		req := httptest.NewRequest(http.MethodPost, "/admin/sites/3/webhooks", strings.NewReader(p.Form))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("model.user", User{Model: mockSite.Model, Email: "owner@example.com"})
+		c.SetParamNames("id")
+		c.SetParamValues("3")
+
+		if assert.NoError(t, h.AdminWebhooksPost(c)) {
+			assert.Equal(t, p.ExpectedCode, rec.Code, p.Form)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+/*
+Package wxr reads WordPress eXtended RSS files, the exports WordPress makes
+of a blog. Each item is a post or page, with the comments left on it.
+
+A Reader goes through the export one item at a time, so exports of any size
+can be read without holding them in memory.
+*/
+package wxr
+
+import (
+	"encoding/xml"
+	"io"
+	"strings"
+	"time"
+)
+
+// dateLayout is how dates are written in exports.
+const dateLayout = "2006-01-02 15:04:05"
+
+// Item is a post, page or other piece of content, and the comments on it.
+type Item struct {
+	Title    string    `xml:"title"`
+	Link     string    `xml:"link"`
+	PostID   string    `xml:"post_id"`
+	PostType string    `xml:"post_type"`
+	Status   string    `xml:"status"`
+	Comments []Comment `xml:"comment"`
+}
+
+/*
+Comment is a comment on an item. Approved is "1" for approved comments, "0"
+for ones waiting for a moderator, and "spam" or "trash". Type is empty for
+comments, or "pingback" or "trackback". Parent is "0" for comments that
+aren't replies.
+*/
+type Comment struct {
+	ID          string `xml:"comment_id"`
+	Author      string `xml:"comment_author"`
+	AuthorEmail string `xml:"comment_author_email"`
+	AuthorURL   string `xml:"comment_author_url"`
+	AuthorIP    string `xml:"comment_author_IP"`
+	Date        string `xml:"comment_date"`
+	DateGMT     string `xml:"comment_date_gmt"`
+	Content     string `xml:"comment_content"`
+	Approved    string `xml:"comment_approved"`
+	Type        string `xml:"comment_type"`
+	Parent      string `xml:"comment_parent"`
+	UserID      string `xml:"comment_user_id"`
+}
+
+/*
+Time returns when the comment was written. Exports have the time in UTC as
+well as in the blog's time zone, but old ones can be missing the UTC one, in
+which case the blog's time is taken as UTC.
+*/
+func (c Comment) Time() (time.Time, error) {
+	if t, err := time.Parse(dateLayout, strings.TrimSpace(c.DateGMT)); err == nil && t.Year() > 1 {
+		return t, nil
+	}
+	return time.Parse(dateLayout, strings.TrimSpace(c.Date))
+}
+
+/*
+HTML returns the comment the way WordPress shows it. Comments are stored
+with plain line breaks, which WordPress turns into paragraphs and breaks
+when it shows them, so HTML does the same.
+*/
+func (c Comment) HTML() string {
+	content := strings.Replace(strings.TrimSpace(c.Content), "\r\n", "\n", -1)
+
+	var b strings.Builder
+	for _, paragraph := range strings.Split(content, "\n\n") {
+		if paragraph = strings.TrimSpace(paragraph); paragraph != "" {
+			b.WriteString("<p>" + strings.Replace(paragraph, "\n", "<br>\n", -1) + "</p>\n")
+		}
+	}
+	return b.String()
+}
+
+// Reader reads the items of an export.
+type Reader struct {
+	dec *xml.Decoder
+}
+
+// NewReader returns a Reader for the export in r.
+func NewReader(r io.Reader) *Reader {
+	dec := xml.NewDecoder(r)
+	// Exports often have HTML's entities in them, which XML doesn't know.
+	dec.Entity = xml.HTMLEntity
+	return &Reader{dec: dec}
+}
+
+// Next returns the next item in the export. It returns io.EOF when there are no more.
+func (r *Reader) Next() (Item, error) {
+	for {
+		token, err := r.dec.Token()
+		if err != nil {
+			return Item{}, err
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "item" {
+			continue
+		}
+
+		item := Item{}
+		if err := r.dec.DecodeElement(&item, &start); err != nil {
+			return Item{}, err
+		}
+		return item, nil
+	}
+}
@@ -0,0 +1,132 @@
+package wxr
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const export = `<?xml version="1.0" encoding="UTF-8" ?>
+<rss version="2.0"
+	xmlns:content="http://purl.org/rss/1.0/modules/content/"
+	xmlns:dc="http://purl.org/dc/elements/1.1/"
+	xmlns:wp="http://wordpress.org/export/1.2/">
+<channel>
+	<title>A blog</title>
+	<link>https://blog.example.com</link>
+	<wp:base_site_url>https://blog.example.com</wp:base_site_url>
+	<item>
+		<title>Hello &amp; welcome&hellip;</title>
+		<link>https://blog.example.com/2014/03/hello/</link>
+		<wp:post_id>12</wp:post_id>
+		<wp:post_type><![CDATA[post]]></wp:post_type>
+		<wp:status><![CDATA[publish]]></wp:status>
+		<wp:comment>
+			<wp:comment_id>5</wp:comment_id>
+			<wp:comment_author><![CDATA[Jane]]></wp:comment_author>
+			<wp:comment_author_email><![CDATA[jane@example.com]]></wp:comment_author_email>
+			<wp:comment_author_url>https://jane.example.com</wp:comment_author_url>
+			<wp:comment_author_IP><![CDATA[192.0.2.1]]></wp:comment_author_IP>
+			<wp:comment_date><![CDATA[2014-03-01 12:00:00]]></wp:comment_date>
+			<wp:comment_date_gmt><![CDATA[2014-03-01 11:00:00]]></wp:comment_date_gmt>
+			<wp:comment_content><![CDATA[First line
+second line
+
+New paragraph]]></wp:comment_content>
+			<wp:comment_approved><![CDATA[1]]></wp:comment_approved>
+			<wp:comment_type><![CDATA[]]></wp:comment_type>
+			<wp:comment_parent>0</wp:comment_parent>
+			<wp:comment_user_id>3</wp:comment_user_id>
+			<wp:commentmeta>
+				<wp:meta_key><![CDATA[akismet_result]]></wp:meta_key>
+				<wp:meta_value><![CDATA[false]]></wp:meta_value>
+			</wp:commentmeta>
+		</wp:comment>
+		<wp:comment>
+			<wp:comment_id>6</wp:comment_id>
+			<wp:comment_author><![CDATA[Guest]]></wp:comment_author>
+			<wp:comment_date><![CDATA[2014-03-01 13:00:00]]></wp:comment_date>
+			<wp:comment_date_gmt><![CDATA[0000-00-00 00:00:00]]></wp:comment_date_gmt>
+			<wp:comment_content><![CDATA[A reply]]></wp:comment_content>
+			<wp:comment_approved><![CDATA[spam]]></wp:comment_approved>
+			<wp:comment_parent>5</wp:comment_parent>
+			<wp:comment_user_id>0</wp:comment_user_id>
+		</wp:comment>
+	</item>
+	<item>
+		<title>About</title>
+		<link>https://blog.example.com/about/</link>
+		<wp:post_id>2</wp:post_id>
+		<wp:post_type><![CDATA[page]]></wp:post_type>
+	</item>
+</channel>
+</rss>`
+
+func TestReader(t *testing.T) {
+	r := NewReader(strings.NewReader(export))
+
+	var items []Item
+	for {
+		item, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(t, err) {
+			return
+		}
+		items = append(items, item)
+	}
+
+	if !assert.Len(t, items, 2) {
+		return
+	}
+
+	post := items[0]
+	assert.Equal(t, "Hello & welcome…", post.Title)
+	assert.Equal(t, "https://blog.example.com/2014/03/hello/", post.Link)
+	assert.Equal(t, "12", post.PostID)
+	assert.Equal(t, "post", post.PostType)
+	assert.Equal(t, "publish", post.Status)
+
+	if !assert.Len(t, post.Comments, 2) {
+		return
+	}
+
+	first := post.Comments[0]
+	assert.Equal(t, Comment{
+		ID:          "5",
+		Author:      "Jane",
+		AuthorEmail: "jane@example.com",
+		AuthorURL:   "https://jane.example.com",
+		AuthorIP:    "192.0.2.1",
+		Date:        "2014-03-01 12:00:00",
+		DateGMT:     "2014-03-01 11:00:00",
+		Content:     "First line\nsecond line\n\nNew paragraph",
+		Approved:    "1",
+		Parent:      "0",
+		UserID:      "3",
+	}, first)
+	assert.Equal(t, "<p>First line<br>\nsecond line</p>\n<p>New paragraph</p>\n", first.HTML())
+
+	created, err := first.Time()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2014, 3, 1, 11, 0, 0, 0, time.UTC), created)
+
+	created, err = post.Comments[1].Time()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2014, 3, 1, 13, 0, 0, 0, time.UTC), created)
+	assert.Equal(t, "5", post.Comments[1].Parent)
+
+	assert.Equal(t, "About", items[1].Title)
+	assert.Empty(t, items[1].Comments)
+}
+
+func TestReaderBrokenExport(t *testing.T) {
+	r := NewReader(strings.NewReader(`<rss><channel><item><title>Unfinished`))
+
+	_, err := r.Next()
+	assert.Error(t, err)
+}